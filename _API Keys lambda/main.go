@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/audit"
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/cors"
+	"to_do_list_demo/internal/health"
+	"to_do_list_demo/internal/idempotency"
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+	"to_do_list_demo/internal/storage"
+)
+
+var (
+	dbClient      *dynamodb.Client
+	tableName     = "To-Do-List-Users"
+	keysTable     = auth.KeysTable()
+	keysUserIndex = "userId-index"
+	authn         *auth.Authenticator
+	auditLog      *audit.Logger
+	idempotent    *idempotency.Store
+	routes        router.Router
+	corsPolicy    *cors.Policy
+	readiness     *health.Checker
+)
+
+const (
+	maxActiveKeys = 20
+	maxNameLength = 100
+)
+
+//////////////////////
+// STRUCTS
+//////////////////////
+
+type CreateAPIKey struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// CreatedAPIKey is only returned once. The full key cannot be read back.
+type CreatedAPIKey struct {
+	auth.APIKey
+	Key string `json:"key"`
+}
+
+//////////////////////
+// INIT
+//////////////////////
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal("unable to load AWS SDK config:", err)
+	}
+
+	dbClient = storage.NewClient(cfg)
+	authn = auth.New(dbClient, tableName)
+	auditLog = audit.New(dbClient)
+	idempotent = idempotency.New(dbClient)
+	corsPolicy = cors.FromEnv()
+
+	if i := os.Getenv("API_KEYS_USER_INDEX"); i != "" {
+		keysUserIndex = i
+	}
+
+	// Keys are managed with a session only, so a leaked key cannot mint
+	// more keys or revoke the owner's other keys.
+	// Creating a key is not wrapped in idempotent: the response is the only
+	// place the full key is ever shown, and must not be stored.
+	routes.Handle("POST", "/api/to-do-list/mypost/users/me/api-keys", authn.Middleware(auth.SessionOnly, createAPIKey))
+	routes.Handle("GET", "/api/to-do-list/mypost/users/me/api-keys", authn.Middleware(auth.SessionOnly, listAPIKeys))
+	routes.Handle("DELETE", "/api/to-do-list/mypost/users/me/api-keys/{keyId}", authn.Middleware(auth.SessionOnly, idempotent.WrapAuth(revokeAPIKey)))
+
+	readiness = health.New(
+		health.Table(dbClient, tableName),
+		health.Table(dbClient, keysTable),
+		health.Table(dbClient, auditLog.Table),
+		health.Table(dbClient, idempotent.Table),
+		health.SessionKey(),
+		health.Config("cors", corsPolicy.Validate),
+	)
+	readiness.Register(&routes, "/api/to-do-list/mypost/users/me/api-keys")
+}
+
+//////////////////////
+// CREATE API KEY
+//////////////////////
+
+func createAPIKey(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	if p.ActorID != "" {
+		return respond.Error(403, "not allowed while impersonating")
+	}
+
+	var body CreateAPIKey
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("createAPIKey unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > maxNameLength {
+		return respond.Error(400, "name is required and must be at most 100 characters")
+	}
+
+	if len(body.Scopes) == 0 {
+		body.Scopes = []string{auth.ScopeReadOnly}
+	}
+
+	scopes := make([]string, 0, len(body.Scopes))
+	seen := map[string]bool{}
+	for _, s := range body.Scopes {
+		if !auth.ValidScope(s) {
+			return respond.Error(400, "unknown scope: "+s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+
+	active, err := userKeys(ctx, p.UserID)
+	if err != nil {
+		log.Println("Query error:", err)
+		return respond.DBError(err)
+	}
+
+	if countActive(active) >= maxActiveKeys {
+		return respond.Error(409, "too many active api keys, revoke one first")
+	}
+
+	keyID, secret, err := newKeyParts()
+	if err != nil {
+		log.Println("random error:", err)
+		return respond.Error(500, "could not create api key")
+	}
+
+	fullKey := auth.APIKeyPrefix + keyID + "_" + secret
+
+	k := auth.APIKey{
+		KeyID:     keyID,
+		UserID:    p.UserID,
+		Name:      name,
+		Prefix:    auth.APIKeyPrefix + keyID,
+		Hash:      auth.HashAPIKey(fullKey),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	item, err := attributevalue.MarshalMap(k)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return respond.Error(500, "marshal failed")
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(keysTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(keyId)"),
+	})
+	if err != nil {
+		log.Println("PutItem error:", err)
+		return respond.DBError(err)
+	}
+
+	entry := audit.NewEntry(req, p.UserID, p.Actor(), audit.ActionAPIKeyCreate)
+	entry.Details = map[string]string{"keyId": k.KeyID, "scopes": strings.Join(k.Scopes, " ")}
+	auditLog.Log(ctx, entry)
+
+	return respond.JSON(201, CreatedAPIKey{APIKey: k, Key: fullKey})
+}
+
+//////////////////////
+// LIST API KEYS
+//////////////////////
+
+func listAPIKeys(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	scope := "api-keys:" + p.UserID
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	result, err := dbClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(keysTable),
+		IndexName:              aws.String(keysUserIndex),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: p.UserID},
+		},
+		Limit:             aws.Int32(pr.Limit),
+		ExclusiveStartKey: pr.StartKey,
+	})
+	if err != nil {
+		log.Println("Query error:", err)
+		return respond.DBError(err)
+	}
+
+	page := pagination.Page[auth.APIKey]{Items: []auth.APIKey{}}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &page.Items); err != nil {
+		log.Println("unmarshal error:", err)
+		return respond.Error(500, "unmarshal error")
+	}
+
+	page.NextCursor, err = pagination.Next(result.LastEvaluatedKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+//////////////////////
+// REVOKE API KEY
+//////////////////////
+
+func revokeAPIKey(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	keyID := req.PathParameters["keyId"]
+
+	// The userId condition keeps users from revoking each other's keys,
+	// and answers 404 rather than 403 so key ids cannot be probed.
+	result, err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(keysTable),
+		Key: map[string]types.AttributeValue{
+			"keyId": &types.AttributeValueMemberS{Value: keyID},
+		},
+		UpdateExpression:    aws.String("SET revokedAt = :now"),
+		ConditionExpression: aws.String("userId = :userId AND attribute_not_exists(revokedAt)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+			":userId": &types.AttributeValueMemberS{Value: p.UserID},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return respond.Error(404, "api key not found")
+	}
+	if err != nil {
+		log.Println("UpdateItem error:", err)
+		return respond.DBError(err)
+	}
+
+	var k auth.APIKey
+	if err := attributevalue.UnmarshalMap(result.Attributes, &k); err != nil {
+		log.Println("unmarshal error:", err)
+		return respond.Error(500, "unmarshal error")
+	}
+
+	entry := audit.NewEntry(req, p.UserID, p.Actor(), audit.ActionAPIKeyRevoke)
+	entry.Details = map[string]string{"keyId": k.KeyID}
+	auditLog.Log(ctx, entry)
+
+	return respond.JSON(200, k)
+}
+
+//////////////////////
+// API KEYS TABLE
+//////////////////////
+
+// userKeys returns every key of userID, revoked ones included, through the
+// userId index.
+func userKeys(ctx context.Context, userID string) ([]auth.APIKey, error) {
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(keysTable),
+		IndexName:              aws.String(keysUserIndex),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: userID},
+		},
+	}
+
+	keys := []auth.APIKey{}
+
+	for {
+		result, err := dbClient.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		var page []auth.APIKey
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return keys, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+//////////////////////
+// HELPERS
+//////////////////////
+
+func countActive(keys []auth.APIKey) int {
+	n := 0
+	for _, k := range keys {
+		if k.RevokedAt == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func newKeyParts() (keyID, secret string, err error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+
+	s := make([]byte, 32)
+	if _, err := rand.Read(s); err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(id), base64.RawURLEncoding.EncodeToString(s), nil
+}
+
+//////////////////////
+// MAIN
+//////////////////////
+
+func main() {
+	lambda.Start(corsPolicy.Wrap(&routes, routes.Serve))
+}
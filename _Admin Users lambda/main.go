@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/audit"
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/cors"
+	"to_do_list_demo/internal/etag"
+	"to_do_list_demo/internal/health"
+	"to_do_list_demo/internal/idempotency"
+	"to_do_list_demo/internal/mail"
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+	"to_do_list_demo/internal/session"
+	"to_do_list_demo/internal/storage"
+)
+
+var (
+	dbClient   *dynamodb.Client
+	tableName  = "To-Do-List-Users"
+	authn      *auth.Authenticator
+	auditLog   *audit.Logger
+	idempotent *idempotency.Store
+	mailer     mail.Sender
+	routes     router.Router
+	corsPolicy *cors.Policy
+	readiness  *health.Checker
+)
+
+const (
+	impersonationTTL = 15 * time.Minute
+	passwordResetTTL = 24 * time.Hour
+
+	// usersCursorScope binds list cursors to the users list. The filters
+	// are added to it, so a cursor cannot be reused with other filters.
+	usersCursorScope = "admin.users"
+)
+
+//////////////////////
+// STRUCTS
+//////////////////////
+
+type User struct {
+	UserID                string `json:"userId" dynamodbav:"userId"`
+	Name                  string `json:"name" dynamodbav:"name"`
+	Email                 string `json:"email" dynamodbav:"email"`
+	Password              string `json:"-" dynamodbav:"password,omitempty"`
+	Role                  string `json:"role" dynamodbav:"role,omitempty"`
+	Disabled              bool   `json:"disabled" dynamodbav:"disabled,omitempty"`
+	PasswordResetRequired bool   `json:"passwordResetRequired" dynamodbav:"passwordResetRequired,omitempty"`
+	Version               int64  `json:"version" dynamodbav:"version"`
+}
+
+type SetRole struct {
+	Role string `json:"role"`
+}
+
+type ImpersonationResponse struct {
+	AccessToken string `json:"accessToken"`
+	TokenType   string `json:"tokenType"`
+	ExpiresIn   int64  `json:"expiresIn"`
+	User        User   `json:"user"`
+}
+
+//////////////////////
+// INIT
+//////////////////////
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal("unable to load AWS SDK config:", err)
+	}
+
+	dbClient = storage.NewClient(cfg)
+	authn = auth.New(dbClient, tableName)
+	auditLog = audit.New(dbClient)
+	idempotent = idempotency.New(dbClient)
+	corsPolicy = cors.FromEnv()
+	mailer = mail.NewFromEnv()
+
+	staff := []string{auth.RoleAdmin, auth.RoleSupport}
+
+	routes.Handle("GET", "/api/to-do-list/mypost/admin/users", authn.StaffMiddleware(listUsers, staff...))
+	routes.Handle("GET", "/api/to-do-list/mypost/admin/users/{userId}", authn.StaffMiddleware(getUser, staff...))
+	routes.Handle("POST", "/api/to-do-list/mypost/admin/users/{userId}/disable", authn.StaffMiddleware(idempotent.WrapAuth(disableUser), auth.RoleAdmin))
+	routes.Handle("POST", "/api/to-do-list/mypost/admin/users/{userId}/enable", authn.StaffMiddleware(idempotent.WrapAuth(enableUser), auth.RoleAdmin))
+	routes.Handle("PUT", "/api/to-do-list/mypost/admin/users/{userId}/role", authn.StaffMiddleware(idempotent.WrapAuth(setRole), auth.RoleAdmin))
+	routes.Handle("POST", "/api/to-do-list/mypost/admin/users/{userId}/password-reset", authn.StaffMiddleware(idempotent.WrapAuth(forcePasswordReset), staff...))
+	// Impersonation returns a session token, so it is not wrapped in idempotent.
+	routes.Handle("POST", "/api/to-do-list/mypost/admin/users/{userId}/impersonate", authn.StaffMiddleware(impersonate, staff...))
+
+	readiness = health.New(
+		health.Table(dbClient, tableName),
+		health.Table(dbClient, auditLog.Table),
+		health.Table(dbClient, idempotent.Table),
+		health.SessionKey(),
+		health.Config("cors", corsPolicy.Validate),
+		health.Config("mail", mail.ValidateEnv),
+	)
+	readiness.Register(&routes, "/api/to-do-list/mypost/admin")
+}
+
+//////////////////////
+// LIST / SEARCH USERS
+//////////////////////
+
+func listUsers(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	q := req.QueryStringParameters
+
+	search := strings.TrimSpace(q["q"])
+	role := q["role"]
+
+	if role != "" && !auth.ValidRole(role) {
+		return respond.Error(400, "invalid role")
+	}
+
+	scope := usersCursorScope + "\nq=" + search + "\nrole=" + role
+
+	pr, err := pagination.Parse(q, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}
+
+	var filters []string
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+
+	// searchText holds the lowercased name and email. Users written before
+	// it existed are still matched on their raw name and email.
+	if search != "" {
+		filters = append(filters, "(contains(searchText, :lq) OR contains(#email, :q) OR contains(#name, :q) OR userId = :q)")
+		names["#email"] = "email"
+		names["#name"] = "name"
+		values[":q"] = &types.AttributeValueMemberS{Value: search}
+		values[":lq"] = &types.AttributeValueMemberS{Value: strings.ToLower(search)}
+	}
+
+	if role != "" {
+		names["#role"] = "role"
+		values[":role"] = &types.AttributeValueMemberS{Value: role}
+		if role == auth.RoleUser {
+			filters = append(filters, "(#role = :role OR attribute_not_exists(#role))")
+		} else {
+			filters = append(filters, "#role = :role")
+		}
+	}
+
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+		input.ExpressionAttributeNames = names
+		input.ExpressionAttributeValues = values
+	}
+
+	// A filtered list scans until it has a full page, and returns what it
+	// found with a cursor to continue when it runs out of pages or time.
+	items, lastKey, err := pagination.Scan(ctx, dbClient, input, pr, "userId")
+	if err != nil {
+		log.Println("Scan error:", err)
+		return respond.DBError(err)
+	}
+
+	page := pagination.Page[User]{Items: []User{}}
+	if err := attributevalue.UnmarshalListOfMaps(items, &page.Items); err != nil {
+		log.Println("unmarshal error:", err)
+		return respond.Error(500, "unmarshal error")
+	}
+
+	for i := range page.Items {
+		page.Items[i].Role = roleOf(page.Items[i])
+	}
+
+	page.NextCursor, err = pagination.Next(lastKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	entry := audit.NewEntry(req, p.UserID, p.UserID, audit.ActionAdminList)
+	entry.Details = map[string]string{"q": q["q"], "role": q["role"]}
+
+	err = auditLog.Record(ctx, entry)
+	if err != nil {
+		log.Println("audit error:", err)
+		return respond.Error(500, "audit error")
+	}
+
+	return respond.JSON(200, page)
+}
+
+//////////////////////
+// GET USER
+//////////////////////
+
+func getUser(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	user, err := loadUser(ctx, req.PathParameters["userId"])
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if user == nil {
+		return respond.Error(404, "user not found")
+	}
+
+	view := audit.NewEntry(req, user.UserID, p.UserID, audit.ActionAdminView)
+
+	err = auditLog.RecordAll(ctx, view, view.ActorCopy(req))
+	if err != nil {
+		log.Println("audit error:", err)
+		return respond.Error(500, "audit error")
+	}
+
+	if etag.NoneMatch(auth.Header(req.Headers, "If-None-Match"), user.Version) {
+		return notModified(user.Version)
+	}
+
+	return userResponse(200, *user)
+}
+
+//////////////////////
+// DISABLE / ENABLE
+//////////////////////
+
+func disableUser(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	targetID := req.PathParameters["userId"]
+	if targetID == p.UserID {
+		return respond.Error(400, "you cannot disable your own account")
+	}
+
+	// Revoking sessions logs the user out everywhere straight away.
+	return updateUser(ctx, req, "SET disabled = :true, sessionsRevokedAt = :now",
+		map[string]types.AttributeValue{
+			":true": &types.AttributeValueMemberBOOL{Value: true},
+			":now":  &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		}, nil,
+		audit.NewEntry(req, targetID, p.UserID, audit.ActionAdminDisable),
+		revocationEntry(req, targetID, p.UserID, audit.ActionAdminDisable))
+}
+
+func enableUser(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	return updateUser(ctx, req, "REMOVE disabled", nil, nil,
+		audit.NewEntry(req, req.PathParameters["userId"], p.UserID, audit.ActionAdminEnable))
+}
+
+//////////////////////
+// ROLE
+//////////////////////
+
+func setRole(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body SetRole
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("setRole unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	role := strings.TrimSpace(body.Role)
+	if !auth.ValidRole(role) {
+		return respond.Error(400, "role must be user, admin or support")
+	}
+
+	targetID := req.PathParameters["userId"]
+	if targetID == p.UserID {
+		return respond.Error(400, "you cannot change your own role")
+	}
+
+	target, err := loadUser(ctx, targetID)
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if target == nil {
+		return respond.Error(404, "user not found")
+	}
+
+	entry := audit.NewEntry(req, targetID, p.UserID, audit.ActionAdminRoleChange)
+	entry.Details = map[string]string{"from": roleOf(*target), "to": role}
+
+	return updateUser(ctx, req, "SET #role = :role",
+		map[string]types.AttributeValue{
+			":role": &types.AttributeValueMemberS{Value: role},
+		},
+		map[string]string{"#role": "role"},
+		entry)
+}
+
+//////////////////////
+// FORCE PASSWORD RESET
+//////////////////////
+
+func forcePasswordReset(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	target, err := loadUser(ctx, req.PathParameters["userId"])
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if target == nil {
+		return respond.Error(404, "user not found")
+	}
+
+	if !canManage(p, *target) {
+		return respond.Error(403, "forbidden")
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		log.Println("random error:", err)
+		return respond.Error(500, "could not start password reset")
+	}
+
+	now := time.Now()
+
+	resp, err := updateUser(ctx, req,
+		"SET passwordResetRequired = :true, passwordResetHash = :hash, passwordResetExpiresAt = :expiresAt, sessionsRevokedAt = :now",
+		map[string]types.AttributeValue{
+			":true":      &types.AttributeValueMemberBOOL{Value: true},
+			":hash":      &types.AttributeValueMemberS{Value: hashToken(token)},
+			":expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(passwordResetTTL).Unix(), 10)},
+			":now":       &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		}, nil,
+		audit.NewEntry(req, target.UserID, p.UserID, audit.ActionAdminPasswordReset),
+		revocationEntry(req, target.UserID, p.UserID, audit.ActionAdminPasswordReset))
+
+	if err == nil && resp.StatusCode == 200 {
+		sendPasswordResetEmail(ctx, target.Email, token)
+	}
+
+	return resp, err
+}
+
+func sendPasswordResetEmail(ctx context.Context, to, token string) {
+
+	body := "Your password must be reset before you can sign in again. Use this code: " + token
+
+	if link := os.Getenv("PASSWORD_RESET_URL"); link != "" {
+		body = "Your password must be reset before you can sign in again. Choose a new one here:\n\n" +
+			link + "?email=" + url.QueryEscape(to) + "&token=" + url.QueryEscape(token)
+	}
+
+	err := mailer.Send(ctx, mail.Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body:    body + "\n\nThe link expires in 24 hours.",
+	})
+	if err != nil {
+		log.Println("password reset email error:", err)
+	}
+}
+
+//////////////////////
+// IMPERSONATE
+//////////////////////
+
+func impersonate(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	target, err := loadUser(ctx, req.PathParameters["userId"])
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if target == nil {
+		return respond.Error(404, "user not found")
+	}
+
+	// Staff accounts cannot be impersonated, so impersonation never grants
+	// more access than a regular user has.
+	if roleOf(*target) != auth.RoleUser {
+		return respond.Error(403, "only regular users can be impersonated")
+	}
+
+	if target.Disabled {
+		return respond.Error(409, "user is disabled")
+	}
+
+	// The entry is written before the token exists, so there is never an
+	// impersonation session without a record of it.
+	entry := audit.NewEntry(req, target.UserID, p.UserID, audit.ActionAdminImpersonate)
+
+	err = auditLog.RecordAll(ctx, entry, entry.ActorCopy(req))
+	if err != nil {
+		log.Println("audit error:", err)
+		return respond.Error(500, "audit error")
+	}
+
+	t, err := session.IssueImpersonation(target.UserID, p.UserID, impersonationTTL)
+	if err != nil {
+		log.Println("session issue error:", err)
+		return respond.Error(500, "could not issue session")
+	}
+
+	return respond.JSON(200, ImpersonationResponse{
+		AccessToken: t.AccessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(impersonationTTL.Seconds()),
+		User:        *target,
+	})
+}
+
+//////////////////////
+// USERS TABLE
+//////////////////////
+
+// updateUser applies update to the user the entries are about and writes the
+// entries to the audit log in the same transaction, then returns the updated
+// user. Each entry is also copied to the staff member's own partition with
+// the request's IP and user agent, which the user does not get to see.
+func updateUser(ctx context.Context, req events.APIGatewayV2HTTPRequest, update string, values map[string]types.AttributeValue, names map[string]string, entries ...audit.Entry) (events.APIGatewayV2HTTPResponse, error) {
+
+	targetID := entries[0].UserID
+
+	if names == nil {
+		names = map[string]string{}
+	}
+	if values == nil {
+		values = map[string]types.AttributeValue{}
+	}
+	update += " " + etag.Increment(names, values)
+
+	// The update must stay first: a failed condition is reported on it.
+	items := []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName: aws.String(tableName),
+				Key: map[string]types.AttributeValue{
+					"userId": &types.AttributeValueMemberS{Value: targetID},
+				},
+				UpdateExpression:          aws.String(update),
+				ConditionExpression:       aws.String("attribute_exists(userId)"),
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+			},
+		},
+	}
+
+	for _, e := range entries {
+		for _, c := range []audit.Entry{e, e.ActorCopy(req)} {
+			item, err := auditLog.TransactItem(c)
+			if err != nil {
+				log.Println("audit error:", err)
+				return respond.Error(500, "audit error")
+			}
+			items = append(items, item)
+		}
+	}
+
+	_, err := dbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 &&
+		aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return respond.Error(404, "user not found")
+	}
+	if err != nil {
+		log.Println("TransactWriteItems error:", err)
+		return respond.DBError(err)
+	}
+
+	user, err := loadUser(ctx, targetID)
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	// The user deleted their account between the update and this read.
+	if user == nil {
+		return respond.Error(404, "user not found")
+	}
+
+	return userResponse(200, *user)
+}
+
+// revocationEntry records that action signed the user out of every session.
+func revocationEntry(req events.APIGatewayV2HTTPRequest, userID, actorID, action string) audit.Entry {
+	e := audit.NewEntry(req, userID, actorID, audit.ActionSessionsRevoke)
+	e.Details = map[string]string{"reason": action}
+	return e
+}
+
+// loadUser returns nil when the user does not exist.
+func loadUser(ctx context.Context, userID string) (*User, error) {
+
+	result, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var user User
+	if err := attributevalue.UnmarshalMap(result.Item, &user); err != nil {
+		return nil, err
+	}
+
+	user.Role = roleOf(user)
+	return &user, nil
+}
+
+//////////////////////
+// HELPERS
+//////////////////////
+
+func roleOf(u User) string {
+	if u.Role == "" {
+		return auth.RoleUser
+	}
+	return u.Role
+}
+
+// canManage reports whether p may act on target. Support staff only manage
+// regular users; admins manage everyone but themselves.
+func canManage(p *auth.Principal, target User) bool {
+	if target.UserID == p.UserID {
+		return false
+	}
+	return p.HasRole(auth.RoleAdmin) || roleOf(target) == auth.RoleUser
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// userResponse answers with user and its ETag.
+func userResponse(code int, user User) (events.APIGatewayV2HTTPResponse, error) {
+
+	resp, err := respond.JSON(code, user)
+	resp.Headers["ETag"] = etag.Format(user.Version)
+
+	return resp, err
+}
+
+func notModified(version int64) (events.APIGatewayV2HTTPResponse, error) {
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 304,
+		Headers: map[string]string{
+			"ETag": etag.Format(version),
+		},
+	}, nil
+}
+
+//////////////////////
+// MAIN
+//////////////////////
+
+func main() {
+	lambda.Start(corsPolicy.Wrap(&routes, routes.Serve))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+
+	"to_do_list_demo/internal/storage"
+	"to_do_list_demo/internal/tasks"
+)
+
+var store *tasks.Store
+
+//////////////////////
+// INIT
+//////////////////////
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal("unable to load AWS SDK config:", err)
+	}
+
+	store = tasks.New(storage.NewClient(cfg))
+}
+
+//////////////////////
+// STRUCTS
+//////////////////////
+
+// Summary is what one run did.
+type Summary struct {
+	Projects int `json:"projects"`
+	Archived int `json:"archived"`
+	Failed   int `json:"failed"`
+}
+
+//////////////////////
+// RUN
+//////////////////////
+
+// run applies the auto-archive rule of every project that has one at now.
+// A project that fails is logged and counted, and the next run picks it up
+// again.
+func run(ctx context.Context, now time.Time) (Summary, error) {
+
+	var sum Summary
+
+	err := store.AutoArchiveProjects(ctx, func(p *tasks.Project) error {
+		sum.Projects++
+		n, err := store.AutoArchive(ctx, p, now)
+		sum.Archived += n
+		if err != nil {
+			log.Println("AutoArchive error:", p.ProjectID, err)
+			sum.Failed++
+		}
+		return nil
+	})
+
+	return sum, err
+}
+
+//////////////////////
+// MAIN
+//////////////////////
+
+// handle is invoked by an EventBridge schedule, rate(1 day).
+func handle(ctx context.Context, ev events.CloudWatchEvent) (Summary, error) {
+	return run(ctx, time.Now())
+}
+
+// main runs the archive job as a lambda, or once from the command line
+// with "run", against the tables of the local AWS config:
+//
+//	cd "_Archive lambda" && go run main.go run
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		sum, err := run(context.Background(), time.Now())
+		if err != nil {
+			log.Fatal("run error:", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(sum)
+		return
+	}
+
+	lambda.Start(handle)
+}
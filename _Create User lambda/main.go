@@ -13,11 +13,27 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/audit"
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/cors"
+	"to_do_list_demo/internal/health"
+	"to_do_list_demo/internal/idempotency"
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+	"to_do_list_demo/internal/storage"
 )
 
 var (
-	dbClient  *dynamodb.Client
-	tableName = "To-Do-List-Users"
+	dbClient   *dynamodb.Client
+	tableName  = "To-Do-List-Users"
+	auditLog   *audit.Logger
+	idempotent *idempotency.Store
+
+	routes     router.Router
+	corsPolicy *cors.Policy
+	readiness  *health.Checker
 )
 
 //////////////////////
@@ -29,6 +45,16 @@ type User struct {
 	Name     string `json:"name" dynamodbav:"name"`
 	Email    string `json:"email" dynamodbav:"email"`
 	Password string `json:"password" dynamodbav:"password"`
+	Role     string `json:"-" dynamodbav:"role"`
+	Version  int64  `json:"-" dynamodbav:"version"`
+
+	// EmailVerified is set once the owner of the address proves it, for
+	// example through an email change or password reset. OIDC logins only
+	// link onto accounts with a verified email without asking for the
+	// password.
+	EmailVerified bool `json:"-" dynamodbav:"emailVerified"`
+
+	SearchText string `json:"-" dynamodbav:"searchText"`
 }
 
 type LoginUser struct {
@@ -46,41 +72,20 @@ func init() {
 		log.Fatal("unable to load AWS SDK config:", err)
 	}
 
-	dbClient = dynamodb.NewFromConfig(cfg)
-}
-
-//////////////////////
-// HANDLER
-//////////////////////
-
-func handler(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
-
-	log.Println("request:", req.RequestContext.HTTP.Method, req.RequestContext.HTTP.Path)
-
-	method := req.RequestContext.HTTP.Method
-	path := req.RequestContext.HTTP.Path
+	dbClient = storage.NewClient(cfg)
+	auditLog = audit.New(dbClient)
+	idempotent = idempotency.New(dbClient)
+	corsPolicy = cors.FromEnv()
 
-	switch method + " " + path {
-	case "POST /api/to-do-list/mypost/users":
-		return createUser(ctx, req)
+	routes.Handle("POST", "/api/to-do-list/mypost/users", idempotent.Wrap(createUser))
 
-	case "HEAD /api/to-do-list/mypost/health":
-		return handleHello(ctx, req)
-
-	case "OPTIONS /api/to-do-list/mypost/users":
-		return response(200, map[string]string{"message": "ok"})
-
-	default:
-		return response(405, map[string]string{"error": "method not allowed"})
-	}
-}
-
-//////////////////////
-// HEALTH
-//////////////////////
-
-func handleHello(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
-	return response(204, nil)
+	readiness = health.New(
+		health.Table(dbClient, tableName),
+		health.Table(dbClient, auditLog.Table),
+		health.Table(dbClient, idempotent.Table),
+		health.Config("cors", corsPolicy.Validate),
+	)
+	readiness.Register(&routes, "/api/to-do-list/mypost")
 }
 
 //////////////////////
@@ -93,7 +98,7 @@ func createUser(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events
 
 	if err := json.Unmarshal([]byte(req.Body), &user); err != nil {
 		log.Println("createUser unmarshal error:", err, "body:", req.Body)
-		return response(400, map[string]string{"error": "invalid json"})
+		return respond.Error(400, "invalid json")
 	}
 
 	// Trim whitespace
@@ -103,58 +108,83 @@ func createUser(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events
 	user.Password = strings.TrimSpace(user.Password)
 
 	if user.UserID == "" || user.Name == "" || user.Email == "" || user.Password == "" {
-		return response(400, map[string]string{"error": "missing fields"})
+		return respond.Error(400, "missing fields")
 	}
 
+	// Logins look users up by email, so an address can only belong to one
+	// account.
+	taken, err := emailTaken(ctx, user.Email)
+	if err != nil {
+		log.Println("Scan error:", err)
+		return respond.DBError(err)
+	}
+
+	if taken {
+		return respond.Error(409, "email already in use")
+	}
+
+	// Sign-ups are always regular users; staff roles are granted by an admin.
+	user.Role = auth.RoleUser
+	user.Version = 1
+	user.SearchText = auth.SearchText(user.Name, user.Email)
+
 	item, err := attributevalue.MarshalMap(user)
 	if err != nil {
 		log.Println("marshal error:", err)
-		return response(500, map[string]string{"error": "marshal failed"})
+		return respond.Error(500, "marshal failed")
 	}
 
+	// Never overwrite an existing user, for example when a client retries
+	// without an Idempotency-Key.
 	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item:      item,
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(userId)"),
 	})
 
+	if storage.IsConditionFailed(err) {
+		return respond.Error(409, "user already exists")
+	}
 	if err != nil {
 		log.Println("PutItem error:", err)
-		return response(500, map[string]string{"error": "dynamodb error"})
+		return respond.DBError(err)
 	}
 
-	return response(201, map[string]string{"message": "user created"})
-}
+	auditLog.Log(ctx, audit.NewEntry(req, user.UserID, user.UserID, audit.ActionSignup))
 
-//////////////////////
-// RESPONSE HELPER
-//////////////////////
+	return respond.JSON(201, map[string]string{"message": "user created"})
+}
 
-func response(code int, body any) (events.APIGatewayV2HTTPResponse, error) {
+// emailTaken reports whether any user already has email.
+func emailTaken(ctx context.Context, email string) (bool, error) {
 
-	jsonBody, err := json.Marshal(body)
-	if err != nil {
-		log.Println("json marshal error:", err)
-
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 500,
-			Headers: map[string]string{
-				"Content-Type":                "application/json",
-				"Access-Control-Allow-Origin": "*",
-			},
-			Body: `{"error":"json marshal failed"}`,
-		}, nil
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(tableName),
+		FilterExpression: aws.String("#email = :email"),
+		ExpressionAttributeNames: map[string]string{
+			"#email": "email",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":email": &types.AttributeValueMemberS{Value: email},
+		},
+		ProjectionExpression: aws.String("userId"),
 	}
 
-	return events.APIGatewayV2HTTPResponse{
-		StatusCode: code,
-		Headers: map[string]string{
-			"Content-Type":                 "application/json",
-			"Access-Control-Allow-Origin":  "*",
-			"Access-Control-Allow-Methods": "GET,POST,OPTIONS",
-			"Access-Control-Allow-Headers": "Content-Type",
-		},
-		Body: string(jsonBody),
-	}, nil
+	for {
+		result, err := dbClient.Scan(ctx, input)
+		if err != nil {
+			return false, err
+		}
+
+		if len(result.Items) > 0 {
+			return true, nil
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return false, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
 }
 
 //////////////////////
@@ -162,5 +192,5 @@ func response(code int, body any) (events.APIGatewayV2HTTPResponse, error) {
 //////////////////////
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(corsPolicy.Wrap(&routes, routes.Serve))
 }
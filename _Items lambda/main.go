@@ -0,0 +1,687 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	// The Lambda runtime image has no zoneinfo, so embed it for the
+	// users' time zones.
+	_ "time/tzdata"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/cors"
+	"to_do_list_demo/internal/etag"
+	"to_do_list_demo/internal/health"
+	"to_do_list_demo/internal/idempotency"
+	"to_do_list_demo/internal/notify"
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+	"to_do_list_demo/internal/storage"
+	"to_do_list_demo/internal/tasks"
+)
+
+var (
+	dbClient   *dynamodb.Client
+	tableName  = "To-Do-List-Users"
+	store      *tasks.Store
+	authn      *auth.Authenticator
+	idempotent *idempotency.Store
+	inbox      *notify.Inbox
+	routes     router.Router
+	corsPolicy *cors.Policy
+	readiness  *health.Checker
+)
+
+//////////////////////
+// INIT
+//////////////////////
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal("unable to load AWS SDK config:", err)
+	}
+
+	dbClient = storage.NewClient(cfg)
+	store = tasks.New(dbClient)
+	store.Users = tableName
+	authn = auth.New(dbClient, tableName)
+	idempotent = idempotency.New(dbClient)
+	inbox = notify.NewInbox(dbClient)
+	corsPolicy = cors.FromEnv()
+
+	routes.Handle("GET", "/api/to-do-list/mypost/projects/{projectId}/items", authn.Middleware(auth.ScopeReadOnly, listItems))
+	routes.Handle("POST", "/api/to-do-list/mypost/projects/{projectId}/items", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(createItem))))
+	routes.Handle("GET", "/api/to-do-list/mypost/users/me/tasks", authn.Middleware(auth.ScopeReadOnly, listMyTasks))
+	routes.Handle("GET", "/api/to-do-list/mypost/items/{itemId}", authn.Middleware(auth.ScopeReadOnly, getItem))
+	routes.Handle("PATCH", "/api/to-do-list/mypost/items/{itemId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(updateItem))))
+	routes.Handle("DELETE", "/api/to-do-list/mypost/items/{itemId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(deleteItem))))
+	routes.Handle("POST", "/api/to-do-list/mypost/items:batch", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(batchItems))))
+	routes.Handle("POST", "/api/to-do-list/mypost/items/{itemId}/move", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(moveItem))))
+	routes.Handle("POST", "/api/to-do-list/mypost/items/{itemId}/restore", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(restoreItem))))
+	routes.Handle("POST", "/api/to-do-list/mypost/items/{itemId}/unarchive", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(unarchiveItem))))
+	routes.Handle("GET", "/api/to-do-list/mypost/users/me/trash", authn.Middleware(auth.ScopeReadOnly, listTrash))
+	routes.Handle("GET", "/api/to-do-list/mypost/items/{itemId}/subtasks", authn.Middleware(auth.ScopeReadOnly, listSubtasks))
+	routes.Handle("GET", "/api/to-do-list/mypost/items/{itemId}/comments", authn.Middleware(auth.ScopeReadOnly, listComments))
+	routes.Handle("POST", "/api/to-do-list/mypost/items/{itemId}/comments", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(createComment))))
+	routes.Handle("PATCH", "/api/to-do-list/mypost/items/{itemId}/comments/{commentId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(updateComment))))
+	routes.Handle("DELETE", "/api/to-do-list/mypost/items/{itemId}/comments/{commentId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(deleteComment))))
+	routes.Handle("GET", "/api/to-do-list/mypost/items/{itemId}/history", authn.Middleware(auth.ScopeReadOnly, listHistory))
+	routes.Handle("POST", "/api/to-do-list/mypost/items/{itemId}/history/{entryId}/revert", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(revertChange))))
+	routes.Handle("GET", "/api/to-do-list/mypost/items/{itemId}/reminders", authn.Middleware(auth.ScopeReadOnly, listReminders))
+	routes.Handle("POST", "/api/to-do-list/mypost/items/{itemId}/reminders", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(createReminder))))
+	routes.Handle("DELETE", "/api/to-do-list/mypost/items/{itemId}/reminders/{reminderId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(deleteReminder))))
+	routes.Handle("GET", "/api/to-do-list/mypost/users/me/inbox", authn.Middleware(auth.ScopeReadOnly, listInbox))
+	routes.Handle("PATCH", "/api/to-do-list/mypost/users/me/inbox/{notificationId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(markInbox))))
+	routes.Handle("DELETE", "/api/to-do-list/mypost/users/me/inbox/{notificationId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(deleteInbox))))
+
+	readiness = health.New(
+		health.Table(dbClient, tableName),
+		health.Table(dbClient, store.Projects),
+		health.Table(dbClient, store.Items),
+		health.Table(dbClient, store.Comments),
+		health.Table(dbClient, store.Reminders),
+		health.Table(dbClient, store.History),
+		health.Table(dbClient, inbox.Table),
+		health.Table(dbClient, store.Labels),
+		health.Table(dbClient, store.Search.Table),
+		health.Table(dbClient, idempotent.Table),
+		health.SessionKey(),
+		health.Config("cors", corsPolicy.Validate),
+	)
+	readiness.Register(&routes, "/api/to-do-list/mypost/items")
+}
+
+//////////////////////
+// LIST ITEMS
+//////////////////////
+
+// listItems lists a project's items, filtered and sorted by the query
+// string (see tasks.ItemFilter).
+func listItems(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	projectID := req.PathParameters["projectId"]
+
+	filter, err := tasks.ParseItemFilter(req.QueryStringParameters)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	scope := "items:" + p.UserID + "\n" + projectID + "\n" + filter.Scope()
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	items, lastKey, err := store.ListItems(ctx, p.UserID, projectID, filter, pr)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	page := pagination.Page[tasks.Item]{Items: items}
+
+	page.NextCursor, err = pagination.Next(lastKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+//////////////////////
+// MY TASKS
+//////////////////////
+
+// listMyTasks lists the user's open items across all projects in one of
+// the views of tasks.View, worked out in the time zone of their profile.
+func listMyTasks(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	view, err := tasks.ParseView(req.QueryStringParameters)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	scope := "my-tasks:" + p.UserID + "\n" + view.Scope()
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	items, lastKey, err := store.ListMyTasks(ctx, p.UserID, view, pr)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	page := pagination.Page[tasks.Item]{Items: items}
+
+	page.NextCursor, err = pagination.Next(lastKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+//////////////////////
+// CREATE ITEM
+//////////////////////
+
+func createItem(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body tasks.ItemPatch
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("createItem unmarshal error:", err)
+		return bodyError(err)
+	}
+
+	body.Force = req.QueryStringParameters["force"] == "true"
+
+	it, err := store.CreateItem(ctx, p.UserID, req.PathParameters["projectId"], body)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ItemResponse(201, it)
+}
+
+//////////////////////
+// GET ITEM
+//////////////////////
+
+func getItem(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	it, err := store.GetItem(ctx, p.UserID, req.PathParameters["itemId"])
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	if etag.NoneMatch(auth.Header(req.Headers, "If-None-Match"), it.Version) {
+		return tasks.NotModified(it.Version)
+	}
+
+	return tasks.ItemResponse(200, it)
+}
+
+//////////////////////
+// UPDATE ITEM
+//////////////////////
+
+func updateItem(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body tasks.ItemPatch
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("updateItem unmarshal error:", err)
+		return bodyError(err)
+	}
+
+	if body.Empty() {
+		return respond.Error(400, "nothing to update")
+	}
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+	body.Force = req.QueryStringParameters["force"] == "true"
+	body.Scope = req.QueryStringParameters["scope"]
+
+	it, err := store.PatchItem(ctx, p.UserID, req.PathParameters["itemId"], pre, body)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ItemResponse(200, it)
+}
+
+//////////////////////
+// DELETE ITEM
+//////////////////////
+
+func deleteItem(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+	scope := req.QueryStringParameters["scope"]
+
+	if err := store.DeleteItem(ctx, p.UserID, req.PathParameters["itemId"], pre, scope); err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, map[string]string{"message": "item deleted"})
+}
+
+//////////////////////
+// MOVE ITEM
+//////////////////////
+
+// moveItem places a task in its project's manual order, between the tasks
+// before and after, and into the state column when it is given.
+func moveItem(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body tasks.MoveTo
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("moveItem unmarshal error:", err)
+		return bodyError(err)
+	}
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	it, err := store.MoveItem(ctx, p.UserID, req.PathParameters["itemId"], pre, body)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ItemResponse(200, it)
+}
+
+//////////////////////
+// BATCH
+//////////////////////
+
+// batchItems runs the operations of a batch and answers with a result per
+// operation. An atomic batch that failed answers with the status of the
+// operation that failed.
+func batchItems(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body tasks.Batch
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("batchItems unmarshal error:", err)
+		return bodyError(err)
+	}
+
+	results, err := store.RunBatch(ctx, p.UserID, body)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	code := 200
+	for _, r := range results {
+		if body.Atomic && r.Status >= 400 && r.Status != tasks.StatusNotApplied {
+			code = r.Status
+		}
+	}
+
+	return respond.JSON(code, map[string][]tasks.BatchResult{"results": results})
+}
+
+//////////////////////
+// TRASH
+//////////////////////
+
+// listTrash lists what the user deleted, newest first: the tasks, or the
+// projects with ?type=projects. Subtasks and the tasks of a project are
+// restored with what they were deleted along with, so they are not listed.
+func listTrash(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	kind := req.QueryStringParameters["type"]
+	if kind == "" {
+		kind = "items"
+	}
+	if kind != "items" && kind != "projects" {
+		return respond.Error(400, "type must be items or projects")
+	}
+	scope := "trash:" + p.UserID + "\n" + kind
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	if kind == "projects" {
+		projects, lastKey, err := store.ListTrashedProjects(ctx, p.UserID, pr)
+		if err != nil {
+			return tasks.ErrorResponse(err)
+		}
+
+		page := pagination.Page[tasks.Project]{Items: projects}
+
+		page.NextCursor, err = pagination.Next(lastKey, scope)
+		if err != nil {
+			return pagination.ErrorResponse(err)
+		}
+
+		return respond.JSON(200, page)
+	}
+
+	items, lastKey, err := store.ListTrash(ctx, p.UserID, pr)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	page := pagination.Page[tasks.Item]{Items: items}
+
+	page.NextCursor, err = pagination.Next(lastKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+// restoreItem takes a task out of the trash with the subtasks deleted
+// along with it.
+func restoreItem(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	it, err := store.RestoreItem(ctx, p.UserID, req.PathParameters["itemId"])
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ItemResponse(200, it)
+}
+
+// unarchiveItem takes a task out of its project's archive with its
+// subtasks.
+func unarchiveItem(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	it, err := store.UnarchiveItem(ctx, p.UserID, req.PathParameters["itemId"], pre)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ItemResponse(200, it)
+}
+
+//////////////////////
+// SUBTASKS
+//////////////////////
+
+// listSubtasks lists the direct subtasks of a task. Subtasks are created
+// and moved with the parentId field of the item body.
+func listSubtasks(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	itemID := req.PathParameters["itemId"]
+	scope := "subtasks:" + p.UserID + "\n" + itemID
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	items, lastKey, err := store.ListSubtasks(ctx, p.UserID, itemID, pr)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	page := pagination.Page[tasks.Item]{Items: items}
+
+	page.NextCursor, err = pagination.Next(lastKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+//////////////////////
+// COMMENTS
+//////////////////////
+
+func listComments(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	itemID := req.PathParameters["itemId"]
+	scope := "comments:" + p.UserID + "\n" + itemID
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	comments, lastKey, err := store.ListComments(ctx, p.UserID, itemID, pr)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	page := pagination.Page[tasks.Comment]{Items: comments}
+
+	page.NextCursor, err = pagination.Next(lastKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+func createComment(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body tasks.CommentBody
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("createComment unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	c, err := store.CreateComment(ctx, p.UserID, req.PathParameters["itemId"], body)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.CommentResponse(201, c)
+}
+
+func updateComment(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body tasks.CommentBody
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("updateComment unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	c, err := store.UpdateComment(ctx, p.UserID, req.PathParameters["itemId"], req.PathParameters["commentId"], pre, body)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.CommentResponse(200, c)
+}
+
+func deleteComment(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	if err := store.DeleteComment(ctx, p.UserID, req.PathParameters["itemId"], req.PathParameters["commentId"], pre); err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, map[string]string{"message": "comment deleted"})
+}
+
+//////////////////////
+// HISTORY
+//////////////////////
+
+// listHistory lists the changes to the item, newest first: one entry per
+// changed field with its value before and after.
+func listHistory(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	itemID := req.PathParameters["itemId"]
+	scope := "history:" + p.UserID + "\n" + itemID
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	entries, lastKey, err := store.ListHistory(ctx, p.UserID, itemID, pr)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	page := pagination.Page[tasks.HistoryEntry]{Items: entries}
+
+	page.NextCursor, err = pagination.Next(lastKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+// revertChange sets the field of a history entry back to its value
+// before, unless it changed again since (409).
+func revertChange(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	it, err := store.RevertChange(ctx, p.UserID, req.PathParameters["itemId"], req.PathParameters["entryId"], pre)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ItemResponse(200, it)
+}
+
+//////////////////////
+// REMINDERS
+//////////////////////
+
+func listReminders(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	reminders, err := store.ListReminders(ctx, p.UserID, req.PathParameters["itemId"])
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, pagination.Page[tasks.Reminder]{Items: reminders})
+}
+
+func createReminder(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body tasks.ReminderBody
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("createReminder unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	r, err := store.CreateReminder(ctx, p.UserID, req.PathParameters["itemId"], body)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return respond.JSON(201, r)
+}
+
+func deleteReminder(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	if err := store.DeleteReminder(ctx, p.UserID, req.PathParameters["itemId"], req.PathParameters["reminderId"]); err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, map[string]string{"message": "reminder deleted"})
+}
+
+//////////////////////
+// INBOX
+//////////////////////
+
+// listInbox lists the user's in-app notifications, newest first, only the
+// unread ones with ?unread=true.
+func listInbox(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	unread := req.QueryStringParameters["unread"] == "true"
+	scope := "inbox:" + p.UserID
+	if unread {
+		scope += "\nunread"
+	}
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	entries, lastKey, err := inbox.List(ctx, p.UserID, unread, pr)
+	if err != nil {
+		log.Println("inbox list error:", err)
+		return respond.DBError(err)
+	}
+
+	page := pagination.Page[notify.Entry]{Items: entries}
+
+	page.NextCursor, err = pagination.Next(lastKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+type inboxPatch struct {
+	Read *bool `json:"read"`
+}
+
+func markInbox(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body inboxPatch
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("markInbox unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+	if body.Read == nil {
+		return respond.Error(400, "read is required")
+	}
+
+	e, err := inbox.MarkRead(ctx, p.UserID, req.PathParameters["notificationId"], *body.Read)
+	if errors.Is(err, notify.ErrNotFound) {
+		return respond.Error(404, "notification not found")
+	}
+	if err != nil {
+		log.Println("inbox update error:", err)
+		return respond.DBError(err)
+	}
+
+	return respond.JSON(200, e)
+}
+
+func deleteInbox(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	err := inbox.Delete(ctx, p.UserID, req.PathParameters["notificationId"])
+	if errors.Is(err, notify.ErrNotFound) {
+		return respond.Error(404, "notification not found")
+	}
+	if err != nil {
+		log.Println("inbox delete error:", err)
+		return respond.DBError(err)
+	}
+
+	return respond.JSON(200, map[string]string{"message": "notification deleted"})
+}
+
+//////////////////////
+// HELPERS
+//////////////////////
+
+// bodyError answers a body that did not unmarshal. A field the tasks
+// package rejected, such as an unknown priority, gets its own message.
+func bodyError(err error) (events.APIGatewayV2HTTPResponse, error) {
+	var te *tasks.Error
+	if errors.As(err, &te) {
+		return respond.Error(te.Code, te.Msg)
+	}
+	return respond.Error(400, "invalid json")
+}
+
+//////////////////////
+// MAIN
+//////////////////////
+
+func main() {
+	lambda.Start(corsPolicy.Wrap(&routes, routes.Serve))
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/cors"
+	"to_do_list_demo/internal/etag"
+	"to_do_list_demo/internal/health"
+	"to_do_list_demo/internal/idempotency"
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+	"to_do_list_demo/internal/storage"
+	"to_do_list_demo/internal/tasks"
+)
+
+var (
+	dbClient    *dynamodb.Client
+	tableName   = "To-Do-List-Users"
+	labelsTable = "To-Do-List-Labels"
+	store       *tasks.Store
+	authn       *auth.Authenticator
+	idempotent  *idempotency.Store
+	routes      router.Router
+	corsPolicy  *cors.Policy
+	readiness   *health.Checker
+)
+
+const (
+	maxLabels     = 100
+	maxNameLength = 50
+	defaultColor  = "#808080"
+)
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+//////////////////////
+// STRUCTS
+//////////////////////
+
+// Label is an item in the labels table, partitioned by userId so every user
+// has their own set of labels.
+type Label struct {
+	UserID    string `json:"-" dynamodbav:"userId"`
+	LabelID   string `json:"labelId" dynamodbav:"labelId"`
+	Name      string `json:"name" dynamodbav:"name"`
+	Color     string `json:"color" dynamodbav:"color"`
+	CreatedAt string `json:"createdAt" dynamodbav:"createdAt"`
+	Version   int64  `json:"version" dynamodbav:"version"`
+}
+
+type CreateLabel struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// UpdateLabel is the PATCH body. Only the fields that are present change.
+type UpdateLabel struct {
+	Name  *string `json:"name"`
+	Color *string `json:"color"`
+}
+
+type MergeLabel struct {
+	Into string `json:"into"`
+}
+
+//////////////////////
+// INIT
+//////////////////////
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal("unable to load AWS SDK config:", err)
+	}
+
+	dbClient = storage.NewClient(cfg)
+	authn = auth.New(dbClient, tableName)
+	idempotent = idempotency.New(dbClient)
+	corsPolicy = cors.FromEnv()
+
+	if t := os.Getenv("LABELS_TABLE"); t != "" {
+		labelsTable = t
+	}
+
+	store = tasks.New(dbClient)
+	store.Labels = labelsTable
+
+	routes.Handle("GET", "/api/to-do-list/mypost/users/me/labels", authn.Middleware(auth.ScopeReadOnly, listLabels))
+	routes.Handle("POST", "/api/to-do-list/mypost/users/me/labels", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(createLabel))))
+	routes.Handle("GET", "/api/to-do-list/mypost/users/me/labels/{labelId}", authn.Middleware(auth.ScopeReadOnly, getLabel))
+	routes.Handle("PATCH", "/api/to-do-list/mypost/users/me/labels/{labelId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(updateLabel))))
+	routes.Handle("DELETE", "/api/to-do-list/mypost/users/me/labels/{labelId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(deleteLabel))))
+	routes.Handle("POST", "/api/to-do-list/mypost/users/me/labels/{labelId}/merge", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(mergeLabel))))
+
+	readiness = health.New(
+		health.Table(dbClient, tableName),
+		health.Table(dbClient, labelsTable),
+		health.Table(dbClient, store.Items),
+		health.Table(dbClient, store.History),
+		health.Table(dbClient, store.Search.Table),
+		health.Table(dbClient, idempotent.Table),
+		health.SessionKey(),
+		health.Config("cors", corsPolicy.Validate),
+	)
+	readiness.Register(&routes, "/api/to-do-list/mypost/users/me/labels")
+}
+
+//////////////////////
+// LIST LABELS
+//////////////////////
+
+func listLabels(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	scope := "labels:" + p.UserID
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	result, err := dbClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(labelsTable),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: p.UserID},
+		},
+		Limit:             aws.Int32(pr.Limit),
+		ExclusiveStartKey: pr.StartKey,
+	})
+	if err != nil {
+		log.Println("Query error:", err)
+		return respond.DBError(err)
+	}
+
+	page := pagination.Page[Label]{Items: []Label{}}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &page.Items); err != nil {
+		log.Println("unmarshal error:", err)
+		return respond.Error(500, "unmarshal error")
+	}
+
+	page.NextCursor, err = pagination.Next(result.LastEvaluatedKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+//////////////////////
+// GET LABEL
+//////////////////////
+
+func getLabel(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	l, err := loadLabel(ctx, p.UserID, req.PathParameters["labelId"])
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if l == nil {
+		return respond.Error(404, "label not found")
+	}
+
+	if etag.NoneMatch(auth.Header(req.Headers, "If-None-Match"), l.Version) {
+		return notModified(l.Version)
+	}
+
+	return labelResponse(200, *l)
+}
+
+//////////////////////
+// CREATE LABEL
+//////////////////////
+
+func createLabel(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body CreateLabel
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("createLabel unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > maxNameLength {
+		return respond.Error(400, "name is required and must be at most 50 characters")
+	}
+
+	color := strings.TrimSpace(body.Color)
+	if color == "" {
+		color = defaultColor
+	}
+	if !colorPattern.MatchString(color) {
+		return respond.Error(400, "color must look like #1a2b3c")
+	}
+
+	labels, err := userLabels(ctx, p.UserID)
+	if err != nil {
+		log.Println("Query error:", err)
+		return respond.DBError(err)
+	}
+
+	if len(labels) >= maxLabels {
+		return respond.Error(409, "too many labels, delete or merge some first")
+	}
+
+	if findByName(labels, name) != nil {
+		return respond.Error(409, "a label with this name already exists")
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Println("random error:", err)
+		return respond.Error(500, "could not create label")
+	}
+
+	l := Label{
+		UserID:    p.UserID,
+		LabelID:   hex.EncodeToString(id),
+		Name:      name,
+		Color:     strings.ToLower(color),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Version:   1,
+	}
+
+	item, err := attributevalue.MarshalMap(l)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return respond.Error(500, "marshal failed")
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(labelsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(labelId)"),
+	})
+	if err != nil {
+		log.Println("PutItem error:", err)
+		return respond.DBError(err)
+	}
+
+	return labelResponse(201, l)
+}
+
+//////////////////////
+// UPDATE LABEL
+//////////////////////
+
+// updateLabel renames or recolors a label. Tasks refer to labels by id, so
+// a rename shows up on every tagged task without touching them.
+func updateLabel(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var update UpdateLabel
+
+	if err := json.Unmarshal([]byte(req.Body), &update); err != nil {
+		log.Println("updateLabel unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	if update.Name == nil && update.Color == nil {
+		return respond.Error(400, "nothing to update")
+	}
+
+	labelID := req.PathParameters["labelId"]
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	var sets []string
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+
+	if update.Name != nil {
+		name := strings.TrimSpace(*update.Name)
+		if name == "" || len(name) > maxNameLength {
+			return respond.Error(400, "name is required and must be at most 50 characters")
+		}
+
+		labels, err := userLabels(ctx, p.UserID)
+		if err != nil {
+			log.Println("Query error:", err)
+			return respond.DBError(err)
+		}
+
+		if other := findByName(labels, name); other != nil && other.LabelID != labelID {
+			return respond.Error(409, "a label with this name already exists, merge the labels instead")
+		}
+
+		sets = append(sets, "#name = :name")
+		names["#name"] = "name"
+		values[":name"] = &types.AttributeValueMemberS{Value: name}
+	}
+
+	if update.Color != nil {
+		color := strings.TrimSpace(*update.Color)
+		if !colorPattern.MatchString(color) {
+			return respond.Error(400, "color must look like #1a2b3c")
+		}
+
+		sets = append(sets, "color = :color")
+		values[":color"] = &types.AttributeValueMemberS{Value: strings.ToLower(color)}
+	}
+
+	cond := "attribute_exists(labelId)"
+	if c := pre.Condition(names, values); c != "" {
+		cond += " AND " + c
+	}
+
+	result, err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(labelsTable),
+		Key:                       labelKey(p.UserID, labelID),
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ") + " " + etag.Increment(names, values)),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return conflict(ctx, p.UserID, labelID)
+	}
+	if err != nil {
+		log.Println("UpdateItem error:", err)
+		return respond.DBError(err)
+	}
+
+	var l Label
+	if err := attributevalue.UnmarshalMap(result.Attributes, &l); err != nil {
+		log.Println("unmarshal error:", err)
+		return respond.Error(500, "unmarshal error")
+	}
+
+	return labelResponse(200, l)
+}
+
+//////////////////////
+// DELETE LABEL
+//////////////////////
+
+// deleteLabel deletes a label and takes it off every task. The tasks are
+// untagged before the label goes and once more after it, for a task tagged
+// in between; once the label is gone it can no longer be added.
+func deleteLabel(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	labelID := req.PathParameters["labelId"]
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	l, err := loadLabel(ctx, p.UserID, labelID)
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if l == nil {
+		return respond.Error(404, "label not found")
+	}
+
+	if pre != nil && !pre.Allows(l.Version) {
+		return labelResponse(412, *l)
+	}
+
+	if err := store.Relabel(ctx, p.UserID, labelID, ""); err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+
+	cond := "attribute_exists(labelId)"
+	if c := pre.Condition(names, values); c != "" {
+		cond += " AND " + c
+	}
+
+	_, err = dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(labelsTable),
+		Key:                       labelKey(p.UserID, labelID),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  nilIfEmpty(names),
+		ExpressionAttributeValues: nilIfEmpty(values),
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return conflict(ctx, p.UserID, labelID)
+	}
+	if err != nil {
+		log.Println("DeleteItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if err := store.Relabel(ctx, p.UserID, labelID, ""); err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, map[string]string{"message": "label deleted"})
+}
+
+//////////////////////
+// MERGE LABELS
+//////////////////////
+
+// mergeLabel folds the label in the path into the label named by into and
+// deletes it. Its tasks are retagged with into before the delete and once
+// more after it, like deleteLabel. The delete checks into in the same
+// transaction, so a merge never deletes a label when its target has just
+// been deleted.
+func mergeLabel(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body MergeLabel
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("mergeLabel unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	from := req.PathParameters["labelId"]
+	into := strings.TrimSpace(body.Into)
+
+	if into == "" {
+		return respond.Error(400, "into is required")
+	}
+
+	if into == from {
+		return respond.Error(400, "cannot merge a label into itself")
+	}
+
+	for _, id := range []string{from, into} {
+		l, err := loadLabel(ctx, p.UserID, id)
+		if err != nil {
+			log.Println("GetItem error:", err)
+			return respond.DBError(err)
+		}
+		if l == nil {
+			return respond.Error(404, "label not found")
+		}
+	}
+
+	if err := store.Relabel(ctx, p.UserID, from, into); err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	_, err := dbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				ConditionCheck: &types.ConditionCheck{
+					TableName:           aws.String(labelsTable),
+					Key:                 labelKey(p.UserID, into),
+					ConditionExpression: aws.String("attribute_exists(labelId)"),
+				},
+			},
+			{
+				Delete: &types.Delete{
+					TableName:           aws.String(labelsTable),
+					Key:                 labelKey(p.UserID, from),
+					ConditionExpression: aws.String("attribute_exists(labelId)"),
+				},
+			},
+		},
+	})
+
+	if storage.IsConditionFailed(err) {
+		return respond.Error(404, "label not found")
+	}
+	if err != nil {
+		log.Println("TransactWriteItems error:", err)
+		return respond.DBError(err)
+	}
+
+	if err := store.Relabel(ctx, p.UserID, from, into); err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, map[string]string{"message": "labels merged", "labelId": into})
+}
+
+//////////////////////
+// LABELS TABLE
+//////////////////////
+
+// userLabels returns every label of userID. There are at most maxLabels, so
+// this is a single page in practice.
+func userLabels(ctx context.Context, userID string) ([]Label, error) {
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(labelsTable),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: userID},
+		},
+	}
+
+	labels := []Label{}
+
+	for {
+		result, err := dbClient.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		var page []Label
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		labels = append(labels, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return labels, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// loadLabel returns nil when the label does not exist.
+func loadLabel(ctx context.Context, userID, labelID string) (*Label, error) {
+
+	result, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(labelsTable),
+		Key:            labelKey(userID, labelID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var l Label
+	if err := attributevalue.UnmarshalMap(result.Item, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// conflict answers a write whose condition failed: 404 when the label is
+// gone, otherwise 412 with the current label so the client can retry with
+// the new ETag.
+func conflict(ctx context.Context, userID, labelID string) (events.APIGatewayV2HTTPResponse, error) {
+
+	l, err := loadLabel(ctx, userID, labelID)
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if l == nil {
+		return respond.Error(404, "label not found")
+	}
+
+	return labelResponse(412, *l)
+}
+
+func labelKey(userID, labelID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":  &types.AttributeValueMemberS{Value: userID},
+		"labelId": &types.AttributeValueMemberS{Value: labelID},
+	}
+}
+
+//////////////////////
+// HELPERS
+//////////////////////
+
+// findByName matches names case-insensitively, so "Urgent" and "urgent"
+// cannot both exist.
+func findByName(labels []Label, name string) *Label {
+	for i := range labels {
+		if strings.EqualFold(labels[i].Name, name) {
+			return &labels[i]
+		}
+	}
+	return nil
+}
+
+// labelResponse answers with l and its ETag.
+func labelResponse(code int, l Label) (events.APIGatewayV2HTTPResponse, error) {
+
+	resp, err := respond.JSON(code, l)
+	resp.Headers["ETag"] = etag.Format(l.Version)
+
+	return resp, err
+}
+
+func notModified(version int64) (events.APIGatewayV2HTTPResponse, error) {
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 304,
+		Headers: map[string]string{
+			"ETag": etag.Format(version),
+		},
+	}, nil
+}
+
+func nilIfEmpty[V any](m map[string]V) map[string]V {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+//////////////////////
+// MAIN
+//////////////////////
+
+func main() {
+	lambda.Start(corsPolicy.Wrap(&routes, routes.Serve))
+}
@@ -2,9 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -14,11 +23,46 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/audit"
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/cors"
+	"to_do_list_demo/internal/etag"
+	"to_do_list_demo/internal/health"
+	"to_do_list_demo/internal/idempotency"
+	"to_do_list_demo/internal/oidc"
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+	"to_do_list_demo/internal/session"
+	"to_do_list_demo/internal/storage"
+)
+
+var (
+	dbClient       *dynamodb.Client
+	tableName      = "To-Do-List-Users"
+	oidcStateTable = "To-Do-List-OIDC-State"
+	auditLog       *audit.Logger
+	idempotent     *idempotency.Store
+	routes         router.Router
+	corsPolicy     *cors.Policy
+	readiness      *health.Checker
+
+	// oidcProvider is nil when OIDC login is not configured.
+	oidcProvider *oidc.Provider
+)
+
+const (
+	oidcStateTTL = 10 * time.Minute
+
+	// linkStatePrefix keys pending OIDC links in the OIDC state table, so
+	// a link token can never be used as a login state or the other way round.
+	linkStatePrefix = "link:"
 )
 
 var (
-	dbClient  *dynamodb.Client
-	tableName = "To-Do-List-Users"
+	errEmailNotVerified = errors.New("identity provider did not return a verified email")
+	errAlreadyLinked    = errors.New("account is already linked to a different identity")
+	errPasswordRequired = errors.New("account email is not verified, confirm the link with the account password")
 )
 
 //////////////////////
@@ -26,10 +70,19 @@ var (
 //////////////////////
 
 type User struct {
-	UserID   string `json:"userId" dynamodbav:"userId"`
-	Name     string `json:"name" dynamodbav:"name"`
-	Email    string `json:"email" dynamodbav:"email"`
-	Password string `json:"password" dynamodbav:"password"`
+	UserID                 string `json:"userId" dynamodbav:"userId"`
+	Name                   string `json:"name" dynamodbav:"name"`
+	Email                  string `json:"email" dynamodbav:"email"`
+	Password               string `json:"password,omitempty" dynamodbav:"password,omitempty"`
+	Role                   string `json:"role,omitempty" dynamodbav:"role,omitempty"`
+	OIDCSubject            string `json:"-" dynamodbav:"oidcSubject,omitempty"`
+	Disabled               bool   `json:"-" dynamodbav:"disabled,omitempty"`
+	EmailVerified          bool   `json:"-" dynamodbav:"emailVerified,omitempty"`
+	SearchText             string `json:"-" dynamodbav:"searchText,omitempty"`
+	PasswordResetRequired  bool   `json:"-" dynamodbav:"passwordResetRequired,omitempty"`
+	PasswordResetHash      string `json:"-" dynamodbav:"passwordResetHash,omitempty"`
+	PasswordResetExpiresAt int64  `json:"-" dynamodbav:"passwordResetExpiresAt,omitempty"`
+	Version                int64  `json:"-" dynamodbav:"version,omitempty"`
 }
 
 type LoginUser struct {
@@ -37,6 +90,45 @@ type LoginUser struct {
 	Password string `json:"password" dynamodbav:"password"`
 }
 
+type ResetPassword struct {
+	Email    string `json:"email"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type ConfirmOIDCLink struct {
+	LinkToken string `json:"linkToken"`
+	Password  string `json:"password"`
+}
+
+type SessionResponse struct {
+	AccessToken string `json:"accessToken"`
+	TokenType   string `json:"tokenType"`
+	ExpiresIn   int64  `json:"expiresIn"`
+	User        User   `json:"user"`
+}
+
+// OIDCLoginState is kept between the redirect to the identity provider and
+// the callback. It expires through DynamoDB TTL on expiresAt.
+type OIDCLoginState struct {
+	State        string `dynamodbav:"state"`
+	Nonce        string `dynamodbav:"nonce"`
+	CodeVerifier string `dynamodbav:"codeVerifier"`
+	ExpiresAt    int64  `dynamodbav:"expiresAt"`
+}
+
+// OIDCPendingLink is an OIDC identity waiting to be linked onto an account
+// whose email was never verified. It lives in the OIDC state table under
+// linkStatePrefix plus the hash of the link token.
+type OIDCPendingLink struct {
+	State     string `dynamodbav:"state"`
+	UserID    string `dynamodbav:"userId"`
+	Email     string `dynamodbav:"email"`
+	Issuer    string `dynamodbav:"issuer"`
+	Subject   string `dynamodbav:"subject"`
+	ExpiresAt int64  `dynamodbav:"expiresAt"`
+}
+
 //////////////////////
 // INIT
 //////////////////////
@@ -47,41 +139,50 @@ func init() {
 		log.Fatal("unable to load AWS SDK config:", err)
 	}
 
-	dbClient = dynamodb.NewFromConfig(cfg)
-}
-
-//////////////////////
-// HANDLER
-//////////////////////
+	dbClient = storage.NewClient(cfg)
+	auditLog = audit.New(dbClient)
+	idempotent = idempotency.New(dbClient)
+	corsPolicy = cors.FromEnv()
 
-func handler(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
-
-	log.Println("request:", req.RequestContext.HTTP.Method, req.RequestContext.HTTP.Path)
-
-	method := req.RequestContext.HTTP.Method
-	path := req.RequestContext.HTTP.Path
-
-	switch method + " " + path {
-	case "POST /api/to-do-list/mypost/users/login":
-		return loginUser(ctx, req)
-
-	case "HEAD /api/to-do-list/mypost/users/login/health":
-		return handleHello(ctx, req)
+	if t := os.Getenv("OIDC_STATE_TABLE"); t != "" {
+		oidcStateTable = t
+	}
 
-	case "OPTIONS /api/to-do-list/mypost/users/login":
-		return response(200, map[string]string{"message": "ok"})
+	oidcProvider, err = oidc.NewFromEnv()
+	if err != nil {
+		log.Println("oidc login disabled:", err)
+		oidcProvider = nil
+	}
 
-	default:
-		return response(405, map[string]string{"error": "method not allowed"})
+	// Login is not wrapped in idempotent: a stored response would keep a copy
+	// of the session token in the idempotency table.
+	routes.Handle("POST", "/api/to-do-list/mypost/users/login", loginUser)
+	routes.Handle("POST", "/api/to-do-list/mypost/users/login/password-reset", idempotent.Wrap(resetPassword))
+	routes.Handle("GET", "/api/to-do-list/mypost/users/login/oidc", startOIDCLogin)
+	routes.Handle("GET", "/api/to-do-list/mypost/users/login/oidc/callback", finishOIDCLogin)
+	routes.Handle("POST", "/api/to-do-list/mypost/users/login/oidc/link", confirmOIDCLink)
+
+	checks := []health.Check{
+		health.Table(dbClient, tableName),
+		health.Table(dbClient, auditLog.Table),
+		health.Table(dbClient, idempotent.Table),
+		health.SessionKey(),
+		health.Config("cors", corsPolicy.Validate),
 	}
+	if oidcProvider != nil {
+		checks = append(checks, health.Table(dbClient, oidcStateTable), health.Check{Name: "oidc:discovery", Run: discoverOIDC})
+	}
+	readiness = health.New(checks...)
+	readiness.Register(&routes, "/api/to-do-list/mypost/users/login")
 }
 
 //////////////////////
 // HEALTH
 //////////////////////
 
-func handleHello(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
-	return response(204, nil)
+func discoverOIDC(ctx context.Context) error {
+	_, err := oidcProvider.Discover(ctx)
+	return err
 }
 
 //////////////////////
@@ -94,81 +195,659 @@ func loginUser(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.
 
 	if err := json.Unmarshal([]byte(req.Body), &login); err != nil {
 		log.Println("login unmarshal error:", err, "body:", req.Body)
-		return response(400, map[string]string{"error": "invalid JSON"})
+		return respond.Error(400, "invalid JSON")
 	}
 
 	email := strings.TrimSpace(login.Email)
 	password := strings.TrimSpace(login.Password)
 
 	if email == "" || password == "" {
-		return response(400, map[string]string{"error": "email and password required"})
+		return respond.Error(400, "email and password required")
 	}
 
-	input := &dynamodb.ScanInput{
-		TableName:        aws.String(tableName),
-		FilterExpression: aws.String("email = :email AND password = :password"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":email":    &types.AttributeValueMemberS{Value: email},
-			":password": &types.AttributeValueMemberS{Value: password},
-		},
-		Limit: aws.Int32(1),
+	user, err := findUser(ctx, "email = :email", map[string]types.AttributeValue{
+		":email": &types.AttributeValueMemberS{Value: email},
+	})
+	if err != nil {
+		log.Println("Scan error:", err)
+		return respond.DBError(err)
+	}
+
+	if user == nil {
+		return respond.Error(401, "invalid email or password")
 	}
 
-	result, err := dbClient.Scan(ctx, input)
+	entry := audit.NewEntry(req, user.UserID, user.UserID, audit.ActionLogin)
+	entry.Details = map[string]string{"method": session.MethodPassword}
+
+	if user.Password == "" || subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) != 1 {
+		auditLog.Log(ctx, entry.Failed("invalid password"))
+		return respond.Error(401, "invalid email or password")
+	}
+
+	if user.Disabled {
+		auditLog.Log(ctx, entry.Failed("account disabled"))
+		return respond.Error(403, "account disabled")
+	}
+
+	if user.PasswordResetRequired {
+		auditLog.Log(ctx, entry.Failed("password reset required"))
+		return respond.Error(403, "password reset required, check your email")
+	}
+
+	auditLog.Log(ctx, entry)
+
+	return sessionResponse(*user, session.MethodPassword)
+}
+
+//////////////////////
+// PASSWORD RESET
+//////////////////////
+
+// resetPassword completes a reset started by an admin. Every failure gives
+// the same answer so the endpoint cannot be used to probe for accounts.
+func resetPassword(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body ResetPassword
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("resetPassword unmarshal error:", err)
+		return respond.Error(400, "invalid JSON")
+	}
+
+	email := strings.TrimSpace(body.Email)
+	token := strings.TrimSpace(body.Token)
+	password := strings.TrimSpace(body.Password)
+
+	if email == "" || token == "" || password == "" {
+		return respond.Error(400, "email, token and password required")
+	}
+
+	invalid := map[string]string{"error": "invalid or expired reset token"}
+
+	user, err := findUser(ctx, "email = :email", map[string]types.AttributeValue{
+		":email": &types.AttributeValueMemberS{Value: email},
+	})
 	if err != nil {
 		log.Println("Scan error:", err)
-		return response(500, map[string]string{"error": "dynamodb error"})
+		return respond.DBError(err)
 	}
 
-	if len(result.Items) == 0 {
-		itemsJSON, _ := json.Marshal(result.Items)
-		return response(401, map[string]string{
-			"error": "invalid email or password. result.Items: " + string(itemsJSON),
-		})
+	hash := hashToken(token)
+
+	if user == nil {
+		return respond.JSON(400, invalid)
 	}
 
-	var user User
-	if err := attributevalue.UnmarshalMap(result.Items[0], &user); err != nil {
-		log.Println("unmarshal error:", err)
-		return response(500, map[string]string{"error": "unmarshal error"})
+	entry := audit.NewEntry(req, user.UserID, user.UserID, audit.ActionPasswordReset)
+
+	if user.PasswordResetHash == "" ||
+		subtle.ConstantTimeCompare([]byte(hash), []byte(user.PasswordResetHash)) != 1 ||
+		time.Now().Unix() > user.PasswordResetExpiresAt {
+		auditLog.Log(ctx, entry.Failed("invalid or expired token"))
+		return respond.JSON(400, invalid)
 	}
 
-	user.Password = ""
-	itemsJSON, _ := json.Marshal(result.Items)
-	user.Password = "pass empty, result.Items:" + string(itemsJSON)
+	// The token was mailed to the account's address, so using it also
+	// proves the user owns that address.
+	names := map[string]string{"#password": "password"}
+	values := map[string]types.AttributeValue{
+		":password": &types.AttributeValueMemberS{Value: password},
+		":hash":     &types.AttributeValueMemberS{Value: hash},
+		":verified": &types.AttributeValueMemberBOOL{Value: true},
+		":now":      &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+	}
 
-	return response(200, user)
+	// Sessions opened with the old password end with it.
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: user.UserID},
+		},
+		UpdateExpression:          aws.String("SET #password = :password, emailVerified = :verified, sessionsRevokedAt = :now REMOVE passwordResetRequired, passwordResetHash, passwordResetExpiresAt " + etag.Increment(names, values)),
+		ConditionExpression:       aws.String("passwordResetHash = :hash"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		auditLog.Log(ctx, entry.Failed("invalid or expired token"))
+		return respond.JSON(400, invalid)
+	}
+	if err != nil {
+		log.Println("UpdateItem error:", err)
+		return respond.DBError(err)
+	}
+
+	revoked := audit.NewEntry(req, user.UserID, user.UserID, audit.ActionSessionsRevoke)
+	revoked.Details = map[string]string{"reason": audit.ActionPasswordReset}
+
+	auditLog.Log(ctx, entry)
+	auditLog.Log(ctx, revoked)
+
+	return respond.JSON(200, map[string]string{"message": "password updated"})
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 //////////////////////
-// RESPONSE HELPER
+// OIDC LOGIN
 //////////////////////
 
-func response(code int, body any) (events.APIGatewayV2HTTPResponse, error) {
+func startOIDCLogin(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+
+	if oidcProvider == nil {
+		return respond.Error(404, "oidc login not configured")
+	}
+
+	var st OIDCLoginState
+	var err error
+
+	if st.State, err = oidc.RandomString(32); err == nil {
+		if st.Nonce, err = oidc.RandomString(32); err == nil {
+			st.CodeVerifier, err = oidc.NewVerifier()
+		}
+	}
+	if err != nil {
+		log.Println("oidc random error:", err)
+		return respond.Error(500, "could not start login")
+	}
+	st.ExpiresAt = time.Now().Add(oidcStateTTL).Unix()
 
-	jsonBody, err := json.Marshal(body)
+	authURL, err := oidcProvider.AuthCodeURL(ctx, st.State, st.Nonce, oidc.Challenge(st.CodeVerifier))
 	if err != nil {
-		log.Println("json marshal error:", err)
+		log.Println("oidc discovery error:", err)
+		return respond.Error(502, "identity provider unavailable")
+	}
+
+	item, err := attributevalue.MarshalMap(st)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return respond.Error(500, "marshal failed")
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(oidcStateTable),
+		Item:      item,
+	})
+	if err != nil {
+		log.Println("PutItem error:", err)
+		return respond.DBError(err)
+	}
+
+	return redirect(authURL)
+}
+
+func finishOIDCLogin(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+
+	if oidcProvider == nil {
+		return respond.Error(404, "oidc login not configured")
+	}
+
+	q := req.QueryStringParameters
+
+	if e := q["error"]; e != "" {
+		log.Println("oidc provider error:", e, q["error_description"])
+		return respond.Error(401, "login was not completed")
+	}
+
+	code := q["code"]
+	state := q["state"]
+	if code == "" || state == "" {
+		return respond.Error(400, "code and state required")
+	}
+
+	// Deleting the state consumes it, so a callback URL cannot be replayed.
+	out, err := dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(oidcStateTable),
+		Key: map[string]types.AttributeValue{
+			"state": &types.AttributeValueMemberS{Value: state},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		log.Println("DeleteItem error:", err)
+		return respond.DBError(err)
+	}
+
+	var st OIDCLoginState
+	if out.Attributes != nil {
+		if err := attributevalue.UnmarshalMap(out.Attributes, &st); err != nil {
+			log.Println("unmarshal error:", err)
+			return respond.Error(500, "unmarshal error")
+		}
+	}
+
+	if st.State == "" || time.Now().Unix() > st.ExpiresAt {
+		return respond.Error(400, "login session expired, please start again")
+	}
+
+	tok, err := oidcProvider.Exchange(ctx, code, st.CodeVerifier)
+	if err != nil {
+		log.Println("oidc exchange error:", err)
+		return respond.Error(401, "could not complete login")
+	}
+
+	idToken, err := oidcProvider.VerifyIDToken(ctx, tok.IDToken, st.Nonce)
+	if err != nil {
+		log.Println("oidc id_token error:", err)
+		return respond.Error(401, "could not complete login")
+	}
+
+	user, err := linkOIDCUser(ctx, req, idToken)
+	switch {
+	case errors.Is(err, errEmailNotVerified):
+		return respond.Error(403, err.Error())
+	case errors.Is(err, errAlreadyLinked):
+		return respond.Error(409, err.Error())
+	case errors.Is(err, errPasswordRequired):
+		return requestLinkConfirmation(ctx, user, idToken)
+	case err != nil:
+		log.Println("oidc link error:", err)
+		return respond.DBError(err)
+	}
+
+	entry := audit.NewEntry(req, user.UserID, user.UserID, audit.ActionLogin)
+	entry.Details = map[string]string{"method": session.MethodOIDC, "issuer": idToken.Issuer}
+
+	if user.Disabled {
+		auditLog.Log(ctx, entry.Failed("account disabled"))
+		return respond.Error(403, "account disabled")
+	}
+
+	auditLog.Log(ctx, entry)
+
+	if dest := os.Getenv("OIDC_POST_LOGIN_REDIRECT"); dest != "" {
+		t, err := session.Issue(user.UserID, session.MethodOIDC)
+		if err != nil {
+			log.Println("session issue error:", err)
+			return respond.Error(500, "could not issue session")
+		}
+
+		// The token goes in the fragment so it never reaches server logs.
+		fragment := url.Values{
+			"access_token": {t.AccessToken},
+			"token_type":   {"Bearer"},
+			"expires_in":   {strconv.FormatInt(int64(time.Until(t.ExpiresAt).Seconds()), 10)},
+		}
+		return redirect(dest + "#" + fragment.Encode())
+	}
 
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 500,
-			Headers: map[string]string{
-				"Content-Type":                "application/json",
-				"Access-Control-Allow-Origin": "*",
+	return sessionResponse(user, session.MethodOIDC)
+}
+
+// linkOIDCUser finds the user for a verified ID token. An identity that was
+// linked before is matched on issuer and subject; otherwise the token's
+// verified email is linked onto the existing user with that email, or a new
+// user is created for it.
+//
+// Anyone can sign up with an address they do not own, so the email is only
+// linked automatically when the account has proven it owns the address too.
+// For other accounts the user is returned with errPasswordRequired and the
+// link waits for the account password.
+func linkOIDCUser(ctx context.Context, req events.APIGatewayV2HTTPRequest, idToken *oidc.IDToken) (User, error) {
+
+	subject := oidcSubject(idToken)
+
+	user, err := findUser(ctx, "oidcSubject = :subject", map[string]types.AttributeValue{
+		":subject": &types.AttributeValueMemberS{Value: subject},
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if user != nil {
+		return *user, nil
+	}
+
+	email := strings.TrimSpace(idToken.Email)
+	if !idToken.EmailVerified || email == "" {
+		return User{}, errEmailNotVerified
+	}
+
+	user, err = findUser(ctx, "email = :email", map[string]types.AttributeValue{
+		":email": &types.AttributeValueMemberS{Value: email},
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	if user != nil {
+		if user.OIDCSubject != "" && user.OIDCSubject != subject {
+			return User{}, errAlreadyLinked
+		}
+
+		if !user.EmailVerified {
+			return *user, errPasswordRequired
+		}
+
+		names := map[string]string{}
+		values := map[string]types.AttributeValue{
+			":subject":  &types.AttributeValueMemberS{Value: subject},
+			":verified": &types.AttributeValueMemberBOOL{Value: true},
+		}
+
+		_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(tableName),
+			Key: map[string]types.AttributeValue{
+				"userId": &types.AttributeValueMemberS{Value: user.UserID},
 			},
-			Body: `{"error":"json marshal failed"}`,
-		}, nil
+			UpdateExpression:          aws.String("SET oidcSubject = :subject " + etag.Increment(names, values)),
+			ConditionExpression:       aws.String("emailVerified = :verified AND (attribute_not_exists(oidcSubject) OR oidcSubject = :subject)"),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return User{}, errAlreadyLinked
+		}
+		if err != nil {
+			return User{}, err
+		}
+
+		entry := audit.NewEntry(req, user.UserID, user.UserID, audit.ActionOIDCLink)
+		entry.Details = map[string]string{"issuer": idToken.Issuer, "confirmedBy": "verified email"}
+		auditLog.Log(ctx, entry)
+
+		user.OIDCSubject = subject
+		return *user, nil
 	}
 
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return User{}, err
+	}
+
+	name := strings.TrimSpace(idToken.Name)
+	if name == "" {
+		name = email
+	}
+
+	newUser := User{
+		UserID:        hex.EncodeToString(id),
+		Name:          name,
+		Email:         email,
+		Role:          auth.RoleUser,
+		OIDCSubject:   subject,
+		EmailVerified: true,
+		SearchText:    auth.SearchText(name, email),
+		Version:       1,
+	}
+
+	item, err := attributevalue.MarshalMap(newUser)
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(userId)"),
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	log.Println("oidc user created:", newUser.UserID)
+	return newUser, nil
+}
+
+func oidcSubject(idToken *oidc.IDToken) string {
+	return idToken.Issuer + "|" + idToken.Subject
+}
+
+// requestLinkConfirmation parks the link between idToken and user, whose
+// email is not verified, and hands the client a one-time link token. The
+// link is made by confirmOIDCLink once the caller also sends the account
+// password.
+func requestLinkConfirmation(ctx context.Context, user User, idToken *oidc.IDToken) (events.APIGatewayV2HTTPResponse, error) {
+
+	token, err := randomToken()
+	if err != nil {
+		log.Println("random error:", err)
+		return respond.Error(500, "could not start account linking")
+	}
+
+	link := OIDCPendingLink{
+		State:     linkStatePrefix + hashToken(token),
+		UserID:    user.UserID,
+		Email:     user.Email,
+		Issuer:    idToken.Issuer,
+		Subject:   oidcSubject(idToken),
+		ExpiresAt: time.Now().Add(oidcStateTTL).Unix(),
+	}
+
+	item, err := attributevalue.MarshalMap(link)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return respond.Error(500, "marshal failed")
+	}
+
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(oidcStateTable),
+		Item:      item,
+	})
+	if err != nil {
+		log.Println("PutItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if dest := os.Getenv("OIDC_POST_LOGIN_REDIRECT"); dest != "" {
+		fragment := url.Values{
+			"error":      {"link_confirmation_required"},
+			"link_token": {token},
+		}
+		return redirect(dest + "#" + fragment.Encode())
+	}
+
+	return respond.JSON(409, map[string]string{
+		"error":     errPasswordRequired.Error(),
+		"linkToken": token,
+	})
+}
+
+// confirmOIDCLink links a pending OIDC identity onto its account after
+// checking the account password. The link token is consumed by the first
+// attempt, right or wrong, so it cannot be used to guess the password.
+func confirmOIDCLink(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+
+	if oidcProvider == nil {
+		return respond.Error(404, "oidc login not configured")
+	}
+
+	var body ConfirmOIDCLink
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("confirmOIDCLink unmarshal error:", err)
+		return respond.Error(400, "invalid JSON")
+	}
+
+	token := strings.TrimSpace(body.LinkToken)
+	password := strings.TrimSpace(body.Password)
+
+	if token == "" || password == "" {
+		return respond.Error(400, "linkToken and password required")
+	}
+
+	out, err := dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(oidcStateTable),
+		Key: map[string]types.AttributeValue{
+			"state": &types.AttributeValueMemberS{Value: linkStatePrefix + hashToken(token)},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		log.Println("DeleteItem error:", err)
+		return respond.DBError(err)
+	}
+
+	var link OIDCPendingLink
+	if out.Attributes != nil {
+		if err := attributevalue.UnmarshalMap(out.Attributes, &link); err != nil {
+			log.Println("unmarshal error:", err)
+			return respond.Error(500, "unmarshal error")
+		}
+	}
+
+	if link.State == "" || time.Now().Unix() > link.ExpiresAt {
+		return respond.Error(400, "invalid or expired link token, please log in again")
+	}
+
+	user, err := getUser(ctx, link.UserID)
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if user == nil || user.Email != link.Email {
+		return respond.Error(400, "invalid or expired link token, please log in again")
+	}
+
+	entry := audit.NewEntry(req, user.UserID, user.UserID, audit.ActionOIDCLink)
+	entry.Details = map[string]string{"issuer": link.Issuer, "confirmedBy": "password"}
+
+	if user.Password == "" || subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) != 1 {
+		auditLog.Log(ctx, entry.Failed("invalid password"))
+		return respond.Error(401, "invalid password")
+	}
+
+	if user.Disabled {
+		auditLog.Log(ctx, entry.Failed("account disabled"))
+		return respond.Error(403, "account disabled")
+	}
+
+	names := map[string]string{"#email": "email"}
+	values := map[string]types.AttributeValue{
+		":subject":  &types.AttributeValueMemberS{Value: link.Subject},
+		":email":    &types.AttributeValueMemberS{Value: link.Email},
+		":verified": &types.AttributeValueMemberBOOL{Value: true},
+	}
+
+	// The identity provider verified the address and the password proves
+	// the account, so the email counts as verified from now on.
+	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: user.UserID},
+		},
+		UpdateExpression:          aws.String("SET oidcSubject = :subject, emailVerified = :verified " + etag.Increment(names, values)),
+		ConditionExpression:       aws.String("#email = :email AND (attribute_not_exists(oidcSubject) OR oidcSubject = :subject)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		auditLog.Log(ctx, entry.Failed("account changed"))
+		return respond.Error(409, errAlreadyLinked.Error())
+	}
+	if err != nil {
+		log.Println("UpdateItem error:", err)
+		return respond.DBError(err)
+	}
+
+	auditLog.Log(ctx, entry)
+
+	user.OIDCSubject = link.Subject
+	return sessionResponse(*user, session.MethodOIDC)
+}
+
+func getUser(ctx context.Context, userID string) (*User, error) {
+
+	result, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var user User
+	if err := attributevalue.UnmarshalMap(result.Item, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// findUser scans the users table page by page until filter matches. It
+// returns nil when no user matches.
+func findUser(ctx context.Context, filter string, values map[string]types.AttributeValue) (*User, error) {
+
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(tableName),
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeValues: values,
+	}
+
+	for {
+		result, err := dbClient.Scan(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(result.Items) > 0 {
+			var user User
+			if err := attributevalue.UnmarshalMap(result.Items[0], &user); err != nil {
+				return nil, err
+			}
+			return &user, nil
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+//////////////////////
+// SESSION
+//////////////////////
+
+func sessionResponse(user User, method string) (events.APIGatewayV2HTTPResponse, error) {
+
+	t, err := session.Issue(user.UserID, method)
+	if err != nil {
+		log.Println("session issue error:", err)
+		return respond.Error(500, "could not issue session")
+	}
+
+	user.Password = ""
+
+	return respond.JSON(200, SessionResponse{
+		AccessToken: t.AccessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(t.ExpiresAt).Seconds()),
+		User:        user,
+	})
+}
+
+func redirect(location string) (events.APIGatewayV2HTTPResponse, error) {
 	return events.APIGatewayV2HTTPResponse{
-		StatusCode: code,
+		StatusCode: 302,
 		Headers: map[string]string{
-			"Content-Type":                 "application/json",
-			"Access-Control-Allow-Origin":  "*",
-			"Access-Control-Allow-Methods": "GET,POST,OPTIONS",
-			"Access-Control-Allow-Headers": "Content-Type",
+			"Location":      location,
+			"Cache-Control": "no-store",
 		},
-		Body: string(jsonBody),
 	}, nil
 }
 
@@ -177,5 +856,5 @@ func response(code int, body any) (events.APIGatewayV2HTTPResponse, error) {
 //////////////////////
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(corsPolicy.Wrap(&routes, routes.Serve))
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/cors"
+	"to_do_list_demo/internal/etag"
+	"to_do_list_demo/internal/health"
+	"to_do_list_demo/internal/idempotency"
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+	"to_do_list_demo/internal/storage"
+	"to_do_list_demo/internal/tasks"
+)
+
+var (
+	dbClient   *dynamodb.Client
+	tableName  = "To-Do-List-Users"
+	store      *tasks.Store
+	authn      *auth.Authenticator
+	idempotent *idempotency.Store
+	routes     router.Router
+	corsPolicy *cors.Policy
+	readiness  *health.Checker
+)
+
+//////////////////////
+// INIT
+//////////////////////
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal("unable to load AWS SDK config:", err)
+	}
+
+	dbClient = storage.NewClient(cfg)
+	store = tasks.New(dbClient)
+	authn = auth.New(dbClient, tableName)
+	idempotent = idempotency.New(dbClient)
+	corsPolicy = cors.FromEnv()
+
+	routes.Handle("GET", "/api/to-do-list/mypost/projects", authn.Middleware(auth.ScopeReadOnly, listProjects))
+	routes.Handle("POST", "/api/to-do-list/mypost/projects", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(createProject))))
+	routes.Handle("GET", "/api/to-do-list/mypost/projects/{projectId}", authn.Middleware(auth.ScopeReadOnly, getProject))
+	routes.Handle("PATCH", "/api/to-do-list/mypost/projects/{projectId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(updateProject))))
+	routes.Handle("DELETE", "/api/to-do-list/mypost/projects/{projectId}", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(deleteProject))))
+	routes.Handle("POST", "/api/to-do-list/mypost/projects/{projectId}/restore", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(restoreProject))))
+	routes.Handle("POST", "/api/to-do-list/mypost/projects/{projectId}/archive", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(archiveProject))))
+	routes.Handle("POST", "/api/to-do-list/mypost/projects/{projectId}/unarchive", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(unarchiveProject))))
+	routes.Handle("GET", "/api/to-do-list/mypost/projects/{projectId}/graph", authn.Middleware(auth.ScopeReadOnly, getGraph))
+	routes.Handle("GET", "/api/to-do-list/mypost/projects/{projectId}/history", authn.Middleware(auth.ScopeReadOnly, listHistory))
+	routes.Handle("GET", "/api/to-do-list/mypost/projects/{projectId}/workflow", authn.Middleware(auth.ScopeReadOnly, getWorkflow))
+	routes.Handle("PUT", "/api/to-do-list/mypost/projects/{projectId}/workflow", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(putWorkflow))))
+	routes.Handle("DELETE", "/api/to-do-list/mypost/projects/{projectId}/workflow", authn.Middleware(auth.ScopeTasksWrite, idempotent.WrapAuth(tasks.Acting(deleteWorkflow))))
+
+	readiness = health.New(
+		health.Table(dbClient, tableName),
+		health.Table(dbClient, store.Projects),
+		health.Table(dbClient, store.Items),
+		health.Table(dbClient, store.Comments),
+		health.Table(dbClient, store.Reminders),
+		health.Table(dbClient, store.History),
+		health.Table(dbClient, store.Search.Table),
+		health.Table(dbClient, idempotent.Table),
+		health.SessionKey(),
+		health.Config("cors", corsPolicy.Validate),
+	)
+	readiness.Register(&routes, "/api/to-do-list/mypost/projects")
+}
+
+//////////////////////
+// LIST PROJECTS
+//////////////////////
+
+// listProjects lists the user's projects, or the archived ones with
+// ?archived=true.
+func listProjects(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	archived := false
+	if s := req.QueryStringParameters["archived"]; s != "" {
+		var err error
+		if archived, err = strconv.ParseBool(s); err != nil {
+			return respond.Error(400, "archived must be true or false")
+		}
+	}
+
+	scope := "projects:" + p.UserID
+	if archived {
+		scope += "\narchived"
+	}
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	projects, lastKey, err := store.ListProjects(ctx, p.UserID, archived, pr)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	page := pagination.Page[tasks.Project]{Items: projects}
+
+	page.NextCursor, err = pagination.Next(lastKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+//////////////////////
+// CREATE PROJECT
+//////////////////////
+
+func createProject(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body tasks.ProjectPatch
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("createProject unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	project, err := store.CreateProject(ctx, p.UserID, body)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ProjectResponse(201, project)
+}
+
+//////////////////////
+// GET PROJECT
+//////////////////////
+
+func getProject(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	project, err := store.GetProject(ctx, p.UserID, req.PathParameters["projectId"])
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	if etag.NoneMatch(auth.Header(req.Headers, "If-None-Match"), project.Version) {
+		return tasks.NotModified(project.Version)
+	}
+
+	return tasks.ProjectResponse(200, project)
+}
+
+//////////////////////
+// UPDATE PROJECT
+//////////////////////
+
+func updateProject(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body tasks.ProjectPatch
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("updateProject unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	if body == (tasks.ProjectPatch{}) {
+		return respond.Error(400, "nothing to update")
+	}
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	project, err := store.PatchProject(ctx, p.UserID, req.PathParameters["projectId"], pre, body)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ProjectResponse(200, project)
+}
+
+//////////////////////
+// DELETE PROJECT
+//////////////////////
+
+// deleteProject removes the project with all of its items.
+func deleteProject(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	if err := store.DeleteProject(ctx, p.UserID, req.PathParameters["projectId"], pre); err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, map[string]string{"message": "project deleted"})
+}
+
+// restoreProject takes a project out of the trash with the tasks deleted
+// along with it.
+func restoreProject(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	project, err := store.RestoreProject(ctx, p.UserID, req.PathParameters["projectId"])
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ProjectResponse(200, project)
+}
+
+//////////////////////
+// ARCHIVE PROJECT
+//////////////////////
+
+// archiveProject makes the project read-only and moves its tasks to the
+// archive.
+func archiveProject(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	project, err := store.ArchiveProject(ctx, p.UserID, req.PathParameters["projectId"], pre)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ProjectResponse(200, project)
+}
+
+// unarchiveProject brings the project back with the tasks archived along
+// with it.
+func unarchiveProject(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	project, err := store.UnarchiveProject(ctx, p.UserID, req.PathParameters["projectId"], pre)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ProjectResponse(200, project)
+}
+
+//////////////////////
+// GRAPH
+//////////////////////
+
+// getGraph returns the project's tasks with their dependencies and the
+// critical path through them.
+func getGraph(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	g, err := store.ProjectGraph(ctx, p.UserID, req.PathParameters["projectId"])
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, g)
+}
+
+//////////////////////
+// HISTORY
+//////////////////////
+
+// listHistory lists the changes to the project itself, newest first. The
+// changes to its tasks are in each task's history.
+func listHistory(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	projectID := req.PathParameters["projectId"]
+	scope := "project-history:" + p.UserID + "\n" + projectID
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	entries, lastKey, err := store.ProjectHistory(ctx, p.UserID, projectID, pr)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	page := pagination.Page[tasks.HistoryEntry]{Items: entries}
+
+	page.NextCursor, err = pagination.Next(lastKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+//////////////////////
+// WORKFLOW
+//////////////////////
+
+// getWorkflow returns the states and transitions of the project, the
+// default ones if it has none of its own.
+func getWorkflow(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	project, err := store.GetProject(ctx, p.UserID, req.PathParameters["projectId"])
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, project.EffectiveWorkflow())
+}
+
+func putWorkflow(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body tasks.Workflow
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("putWorkflow unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	project, err := store.SetWorkflow(ctx, p.UserID, req.PathParameters["projectId"], pre, &body)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ProjectResponse(200, project)
+}
+
+// deleteWorkflow puts the project back on the default workflow.
+func deleteWorkflow(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	project, err := store.SetWorkflow(ctx, p.UserID, req.PathParameters["projectId"], pre, nil)
+	if err != nil {
+		return tasks.ErrorResponse(err)
+	}
+
+	return tasks.ProjectResponse(200, project)
+}
+
+//////////////////////
+// MAIN
+//////////////////////
+
+func main() {
+	lambda.Start(corsPolicy.Wrap(&routes, routes.Serve))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+
+	"to_do_list_demo/internal/storage"
+	"to_do_list_demo/internal/tasks"
+)
+
+// ttlPrincipal is the userIdentity.principalId of the stream records of
+// rows the DynamoDB TTL removed.
+const ttlPrincipal = "dynamodb.amazonaws.com"
+
+var store *tasks.Store
+
+//////////////////////
+// INIT
+//////////////////////
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal("unable to load AWS SDK config:", err)
+	}
+
+	store = tasks.New(storage.NewClient(cfg))
+}
+
+//////////////////////
+// PURGE
+//////////////////////
+
+// purge deletes what belonged to a project or item the TTL removed from
+// the trash: comments, reminders, history and search index entries.
+// Other changes to the tables are left alone, the lambdas that made them
+// have already done this.
+func purge(ctx context.Context, r events.DynamoDBEventRecord) error {
+
+	if r.EventName != "REMOVE" || r.UserIdentity == nil || r.UserIdentity.PrincipalID != ttlPrincipal {
+		return nil
+	}
+
+	ownerID := text(r.Change.OldImage, "ownerId")
+	if id := text(r.Change.Keys, "itemId"); id != "" {
+		return store.ItemPurged(ctx, ownerID, id)
+	}
+	if id := text(r.Change.Keys, "projectId"); id != "" {
+		return store.ProjectPurged(ctx, ownerID, id)
+	}
+	return nil
+}
+
+// text returns the string attribute name of m, "" if it has none.
+func text(m map[string]events.DynamoDBAttributeValue, name string) string {
+	v, ok := m[name]
+	if !ok || v.DataType() != events.DataTypeString {
+		return ""
+	}
+	return v.String()
+}
+
+//////////////////////
+// MAIN
+//////////////////////
+
+// handle is invoked by the DynamoDB streams of the projects and items
+// tables (OLD_IMAGE, ReportBatchItemFailures on). A record that fails is
+// reported, so only it and the ones after it are retried.
+func handle(ctx context.Context, ev events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+
+	for _, r := range ev.Records {
+		if err := purge(ctx, r); err != nil {
+			log.Println("purge error:", err)
+			return events.DynamoDBEventResponse{
+				BatchItemFailures: []events.DynamoDBBatchItemFailure{{ItemIdentifier: r.Change.SequenceNumber}},
+			}, nil
+		}
+	}
+	return events.DynamoDBEventResponse{}, nil
+}
+
+func main() {
+	lambda.Start(handle)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	// The Lambda runtime image has no zoneinfo, so embed it for timeZone.
+	_ "time/tzdata"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/mail"
+	"to_do_list_demo/internal/notify"
+	"to_do_list_demo/internal/storage"
+	"to_do_list_demo/internal/tasks"
+)
+
+var (
+	dbClient  *dynamodb.Client
+	tableName = "To-Do-List-Users"
+	store     *tasks.Store
+	inbox     *notify.Inbox
+	notifiers map[string]notify.Notifier
+)
+
+const (
+	// batchSize is how many due reminders one run reads per shard. A run
+	// every minute sends up to batchSize * tasks.ReminderShards of them.
+	batchSize = 100
+
+	// leaseTime is how long a run holds a reminder it is sending. A
+	// reminder whose run died is picked up again after it.
+	leaseTime = 2 * time.Minute
+
+	// maxAttempts is how often a failing channel is retried before the
+	// reminder is given up on for it.
+	maxAttempts = 5
+)
+
+//////////////////////
+// INIT
+//////////////////////
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal("unable to load AWS SDK config:", err)
+	}
+
+	dbClient = storage.NewClient(cfg)
+	store = tasks.New(dbClient)
+	store.Users = tableName
+	inbox = notify.NewInbox(dbClient)
+
+	if err := notify.ValidateWebhookEnv(); err != nil {
+		log.Println("config warning:", err)
+	}
+	if err := mail.ValidateEnv(); err != nil {
+		log.Println("config warning:", err)
+	}
+
+	notifiers = map[string]notify.Notifier{
+		tasks.ChannelEmail:   &notify.Email{Sender: mail.NewFromEnv()},
+		tasks.ChannelWebhook: notify.NewWebhook(),
+		tasks.ChannelInbox:   inbox,
+	}
+}
+
+//////////////////////
+// STRUCTS
+//////////////////////
+
+// Summary is what one run did.
+type Summary struct {
+	Sent    int `json:"sent"`
+	Skipped int `json:"skipped"`
+	Retried int `json:"retried"`
+	Failed  int `json:"failed"`
+}
+
+type recipient struct {
+	Email         string `dynamodbav:"email"`
+	EmailVerified bool   `dynamodbav:"emailVerified"`
+	TimeZone      string `dynamodbav:"timeZone"`
+}
+
+//////////////////////
+// RUN
+//////////////////////
+
+// run sends the reminders due at now. Every reminder is leased before it
+// is sent and each channel is recorded as soon as it was delivered, so
+// runs that overlap or follow a crash do not send a reminder twice.
+func run(ctx context.Context, now time.Time) (Summary, error) {
+
+	var sum Summary
+	ts := now.UTC().Format(time.RFC3339)
+
+	for shard := range tasks.ReminderShards {
+		due, err := store.DueReminders(ctx, strconv.Itoa(shard), ts, batchSize)
+		if err != nil {
+			return sum, err
+		}
+
+		for i := range due {
+			deliver(ctx, now, &due[i], &sum)
+		}
+	}
+
+	return sum, nil
+}
+
+// deliver sends r through each of its channels it has not gone out
+// through yet. A reminder for a task that is done or gone is dropped.
+func deliver(ctx context.Context, now time.Time, r *tasks.Reminder, sum *Summary) {
+
+	lease := tasks.NewID()
+	until := now.Add(leaseTime).UTC().Format(time.RFC3339)
+
+	if err := store.ClaimReminder(ctx, r, lease, until); err != nil {
+		if err != tasks.ErrConflict {
+			log.Println("claim error:", err)
+		}
+		return
+	}
+
+	it, err := store.GetItem(ctx, r.OwnerID, r.ItemID)
+	if err == tasks.ErrNotFound || err == nil && (it.Done() || it.ArchivedAt != "") {
+		sum.Skipped++
+		finish(ctx, r, nil)
+		return
+	}
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return
+	}
+
+	to, err := loadRecipient(ctx, r.OwnerID)
+	if err != nil {
+		log.Println("user error:", err)
+		return
+	}
+
+	n := notify.Notification{
+		ID:         notify.ID(r.ReminderID, r.SendAt),
+		ItemID:     it.ItemID,
+		ProjectID:  it.ProjectID,
+		ReminderID: r.ReminderID,
+		Title:      it.Title,
+		DueDate:    it.DueDate,
+		SendAt:     r.SendAt,
+		UserID:     r.OwnerID,
+		WebhookURL: r.WebhookURL,
+		Location:   time.UTC,
+	}
+	if to.EmailVerified {
+		n.Email = to.Email
+	}
+	if loc, err := time.LoadLocation(to.TimeZone); err == nil {
+		n.Location = loc
+	}
+
+	var failed []string
+	retry := false
+
+	for _, channel := range r.Channels {
+		if slices.Contains(r.Delivered, channel) {
+			continue
+		}
+
+		err := notifiers[channel].Notify(ctx, n)
+		if err == nil {
+			if err := store.MarkDelivered(ctx, r, channel); err != nil {
+				log.Println("MarkDelivered error:", err)
+				return
+			}
+			continue
+		}
+
+		log.Println("notify error:", channel, r.ReminderID, err)
+		if errors.Is(err, notify.ErrNoAddress) || r.Attempts >= maxAttempts {
+			failed = append(failed, channel)
+		} else {
+			retry = true
+		}
+	}
+
+	// The lease runs out and a later run tries the failed channels again.
+	if retry {
+		sum.Retried++
+		return
+	}
+
+	if len(failed) > 0 {
+		sum.Failed++
+	} else {
+		sum.Sent++
+	}
+	finish(ctx, r, failed)
+}
+
+func finish(ctx context.Context, r *tasks.Reminder, failed []string) {
+	if err := store.FinishReminder(ctx, r, failed); err != nil && err != tasks.ErrConflict {
+		log.Println("FinishReminder error:", err)
+	}
+}
+
+func loadRecipient(ctx context.Context, userID string) (*recipient, error) {
+
+	result, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+		ProjectionExpression: aws.String("email, emailVerified, timeZone"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var to recipient
+	if err := attributevalue.UnmarshalMap(result.Item, &to); err != nil {
+		return nil, err
+	}
+	return &to, nil
+}
+
+//////////////////////
+// MAIN
+//////////////////////
+
+// handle is invoked by an EventBridge schedule, rate(1 minute).
+func handle(ctx context.Context, ev events.CloudWatchEvent) (Summary, error) {
+	return run(ctx, time.Now())
+}
+
+// main runs the scheduler as a lambda, or once from the command line with
+// "run", against the tables of the local AWS config:
+//
+//	cd "_Scheduler lambda" && go run main.go run
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		sum, err := run(context.Background(), time.Now())
+		if err != nil {
+			log.Fatal("run error:", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(sum)
+		return
+	}
+
+	lambda.Start(handle)
+}
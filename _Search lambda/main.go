@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/cors"
+	"to_do_list_demo/internal/health"
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+	"to_do_list_demo/internal/search"
+	"to_do_list_demo/internal/storage"
+)
+
+var (
+	dbClient   *dynamodb.Client
+	tableName  = "To-Do-List-Users"
+	index      *search.Index
+	authn      *auth.Authenticator
+	routes     router.Router
+	corsPolicy *cors.Policy
+	readiness  *health.Checker
+)
+
+//////////////////////
+// INIT
+//////////////////////
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal("unable to load AWS SDK config:", err)
+	}
+
+	dbClient = storage.NewClient(cfg)
+	index = search.New(dbClient)
+	authn = auth.New(dbClient, tableName)
+	corsPolicy = cors.FromEnv()
+
+	routes.Handle("GET", "/api/to-do-list/mypost/search", authn.Middleware(auth.ScopeReadOnly, searchTasks))
+
+	readiness = health.New(
+		health.Table(dbClient, tableName),
+		health.Table(dbClient, index.Table),
+		health.SessionKey(),
+		health.Config("cors", corsPolicy.Validate),
+	)
+	readiness.Register(&routes, "/api/to-do-list/mypost/search")
+}
+
+//////////////////////
+// SEARCH
+//////////////////////
+
+// searchTasks answers GET /search?q= with the user's projects, items and
+// comments matching q, best match first (see search.Query for the syntax).
+//
+// Results are ranked as a whole, so the cursor holds the offset of the next
+// page in that ranking.
+func searchTasks(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	q, err := search.Parse(req.QueryStringParameters["q"])
+	if err != nil {
+		var qe *search.QueryError
+		if errors.As(err, &qe) {
+			return respond.Error(400, qe.Msg)
+		}
+		return respond.Error(400, "invalid query")
+	}
+
+	scope := "search:" + p.UserID + "\n" + q.String()
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	offset := 0
+	if n, ok := pr.StartKey["offset"].(*types.AttributeValueMemberN); ok {
+		offset, _ = strconv.Atoi(n.Value)
+	}
+
+	hits, err := index.Search(ctx, p.UserID, q)
+	if err != nil {
+		log.Println("search error:", err)
+		return respond.DBError(err)
+	}
+
+	start := min(offset, len(hits))
+	end := min(start+int(pr.Limit), len(hits))
+	page := pagination.Page[search.Hit]{Items: hits[start:end]}
+
+	if end < len(hits) {
+		page.NextCursor, err = pagination.Next(map[string]types.AttributeValue{
+			"offset": &types.AttributeValueMemberN{Value: strconv.Itoa(end)},
+		}, scope)
+		if err != nil {
+			return pagination.ErrorResponse(err)
+		}
+	}
+
+	return respond.JSON(200, page)
+}
+
+//////////////////////
+// MAIN
+//////////////////////
+
+func main() {
+	lambda.Start(corsPolicy.Wrap(&routes, routes.Serve))
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	// The Lambda runtime image has no zoneinfo, so embed it for timeZone.
+	_ "time/tzdata"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/audit"
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/cors"
+	"to_do_list_demo/internal/etag"
+	"to_do_list_demo/internal/health"
+	"to_do_list_demo/internal/idempotency"
+	"to_do_list_demo/internal/mail"
+	"to_do_list_demo/internal/notify"
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+	"to_do_list_demo/internal/storage"
+	"to_do_list_demo/internal/tasks"
+)
+
+var (
+	dbClient      *dynamodb.Client
+	tableName     = "To-Do-List-Users"
+	labelsTable   = "To-Do-List-Labels"
+	keysTable     = auth.KeysTable()
+	keysUserIndex = "userId-index"
+	store         *tasks.Store
+	authn         *auth.Authenticator
+	auditLog      *audit.Logger
+	idempotent    *idempotency.Store
+	mailer        mail.Sender
+
+	routes     router.Router
+	corsPolicy *cors.Policy
+	readiness  *health.Checker
+)
+
+const emailVerifyTTL = 24 * time.Hour
+
+//////////////////////
+// STRUCTS
+//////////////////////
+
+type User struct {
+	UserID               string `json:"userId" dynamodbav:"userId"`
+	Name                 string `json:"name" dynamodbav:"name"`
+	Email                string `json:"email" dynamodbav:"email"`
+	EmailVerified        bool   `json:"emailVerified" dynamodbav:"emailVerified,omitempty"`
+	Password             string `json:"-" dynamodbav:"password,omitempty"`
+	PendingEmail         string `json:"pendingEmail,omitempty" dynamodbav:"pendingEmail,omitempty"`
+	EmailVerifyHash      string `json:"-" dynamodbav:"emailVerifyHash,omitempty"`
+	EmailVerifyExpiresAt int64  `json:"-" dynamodbav:"emailVerifyExpiresAt,omitempty"`
+	TimeZone             string `json:"timeZone,omitempty" dynamodbav:"timeZone,omitempty"`
+	Version              int64  `json:"version" dynamodbav:"version"`
+}
+
+// UpdateUser is the PATCH body. Only the fields that are present change.
+type UpdateUser struct {
+	Name            *string `json:"name"`
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	TimeZone        *string `json:"timeZone"`
+	CurrentPassword string  `json:"currentPassword"`
+}
+
+type VerifyEmail struct {
+	Token string `json:"token"`
+}
+
+//////////////////////
+// INIT
+//////////////////////
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal("unable to load AWS SDK config:", err)
+	}
+
+	dbClient = storage.NewClient(cfg)
+	authn = auth.New(dbClient, tableName)
+	auditLog = audit.New(dbClient)
+	idempotent = idempotency.New(dbClient)
+	store = tasks.New(dbClient)
+	mailer = mail.NewFromEnv()
+	corsPolicy = cors.FromEnv()
+
+	if t := os.Getenv("LABELS_TABLE"); t != "" {
+		labelsTable = t
+	}
+	if i := os.Getenv("API_KEYS_USER_INDEX"); i != "" {
+		keysUserIndex = i
+	}
+
+	routes.Handle("GET", "/api/to-do-list/mypost/users/me", authn.Middleware(auth.ScopeReadOnly, getMe))
+	routes.Handle("PATCH", "/api/to-do-list/mypost/users/me", authn.Middleware(auth.SessionOnly, idempotent.WrapAuth(updateMe)))
+	routes.Handle("DELETE", "/api/to-do-list/mypost/users/me", authn.Middleware(auth.SessionOnly, idempotent.WrapAuth(deleteMe)))
+	routes.Handle("POST", "/api/to-do-list/mypost/users/me/email/verify", authn.Middleware(auth.SessionOnly, idempotent.WrapAuth(verifyEmail)))
+	routes.Handle("GET", "/api/to-do-list/mypost/users/me/security-events", authn.Middleware(auth.SessionOnly, listSecurityEvents))
+	routes.Handle("POST", "/api/to-do-list/mypost/users/me/sessions/revoke", authn.Middleware(auth.SessionOnly, revokeSessions))
+
+	readiness = health.New(
+		health.Table(dbClient, tableName),
+		health.Table(dbClient, auditLog.Table),
+		health.Table(dbClient, idempotent.Table),
+		health.Table(dbClient, keysTable),
+		health.Table(dbClient, labelsTable),
+		health.Table(dbClient, store.Projects),
+		health.Table(dbClient, store.Items),
+		health.Table(dbClient, store.Comments),
+		health.Table(dbClient, store.Reminders),
+		health.Table(dbClient, store.History),
+		health.Table(dbClient, notify.NewInbox(dbClient).Table),
+		health.Table(dbClient, store.Search.Table),
+		health.SessionKey(),
+		health.Config("cors", corsPolicy.Validate),
+		health.Config("mail", mail.ValidateEnv),
+	)
+	readiness.Register(&routes, "/api/to-do-list/mypost/users/me")
+}
+
+//////////////////////
+// GET ME
+//////////////////////
+
+func getMe(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	user, err := loadUser(ctx, p.UserID)
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if user == nil {
+		return respond.Error(404, "user not found")
+	}
+
+	if etag.NoneMatch(auth.Header(req.Headers, "If-None-Match"), user.Version) {
+		return notModified(user.Version)
+	}
+
+	return userResponse(200, *user)
+}
+
+//////////////////////
+// UPDATE ME
+//////////////////////
+
+func updateMe(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var update UpdateUser
+
+	if err := json.Unmarshal([]byte(req.Body), &update); err != nil {
+		log.Println("updateMe unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	if update.Name == nil && update.Email == nil && update.Password == nil && update.TimeZone == nil {
+		return respond.Error(400, "nothing to update")
+	}
+
+	if p.ActorID != "" && (update.Email != nil || update.Password != nil) {
+		return respond.Error(403, "not allowed while impersonating")
+	}
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	user, err := loadUser(ctx, p.UserID)
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if user == nil {
+		return respond.Error(404, "user not found")
+	}
+
+	if pre != nil && !pre.Allows(user.Version) {
+		return userResponse(412, *user)
+	}
+
+	var sets []string
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+
+	if update.Name != nil {
+		name := strings.TrimSpace(*update.Name)
+		if name == "" {
+			return respond.Error(400, "name cannot be empty")
+		}
+
+		sets = append(sets, "#name = :name", "searchText = :searchText")
+		names["#name"] = "name"
+		values[":name"] = &types.AttributeValueMemberS{Value: name}
+		values[":searchText"] = &types.AttributeValueMemberS{Value: auth.SearchText(name, user.Email)}
+	}
+
+	// Date views such as "due today" are evaluated in this zone; without
+	// one they use UTC.
+	if update.TimeZone != nil {
+		tz := strings.TrimSpace(*update.TimeZone)
+		if _, err := time.LoadLocation(tz); err != nil || tz == "" || tz == "Local" {
+			return respond.Error(400, "invalid time zone, use an IANA name such as Europe/Berlin")
+		}
+
+		sets = append(sets, "#timeZone = :timeZone")
+		names["#timeZone"] = "timeZone"
+		values[":timeZone"] = &types.AttributeValueMemberS{Value: tz}
+	}
+
+	if update.Password != nil {
+		password := strings.TrimSpace(*update.Password)
+		if password == "" {
+			return respond.Error(400, "password cannot be empty")
+		}
+
+		// Accounts created through an identity provider have no password
+		// yet, so there is nothing to confirm.
+		current := strings.TrimSpace(update.CurrentPassword)
+		if user.Password != "" && subtle.ConstantTimeCompare([]byte(current), []byte(user.Password)) != 1 {
+			auditLog.Log(ctx, audit.NewEntry(req, user.UserID, p.Actor(), audit.ActionPasswordChange).Failed("current password is incorrect"))
+			return respond.Error(403, "current password is incorrect")
+		}
+
+		// A new password signs out every session, including the one making
+		// the change, in case the old password had leaked.
+		sets = append(sets, "#password = :password", "sessionsRevokedAt = :now")
+		names["#password"] = "password"
+		values[":password"] = &types.AttributeValueMemberS{Value: password}
+		values[":now"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)}
+	}
+
+	var verifyToken, newEmail string
+
+	if update.Email != nil {
+		newEmail = strings.TrimSpace(*update.Email)
+
+		addr, err := netmail.ParseAddress(newEmail)
+		if err != nil || addr.Address != newEmail {
+			return respond.Error(400, "invalid email")
+		}
+
+		if newEmail != user.Email {
+			inUse, err := emailInUse(ctx, newEmail, user.UserID)
+			if err != nil {
+				log.Println("Scan error:", err)
+				return respond.DBError(err)
+			}
+
+			if inUse {
+				return respond.Error(409, "email already in use")
+			}
+
+			// The address only changes once the owner of the new
+			// mailbox proves it by sending back the token.
+			if verifyToken, err = randomToken(); err != nil {
+				log.Println("random error:", err)
+				return respond.Error(500, "could not start verification")
+			}
+
+			sets = append(sets, "pendingEmail = :pendingEmail", "emailVerifyHash = :hash", "emailVerifyExpiresAt = :expiresAt")
+			values[":pendingEmail"] = &types.AttributeValueMemberS{Value: newEmail}
+			values[":hash"] = &types.AttributeValueMemberS{Value: hashToken(verifyToken)}
+			values[":expiresAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(emailVerifyTTL).Unix(), 10)}
+		}
+	}
+
+	if len(sets) == 0 {
+		return userResponse(200, *user)
+	}
+
+	cond := "attribute_exists(userId)"
+	if c := pre.Condition(names, values); c != "" {
+		cond += " AND " + c
+	}
+
+	result, err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: user.UserID},
+		},
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ") + " " + etag.Increment(names, values)),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return conflict(ctx, user.UserID)
+	}
+	if err != nil {
+		log.Println("UpdateItem error:", err)
+		return respond.DBError(err)
+	}
+
+	var updated User
+	if err := attributevalue.UnmarshalMap(result.Attributes, &updated); err != nil {
+		log.Println("unmarshal error:", err)
+		return respond.Error(500, "unmarshal error")
+	}
+
+	if update.Password != nil {
+		revoked := audit.NewEntry(req, user.UserID, p.Actor(), audit.ActionSessionsRevoke)
+		revoked.Details = map[string]string{"reason": audit.ActionPasswordChange}
+
+		auditLog.Log(ctx, audit.NewEntry(req, user.UserID, p.Actor(), audit.ActionPasswordChange))
+		auditLog.Log(ctx, revoked)
+	}
+
+	if verifyToken != "" {
+		entry := audit.NewEntry(req, user.UserID, p.Actor(), audit.ActionEmailChangeRequest)
+		entry.Details = map[string]string{"to": newEmail}
+		auditLog.Log(ctx, entry)
+
+		sendVerificationEmail(ctx, newEmail, verifyToken)
+	}
+
+	return userResponse(200, updated)
+}
+
+//////////////////////
+// VERIFY EMAIL
+//////////////////////
+
+func verifyEmail(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	var body VerifyEmail
+
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		log.Println("verifyEmail unmarshal error:", err)
+		return respond.Error(400, "invalid json")
+	}
+
+	token := strings.TrimSpace(body.Token)
+	if token == "" {
+		return respond.Error(400, "token required")
+	}
+
+	user, err := loadUser(ctx, p.UserID)
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if user == nil {
+		return respond.Error(404, "user not found")
+	}
+
+	if user.PendingEmail == "" {
+		return respond.Error(400, "no email change pending")
+	}
+
+	hash := hashToken(token)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(user.EmailVerifyHash)) != 1 {
+		return respond.Error(400, "invalid verification token")
+	}
+
+	if time.Now().Unix() > user.EmailVerifyExpiresAt {
+		return respond.Error(400, "verification token expired")
+	}
+
+	inUse, err := emailInUse(ctx, user.PendingEmail, user.UserID)
+	if err != nil {
+		log.Println("Scan error:", err)
+		return respond.DBError(err)
+	}
+
+	if inUse {
+		return respond.Error(409, "email already in use")
+	}
+
+	names := map[string]string{"#email": "email"}
+	values := map[string]types.AttributeValue{
+		":hash":       &types.AttributeValueMemberS{Value: hash},
+		":verified":   &types.AttributeValueMemberBOOL{Value: true},
+		":searchText": &types.AttributeValueMemberS{Value: auth.SearchText(user.Name, user.PendingEmail)},
+	}
+
+	result, err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: user.UserID},
+		},
+		UpdateExpression:          aws.String("SET #email = pendingEmail, emailVerified = :verified, searchText = :searchText REMOVE pendingEmail, emailVerifyHash, emailVerifyExpiresAt " + etag.Increment(names, values)),
+		ConditionExpression:       aws.String("emailVerifyHash = :hash"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return respond.Error(400, "invalid verification token")
+	}
+	if err != nil {
+		log.Println("UpdateItem error:", err)
+		return respond.DBError(err)
+	}
+
+	var updated User
+	if err := attributevalue.UnmarshalMap(result.Attributes, &updated); err != nil {
+		log.Println("unmarshal error:", err)
+		return respond.Error(500, "unmarshal error")
+	}
+
+	entry := audit.NewEntry(req, user.UserID, p.Actor(), audit.ActionEmailChange)
+	entry.Details = map[string]string{"from": user.Email, "to": updated.Email}
+	auditLog.Log(ctx, entry)
+
+	return userResponse(200, updated)
+}
+
+func sendVerificationEmail(ctx context.Context, to, token string) {
+
+	body := "Use this code to confirm your new email address: " + token
+
+	if link := os.Getenv("EMAIL_VERIFY_URL"); link != "" {
+		body = "Confirm your new email address by opening this link:\n\n" + link + "?token=" + url.QueryEscape(token)
+	}
+
+	err := mailer.Send(ctx, mail.Message{
+		To:      to,
+		Subject: "Confirm your new email address",
+		Body:    body + "\n\nThe link expires in 24 hours. If you did not ask for this, ignore this email.",
+	})
+	if err != nil {
+		// The change stays pending; the user can request it again.
+		log.Println("verification email error:", err)
+	}
+}
+
+//////////////////////
+// DELETE ME
+//////////////////////
+
+// deleteMe deletes the caller's data, then the user. The precondition is
+// checked before anything is deleted; if a step fails the request can be
+// retried and picks up where it stopped. Audit entries are kept.
+func deleteMe(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	if p.ActorID != "" {
+		return respond.Error(403, "not allowed while impersonating")
+	}
+
+	pre := etag.IfMatch(auth.Header(req.Headers, "If-Match"))
+
+	user, err := loadUser(ctx, p.UserID)
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if user == nil {
+		return respond.Error(404, "user not found")
+	}
+
+	if pre != nil && !pre.Allows(user.Version) {
+		return userResponse(412, *user)
+	}
+
+	if err := deleteUserData(ctx, p.UserID); err != nil {
+		log.Println("deleteUserData error:", err)
+		return respond.DBError(err)
+	}
+
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+
+	cond := "attribute_exists(userId)"
+	if c := pre.Condition(names, values); c != "" {
+		cond += " AND " + c
+	}
+
+	_, err = dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: p.UserID},
+		},
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  nilIfEmpty(names),
+		ExpressionAttributeValues: nilIfEmpty(values),
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return conflict(ctx, p.UserID)
+	}
+	if err != nil {
+		log.Println("DeleteItem error:", err)
+		return respond.DBError(err)
+	}
+
+	auditLog.Log(ctx, audit.NewEntry(req, p.UserID, p.Actor(), audit.ActionAccountDelete))
+
+	return respond.JSON(200, map[string]string{"message": "user deleted"})
+}
+
+// deleteUserData deletes everything owned by userID: projects, items, their
+// reminders and history, inbox notifications, labels and API keys.
+func deleteUserData(ctx context.Context, userID string) error {
+
+	if err := store.DeleteOwner(ctx, userID); err != nil {
+		return err
+	}
+	if err := notify.NewInbox(dbClient).DeleteOwner(ctx, userID); err != nil {
+		return err
+	}
+
+	user := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: userID},
+	}
+
+	err := storage.DeleteQueried(ctx, dbClient, &dynamodb.QueryInput{
+		TableName:                 aws.String(labelsTable),
+		KeyConditionExpression:    aws.String("userId = :userId"),
+		ExpressionAttributeValues: user,
+	}, "userId", "labelId")
+	if err != nil {
+		return err
+	}
+
+	return storage.DeleteQueried(ctx, dbClient, &dynamodb.QueryInput{
+		TableName:                 aws.String(keysTable),
+		IndexName:                 aws.String(keysUserIndex),
+		KeyConditionExpression:    aws.String("userId = :userId"),
+		ExpressionAttributeValues: user,
+	}, "keyId")
+}
+
+//////////////////////
+// SECURITY EVENTS
+//////////////////////
+
+// listSecurityEvents returns the caller's own audit log, newest first.
+func listSecurityEvents(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	scope := "security-events:" + p.UserID
+
+	pr, err := pagination.Parse(req.QueryStringParameters, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(auditLog.Table),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: p.UserID},
+		},
+		ScanIndexForward:  aws.Bool(false),
+		Limit:             aws.Int32(pr.Limit),
+		ExclusiveStartKey: pr.StartKey,
+	}
+
+	result, err := dbClient.Query(ctx, input)
+	if err != nil {
+		log.Println("Query error:", err)
+		return respond.DBError(err)
+	}
+
+	page := pagination.Page[audit.Entry]{Items: []audit.Entry{}}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &page.Items); err != nil {
+		log.Println("unmarshal error:", err)
+		return respond.Error(500, "unmarshal error")
+	}
+
+	// Entries written by staff before their IP and user agent were kept
+	// out of the user's partition still carry them.
+	for i, e := range page.Items {
+		if e.ActorID != p.UserID {
+			page.Items[i].IP = ""
+			page.Items[i].UserAgent = ""
+		}
+	}
+
+	page.NextCursor, err = pagination.Next(result.LastEvaluatedKey, scope)
+	if err != nil {
+		return pagination.ErrorResponse(err)
+	}
+
+	return respond.JSON(200, page)
+}
+
+//////////////////////
+// REVOKE SESSIONS
+//////////////////////
+
+// revokeSessions signs the user out of every session, including the one
+// making the request. Session tokens are not stored, so they cannot be
+// revoked one by one; API keys are revoked separately.
+func revokeSessions(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+
+	entry := audit.NewEntry(req, p.UserID, p.Actor(), audit.ActionSessionsRevoke)
+	entry.Details = map[string]string{"reason": "requested"}
+
+	auditItem, err := auditLog.TransactItem(entry)
+	if err != nil {
+		log.Println("audit error:", err)
+		return respond.Error(500, "audit error")
+	}
+
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{
+		":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+
+	_, err = dbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					TableName: aws.String(tableName),
+					Key: map[string]types.AttributeValue{
+						"userId": &types.AttributeValueMemberS{Value: p.UserID},
+					},
+					UpdateExpression:          aws.String("SET sessionsRevokedAt = :now " + etag.Increment(names, values)),
+					ConditionExpression:       aws.String("attribute_exists(userId)"),
+					ExpressionAttributeNames:  names,
+					ExpressionAttributeValues: values,
+				},
+			},
+			auditItem,
+		},
+	})
+	if err != nil {
+		log.Println("TransactWriteItems error:", err)
+		return respond.DBError(err)
+	}
+
+	return respond.JSON(200, map[string]string{"message": "all sessions revoked"})
+}
+
+//////////////////////
+// USERS TABLE
+//////////////////////
+
+// conflict answers a write whose condition failed: 404 when the user is
+// gone, otherwise 412 with the current user so the client can merge its
+// change and retry with the new ETag.
+func conflict(ctx context.Context, userID string) (events.APIGatewayV2HTTPResponse, error) {
+
+	user, err := loadUser(ctx, userID)
+	if err != nil {
+		log.Println("GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if user == nil {
+		return respond.Error(404, "user not found")
+	}
+
+	return userResponse(412, *user)
+}
+
+// loadUser returns nil when the user does not exist.
+func loadUser(ctx context.Context, userID string) (*User, error) {
+
+	result, err := dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var user User
+	if err := attributevalue.UnmarshalMap(result.Item, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// emailInUse reports whether another user already has email.
+func emailInUse(ctx context.Context, email, exceptUserID string) (bool, error) {
+
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(tableName),
+		FilterExpression: aws.String("#email = :email AND userId <> :userId"),
+		ExpressionAttributeNames: map[string]string{
+			"#email": "email",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":email":  &types.AttributeValueMemberS{Value: email},
+			":userId": &types.AttributeValueMemberS{Value: exceptUserID},
+		},
+		ProjectionExpression: aws.String("userId"),
+	}
+
+	for {
+		result, err := dbClient.Scan(ctx, input)
+		if err != nil {
+			return false, err
+		}
+
+		if len(result.Items) > 0 {
+			return true, nil
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return false, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+//////////////////////
+// HELPERS
+//////////////////////
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func nilIfEmpty[V any](m map[string]V) map[string]V {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// userResponse answers with user and its ETag.
+func userResponse(code int, user User) (events.APIGatewayV2HTTPResponse, error) {
+
+	resp, err := respond.JSON(code, user)
+	resp.Headers["ETag"] = etag.Format(user.Version)
+
+	return resp, err
+}
+
+func notModified(version int64) (events.APIGatewayV2HTTPResponse, error) {
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 304,
+		Headers: map[string]string{
+			"ETag": etag.Format(version),
+		},
+	}, nil
+}
+
+//////////////////////
+// MAIN
+//////////////////////
+
+func main() {
+	lambda.Start(corsPolicy.Wrap(&routes, routes.Serve))
+}
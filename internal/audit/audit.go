@@ -0,0 +1,210 @@
+// Package audit writes the append-only security audit log of actions taken
+// on user accounts.
+//
+// Entries are partitioned by the userId of the account the action was taken
+// on and sorted by eventId, which starts with a UTC timestamp so a Query on
+// one user returns that account's history in time order. Entries are only
+// ever put, never updated or deleted; the lambdas' IAM role should deny
+// UpdateItem and DeleteItem on the table.
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const defaultTable = "To-Do-List-Audit"
+
+// Actions recorded in the log.
+const (
+	ActionSignup             = "signup"
+	ActionLogin              = "login"
+	ActionOIDCLink           = "oidc.link"
+	ActionPasswordChange     = "password.change"
+	ActionPasswordReset      = "password.reset"
+	ActionEmailChangeRequest = "email.change_requested"
+	ActionEmailChange        = "email.change"
+	ActionAccountDelete      = "account.delete"
+	ActionSessionsRevoke     = "sessions.revoke"
+	ActionAPIKeyCreate       = "apikey.create"
+	ActionAPIKeyRevoke       = "apikey.revoke"
+
+	ActionAdminList          = "admin.users.list"
+	ActionAdminView          = "admin.users.view"
+	ActionAdminDisable       = "admin.users.disable"
+	ActionAdminEnable        = "admin.users.enable"
+	ActionAdminRoleChange    = "admin.users.role"
+	ActionAdminPasswordReset = "admin.users.password_reset"
+	ActionAdminImpersonate   = "admin.users.impersonate"
+)
+
+// Outcomes of an action.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Entry is one audit record.
+type Entry struct {
+	UserID    string            `json:"-" dynamodbav:"userId"`
+	EventID   string            `json:"eventId" dynamodbav:"eventId"`
+	Action    string            `json:"action" dynamodbav:"action"`
+	Outcome   string            `json:"outcome" dynamodbav:"outcome"`
+	ActorID   string            `json:"actorId" dynamodbav:"actorId"`
+	IP        string            `json:"ip,omitempty" dynamodbav:"ip,omitempty"`
+	UserAgent string            `json:"userAgent,omitempty" dynamodbav:"userAgent,omitempty"`
+	Details   map[string]string `json:"details,omitempty" dynamodbav:"details,omitempty"`
+	CreatedAt string            `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// NewEntry returns a successful entry for action on userID by actorID.
+//
+// Users read the entries filed under their own userId, so the caller's IP
+// and user agent from req are only kept when users act on their own account.
+// For staff acting on someone else, ActorCopy files the details under the
+// staff member instead.
+func NewEntry(req events.APIGatewayV2HTTPRequest, userID, actorID, action string) Entry {
+	e := Entry{
+		UserID:  userID,
+		Action:  action,
+		Outcome: OutcomeSuccess,
+		ActorID: actorID,
+	}
+	if actorID == userID {
+		e.IP = req.RequestContext.HTTP.SourceIP
+		e.UserAgent = req.RequestContext.HTTP.UserAgent
+	}
+	return e
+}
+
+// ActorCopy returns e filed under its actor, with the IP and user agent from
+// req and the affected user in details["userId"].
+func (e Entry) ActorCopy(req events.APIGatewayV2HTTPRequest) Entry {
+	details := map[string]string{"userId": e.UserID}
+	for k, v := range e.Details {
+		details[k] = v
+	}
+
+	e.UserID = e.ActorID
+	e.IP = req.RequestContext.HTTP.SourceIP
+	e.UserAgent = req.RequestContext.HTTP.UserAgent
+	e.Details = details
+	return e
+}
+
+// Failed marks e as a failed attempt, with reason kept in its details.
+func (e Entry) Failed(reason string) Entry {
+	e.Outcome = OutcomeFailure
+	if reason != "" {
+		details := map[string]string{"reason": reason}
+		for k, v := range e.Details {
+			details[k] = v
+		}
+		e.Details = details
+	}
+	return e
+}
+
+// Logger writes entries to the audit table.
+type Logger struct {
+	DB    *dynamodb.Client
+	Table string
+}
+
+// New returns a Logger for AUDIT_TABLE, or To-Do-List-Audit when unset.
+func New(db *dynamodb.Client) *Logger {
+	table := os.Getenv("AUDIT_TABLE")
+	if table == "" {
+		table = defaultTable
+	}
+	return &Logger{DB: db, Table: table}
+}
+
+// Record writes e on its own.
+func (l *Logger) Record(ctx context.Context, e Entry) error {
+
+	put, err := l.put(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.DB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           put.TableName,
+		Item:                put.Item,
+		ConditionExpression: put.ConditionExpression,
+	})
+	return err
+}
+
+// RecordAll writes entries in one transaction, so either all of them or none
+// are kept.
+func (l *Logger) RecordAll(ctx context.Context, entries ...Entry) error {
+
+	items := make([]types.TransactWriteItem, 0, len(entries))
+	for _, e := range entries {
+		item, err := l.TransactItem(e)
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+
+	_, err := l.DB.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+// Log records e and only logs a failure. It is for events that must not fail
+// the request they describe, such as a login attempt.
+func (l *Logger) Log(ctx context.Context, e Entry) {
+	if err := l.Record(ctx, e); err != nil {
+		log.Println("audit error:", e.Action, err)
+	}
+}
+
+// TransactItem returns e as a write to include in a TransactWriteItems call,
+// so the audited change and its entry are committed together.
+func (l *Logger) TransactItem(e Entry) (types.TransactWriteItem, error) {
+
+	put, err := l.put(e)
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+
+	return types.TransactWriteItem{Put: put}, nil
+}
+
+func (l *Logger) put(e Entry) (*types.Put, error) {
+
+	now := time.Now().UTC()
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	e.EventID = now.Format("2006-01-02T15:04:05.000000000Z") + "#" + hex.EncodeToString(suffix)
+	e.CreatedAt = now.Format(time.RFC3339)
+
+	item, err := attributevalue.MarshalMap(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Put{
+		TableName:           aws.String(l.Table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(eventId)"),
+	}, nil
+}
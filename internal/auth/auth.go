@@ -0,0 +1,399 @@
+// Package auth resolves the caller of an API Gateway request from its
+// credentials and checks what the caller is allowed to do.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/session"
+)
+
+// Roles stored in the role attribute of a user item. Users created before
+// roles existed have no role attribute and count as RoleUser.
+const (
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+)
+
+// Scopes an API key can be granted. tasks:write includes read access.
+const (
+	ScopeReadOnly   = "read-only"
+	ScopeTasksWrite = "tasks:write"
+
+	// SessionOnly marks routes that API keys cannot call at all.
+	SessionOnly = ""
+)
+
+const (
+	// APIKeyPrefix starts every API key, so leaked keys are easy to spot.
+	APIKeyPrefix = "tdl_"
+
+	defaultKeysTable = "To-Do-List-API-Keys"
+
+	// lastUsedResolution limits lastUsedAt writes to one per key per minute.
+	lastUsedResolution = time.Minute
+)
+
+var (
+	ErrUnauthenticated = errors.New("auth: missing or invalid credentials")
+	ErrDisabled        = errors.New("auth: account disabled")
+)
+
+// Principal is the authenticated caller.
+type Principal struct {
+	UserID    string
+	Role      string
+	SessionID string
+	Method    string
+
+	// ActorID is the staff member behind an impersonation session. It is
+	// empty for the user's own sessions.
+	ActorID string
+
+	// APIKeyID and Scopes are set when the caller used an API key instead
+	// of a session token.
+	APIKeyID string
+	Scopes   []string
+}
+
+// Allows reports whether p may call a route that API keys reach with scope.
+// Session callers may call every route; pass SessionOnly for routes that API
+// keys must never reach.
+func (p *Principal) Allows(scope string) bool {
+	if p.APIKeyID == "" {
+		return true
+	}
+	if scope == SessionOnly {
+		return false
+	}
+	for _, s := range p.Scopes {
+		if s == scope || (s == ScopeTasksWrite && scope == ScopeReadOnly) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope reports whether scope can be granted to an API key.
+func ValidScope(scope string) bool {
+	return scope == ScopeReadOnly || scope == ScopeTasksWrite
+}
+
+// Actor returns the id of the person behind the request: the staff member
+// for an impersonation session, the user otherwise.
+func (p *Principal) Actor() string {
+	if p.ActorID != "" {
+		return p.ActorID
+	}
+	return p.UserID
+}
+
+// HasRole reports whether the principal has one of roles.
+func (p *Principal) HasRole(roles ...string) bool {
+	for _, r := range roles {
+		if p.Role == r {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchText returns the searchText attribute of a user item: name and
+// email lowercased, so staff can search users without regard to case.
+func SearchText(name, email string) string {
+	return strings.ToLower(name + "\n" + email)
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin || role == RoleSupport
+}
+
+// isStaff reports whether role may act on other users.
+func isStaff(role string) bool {
+	return role == RoleAdmin || role == RoleSupport
+}
+
+// Authenticator verifies credentials and loads the caller's account state
+// from the users table.
+type Authenticator struct {
+	DB         *dynamodb.Client
+	UsersTable string
+	KeysTable  string
+}
+
+// New returns an Authenticator backed by the given users table and the API
+// keys table from API_KEYS_TABLE.
+func New(db *dynamodb.Client, usersTable string) *Authenticator {
+	return &Authenticator{DB: db, UsersTable: usersTable, KeysTable: KeysTable()}
+}
+
+// KeysTable returns API_KEYS_TABLE, or To-Do-List-API-Keys when unset.
+func KeysTable() string {
+	if t := os.Getenv("API_KEYS_TABLE"); t != "" {
+		return t
+	}
+	return defaultKeysTable
+}
+
+// APIKey is an item in the API keys table. Only the hash of the key is
+// stored; the key itself is shown once, when it is created.
+type APIKey struct {
+	KeyID      string   `json:"keyId" dynamodbav:"keyId"`
+	UserID     string   `json:"-" dynamodbav:"userId"`
+	Name       string   `json:"name" dynamodbav:"name"`
+	Prefix     string   `json:"prefix" dynamodbav:"prefix"`
+	Hash       string   `json:"-" dynamodbav:"hash"`
+	Scopes     []string `json:"scopes" dynamodbav:"scopes,stringset"`
+	CreatedAt  string   `json:"createdAt" dynamodbav:"createdAt"`
+	LastUsedAt int64    `json:"lastUsedAt,omitempty" dynamodbav:"lastUsedAt,omitempty"`
+	RevokedAt  int64    `json:"revokedAt,omitempty" dynamodbav:"revokedAt,omitempty"`
+}
+
+// HashAPIKey returns the stored form of key.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseAPIKey splits a key of the form tdl_<keyId>_<secret> and returns its
+// keyId.
+func ParseAPIKey(key string) (keyID string, ok bool) {
+	rest, found := strings.CutPrefix(key, APIKeyPrefix)
+	if !found {
+		return "", false
+	}
+	keyID, secret, found := strings.Cut(rest, "_")
+	if !found || keyID == "" || secret == "" {
+		return "", false
+	}
+	return keyID, true
+}
+
+type account struct {
+	UserID            string `dynamodbav:"userId"`
+	Role              string `dynamodbav:"role"`
+	Disabled          bool   `dynamodbav:"disabled"`
+	SessionsRevokedAt int64  `dynamodbav:"sessionsRevokedAt"`
+}
+
+// revoked reports whether a session issued at issuedAt was revoked. Both
+// are whole seconds, so a session issued in the same second as the
+// revocation counts as revoked: it may have been issued just before it.
+func (acct *account) revoked(issuedAt int64) bool {
+	return issuedAt <= acct.SessionsRevokedAt
+}
+
+// Authenticate verifies the x-api-key header or the bearer session token on
+// req and checks that the account still exists and is enabled, and that the
+// key or session has not been revoked.
+func (a *Authenticator) Authenticate(ctx context.Context, req events.APIGatewayV2HTTPRequest) (*Principal, error) {
+
+	if key := strings.TrimSpace(Header(req.Headers, "x-api-key")); key != "" {
+		return a.authenticateAPIKey(ctx, key)
+	}
+
+	token := bearerToken(req.Headers)
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	claims, err := session.Verify(token)
+	if err != nil {
+		if errors.Is(err, session.ErrNoSecret) {
+			return nil, err
+		}
+		return nil, ErrUnauthenticated
+	}
+
+	acct, err := a.loadAccount(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if acct == nil || acct.revoked(claims.IssuedAt) {
+		return nil, ErrUnauthenticated
+	}
+
+	if acct.Disabled {
+		return nil, ErrDisabled
+	}
+
+	// An impersonation session only lasts while the staff member behind it
+	// is still enabled, still staff and not signed out everywhere.
+	if claims.Actor != "" {
+		actor, err := a.loadAccount(ctx, claims.Actor)
+		if err != nil {
+			return nil, err
+		}
+		if actor == nil || actor.Disabled || !isStaff(actor.Role) || actor.revoked(claims.IssuedAt) {
+			return nil, ErrUnauthenticated
+		}
+	}
+
+	role := acct.Role
+	if role == "" {
+		role = RoleUser
+	}
+
+	return &Principal{
+		UserID:    claims.Subject,
+		Role:      role,
+		SessionID: claims.SessionID,
+		Method:    claims.Method,
+		ActorID:   claims.Actor,
+	}, nil
+}
+
+func (a *Authenticator) authenticateAPIKey(ctx context.Context, key string) (*Principal, error) {
+
+	keyID, ok := ParseAPIKey(key)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	result, err := a.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(a.KeysTable),
+		Key: map[string]types.AttributeValue{
+			"keyId": &types.AttributeValueMemberS{Value: keyID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrUnauthenticated
+	}
+
+	var k APIKey
+	if err := attributevalue.UnmarshalMap(result.Item, &k); err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(HashAPIKey(key)), []byte(k.Hash)) != 1 || k.RevokedAt != 0 {
+		return nil, ErrUnauthenticated
+	}
+
+	acct, err := a.loadAccount(ctx, k.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if acct == nil {
+		return nil, ErrUnauthenticated
+	}
+
+	if acct.Disabled {
+		return nil, ErrDisabled
+	}
+
+	a.touchAPIKey(ctx, k)
+
+	role := acct.Role
+	if role == "" {
+		role = RoleUser
+	}
+
+	return &Principal{
+		UserID:   k.UserID,
+		Role:     role,
+		Method:   "apikey",
+		APIKeyID: k.KeyID,
+		Scopes:   k.Scopes,
+	}, nil
+}
+
+// touchAPIKey records when k was last used. Failures only cost accuracy, so
+// they are logged and not returned.
+func (a *Authenticator) touchAPIKey(ctx context.Context, k APIKey) {
+
+	now := time.Now()
+	if now.Unix()-k.LastUsedAt < int64(lastUsedResolution.Seconds()) {
+		return
+	}
+
+	_, err := a.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(a.KeysTable),
+		Key: map[string]types.AttributeValue{
+			"keyId": &types.AttributeValueMemberS{Value: k.KeyID},
+		},
+		UpdateExpression:    aws.String("SET lastUsedAt = :now"),
+		ConditionExpression: aws.String("attribute_not_exists(lastUsedAt) OR lastUsedAt < :threshold"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":       &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			":threshold": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(-lastUsedResolution).Unix(), 10)},
+		},
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &ccf) {
+		log.Println("api key lastUsedAt error:", err)
+	}
+}
+
+func (a *Authenticator) loadAccount(ctx context.Context, userID string) (*account, error) {
+
+	result, err := a.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(a.UsersTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+		ProjectionExpression: aws.String("userId, #role, disabled, sessionsRevokedAt"),
+		ExpressionAttributeNames: map[string]string{
+			"#role": "role",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var acct account
+	if err := attributevalue.UnmarshalMap(result.Item, &acct); err != nil {
+		return nil, err
+	}
+
+	return &acct, nil
+}
+
+// Header returns the value of the named header. API Gateway lowercases
+// header names for HTTP APIs, but other callers may not.
+func Header(headers map[string]string, name string) string {
+	if v, ok := headers[strings.ToLower(name)]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+func bearerToken(headers map[string]string) string {
+	h := strings.TrimSpace(Header(headers, "Authorization"))
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+)
+
+// Handler handles a request from an authenticated caller.
+type Handler func(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *Principal) (events.APIGatewayV2HTTPResponse, error)
+
+// Middleware authenticates the caller and only runs next when the caller may
+// call a route that API keys reach with scope.
+func (a *Authenticator) Middleware(scope string, next Handler) router.Handler {
+	return a.middleware(next, func(p *Principal) bool {
+		return p.Allows(scope)
+	})
+}
+
+// StaffMiddleware authenticates the caller and only runs next when the
+// caller has one of roles. Impersonation sessions and API keys never reach
+// staff routes.
+func (a *Authenticator) StaffMiddleware(next Handler, roles ...string) router.Handler {
+	return a.middleware(next, func(p *Principal) bool {
+		return p.ActorID == "" && p.Allows(SessionOnly) && p.HasRole(roles...)
+	})
+}
+
+func (a *Authenticator) middleware(next Handler, allowed func(p *Principal) bool) router.Handler {
+	return func(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+
+		p, err := a.Authenticate(ctx, req)
+		switch {
+		case errors.Is(err, ErrUnauthenticated):
+			return respond.Error(401, "unauthorized")
+		case errors.Is(err, ErrDisabled):
+			return respond.Error(403, "account disabled")
+		case err != nil:
+			log.Println("auth error:", err)
+			return respond.Error(500, "auth error")
+		}
+
+		if !allowed(p) {
+			return respond.Error(403, "forbidden")
+		}
+
+		return next(ctx, req, p)
+	}
+}
@@ -0,0 +1,186 @@
+// Package cors applies the cross-origin policy to lambda responses.
+//
+// Allowed methods are not configured: they come from the router, so each
+// path only advertises the methods it actually serves.
+package cors
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"to_do_list_demo/internal/router"
+)
+
+const defaultMaxAge = 600
+
+var (
+	defaultHeaders        = []string{"Content-Type", "Authorization", "x-api-key", "Idempotency-Key", "If-Match", "If-None-Match"}
+	defaultExposedHeaders = []string{"ETag", "Idempotent-Replayed"}
+)
+
+// Policy is a CORS configuration.
+type Policy struct {
+	// AllowedOrigins holds exact origins such as https://app.example.com.
+	// A single "*" allows any origin, but only without credentials.
+	AllowedOrigins   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	MaxAge           int
+	AllowCredentials bool
+}
+
+// FromEnv reads CORS_ALLOWED_ORIGINS (comma separated), CORS_ALLOW_CREDENTIALS
+// and CORS_MAX_AGE (seconds). Without CORS_ALLOWED_ORIGINS any origin is
+// allowed without credentials, as before the policy was configurable.
+func FromEnv() *Policy {
+	p := &Policy{
+		AllowedOrigins:   []string{"*"},
+		AllowedHeaders:   defaultHeaders,
+		ExposedHeaders:   defaultExposedHeaders,
+		MaxAge:           defaultMaxAge,
+		AllowCredentials: os.Getenv("CORS_ALLOW_CREDENTIALS") == "true",
+	}
+
+	if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" {
+		p.AllowedOrigins = nil
+		for _, o := range strings.Split(v, ",") {
+			if o = normalize(o); o != "" {
+				p.AllowedOrigins = append(p.AllowedOrigins, o)
+			}
+		}
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("CORS_MAX_AGE")); err == nil && n >= 0 {
+		p.MaxAge = n
+	}
+
+	if err := p.Validate(); err != nil {
+		log.Println(err)
+	}
+
+	return p
+}
+
+// Validate reports a policy that browsers would reject or that allows
+// nothing at all.
+func (p *Policy) Validate() error {
+	if len(p.AllowedOrigins) == 0 {
+		return errors.New("cors: CORS_ALLOWED_ORIGINS lists no origins")
+	}
+	if p.AllowCredentials && p.allowsAny() {
+		return errors.New("cors: credentials are not allowed with a wildcard origin, set CORS_ALLOWED_ORIGINS")
+	}
+	return nil
+}
+
+// Wrap answers OPTIONS requests for every path routes knows and adds CORS
+// headers to the responses of next.
+func (p *Policy) Wrap(routes *router.Router, next router.Handler) router.Handler {
+	return func(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+
+		methods := routes.Methods(req.RequestContext.HTTP.Path)
+
+		if req.RequestContext.HTTP.Method == http.MethodOptions && len(methods) > 0 {
+			resp := events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusNoContent,
+				Headers:    map[string]string{"Allow": router.Allow(methods)},
+			}
+			p.apply(req, &resp, methods, true)
+			return resp, nil
+		}
+
+		resp, err := next(ctx, req)
+		p.apply(req, &resp, methods, false)
+		return resp, err
+	}
+}
+
+func (p *Policy) apply(req events.APIGatewayV2HTTPRequest, resp *events.APIGatewayV2HTTPResponse, methods []string, preflight bool) {
+
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+
+	origin := header(req.Headers, "Origin")
+
+	allowOrigin := p.allowOrigin(origin)
+	if allowOrigin != "*" {
+		// The answer depends on the Origin header, so caches must key on it.
+		resp.Headers["Vary"] = "Origin"
+	}
+
+	if allowOrigin == "" {
+		return
+	}
+
+	resp.Headers["Access-Control-Allow-Origin"] = allowOrigin
+
+	if p.AllowCredentials && allowOrigin != "*" {
+		resp.Headers["Access-Control-Allow-Credentials"] = "true"
+	}
+
+	if preflight {
+		resp.Headers["Access-Control-Allow-Methods"] = router.Allow(methods)
+		resp.Headers["Access-Control-Allow-Headers"] = strings.Join(p.AllowedHeaders, ",")
+		resp.Headers["Access-Control-Max-Age"] = strconv.Itoa(p.MaxAge)
+	} else if len(p.ExposedHeaders) > 0 {
+		resp.Headers["Access-Control-Expose-Headers"] = strings.Join(p.ExposedHeaders, ",")
+	}
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" when origin is not allowed.
+func (p *Policy) allowOrigin(origin string) string {
+
+	if origin == "" {
+		return ""
+	}
+
+	if p.allowsAny() {
+		if p.AllowCredentials {
+			return ""
+		}
+		return "*"
+	}
+
+	n := normalize(origin)
+	for _, o := range p.AllowedOrigins {
+		if o == n {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+func (p *Policy) allowsAny() bool {
+	for _, o := range p.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func normalize(origin string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+}
+
+func header(headers map[string]string, name string) string {
+	if v, ok := headers[strings.ToLower(name)]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+// Package etag turns the version attribute of an item into an HTTP entity
+// tag, evaluates the If-Match and If-None-Match request headers and builds
+// the DynamoDB expressions that enforce them.
+//
+// Every write to a versioned item adds one to its version, so the tag of an
+// item changes exactly when the item does. Items written before versions
+// existed have no version attribute and count as version 0.
+package etag
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Format returns the entity tag for version.
+func Format(version int64) string {
+	return `"v` + strconv.FormatInt(version, 10) + `"`
+}
+
+// Parse returns the version in tag, a strong tag made by Format.
+func Parse(tag string) (int64, bool) {
+	tag = strings.TrimSpace(tag)
+	if !strings.HasPrefix(tag, `"v`) || !strings.HasSuffix(tag, `"`) || len(tag) < 4 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(tag[2:len(tag)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// Precondition is a parsed If-Match header.
+type Precondition struct {
+	// Any is set for "If-Match: *", which only requires the item to exist.
+	Any bool
+
+	// Versions lists the versions the client will accept.
+	Versions []int64
+}
+
+// IfMatch parses an If-Match header. It returns nil when the header is
+// absent. Weak or foreign tags can never match, so they are dropped; a
+// header made only of those yields a Precondition that nothing satisfies.
+func IfMatch(header string) *Precondition {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil
+	}
+
+	if header == "*" {
+		return &Precondition{Any: true}
+	}
+
+	p := &Precondition{}
+	for _, t := range strings.Split(header, ",") {
+		if v, ok := Parse(t); ok {
+			p.Versions = append(p.Versions, v)
+		}
+	}
+	return p
+}
+
+// Allows reports whether an item at version satisfies p.
+func (p *Precondition) Allows(version int64) bool {
+	if p.Any {
+		return true
+	}
+	for _, v := range p.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// NoneMatch reports whether an If-None-Match header matches the tag for
+// version, in which case a GET should answer 304. Weak comparison is used,
+// as RFC 9110 requires for If-None-Match.
+func NoneMatch(header string, version int64) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+
+	current := Format(version)
+	for _, t := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == current {
+			return true
+		}
+	}
+	return false
+}
+
+// Condition returns a DynamoDB condition that holds only while the item's
+// version satisfies p, adding the names and values it uses. It returns ""
+// when p places no condition on the version.
+func (p *Precondition) Condition(names map[string]string, values map[string]types.AttributeValue) string {
+	if p == nil || p.Any {
+		return ""
+	}
+
+	names["#version"] = "version"
+
+	alts := []string{}
+	for i, v := range p.Versions {
+		if v == 0 {
+			alts = append(alts, "attribute_not_exists(#version)")
+			continue
+		}
+		k := ":expectedVersion" + strconv.Itoa(i)
+		values[k] = &types.AttributeValueMemberN{Value: strconv.FormatInt(v, 10)}
+		alts = append(alts, "#version = "+k)
+	}
+
+	if len(alts) == 0 {
+		// Nothing can match, but the caller should have answered 412
+		// before writing.
+		return "attribute_not_exists(#version) AND attribute_exists(#version)"
+	}
+
+	return "(" + strings.Join(alts, " OR ") + ")"
+}
+
+// Increment returns the update clause that adds one to the item's version,
+// adding the names and values it uses. Put it after any SET or REMOVE
+// clauses.
+func Increment(names map[string]string, values map[string]types.AttributeValue) string {
+	names["#version"] = "version"
+	values[":versionStep"] = &types.AttributeValueMemberN{Value: "1"}
+	return "ADD #version :versionStep"
+}
@@ -0,0 +1,225 @@
+// Package health runs the readiness checks behind the /ready endpoints.
+//
+// A lambda answering /ready should prove it can actually serve traffic, so
+// the checks touch every table the lambda uses and validate its settings.
+// Results are cached for a few seconds so a busy load balancer or uptime
+// monitor does not turn into a stream of DescribeTable calls.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+	"to_do_list_demo/internal/session"
+)
+
+const (
+	cacheTTL     = 5 * time.Second
+	checkTimeout = 2 * time.Second
+)
+
+// Status values.
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Check is one dependency or setting to verify.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// CheckResult is the outcome of one Check.
+type CheckResult struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Report is the JSON body of a /ready response.
+type Report struct {
+	Status    string                 `json:"status"`
+	Checks    map[string]CheckResult `json:"checks"`
+	CheckedAt string                 `json:"checkedAt"`
+	Cached    bool                   `json:"cached"`
+}
+
+// OK reports whether every check passed.
+func (r Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+// Checker runs a fixed set of checks and caches the report.
+type Checker struct {
+	checks []Check
+
+	mu     sync.Mutex
+	last   *Report
+	lastAt time.Time
+}
+
+// New returns a Checker for checks.
+func New(checks ...Check) *Checker {
+	return &Checker{checks: checks}
+}
+
+// Ready returns the cached report, or runs every check in parallel when the
+// cache is older than a few seconds.
+func (c *Checker) Ready(ctx context.Context) Report {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last != nil && time.Since(c.lastAt) < cacheTTL {
+		r := *c.last
+		r.Cached = true
+		return r
+	}
+
+	results := make([]CheckResult, len(c.checks))
+
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = run(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	r := Report{
+		Status:    StatusOK,
+		Checks:    make(map[string]CheckResult, len(c.checks)),
+		CheckedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	for i, check := range c.checks {
+		r.Checks[check.Name] = results[i]
+		if results[i].Status != StatusOK {
+			r.Status = StatusFail
+		}
+	}
+
+	c.last = &r
+	c.lastAt = time.Now()
+
+	return r
+}
+
+func run(ctx context.Context, check Check) CheckResult {
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Run(ctx)
+	res := CheckResult{Status: StatusOK, LatencyMs: time.Since(start).Milliseconds()}
+
+	if err != nil {
+		res.Status = StatusFail
+		res.Error = describe(err)
+	}
+
+	return res
+}
+
+// describe keeps AWS errors down to their code, so /ready does not echo
+// account ids or ARNs to whoever calls it.
+func describe(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return err.Error()
+}
+
+// Table checks that table exists, is reachable with the lambda's credentials
+// and is ACTIVE.
+func Table(db *dynamodb.Client, table string) Check {
+	return Check{
+		Name: "dynamodb:" + table,
+		Run: func(ctx context.Context) error {
+			out, err := db.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+				TableName: aws.String(table),
+			})
+			if err != nil {
+				return err
+			}
+			if out.Table.TableStatus != types.TableStatusActive {
+				return fmt.Errorf("table status %s", out.Table.TableStatus)
+			}
+			return nil
+		},
+	}
+}
+
+// SessionKey checks that session tokens can be signed and verified with the
+// configured SESSION_SECRET.
+func SessionKey() Check {
+	return Check{
+		Name: "session-key",
+		Run: func(ctx context.Context) error {
+			t, err := session.Issue("health-check", session.MethodPassword)
+			if err != nil {
+				return err
+			}
+			_, err = session.Verify(t.AccessToken)
+			return err
+		},
+	}
+}
+
+// Config wraps a configuration validator as a check.
+func Config(name string, validate func() error) Check {
+	return Check{
+		Name: "config:" + name,
+		Run: func(ctx context.Context) error {
+			return validate()
+		},
+	}
+}
+
+// Register adds the health routes under base to routes: HEAD and GET
+// base/health only report that the lambda is running, while GET base/ready
+// runs the checks and answers 503 if any of them fails.
+func (c *Checker) Register(routes *router.Router, base string) {
+	routes.Handle("HEAD", base+"/health", hello)
+	routes.Handle("GET", base+"/health", live)
+	routes.Handle("GET", base+"/ready", c.handleReady)
+}
+
+func hello(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	return respond.JSON(204, nil)
+}
+
+func live(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	return respond.JSON(200, map[string]string{"status": StatusOK})
+}
+
+func (c *Checker) handleReady(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+
+	report := c.Ready(ctx)
+	if !report.OK() {
+		log.Println("readiness error:", report.Checks)
+		return respond.JSON(503, report)
+	}
+
+	return respond.JSON(200, report)
+}
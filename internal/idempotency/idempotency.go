@@ -0,0 +1,337 @@
+// Package idempotency lets clients safely retry mutating requests by sending
+// an Idempotency-Key header.
+//
+// The first request with a key claims it in the idempotency table and its
+// response is stored there. Retries with the same key and request get the
+// stored response back without running the handler again; the same key
+// with a different query, If-Match or body is rejected. Records expire
+// through DynamoDB TTL on expiresAt.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/router"
+)
+
+const (
+	// Header is the request header carrying the client's key.
+	Header = "Idempotency-Key"
+
+	// ReplayedHeader is set on responses served from the table.
+	ReplayedHeader = "Idempotent-Replayed"
+
+	defaultTable = "To-Do-List-Idempotency"
+	defaultTTL   = 24 * time.Hour
+
+	// lockTTL is how long a claimed key blocks retries while its first
+	// request runs. After that a retry may take the key over, so a Lambda
+	// that timed out does not block the key until the record expires.
+	lockTTL = 30 * time.Second
+
+	maxKeyLength = 255
+)
+
+const (
+	statePending  = "pending"
+	stateComplete = "complete"
+)
+
+// Record is an item in the idempotency table.
+type Record struct {
+	ID            string            `dynamodbav:"idempotencyKey"`
+	Fingerprint   string            `dynamodbav:"fingerprint"`
+	State         string            `dynamodbav:"state"`
+	StatusCode    int               `dynamodbav:"statusCode,omitempty"`
+	Headers       map[string]string `dynamodbav:"headers,omitempty"`
+	ContentType   string            `dynamodbav:"contentType,omitempty"` // records stored before headers were kept
+	Body          string            `dynamodbav:"body,omitempty"`
+	LockExpiresAt int64             `dynamodbav:"lockExpiresAt"`
+	ExpiresAt     int64             `dynamodbav:"expiresAt"`
+}
+
+// Store keeps idempotency records in DynamoDB.
+type Store struct {
+	DB    *dynamodb.Client
+	Table string
+	TTL   time.Duration
+}
+
+// New returns a Store for IDEMPOTENCY_TABLE (default To-Do-List-Idempotency)
+// keeping records for IDEMPOTENCY_TTL (default 24h).
+func New(db *dynamodb.Client) *Store {
+	s := &Store{DB: db, Table: defaultTable, TTL: defaultTTL}
+	if t := os.Getenv("IDEMPOTENCY_TABLE"); t != "" {
+		s.Table = t
+	}
+	if d, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL")); err == nil && d > 0 {
+		s.TTL = d
+	}
+	return s
+}
+
+// Wrap makes a public route idempotent for requests that carry an
+// Idempotency-Key. Requests without the header are passed straight through.
+// Routes that need a signed-in caller use WrapAuth inside the auth
+// middleware instead, so unauthenticated requests never reach the table.
+//
+// Do not wrap handlers whose response carries a secret, such as a new
+// session token or API key, as the table would keep a copy of it.
+func (s *Store) Wrap(next router.Handler) router.Handler {
+	return func(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+		return s.serve(ctx, req, "", func() (events.APIGatewayV2HTTPResponse, error) {
+			return next(ctx, req)
+		})
+	}
+}
+
+// WrapAuth is Wrap for authenticated routes. Keys are scoped to the caller,
+// so two users who happen to pick the same key never see each other's
+// responses, and a retry made with a refreshed session still matches.
+func (s *Store) WrapAuth(next auth.Handler) auth.Handler {
+	return func(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+		caller := p.UserID + "\n" + p.ActorID + "\n" + p.APIKeyID
+		return s.serve(ctx, req, caller, func() (events.APIGatewayV2HTTPResponse, error) {
+			return next(ctx, req, p)
+		})
+	}
+}
+
+func (s *Store) serve(ctx context.Context, req events.APIGatewayV2HTTPRequest, caller string, next func() (events.APIGatewayV2HTTPResponse, error)) (events.APIGatewayV2HTTPResponse, error) {
+
+	key := auth.Header(req.Headers, Header)
+	if key == "" {
+		return next()
+	}
+
+	if len(key) > maxKeyLength {
+		return respond.Error(400, "Idempotency-Key must be at most 255 characters")
+	}
+
+	rec := Record{
+		ID:          hash(req.RequestContext.HTTP.Method + "\n" + req.RequestContext.HTTP.Path + "\n" + hash(caller) + "\n" + key),
+		Fingerprint: fingerprint(req),
+		State:       statePending,
+	}
+
+	claimed, err := s.claim(ctx, rec)
+	if err != nil {
+		log.Println("idempotency claim error:", err)
+		return respond.DBError(err)
+	}
+
+	if !claimed {
+		return s.replay(ctx, rec)
+	}
+
+	resp, err := next()
+
+	if err != nil || !storable(resp.StatusCode) {
+		s.release(ctx, rec.ID)
+		return resp, err
+	}
+
+	s.complete(ctx, rec.ID, resp)
+	return resp, nil
+}
+
+// storable reports whether a response with code is kept for replays.
+// Server errors, throttling, conflicts and failed preconditions depend on
+// the moment the request ran, so a retry with the same key runs the handler
+// again instead of getting the same failure back.
+func storable(code int) bool {
+	switch {
+	case code >= 500:
+		return false
+	case code == 409, code == 412, code == 429:
+		return false
+	}
+	return true
+}
+
+// claim writes rec unless a live record already holds the key.
+func (s *Store) claim(ctx context.Context, rec Record) (bool, error) {
+
+	now := time.Now()
+	rec.LockExpiresAt = now.Add(lockTTL).Unix()
+	rec.ExpiresAt = now.Add(s.TTL).Unix()
+
+	item, err := attributevalue.MarshalMap(rec)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.DB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Table),
+		Item:      item,
+		ConditionExpression: aws.String("attribute_not_exists(idempotencyKey) OR expiresAt < :now OR " +
+			"(#state = :pending AND lockExpiresAt < :now AND fingerprint = :fingerprint)"),
+		ExpressionAttributeNames: map[string]string{
+			"#state": "state",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":         &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			":pending":     &types.AttributeValueMemberS{Value: statePending},
+			":fingerprint": &types.AttributeValueMemberS{Value: rec.Fingerprint},
+		},
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// replay answers a request whose key is already claimed.
+func (s *Store) replay(ctx context.Context, rec Record) (events.APIGatewayV2HTTPResponse, error) {
+
+	result, err := s.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]types.AttributeValue{
+			"idempotencyKey": &types.AttributeValueMemberS{Value: rec.ID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		log.Println("idempotency GetItem error:", err)
+		return respond.DBError(err)
+	}
+
+	if result.Item == nil {
+		// Released between the claim and this read; the client can retry.
+		return respond.Error(409, "request with this Idempotency-Key is still in progress")
+	}
+
+	var stored Record
+	if err := attributevalue.UnmarshalMap(result.Item, &stored); err != nil {
+		log.Println("idempotency unmarshal error:", err)
+		return respond.Error(500, "unmarshal error")
+	}
+
+	if stored.Fingerprint != rec.Fingerprint {
+		return respond.Error(422, "Idempotency-Key was already used with a different request")
+	}
+
+	if stored.State != stateComplete {
+		return respond.Error(409, "request with this Idempotency-Key is still in progress")
+	}
+
+	headers := map[string]string{}
+	for k, v := range stored.Headers {
+		headers[k] = v
+	}
+	if stored.ContentType != "" && auth.Header(headers, "Content-Type") == "" {
+		headers["Content-Type"] = stored.ContentType
+	}
+	headers[ReplayedHeader] = "true"
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: stored.StatusCode,
+		Headers:    headers,
+		Body:       stored.Body,
+	}, nil
+}
+
+// complete stores resp for replays. A failure only means a retry runs the
+// handler again, so it is logged and not returned.
+func (s *Store) complete(ctx context.Context, id string, resp events.APIGatewayV2HTTPResponse) {
+
+	headers, err := attributevalue.Marshal(storedHeaders(resp.Headers))
+	if err != nil {
+		log.Println("idempotency marshal error:", err)
+		return
+	}
+
+	_, err = s.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]types.AttributeValue{
+			"idempotencyKey": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String("SET #state = :complete, statusCode = :code, headers = :headers, body = :body"),
+		ExpressionAttributeNames: map[string]string{
+			"#state": "state",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":complete": &types.AttributeValueMemberS{Value: stateComplete},
+			":code":     &types.AttributeValueMemberN{Value: strconv.Itoa(resp.StatusCode)},
+			":headers":  headers,
+			":body":     &types.AttributeValueMemberS{Value: resp.Body},
+		},
+	})
+	if err != nil {
+		log.Println("idempotency UpdateItem error:", err)
+	}
+}
+
+// storedHeaders returns the response headers kept for replays, such as
+// Content-Type, ETag and Location. Cookies are left out so the table never
+// holds a copy of one.
+func storedHeaders(h map[string]string) map[string]string {
+
+	kept := map[string]string{}
+	for k, v := range h {
+		if strings.EqualFold(k, "Set-Cookie") || strings.EqualFold(k, ReplayedHeader) {
+			continue
+		}
+		kept[k] = v
+	}
+	return kept
+}
+
+// release frees the key after a request whose response is not stored, so it
+// can be retried.
+func (s *Store) release(ctx context.Context, id string) {
+
+	_, err := s.DB.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]types.AttributeValue{
+			"idempotencyKey": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		log.Println("idempotency DeleteItem error:", err)
+	}
+}
+
+// fingerprint identifies what req asks for: its method, path, query in a
+// canonical order, If-Match and body. A query parameter such as ?force=true
+// or a different precondition makes it another request.
+func fingerprint(req events.APIGatewayV2HTTPRequest) string {
+
+	query := url.Values{}
+	for k, v := range req.QueryStringParameters {
+		query.Set(k, v)
+	}
+
+	return hash(strings.Join([]string{
+		req.RequestContext.HTTP.Method,
+		req.RequestContext.HTTP.Path,
+		query.Encode(),
+		auth.Header(req.Headers, "If-Match"),
+		req.Body,
+	}, "\n"))
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
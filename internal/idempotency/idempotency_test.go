@@ -0,0 +1,40 @@
+package idempotency
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestFingerprint(t *testing.T) {
+
+	request := func(query map[string]string, ifMatch, body string) events.APIGatewayV2HTTPRequest {
+		req := events.APIGatewayV2HTTPRequest{
+			QueryStringParameters: query,
+			Headers:               map[string]string{},
+			Body:                  body,
+		}
+		req.RequestContext.HTTP.Method = "DELETE"
+		req.RequestContext.HTTP.Path = "/api/to-do-list/mypost/items/a"
+		if ifMatch != "" {
+			req.Headers["if-match"] = ifMatch
+		}
+		return req
+	}
+
+	base := fingerprint(request(map[string]string{"scope": "this", "force": "true"}, `"3"`, ""))
+
+	if fingerprint(request(map[string]string{"force": "true", "scope": "this"}, `"3"`, "")) != base {
+		t.Error("same request fingerprinted differently")
+	}
+	for name, req := range map[string]events.APIGatewayV2HTTPRequest{
+		"query":    request(map[string]string{"scope": "following", "force": "true"}, `"3"`, ""),
+		"no query": request(nil, `"3"`, ""),
+		"If-Match": request(map[string]string{"scope": "this", "force": "true"}, `"4"`, ""),
+		"body":     request(map[string]string{"scope": "this", "force": "true"}, `"3"`, "{}"),
+	} {
+		if fingerprint(req) == base {
+			t.Errorf("different %s has the same fingerprint", name)
+		}
+	}
+}
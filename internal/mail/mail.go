@@ -0,0 +1,148 @@
+// Package mail sends transactional email such as address verification.
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers messages.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewFromEnv returns an SMTP sender when SMTP_HOST is set and a sender that
+// only logs otherwise, so lambdas keep working before mail is set up.
+func NewFromEnv() Sender {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return logSender{}
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	return &SMTPSender{
+		Addr:     net.JoinHostPort(host, port),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
+
+// ValidateEnv reports SMTP settings that NewFromEnv would accept but that
+// cannot send mail. Leaving SMTP_HOST unset is valid.
+func ValidateEnv() error {
+	if os.Getenv("SMTP_HOST") == "" {
+		return nil
+	}
+	if os.Getenv("SMTP_FROM") == "" {
+		return errors.New("mail: SMTP_HOST is set without SMTP_FROM")
+	}
+	if port := os.Getenv("SMTP_PORT"); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("mail: invalid SMTP_PORT %q", port)
+		}
+	}
+	return nil
+}
+
+// SMTPSender sends mail through an SMTP relay using STARTTLS when offered.
+// Credentials are only sent over a connection upgraded to TLS.
+type SMTPSender struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPSender) Send(ctx context.Context, msg Message) error {
+
+	deadline := time.Now().Add(dialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	conn, err := net.DialTimeout("tcp", s.Addr, time.Until(deadline))
+	if err != nil {
+		return fmt.Errorf("mail: dial: %w", err)
+	}
+	conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(s.Addr)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("mail: %w", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("mail: starttls: %w", err)
+		}
+	}
+
+	if s.Username != "" {
+		if _, ok := c.TLSConnectionState(); !ok {
+			return errors.New("mail: server did not offer STARTTLS, refusing to send credentials in clear text")
+		}
+
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return fmt.Errorf("mail: auth: %w", err)
+		}
+	}
+
+	if err := c.Mail(s.From); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		s.From, headerSafe(msg.To), headerSafe(msg.Subject), msg.Body)
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+
+	return c.Quit()
+}
+
+type logSender struct{}
+
+func (logSender) Send(ctx context.Context, msg Message) error {
+	log.Println("mail not configured, dropping message to", msg.To, "subject:", msg.Subject)
+	return nil
+}
+
+func headerSafe(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
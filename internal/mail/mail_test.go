@@ -0,0 +1,132 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTP is a plain-text SMTP server that never offers STARTTLS. It
+// records every command it receives.
+type fakeSMTP struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	commands []string
+	data     string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeSMTP{ln: ln}
+	go f.serve()
+	return f
+}
+
+func (f *fakeSMTP) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch verb {
+		case "EHLO":
+			tp.PrintfLine("250-fake")
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			body, _ := tp.ReadDotLines()
+			f.mu.Lock()
+			f.data = strings.Join(body, "\n")
+			f.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (f *fakeSMTP) sawCommand(prefix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.commands {
+		if strings.HasPrefix(strings.ToUpper(c), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSendRefusesCredentialsWithoutTLS(t *testing.T) {
+	srv := newFakeSMTP(t)
+
+	s := &SMTPSender{Addr: srv.ln.Addr().String(), Username: "user", Password: "secret", From: "app@example.com"}
+
+	err := s.Send(context.Background(), Message{To: "user@example.com", Subject: "hi", Body: "hello"})
+	if err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Fatalf("Send() error = %v, want a refusal to authenticate", err)
+	}
+
+	if srv.sawCommand("AUTH") {
+		t.Fatal("credentials were sent over a plain-text connection")
+	}
+}
+
+func TestSendWithoutCredentials(t *testing.T) {
+	srv := newFakeSMTP(t)
+
+	s := &SMTPSender{Addr: srv.ln.Addr().String(), From: "app@example.com"}
+
+	err := s.Send(context.Background(), Message{To: "user@example.com", Subject: "hi\r\nBcc: x@example.com", Body: "hello"})
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	srv.mu.Lock()
+	data := srv.data
+	srv.mu.Unlock()
+
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for sc.Scan() {
+		if strings.HasPrefix(sc.Text(), "Bcc:") {
+			t.Fatalf("header injection in message:\n%s", data)
+		}
+	}
+	if !strings.Contains(data, "hello") {
+		t.Fatalf("message body missing:\n%s", data)
+	}
+}
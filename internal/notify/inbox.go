@@ -0,0 +1,166 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/storage"
+)
+
+const defaultInboxTable = "To-Do-List-Inbox"
+
+var ErrNotFound = errors.New("notify: not found")
+
+// Entry is an item in the inbox table, one notification shown in the app.
+type Entry struct {
+	UserID         string `json:"-" dynamodbav:"userId"`
+	NotificationID string `json:"notificationId" dynamodbav:"notificationId"`
+	ItemID         string `json:"itemId" dynamodbav:"itemId"`
+	ProjectID      string `json:"projectId" dynamodbav:"projectId"`
+	Title          string `json:"title" dynamodbav:"title"`
+	Body           string `json:"body" dynamodbav:"body"`
+	DueDate        string `json:"dueDate,omitempty" dynamodbav:"dueDate,omitempty"`
+	CreatedAt      string `json:"createdAt" dynamodbav:"createdAt"`
+	Read           bool   `json:"read" dynamodbav:"read"`
+}
+
+// Inbox is the in-app channel: the inbox table, partition key "userId",
+// sort key "notificationId".
+type Inbox struct {
+	DB    *dynamodb.Client
+	Table string
+}
+
+// NewInbox returns the Inbox for INBOX_TABLE (default To-Do-List-Inbox).
+func NewInbox(db *dynamodb.Client) *Inbox {
+	i := &Inbox{DB: db, Table: defaultInboxTable}
+	if t := os.Getenv("INBOX_TABLE"); t != "" {
+		i.Table = t
+	}
+	return i
+}
+
+func (i *Inbox) key(userID, notificationID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":         &types.AttributeValueMemberS{Value: userID},
+		"notificationId": &types.AttributeValueMemberS{Value: notificationID},
+	}
+}
+
+// Notify puts n in the user's inbox. The entry is keyed by n.ID, so
+// delivering the same notification again changes nothing.
+func (i *Inbox) Notify(ctx context.Context, n Notification) error {
+
+	_, body := Text(n)
+	item, err := attributevalue.MarshalMap(Entry{
+		UserID:         n.UserID,
+		NotificationID: n.ID,
+		ItemID:         n.ItemID,
+		ProjectID:      n.ProjectID,
+		Title:          n.Title,
+		Body:           body,
+		DueDate:        n.DueDate,
+		CreatedAt:      n.SendAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = i.DB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(i.Table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(notificationId)"),
+	})
+	if storage.IsConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns a page of userID's inbox, newest first, only the unread
+// entries when unread is set.
+func (i *Inbox) List(ctx context.Context, userID string, unread bool, r pagination.Request) ([]Entry, map[string]types.AttributeValue, error) {
+
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(i.Table),
+		KeyConditionExpression: aws.String("userId = :user"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user": &types.AttributeValueMemberS{Value: userID},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if unread {
+		in.FilterExpression = aws.String("#read = :false")
+		in.ExpressionAttributeNames = map[string]string{"#read": "read"}
+		in.ExpressionAttributeValues[":false"] = &types.AttributeValueMemberBOOL{Value: false}
+	}
+
+	raw, lastKey, err := pagination.Query(ctx, i.DB, in, r, "userId", "notificationId")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := []Entry{}
+	if err := attributevalue.UnmarshalListOfMaps(raw, &entries); err != nil {
+		return nil, nil, err
+	}
+	return entries, lastKey, nil
+}
+
+// MarkRead marks an entry read or unread.
+func (i *Inbox) MarkRead(ctx context.Context, userID, notificationID string, read bool) (*Entry, error) {
+
+	out, err := i.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(i.Table),
+		Key:                       i.key(userID, notificationID),
+		UpdateExpression:          aws.String("SET #read = :read"),
+		ConditionExpression:       aws.String("attribute_exists(notificationId)"),
+		ExpressionAttributeNames:  map[string]string{"#read": "read"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":read": &types.AttributeValueMemberBOOL{Value: read}},
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if storage.IsConditionFailed(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var e Entry
+	if err := attributevalue.UnmarshalMap(out.Attributes, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Delete removes an entry.
+func (i *Inbox) Delete(ctx context.Context, userID, notificationID string) error {
+
+	_, err := i.DB.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(i.Table),
+		Key:                 i.key(userID, notificationID),
+		ConditionExpression: aws.String("attribute_exists(notificationId)"),
+	})
+	if storage.IsConditionFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// DeleteOwner empties userID's inbox, for account deletion.
+func (i *Inbox) DeleteOwner(ctx context.Context, userID string) error {
+	return storage.DeleteQueried(ctx, i.DB, &dynamodb.QueryInput{
+		TableName:              aws.String(i.Table),
+		KeyConditionExpression: aws.String("userId = :user"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user": &types.AttributeValueMemberS{Value: userID},
+		},
+	}, "userId", "notificationId")
+}
@@ -0,0 +1,187 @@
+// Package notify delivers task reminders through the channels a user
+// picked: email, a webhook of theirs, or the in-app inbox.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"to_do_list_demo/internal/mail"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// ErrNoAddress means a channel has nowhere to deliver to, such as email
+// for a user without a verified address. Trying again will not help.
+var ErrNoAddress = errors.New("notify: no address to deliver to")
+
+// Notification is one reminder going out. ID is the same every time the
+// same reminder is sent for the same due time, so receivers can drop
+// repeats.
+type Notification struct {
+	ID         string `json:"id"`
+	ItemID     string `json:"itemId"`
+	ProjectID  string `json:"projectId"`
+	ReminderID string `json:"reminderId"`
+	Title      string `json:"title"`
+	DueDate    string `json:"dueDate,omitempty"`
+	SendAt     string `json:"sendAt"`
+
+	// Where it goes. Location is the user's time zone, for the text.
+	UserID     string         `json:"-"`
+	Email      string         `json:"-"`
+	WebhookURL string         `json:"-"`
+	Location   *time.Location `json:"-"`
+}
+
+// ID returns the notification id of a reminder sent at sendAt. It sorts
+// by sendAt and is safe in a URL path.
+func ID(reminderID, sendAt string) string {
+	compact := strings.NewReplacer("-", "", ":", "").Replace(sendAt)
+	return compact + "-" + reminderID
+}
+
+// Text returns the subject and body of n for people to read.
+func Text(n Notification) (subject, body string) {
+
+	subject = "Reminder: " + n.Title
+	body = "Reminder for your task \"" + n.Title + "\"."
+
+	if due, err := time.Parse(time.RFC3339, n.DueDate); err == nil {
+		loc := n.Location
+		if loc == nil {
+			loc = time.UTC
+		}
+		body = "Your task \"" + n.Title + "\" is due " + due.In(loc).Format("Mon 2 Jan 2006 15:04 MST") + "."
+	}
+	return subject, body
+}
+
+// Notifier delivers a notification through one channel.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Email sends notifications to the user's verified email address.
+type Email struct {
+	Sender mail.Sender
+}
+
+func (e *Email) Notify(ctx context.Context, n Notification) error {
+
+	if n.Email == "" {
+		return ErrNoAddress
+	}
+
+	subject, body := Text(n)
+	return e.Sender.Send(ctx, mail.Message{To: n.Email, Subject: subject, Body: body})
+}
+
+// Webhook POSTs notifications as JSON to the URL of the reminder. Each
+// request is signed: X-Signature is "sha256=" and the hex HMAC-SHA256 of
+// X-Timestamp, ".", and the body, keyed with Secret.
+type Webhook struct {
+	Client *http.Client
+	Secret []byte
+}
+
+// NewWebhook returns a Webhook signing with WEBHOOK_SECRET. Its client
+// refuses to connect to private, loopback and link-local addresses, so a
+// webhook URL cannot reach into the network the lambda runs in.
+func NewWebhook() *Webhook {
+
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: publicOnly}
+
+	return &Webhook{
+		Client: &http.Client{
+			Timeout:   webhookTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		Secret: []byte(os.Getenv("WEBHOOK_SECRET")),
+	}
+}
+
+// ValidateWebhookEnv reports a missing WEBHOOK_SECRET.
+func ValidateWebhookEnv() error {
+	if os.Getenv("WEBHOOK_SECRET") == "" {
+		return errors.New("notify: WEBHOOK_SECRET is not set")
+	}
+	return nil
+}
+
+func publicOnly(network, address string, _ syscall.RawConn) error {
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("notify: webhook address %s is not public", host)
+	}
+	return nil
+}
+
+func (w *Webhook) Notify(ctx context.Context, n Notification) error {
+
+	if n.WebhookURL == "" {
+		return ErrNoAddress
+	}
+	if len(w.Secret) == 0 {
+		return errors.New("notify: WEBHOOK_SECRET is not set")
+	}
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", n.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Reminder-Id", n.ID)
+	req.Header.Set("X-Timestamp", ts)
+	req.Header.Set("X-Signature", "sha256="+Sign(w.Secret, ts, body))
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("notify: webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notify: webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of ts, ".", and body, keyed with secret.
+// Receivers compute the same to check a request came from us.
+func Sign(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
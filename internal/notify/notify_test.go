@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"to_do_list_demo/internal/mail"
+)
+
+type fakeSender struct {
+	sent []mail.Message
+}
+
+func (f *fakeSender) Send(ctx context.Context, msg mail.Message) error {
+	f.sent = append(f.sent, msg)
+	return nil
+}
+
+func testNotification() Notification {
+	return Notification{
+		ID:         ID("r1", "2030-01-07T08:00:00Z"),
+		ItemID:     "i1",
+		ReminderID: "r1",
+		Title:      "Weekly report",
+		DueDate:    "2030-01-07T09:00:00Z",
+		SendAt:     "2030-01-07T08:00:00Z",
+		UserID:     "u1",
+		Location:   time.FixedZone("CET", 3600),
+	}
+}
+
+func TestID(t *testing.T) {
+	if got := ID("r1", "2030-01-07T08:00:00Z"); got != "20300107T080000Z-r1" {
+		t.Errorf("ID = %q", got)
+	}
+}
+
+func TestEmail(t *testing.T) {
+
+	f := &fakeSender{}
+	e := &Email{Sender: f}
+	n := testNotification()
+
+	if err := e.Notify(context.Background(), n); !errors.Is(err, ErrNoAddress) {
+		t.Errorf("without an address: err = %v", err)
+	}
+
+	n.Email = "ada@example.com"
+	if err := e.Notify(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.sent) != 1 || f.sent[0].To != n.Email || f.sent[0].Subject != "Reminder: Weekly report" {
+		t.Fatalf("sent = %+v", f.sent)
+	}
+	if !strings.Contains(f.sent[0].Body, "Mon 7 Jan 2030 10:00 CET") {
+		t.Errorf("body = %q, want the due time in the user's zone", f.sent[0].Body)
+	}
+}
+
+func TestWebhookSigns(t *testing.T) {
+
+	secret := []byte("s3cret")
+	var got Notification
+	var valid bool
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := "sha256=" + Sign(secret, r.Header.Get("X-Timestamp"), body)
+		valid = r.Header.Get("X-Signature") == want && r.Header.Get("X-Reminder-Id") == "20300107T080000Z-r1"
+		json.Unmarshal(body, &got)
+	}))
+	defer srv.Close()
+
+	w := &Webhook{Client: srv.Client(), Secret: secret}
+	n := testNotification()
+	n.WebhookURL = srv.URL
+
+	if err := w.Notify(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Error("signature or reminder id header does not match")
+	}
+	if got.ItemID != "i1" || got.Title != "Weekly report" {
+		t.Errorf("payload = %+v", got)
+	}
+}
+
+func TestWebhookFails(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer srv.Close()
+
+	n := testNotification()
+	n.WebhookURL = srv.URL
+
+	w := &Webhook{Client: srv.Client(), Secret: []byte("s")}
+	if err := w.Notify(context.Background(), n); err == nil {
+		t.Error("a 500 answer counted as delivered")
+	}
+
+	// The default client never connects to a private address such as the
+	// test server's.
+	t.Setenv("WEBHOOK_SECRET", "s")
+	if err := NewWebhook().Notify(context.Background(), n); err == nil {
+		t.Error("webhook to a loopback address was sent")
+	}
+}
@@ -0,0 +1,203 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// clockSkew is the leeway allowed on exp and iat.
+const clockSkew = time.Minute
+
+// IDToken holds the verified claims of an ID token.
+type IDToken struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Expiry        time.Time
+}
+
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AZP           string   `json:"azp"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified flexBool `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// audience accepts both the string and array forms of aud.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(v string) bool {
+	for _, s := range a {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// flexBool accepts true/false as well as "true"/"false", which some
+// providers send for email_verified.
+type flexBool bool
+
+func (f *flexBool) UnmarshalJSON(b []byte) error {
+	switch strings.Trim(string(b), `"`) {
+	case "true":
+		*f = true
+	case "false", "null":
+		*f = false
+	default:
+		return fmt.Errorf("oidc: invalid boolean %s", b)
+	}
+	return nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// raw and returns its claims.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (*IDToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed id_token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("oidc: id_token header: %w", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("oidc: id_token signature: %w", err)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var c idTokenClaims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("oidc: id_token claims: %w", err)
+	}
+
+	now := time.Now()
+
+	switch {
+	case strings.TrimSuffix(c.Issuer, "/") != p.Issuer:
+		return nil, fmt.Errorf("oidc: unexpected issuer %q", c.Issuer)
+	case !c.Audience.contains(p.ClientID):
+		return nil, errors.New("oidc: id_token not issued for this client")
+	case len(c.Audience) > 1 && c.AZP != p.ClientID:
+		return nil, errors.New("oidc: id_token azp does not match client")
+	case c.Subject == "":
+		return nil, errors.New("oidc: id_token has no subject")
+	case now.After(time.Unix(c.Expiry, 0).Add(clockSkew)):
+		return nil, errors.New("oidc: id_token expired")
+	case time.Unix(c.IssuedAt, 0).After(now.Add(clockSkew)):
+		return nil, errors.New("oidc: id_token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(c.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("oidc: id_token nonce mismatch")
+	}
+
+	return &IDToken{
+		Issuer:        p.Issuer,
+		Subject:       c.Subject,
+		Email:         c.Email,
+		EmailVerified: bool(c.EmailVerified),
+		Name:          c.Name,
+		Expiry:        time.Unix(c.Expiry, 0),
+	}, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("oidc: unsupported id_token alg %q", alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("oidc: alg %q does not match rsa key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, sig); err != nil {
+			return errors.New("oidc: invalid id_token signature")
+		}
+
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("oidc: alg %q does not match ec key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("oidc: invalid id_token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("oidc: invalid id_token signature")
+		}
+
+	default:
+		return errors.New("oidc: unsupported signing key")
+	}
+
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
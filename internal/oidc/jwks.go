@@ -0,0 +1,163 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	jwksTTL = time.Hour
+
+	// jwksMinRefresh bounds how often an unknown kid may force a refetch, so
+	// a stream of forged tokens cannot turn into a stream of JWKS requests.
+	jwksMinRefresh = time.Minute
+)
+
+type keySet struct {
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key returns the signing key for kid, refreshing the cached JWKS when it is
+// stale or does not know kid yet.
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	k, ok := p.keys.keys[kid]
+	fetched := p.keys.keys != nil
+	age := time.Since(p.keys.fetchedAt)
+	p.mu.Unlock()
+
+	if ok && age < jwksTTL {
+		return k, nil
+	}
+
+	if !ok && fetched && age < jwksMinRefresh {
+		return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+	}
+
+	if err := p.refreshKeys(ctx); err != nil {
+		if ok {
+			// Keep verifying with the last known key if the provider is
+			// briefly unreachable.
+			return k, nil
+		}
+		return nil, err
+	}
+
+	p.mu.Lock()
+	k, ok = p.keys.keys[kid]
+	p.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+	}
+
+	return k, nil
+}
+
+func (p *Provider) refreshKeys(ctx context.Context) error {
+	d, err := p.Discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &doc); err != nil {
+		return fmt.Errorf("oidc: jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.publicKey()
+		if err != nil {
+			// Skip keys we cannot use rather than failing the whole set.
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	p.mu.Lock()
+	p.keys = keySet{keys: keys, fetchedAt: time.Now()}
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("oidc: rsa exponent out of range")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("oidc: unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("oidc: ec point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("oidc: unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
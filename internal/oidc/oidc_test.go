@@ -0,0 +1,443 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testClient = "test-client"
+	testNonce  = "test-nonce"
+)
+
+// testIssuer is a minimal OpenID provider: it serves discovery and a JWKS
+// document and can sign ID tokens with any key it publishes.
+type testIssuer struct {
+	server     *httptest.Server
+	jwksHits   atomic.Int32
+	mu         sync.Mutex
+	published  map[string]crypto.Signer
+	signingKey map[string]crypto.Signer
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	iss := &testIssuer{
+		published:  map[string]crypto.Signer{},
+		signingKey: map[string]crypto.Signer{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Discovery{
+			Issuer:                iss.server.URL,
+			AuthorizationEndpoint: iss.server.URL + "/authorize",
+			TokenEndpoint:         iss.server.URL + "/token",
+			JWKSURI:               iss.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		iss.jwksHits.Add(1)
+		json.NewEncoder(w).Encode(iss.jwks())
+	})
+
+	iss.server = httptest.NewServer(mux)
+	t.Cleanup(iss.server.Close)
+
+	return iss
+}
+
+// addKey creates a key for kid. Unpublished keys can sign tokens but are
+// missing from the JWKS document until publish is called.
+func (iss *testIssuer) addKey(t *testing.T, kid, kty string, publish bool) {
+	t.Helper()
+
+	var key crypto.Signer
+	var err error
+	switch kty {
+	case "RSA":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EC":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	iss.signingKey[kid] = key
+	if publish {
+		iss.published[kid] = key
+	}
+}
+
+func (iss *testIssuer) publish(kid string) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.published[kid] = iss.signingKey[kid]
+}
+
+func (iss *testIssuer) jwks() map[string][]jwk {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	var keys []jwk
+	for kid, key := range iss.published {
+		switch k := key.Public().(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, jwk{
+				Kid: kid, Kty: "RSA", Use: "sig",
+				N: b64(k.N.Bytes()),
+				E: b64(big.NewInt(int64(k.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			keys = append(keys, jwk{
+				Kid: kid, Kty: "EC", Use: "sig", Crv: "P-256",
+				X: b64(k.X.FillBytes(make([]byte, 32))),
+				Y: b64(k.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+
+	return map[string][]jwk{"keys": keys}
+}
+
+// sign returns an ID token for claims signed with kid.
+func (iss *testIssuer) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+
+	iss.mu.Lock()
+	key := iss.signingKey[kid]
+	iss.mu.Unlock()
+
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(payload)
+
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signingInput + "." + b64(sig)
+}
+
+// claims returns a valid claim set for the test client, changed by edit.
+func (iss *testIssuer) claims(edit func(c map[string]any)) map[string]any {
+	now := time.Now()
+	c := map[string]any{
+		"iss":            iss.server.URL,
+		"sub":            "subject-1",
+		"aud":            testClient,
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          "user@example.com",
+		"email_verified": true,
+	}
+	if edit != nil {
+		edit(c)
+	}
+	return c
+}
+
+func (iss *testIssuer) provider() *Provider {
+	return &Provider{
+		Issuer:      iss.server.URL,
+		ClientID:    testClient,
+		RedirectURL: "https://app.example.com/callback",
+		HTTPClient:  iss.server.Client(),
+	}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addKey(t, "rsa-1", "RSA", true)
+	iss.addKey(t, "ec-1", "EC", true)
+
+	tests := []struct {
+		name    string
+		kid     string
+		edit    func(c map[string]any)
+		nonce   string
+		wantErr string
+	}{
+		{name: "RS256", kid: "rsa-1"},
+		{name: "ES256", kid: "ec-1"},
+		{
+			name: "audience list with azp",
+			kid:  "rsa-1",
+			edit: func(c map[string]any) { c["aud"] = []string{testClient, "other"}; c["azp"] = testClient },
+		},
+		{
+			name:    "wrong audience",
+			kid:     "rsa-1",
+			edit:    func(c map[string]any) { c["aud"] = "other-client" },
+			wantErr: "not issued for this client",
+		},
+		{
+			name:    "audience list with wrong azp",
+			kid:     "ec-1",
+			edit:    func(c map[string]any) { c["aud"] = []string{testClient, "other"}; c["azp"] = "other" },
+			wantErr: "azp does not match",
+		},
+		{
+			name:    "audience list without azp",
+			kid:     "rsa-1",
+			edit:    func(c map[string]any) { c["aud"] = []string{testClient, "other"} },
+			wantErr: "azp does not match",
+		},
+		{
+			name:    "wrong issuer",
+			kid:     "rsa-1",
+			edit:    func(c map[string]any) { c["iss"] = "https://evil.example.com" },
+			wantErr: "unexpected issuer",
+		},
+		{
+			name:    "expired",
+			kid:     "rsa-1",
+			edit:    func(c map[string]any) { c["exp"] = time.Now().Add(-2 * clockSkew).Unix() },
+			wantErr: "expired",
+		},
+		{
+			name: "expired within clock skew",
+			kid:  "ec-1",
+			edit: func(c map[string]any) { c["exp"] = time.Now().Add(-clockSkew / 2).Unix() },
+		},
+		{
+			name:    "issued in the future",
+			kid:     "rsa-1",
+			edit:    func(c map[string]any) { c["iat"] = time.Now().Add(2 * clockSkew).Unix() },
+			wantErr: "issued in the future",
+		},
+		{
+			name:    "nonce mismatch",
+			kid:     "rsa-1",
+			nonce:   "another-nonce",
+			wantErr: "nonce mismatch",
+		},
+		{
+			name:    "missing nonce",
+			kid:     "ec-1",
+			edit:    func(c map[string]any) { delete(c, "nonce") },
+			wantErr: "nonce mismatch",
+		},
+		{
+			name:    "no subject",
+			kid:     "rsa-1",
+			edit:    func(c map[string]any) { c["sub"] = "" },
+			wantErr: "no subject",
+		},
+	}
+
+	p := iss.provider()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nonce := tt.nonce
+			if nonce == "" {
+				nonce = testNonce
+			}
+
+			tok, err := p.VerifyIDToken(context.Background(), iss.sign(t, tt.kid, iss.claims(tt.edit)), nonce)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("VerifyIDToken() error = %v", err)
+				}
+				if tok.Subject != "subject-1" || tok.Email != "user@example.com" || !tok.EmailVerified {
+					t.Fatalf("VerifyIDToken() = %+v", tok)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("VerifyIDToken() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenRejectsForgedSignatures(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addKey(t, "rsa-1", "RSA", true)
+	iss.addKey(t, "ec-1", "EC", true)
+
+	p := iss.provider()
+	ctx := context.Background()
+
+	raw := iss.sign(t, "rsa-1", iss.claims(nil))
+	parts := strings.Split(raw, ".")
+
+	otherClaims, _ := json.Marshal(iss.claims(func(c map[string]any) { c["sub"] = "admin" }))
+	if _, err := p.VerifyIDToken(ctx, parts[0]+"."+b64(otherClaims)+"."+parts[2], testNonce); err == nil {
+		t.Fatal("accepted a token with a swapped payload")
+	}
+
+	// An EC signature presented under the RSA key id.
+	ec := strings.Split(iss.sign(t, "ec-1", iss.claims(nil)), ".")
+	if _, err := p.VerifyIDToken(ctx, parts[0]+"."+parts[1]+"."+ec[2], testNonce); err == nil {
+		t.Fatal("accepted a signature made with another key")
+	}
+
+	none, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa-1"})
+	if _, err := p.VerifyIDToken(ctx, b64(none)+"."+parts[1]+".", testNonce); err == nil {
+		t.Fatal("accepted alg none")
+	}
+}
+
+func TestUnknownKeyRefetchIsRateLimited(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addKey(t, "old", "RSA", true)
+	iss.addKey(t, "new", "EC", false)
+
+	p := iss.provider()
+	ctx := context.Background()
+
+	if _, err := p.VerifyIDToken(ctx, iss.sign(t, "old", iss.claims(nil)), testNonce); err != nil {
+		t.Fatal(err)
+	}
+	if got := iss.jwksHits.Load(); got != 1 {
+		t.Fatalf("jwks fetched %d times, want 1", got)
+	}
+
+	// The provider rotates to a key the cached set does not know. Right
+	// after a fetch, unknown kids must not trigger another one.
+	iss.publish("new")
+	newToken := iss.sign(t, "new", iss.claims(nil))
+
+	for range 5 {
+		if _, err := p.VerifyIDToken(ctx, newToken, testNonce); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+			t.Fatalf("VerifyIDToken() error = %v, want unknown signing key", err)
+		}
+	}
+	if got := iss.jwksHits.Load(); got != 1 {
+		t.Fatalf("jwks fetched %d times within the refresh interval, want 1", got)
+	}
+
+	// Once the minimum interval has passed, the unknown kid refetches the
+	// set and the rotated key is accepted.
+	p.mu.Lock()
+	p.keys.fetchedAt = time.Now().Add(-jwksMinRefresh - time.Second)
+	p.mu.Unlock()
+
+	if _, err := p.VerifyIDToken(ctx, newToken, testNonce); err != nil {
+		t.Fatalf("VerifyIDToken() after refresh interval error = %v", err)
+	}
+	if got := iss.jwksHits.Load(); got != 2 {
+		t.Fatalf("jwks fetched %d times, want 2", got)
+	}
+
+	// Known keys keep verifying from the cache.
+	if _, err := p.VerifyIDToken(ctx, iss.sign(t, "old", iss.claims(nil)), testNonce); err != nil {
+		t.Fatal(err)
+	}
+	if got := iss.jwksHits.Load(); got != 2 {
+		t.Fatalf("jwks fetched %d times for a cached key, want 2", got)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	iss := newTestIssuer(t)
+	p := iss.provider()
+
+	raw, err := p.AuthCodeURL(context.Background(), "state-1", testNonce, "challenge-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"client_id=" + testClient, "state=state-1", "nonce=" + testNonce, "code_challenge=challenge-1", "code_challenge_method=S256"} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("AuthCodeURL() = %s, missing %s", raw, want)
+		}
+	}
+}
+
+func TestDiscoverRejectsIssuerMismatch(t *testing.T) {
+	iss := newTestIssuer(t)
+	p := iss.provider()
+	p.Issuer = "https://other.example.com"
+	p.HTTPClient = &http.Client{Transport: rewriteHost{to: iss.server.URL, next: iss.server.Client().Transport}}
+
+	if _, err := p.Discover(context.Background()); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("Discover() error = %v, want issuer mismatch", err)
+	}
+}
+
+// rewriteHost sends every request to the test server, whatever its host.
+type rewriteHost struct {
+	to   string
+	next http.RoundTripper
+}
+
+func (rt rewriteHost) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.URL.Scheme = "http"
+	r.URL.Host = strings.TrimPrefix(rt.to, "http://")
+	return rt.next.RoundTrip(r)
+}
+
+func TestChallenge(t *testing.T) {
+	// RFC 7636, appendix B.
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const want = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if got := Challenge(verifier); got != want {
+		t.Fatalf("Challenge() = %s, want %s", got, want)
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	v, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RFC 7636 requires 43 to 128 characters from the unreserved set.
+	if len(v) != 43 {
+		t.Fatalf("len(NewVerifier()) = %d, want 43", len(v))
+	}
+	if strings.ContainsAny(v, "+/=") {
+		t.Fatalf("NewVerifier() = %q is not base64url without padding", v)
+	}
+}
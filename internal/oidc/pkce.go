@@ -0,0 +1,28 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// RandomString returns n bytes of crypto randomness, base64url encoded. It is
+// used for state, nonce and PKCE verifiers.
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewVerifier returns a PKCE code verifier (43 characters, RFC 7636).
+func NewVerifier() (string, error) {
+	return RandomString(32)
+}
+
+// Challenge derives the S256 code challenge for verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,204 @@
+// Package pagination implements the limit and cursor query parameters and
+// the {items, nextCursor} envelope shared by every list endpoint.
+//
+// A cursor wraps the LastEvaluatedKey of a Query or Scan. It is signed with
+// a key derived from SESSION_SECRET and bound to the list it came from, so
+// clients cannot edit a cursor to start reading from someone else's items.
+// Cursors are opaque: clients must pass them back unchanged.
+package pagination
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/respond"
+	"to_do_list_demo/internal/session"
+)
+
+const (
+	DefaultLimit = 25
+	MaxLimit     = 100
+)
+
+var (
+	ErrInvalidLimit  = errors.New("pagination: invalid limit")
+	ErrInvalidCursor = errors.New("pagination: invalid cursor")
+)
+
+// Page is the response body of a list endpoint. NextCursor is empty on the
+// last page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Request is a parsed limit and cursor.
+type Request struct {
+	Limit int32
+
+	// StartKey is the ExclusiveStartKey to continue from, nil on the first
+	// page.
+	StartKey map[string]types.AttributeValue
+}
+
+// Parse reads the limit and cursor query parameters. scope names the list
+// being read, including whose list it is, and must be the same value passed
+// to Next when the cursor was made.
+func Parse(q map[string]string, scope string) (Request, error) {
+
+	r := Request{Limit: DefaultLimit}
+
+	if s := q["limit"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return Request{}, ErrInvalidLimit
+		}
+		r.Limit = int32(min(n, MaxLimit))
+	}
+
+	if c := q["cursor"]; c != "" {
+		key, err := decode(c, scope)
+		if err != nil {
+			return Request{}, err
+		}
+		r.StartKey = key
+	}
+
+	return r, nil
+}
+
+// Next returns the cursor for the page after the one that ended at
+// lastEvaluatedKey, or "" when there is none.
+func Next(lastEvaluatedKey map[string]types.AttributeValue, scope string) (string, error) {
+
+	if len(lastEvaluatedKey) == 0 {
+		return "", nil
+	}
+
+	key := map[string]attr{}
+	for name, v := range lastEvaluatedKey {
+		switch v := v.(type) {
+		case *types.AttributeValueMemberS:
+			key[name] = attr{S: &v.Value}
+		case *types.AttributeValueMemberN:
+			key[name] = attr{N: &v.Value}
+		case *types.AttributeValueMemberB:
+			key[name] = attr{B: v.Value}
+		default:
+			return "", errors.New("pagination: unsupported key attribute " + name)
+		}
+	}
+
+	payload, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+
+	mac, err := sign(scope, payload)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// ErrorResponse answers a failed Parse or Next: 400 for a bad limit or
+// cursor, 500 for anything else.
+func ErrorResponse(err error) (events.APIGatewayV2HTTPResponse, error) {
+
+	switch {
+	case errors.Is(err, ErrInvalidLimit):
+		return respond.Error(400, "invalid limit")
+	case errors.Is(err, ErrInvalidCursor):
+		return respond.Error(400, "invalid cursor")
+	default:
+		log.Println("pagination error:", err)
+		return respond.Error(500, "pagination error")
+	}
+}
+
+// attr is the JSON form of a key attribute. Keys are only ever strings,
+// numbers or binary.
+type attr struct {
+	S *string `json:"S,omitempty"`
+	N *string `json:"N,omitempty"`
+	B []byte  `json:"B,omitempty"`
+}
+
+func decode(cursor, scope string) (map[string]types.AttributeValue, error) {
+
+	p, m, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	got, err := base64.RawURLEncoding.DecodeString(m)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	want, err := sign(scope, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(got, want) {
+		return nil, ErrInvalidCursor
+	}
+
+	var key map[string]attr
+	if err := json.Unmarshal(payload, &key); err != nil || len(key) == 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	start := make(map[string]types.AttributeValue, len(key))
+	for name, a := range key {
+		switch {
+		case a.S != nil:
+			start[name] = &types.AttributeValueMemberS{Value: *a.S}
+		case a.N != nil:
+			start[name] = &types.AttributeValueMemberN{Value: *a.N}
+		case a.B != nil:
+			start[name] = &types.AttributeValueMemberB{Value: a.B}
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	return start, nil
+}
+
+// sign MACs scope and payload with a key derived from SESSION_SECRET, so
+// cursors need no secret of their own but can never pass as session tokens.
+func sign(scope string, payload []byte) ([]byte, error) {
+
+	secret := os.Getenv("SESSION_SECRET")
+	if len(secret) < session.MinSecretLength {
+		return nil, session.ErrNoSecret
+	}
+
+	kdf := hmac.New(sha256.New, []byte(secret))
+	kdf.Write([]byte("to-do-list pagination cursor"))
+
+	mac := hmac.New(sha256.New, kdf.Sum(nil))
+	mac.Write([]byte(scope))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+
+	return mac.Sum(nil), nil
+}
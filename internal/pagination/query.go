@@ -0,0 +1,109 @@
+package pagination
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// Filtered reads get up to filteredPageSize items per call and stop
+	// after maxQueryPages calls or when less than queryReserve of the
+	// invocation is left, returning what they found with a key to continue.
+	filteredPageSize = 200
+	maxQueryPages    = 20
+	queryReserve     = 2 * time.Second
+)
+
+// Query runs in, a Query starting at r.StartKey, until it has r.Limit
+// items or the results end, and returns the items with the key to continue
+// after the last one. keyNames are the attributes of the table key and, for
+// an index, of the index key; they make up the key when a page is cut short.
+//
+// Without a FilterExpression this is a single Query. With one, DynamoDB
+// counts filtered-out items against Limit, so more pages are read to fill
+// the page.
+func Query(ctx context.Context, db *dynamodb.Client, in *dynamodb.QueryInput, r Request, keyNames ...string) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+
+	filtered := in.FilterExpression != nil
+	in.Limit = pageLimit(r, filtered)
+	return fill(ctx, r, filtered, keyNames, func(start map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		in.ExclusiveStartKey = start
+		result, err := db.Query(ctx, in)
+		if err != nil {
+			return nil, nil, err
+		}
+		return result.Items, result.LastEvaluatedKey, nil
+	})
+}
+
+// Scan is Query for a Scan.
+func Scan(ctx context.Context, db *dynamodb.Client, in *dynamodb.ScanInput, r Request, keyNames ...string) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+
+	filtered := in.FilterExpression != nil
+	in.Limit = pageLimit(r, filtered)
+	return fill(ctx, r, filtered, keyNames, func(start map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		in.ExclusiveStartKey = start
+		result, err := db.Scan(ctx, in)
+		if err != nil {
+			return nil, nil, err
+		}
+		return result.Items, result.LastEvaluatedKey, nil
+	})
+}
+
+// pageLimit is the Limit of each call: the page size, or more for a
+// filtered read.
+func pageLimit(r Request, filtered bool) *int32 {
+	if filtered {
+		return aws.Int32(max(r.Limit, filteredPageSize))
+	}
+	return aws.Int32(r.Limit)
+}
+
+// fill calls read from r.StartKey on, each time after the key the call
+// before ended at, until it has r.Limit items, as Query describes.
+func fill(ctx context.Context, r Request, filtered bool, keyNames []string, read func(start map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error)) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+
+	var items []map[string]types.AttributeValue
+	lastKey := r.StartKey
+
+	for pages := 0; ; pages++ {
+		page, next, err := read(lastKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		items = append(items, page...)
+		lastKey = next
+
+		if !filtered || int32(len(items)) >= r.Limit || len(lastKey) == 0 || pages+1 >= maxQueryPages || !timeLeft(ctx) {
+			break
+		}
+	}
+
+	// A page can match more items than were asked for. The rest are picked
+	// up again by continuing after the last item returned.
+	if int32(len(items)) > r.Limit {
+		items = items[:r.Limit]
+		last := items[len(items)-1]
+
+		lastKey = map[string]types.AttributeValue{}
+		for _, name := range keyNames {
+			if v, ok := last[name]; ok {
+				lastKey[name] = v
+			}
+		}
+	}
+
+	return items, lastKey, nil
+}
+
+// timeLeft reports whether the invocation has time for another page.
+func timeLeft(ctx context.Context) bool {
+	d, ok := ctx.Deadline()
+	return !ok || time.Until(d) > queryReserve
+}
@@ -0,0 +1,57 @@
+// Package respond builds the JSON responses the lambdas return to API
+// Gateway, so every lambda answers errors in the same shape.
+package respond
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"to_do_list_demo/internal/storage"
+)
+
+// JSON returns body as a JSON response with status code. A body that cannot
+// be marshalled becomes a 500.
+func JSON(code int, body any) (events.APIGatewayV2HTTPResponse, error) {
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		log.Println("json marshal error:", err)
+
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: 500,
+			Headers: map[string]string{
+				"Content-Type": "application/json",
+			},
+			Body: `{"error":"json marshal failed"}`,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: code,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(jsonBody),
+	}, nil
+}
+
+// Error returns {"error": msg} with status code.
+func Error(code int, msg string) (events.APIGatewayV2HTTPResponse, error) {
+	return JSON(code, map[string]string{"error": msg})
+}
+
+// DBError answers a failed DynamoDB call with the status storage maps it to.
+// Throttled and unavailable responses tell the client when to retry.
+func DBError(err error) (events.APIGatewayV2HTTPResponse, error) {
+
+	code, msg := storage.Status(err)
+
+	resp, rerr := Error(code, msg)
+	if code == 429 || code == 503 {
+		resp.Headers["Retry-After"] = "1"
+	}
+
+	return resp, rerr
+}
@@ -0,0 +1,191 @@
+// Package router matches API Gateway requests against path patterns such as
+// "/api/to-do-list/mypost/admin/users/{userId}".
+package router
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"to_do_list_demo/internal/respond"
+)
+
+// Handler handles a matched request.
+type Handler func(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error)
+
+type route struct {
+	method   string
+	segments []string
+	handler  Handler
+}
+
+// Router is a list of routes, matched in the order they were added.
+type Router struct {
+	routes []route
+}
+
+// Handle registers h for method and pattern. A pattern segment written as
+// {name} matches any single non-empty path segment.
+func (r *Router) Handle(method, pattern string, h Handler) {
+	r.routes = append(r.routes, route{
+		method:   method,
+		segments: split(pattern),
+		handler:  h,
+	})
+}
+
+// Match finds the handler for method and path. Path parameters are returned
+// by name. When the path is known but not for method, the handler is nil and
+// allowed lists the methods the path does accept.
+//
+// When several patterns match, only the most specific ones count: a literal
+// segment beats a {name} segment, so ".../labels/health" is not taken for a
+// label id.
+func (r *Router) Match(method, path string) (h Handler, params map[string]string, allowed []string) {
+
+	for _, m := range r.matches(path) {
+		if m.route.method == method {
+			return m.route.handler, m.params, nil
+		}
+
+		allowed = append(allowed, m.route.method)
+	}
+
+	return nil, nil, allowed
+}
+
+type matched struct {
+	route  route
+	params map[string]string
+}
+
+// matches returns the routes whose pattern is the most specific one
+// matching path, in registration order.
+func (r *Router) matches(path string) []matched {
+
+	segments := split(path)
+
+	var best []matched
+	for _, rt := range r.routes {
+		p, ok := match(rt.segments, segments)
+		if !ok {
+			continue
+		}
+
+		if len(best) > 0 {
+			switch c := compareSpecificity(rt.segments, best[0].route.segments); {
+			case c < 0:
+				continue
+			case c > 0:
+				best = nil
+			}
+		}
+		best = append(best, matched{route: rt, params: p})
+	}
+
+	return best
+}
+
+// compareSpecificity compares two patterns matching the same path. At the
+// first segment where one has a literal and the other a {name}, the literal
+// one is more specific.
+func compareSpecificity(a, b []string) int {
+	for i := range a {
+		pa, pb := isParam(a[i]), isParam(b[i])
+		switch {
+		case pa && !pb:
+			return -1
+		case !pa && pb:
+			return 1
+		}
+	}
+	return 0
+}
+
+func isParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// Serve runs the handler matching req. A path no route knows gets 404; a
+// known path called with another method gets 405 and an Allow header listing
+// the methods it does accept, the same list a CORS preflight is given.
+func (r *Router) Serve(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+
+	log.Println("request:", req.RequestContext.HTTP.Method, req.RequestContext.HTTP.Path)
+
+	h, params, allowed := r.Match(req.RequestContext.HTTP.Method, req.RequestContext.HTTP.Path)
+	if h == nil {
+		if len(allowed) == 0 {
+			return respond.Error(404, "not found")
+		}
+
+		resp, err := respond.Error(405, "method not allowed")
+		resp.Headers["Allow"] = Allow(allowed)
+		return resp, err
+	}
+
+	req.PathParameters = params
+	return h(ctx, req)
+}
+
+// Allow formats methods for an Allow header. OPTIONS is always included, as
+// every known path answers CORS preflights.
+func Allow(methods []string) string {
+
+	seen := map[string]bool{}
+	var out []string
+	for _, m := range append(methods, http.MethodOptions) {
+		if !seen[m] {
+			seen[m] = true
+			out = append(out, m)
+		}
+	}
+
+	return strings.Join(out, ",")
+}
+
+// Methods returns every method registered for path, in registration order.
+func (r *Router) Methods(path string) []string {
+
+	var methods []string
+	for _, m := range r.matches(path) {
+		methods = append(methods, m.route.method)
+	}
+
+	return methods
+}
+
+func match(pattern, segments []string) (map[string]string, bool) {
+
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+
+	var params map[string]string
+
+	for i, p := range pattern {
+		if isParam(p) {
+			if segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[p[1:len(p)-1]] = segments[i]
+			continue
+		}
+
+		if p != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+func split(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
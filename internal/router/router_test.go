@@ -0,0 +1,55 @@
+package router
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func named(name string) Handler {
+	return func(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+		return events.APIGatewayV2HTTPResponse{StatusCode: 200, Body: name + " " + req.PathParameters["labelId"]}, nil
+	}
+}
+
+func TestServePrefersLiteralSegments(t *testing.T) {
+	var r Router
+	r.Handle("GET", "/labels/{labelId}", named("get"))
+	r.Handle("PATCH", "/labels/{labelId}", named("patch"))
+	r.Handle("GET", "/labels/health", named("health"))
+
+	tests := []struct {
+		method, path string
+		code         int
+		body, allow  string
+	}{
+		{"GET", "/labels/health", 200, "health ", ""},
+		{"GET", "/labels/abc", 200, "get abc", ""},
+		{"PATCH", "/labels/abc", 200, "patch abc", ""},
+		{"PATCH", "/labels/health", 405, "", "GET,OPTIONS"},
+		{"DELETE", "/labels/abc", 405, "", "GET,PATCH,OPTIONS"},
+		{"GET", "/nothing", 404, "", ""},
+	}
+
+	for _, tt := range tests {
+		var req events.APIGatewayV2HTTPRequest
+		req.RequestContext.HTTP.Method = tt.method
+		req.RequestContext.HTTP.Path = tt.path
+
+		resp, err := r.Serve(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.code)
+		}
+		if tt.body != "" && resp.Body != tt.body {
+			t.Errorf("%s %s ran %q, want %q", tt.method, tt.path, resp.Body, tt.body)
+		}
+		if got := resp.Headers["Allow"]; got != tt.allow {
+			t.Errorf("%s %s Allow = %q, want %q", tt.method, tt.path, got, tt.allow)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Package rrule reads the part of RFC 5545 recurrence rules that recurring
+// tasks use: FREQ=DAILY, WEEKLY or MONTHLY with INTERVAL, BYDAY and COUNT
+// or UNTIL, and works out the occurrence that follows another one.
+package rrule
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Freq is how often a rule repeats.
+type Freq int
+
+const (
+	Daily Freq = iota + 1
+	Weekly
+	Monthly
+)
+
+var freqNames = map[Freq]string{Daily: "DAILY", Weekly: "WEEKLY", Monthly: "MONTHLY"}
+
+const (
+	maxInterval = 999
+	maxCount    = 1000
+
+	// maxPeriods is how many days, weeks or months Next looks ahead before
+	// it gives up on a rule that never matches, like the 31st of February.
+	maxPeriods = 1000
+)
+
+var dayNames = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// Day is one BYDAY entry. N is 0 for every such weekday, 1..5 for the
+// first to fifth of the month and -1..-5 for the last to fifth last. Only
+// monthly rules take an N.
+type Day struct {
+	Weekday time.Weekday
+	N       int
+}
+
+func (d Day) String() string {
+	if d.N == 0 {
+		return dayNames[d.Weekday]
+	}
+	return strconv.Itoa(d.N) + dayNames[d.Weekday]
+}
+
+// Rule is a parsed recurrence rule. Until is the zero time without an
+// end date; a date without a time (UntilDate) ends the rule after that
+// day wherever the occurrences are.
+type Rule struct {
+	Freq      Freq
+	Interval  int
+	ByDay     []Day
+	Count     int
+	Until     time.Time
+	UntilDate bool
+}
+
+// Parse reads a rule such as "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH;COUNT=10",
+// with or without the "RRULE:" in front. Parts other than FREQ, INTERVAL,
+// BYDAY, COUNT and UNTIL are refused rather than ignored.
+func Parse(s string) (*Rule, error) {
+
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, "RRULE:")
+	if s == "" {
+		return nil, errors.New("empty rule")
+	}
+
+	r := &Rule{Interval: 1}
+	seen := map[string]bool{}
+
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("%q is not KEY=VALUE", part)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%s given twice", key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "FREQ":
+			for f, name := range freqNames {
+				if value == name {
+					r.Freq = f
+				}
+			}
+			if r.Freq == 0 {
+				return nil, fmt.Errorf("FREQ must be DAILY, WEEKLY or MONTHLY")
+			}
+
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxInterval {
+				return nil, fmt.Errorf("INTERVAL must be between 1 and %d", maxInterval)
+			}
+			r.Interval = n
+
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxCount {
+				return nil, fmt.Errorf("COUNT must be between 1 and %d", maxCount)
+			}
+			r.Count = n
+
+		case "UNTIL":
+			if t, err := time.Parse("20060102T150405Z", value); err == nil {
+				r.Until = t
+			} else if t, err := time.Parse("20060102", value); err == nil {
+				r.Until, r.UntilDate = t, true
+			} else {
+				return nil, fmt.Errorf("UNTIL must be a date (20261231) or a UTC time (20261231T170000Z)")
+			}
+
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				d, err := parseDay(v)
+				if err != nil {
+					return nil, err
+				}
+				if !slices.Contains(r.ByDay, d) {
+					r.ByDay = append(r.ByDay, d)
+				}
+			}
+
+		default:
+			return nil, fmt.Errorf("%s is not supported", key)
+		}
+	}
+
+	if r.Freq == 0 {
+		return nil, errors.New("FREQ is required")
+	}
+	if r.Count > 0 && !r.Until.IsZero() {
+		return nil, errors.New("COUNT and UNTIL cannot both be given")
+	}
+	for _, d := range r.ByDay {
+		if d.N != 0 && r.Freq != Monthly {
+			return nil, fmt.Errorf("BYDAY=%s needs FREQ=MONTHLY", d)
+		}
+	}
+
+	slices.SortFunc(r.ByDay, func(a, b Day) int {
+		if a.N != b.N {
+			return a.N - b.N
+		}
+		return int(a.Weekday) - int(b.Weekday)
+	})
+	return r, nil
+}
+
+func parseDay(v string) (Day, error) {
+
+	if len(v) < 2 {
+		return Day{}, fmt.Errorf("BYDAY %q is not a day such as MO or -1FR", v)
+	}
+
+	d := Day{Weekday: -1}
+	for i, name := range dayNames {
+		if strings.HasSuffix(v, name) {
+			d.Weekday = time.Weekday(i)
+		}
+	}
+	if d.Weekday < 0 {
+		return Day{}, fmt.Errorf("BYDAY %q is not a day such as MO or -1FR", v)
+	}
+
+	if n := v[:len(v)-2]; n != "" {
+		var err error
+		if d.N, err = strconv.Atoi(n); err != nil || d.N == 0 || d.N < -5 || d.N > 5 {
+			return Day{}, fmt.Errorf("BYDAY %q: the number must be 1 to 5 or -1 to -5", v)
+		}
+	}
+	return d, nil
+}
+
+// String returns r in the canonical form Parse reads back.
+func (r *Rule) String() string {
+
+	parts := []string{"FREQ=" + freqNames[r.Freq]}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, d := range r.ByDay {
+			days[i] = d.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.UntilDate {
+		parts = append(parts, "UNTIL="+r.Until.Format("20060102"))
+	} else if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Next returns the occurrence after prev, the n-th one of the series. The
+// next occurrence is on a later day at the same wall clock time in prev's
+// location, so it stays at 9:00 across daylight saving changes. ok is false
+// once the series is over.
+func (r *Rule) Next(prev time.Time, n int) (next time.Time, ok bool) {
+
+	if r.Count > 0 && n >= r.Count {
+		return time.Time{}, false
+	}
+
+	next, ok = r.after(prev)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if r.UntilDate {
+		y, m, d := next.Date()
+		if time.Date(y, m, d, 0, 0, 0, 0, time.UTC).After(r.Until) {
+			return time.Time{}, false
+		}
+	} else if !r.Until.IsZero() && next.After(r.Until) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// after returns the first time after t the rule matches.
+func (r *Rule) after(t time.Time) (time.Time, bool) {
+
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+	}
+	y, m, d := t.Date()
+
+	switch r.Freq {
+	case Daily:
+		for k := 1; k <= maxPeriods; k++ {
+			c := at(y, m, d+k*r.Interval)
+			if r.matchesDay(c) {
+				return c, true
+			}
+		}
+
+	case Weekly:
+		days := []time.Weekday{t.Weekday()}
+		if len(r.ByDay) > 0 {
+			days = days[:0]
+			for _, bd := range r.ByDay {
+				days = append(days, bd.Weekday)
+			}
+		}
+		// Weeks start on Monday (WKST=MO).
+		slices.SortFunc(days, func(a, b time.Weekday) int { return mondayFirst(a) - mondayFirst(b) })
+
+		monday := d - mondayFirst(t.Weekday())
+		for k := 0; k <= maxPeriods; k++ {
+			for _, wd := range days {
+				if c := at(y, m, monday+7*k*r.Interval+mondayFirst(wd)); c.After(t) {
+					return c, true
+				}
+			}
+		}
+
+	case Monthly:
+		for k := 0; k <= maxPeriods; k++ {
+			first := time.Date(y, m+time.Month(k*r.Interval), 1, 0, 0, 0, 0, time.UTC)
+			for _, day := range r.monthDays(first.Year(), first.Month(), d) {
+				if c := at(first.Year(), first.Month(), day); c.After(t) {
+					return c, true
+				}
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// matchesDay reports whether a daily rule's BYDAY lets t through.
+func (r *Rule) matchesDay(t time.Time) bool {
+
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, bd := range r.ByDay {
+		if bd.Weekday == t.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// monthDays returns the days of month m a monthly rule falls on, in
+// order. Without BYDAY that is day, the day of the month the series is on,
+// and nothing in months too short for it.
+func (r *Rule) monthDays(y int, m time.Month, day int) []int {
+
+	last := time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+
+	if len(r.ByDay) == 0 {
+		if day > last {
+			return nil
+		}
+		return []int{day}
+	}
+
+	firstWeekday := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC).Weekday()
+
+	var days []int
+	for _, bd := range r.ByDay {
+		first := 1 + (int(bd.Weekday)-int(firstWeekday)+7)%7
+
+		var all []int
+		for d := first; d <= last; d += 7 {
+			all = append(all, d)
+		}
+
+		switch {
+		case bd.N == 0:
+			days = append(days, all...)
+		case bd.N > 0 && bd.N <= len(all):
+			days = append(days, all[bd.N-1])
+		case bd.N < 0 && -bd.N <= len(all):
+			days = append(days, all[len(all)+bd.N])
+		}
+	}
+
+	slices.Sort(days)
+	return slices.Compact(days)
+}
+
+// mondayFirst numbers the days of the week from Monday = 0.
+func mondayFirst(wd time.Weekday) int {
+	return (int(wd) + 6) % 7
+}
@@ -0,0 +1,138 @@
+package rrule
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, s string) *Rule {
+	t.Helper()
+
+	r, err := Parse(s)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", s, err)
+	}
+	return r
+}
+
+// series returns the first n occurrences of s starting at start, which
+// counts as the first.
+func series(t *testing.T, s string, start time.Time, n int) []string {
+	t.Helper()
+
+	r := mustParse(t, s)
+	got := []string{start.Format("2006-01-02 15:04")}
+	for prev := start; len(got) < n; {
+		next, ok := r.Next(prev, len(got))
+		if !ok {
+			break
+		}
+		got = append(got, next.Format("2006-01-02 15:04"))
+		prev = next
+	}
+	return got
+}
+
+func TestNext(t *testing.T) {
+
+	start := time.Date(2026, 1, 30, 9, 0, 0, 0, time.UTC) // a Friday
+
+	// ends: the series is over after want.
+	tests := []struct {
+		rule string
+		want []string
+		ends bool
+	}{
+		{"FREQ=DAILY;INTERVAL=3", []string{"2026-01-30 09:00", "2026-02-02 09:00", "2026-02-05 09:00"}, false},
+		{"FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR", []string{"2026-01-30 09:00", "2026-02-02 09:00", "2026-02-03 09:00"}, false},
+		{"FREQ=WEEKLY", []string{"2026-01-30 09:00", "2026-02-06 09:00", "2026-02-13 09:00"}, false},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,FR", []string{"2026-01-30 09:00", "2026-02-09 09:00", "2026-02-13 09:00", "2026-02-23 09:00"}, false},
+		{"FREQ=MONTHLY", []string{"2026-01-30 09:00", "2026-03-30 09:00", "2026-04-30 09:00"}, false},
+		{"FREQ=MONTHLY;BYDAY=-1FR", []string{"2026-01-30 09:00", "2026-02-27 09:00", "2026-03-27 09:00"}, false},
+		{"FREQ=MONTHLY;INTERVAL=2;BYDAY=1MO", []string{"2026-01-30 09:00", "2026-03-02 09:00", "2026-05-04 09:00"}, false},
+		{"FREQ=DAILY;COUNT=2", []string{"2026-01-30 09:00", "2026-01-31 09:00"}, true},
+		{"FREQ=DAILY;UNTIL=20260201", []string{"2026-01-30 09:00", "2026-01-31 09:00", "2026-02-01 09:00"}, true},
+		{"FREQ=DAILY;UNTIL=20260131T080000Z", []string{"2026-01-30 09:00"}, true},
+	}
+
+	for _, tt := range tests {
+		got := series(t, tt.rule, start, len(tt.want)+1)
+		if !tt.ends {
+			got = got[:min(len(got), len(tt.want))]
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestCountEndsSeries(t *testing.T) {
+
+	r := mustParse(t, "FREQ=WEEKLY;COUNT=3")
+	prev := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+
+	if _, ok := r.Next(prev, 2); !ok {
+		t.Error("second occurrence of 3 has no next")
+	}
+	if _, ok := r.Next(prev, 3); ok {
+		t.Error("third occurrence of 3 has a next")
+	}
+}
+
+func TestNextKeepsWallClockAcrossDST(t *testing.T) {
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+
+	// Clocks go forward on 29 March 2026 in Berlin.
+	prev := time.Date(2026, 3, 28, 9, 0, 0, 0, berlin)
+	next, ok := mustParse(t, "FREQ=DAILY").Next(prev, 1)
+	if !ok {
+		t.Fatal("no next occurrence")
+	}
+
+	if next.Hour() != 9 || next.Day() != 29 {
+		t.Errorf("next = %v, want 29 March 9:00 local", next)
+	}
+	if next.Sub(prev) != 23*time.Hour {
+		t.Errorf("next - prev = %v, want 23h", next.Sub(prev))
+	}
+}
+
+func TestParse(t *testing.T) {
+
+	good := map[string]string{
+		"rrule:freq=weekly;byday=fr,mo":         "FREQ=WEEKLY;BYDAY=MO,FR",
+		"FREQ=MONTHLY;INTERVAL=1;BYDAY=-1FR":    "FREQ=MONTHLY;BYDAY=-1FR",
+		"FREQ=DAILY;UNTIL=20261231T170000Z":     "FREQ=DAILY;UNTIL=20261231T170000Z",
+		"FREQ=DAILY;INTERVAL=2;COUNT=10":        "FREQ=DAILY;INTERVAL=2;COUNT=10",
+		"FREQ=MONTHLY;BYDAY=2TU;UNTIL=20270101": "FREQ=MONTHLY;BYDAY=2TU;UNTIL=20270101",
+	}
+	for in, want := range good {
+		if got := mustParse(t, in).String(); got != want {
+			t.Errorf("Parse(%q).String() = %q, want %q", in, got, want)
+		}
+	}
+
+	bad := []string{
+		"",
+		"FREQ=YEARLY",
+		"INTERVAL=2",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;COUNT=3;UNTIL=20261231",
+		"FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=MONTHLY;BYDAY=6MO",
+		"FREQ=MONTHLY;BYDAY=XX",
+		"FREQ=DAILY;BYMONTHDAY=1",
+		"FREQ=DAILY;FREQ=WEEKLY",
+		"FREQ=DAILY;UNTIL=tomorrow",
+	}
+	for _, in := range bad {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) accepted", in)
+		}
+	}
+}
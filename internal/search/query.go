@@ -0,0 +1,290 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Document types in the index.
+const (
+	TypeItem    = "item"
+	TypeProject = "project"
+	TypeComment = "comment"
+)
+
+const (
+	// minPrefixLength is the shortest prefix a "word*" may have. The index
+	// is bucketed by the first two characters of a token, so a shorter
+	// prefix would have to read every bucket.
+	minPrefixLength = bucketPrefix
+
+	// maxTerms caps the words, prefixes and phrase words of one query.
+	maxTerms = 10
+
+	// phraseBonus multiplies the weight of a field a phrase was found in.
+	phraseBonus = 2
+)
+
+// QueryError is a query that cannot be run. Msg tells the user why.
+type QueryError struct {
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return e.Msg
+}
+
+// Term is one word of a query. A Prefix term matches every token that
+// starts with Text.
+type Term struct {
+	Text   string
+	Prefix bool
+}
+
+func (t Term) matches(token string) bool {
+	if t.Prefix {
+		return strings.HasPrefix(token, t.Text)
+	}
+	return token == t.Text
+}
+
+// Query is a parsed search:
+//
+//	report rev* "weekly sync" status:done project:<projectId> type:item
+//
+// Every word, prefix and phrase must match. status only keeps items,
+// project keeps the project and everything in it, type is item, project or
+// comment.
+type Query struct {
+	Terms   []Term
+	Phrases [][]string
+
+	Type    string
+	Status  string
+	Project string
+}
+
+// Parse reads a Query from s.
+func Parse(s string) (Query, error) {
+
+	var q Query
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+
+		if key, value, rest, ok := filter(s); ok {
+			s = rest
+			switch key {
+			case "type":
+				value = strings.ToLower(value)
+				if value != TypeItem && value != TypeProject && value != TypeComment {
+					return Query{}, &QueryError{Msg: "type must be item, project or comment"}
+				}
+				q.Type = value
+			case "status":
+				q.Status = value
+			case "project":
+				q.Project = value
+			}
+			continue
+		}
+
+		if s[0] == '"' {
+			var phrase string
+			phrase, s = quoted(s)
+			switch words := Tokenize(phrase); len(words) {
+			case 0:
+			case 1:
+				q.Terms = append(q.Terms, Term{Text: words[0]})
+			default:
+				q.Phrases = append(q.Phrases, words)
+			}
+			continue
+		}
+
+		var word string
+		word, s = nextWord(s)
+
+		words := Tokenize(word)
+		if len(words) == 0 {
+			continue
+		}
+
+		prefix := strings.HasSuffix(word, "*")
+		for i, w := range words {
+			t := Term{Text: w, Prefix: prefix && i == len(words)-1}
+			if t.Prefix && utf8.RuneCountInString(w) < minPrefixLength {
+				return Query{}, &QueryError{Msg: "a prefix search needs at least 2 characters before the *"}
+			}
+			q.Terms = append(q.Terms, t)
+		}
+	}
+
+	lookups := q.lookups()
+	if len(lookups) == 0 {
+		return Query{}, &QueryError{Msg: "search for at least one word"}
+	}
+	if len(lookups) > maxTerms {
+		return Query{}, &QueryError{Msg: "search for at most 10 words"}
+	}
+
+	return q, nil
+}
+
+// filter reads a key:value filter at the start of s. The value may be
+// quoted to hold spaces, as in status:"in progress".
+func filter(s string) (key, value, rest string, ok bool) {
+
+	key, after, found := strings.Cut(s, ":")
+	if !found {
+		return "", "", "", false
+	}
+
+	key = strings.ToLower(key)
+	if key != "type" && key != "status" && key != "project" {
+		return "", "", "", false
+	}
+
+	if strings.HasPrefix(after, `"`) {
+		value, rest = quoted(after)
+	} else {
+		value, rest = nextWord(after)
+	}
+
+	value = strings.TrimSpace(value)
+	return key, value, rest, value != ""
+}
+
+// nextWord splits s at the first space.
+func nextWord(s string) (word, rest string) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// quoted reads a "quoted" string at the start of s. A missing closing
+// quote runs to the end.
+func quoted(s string) (value, rest string) {
+	value, rest, _ = strings.Cut(s[1:], `"`)
+	return value, rest
+}
+
+// lookups returns the distinct terms to read from the index: the query's
+// words and prefixes and the words of its phrases.
+func (q Query) lookups() []Term {
+
+	seen := map[Term]bool{}
+	var out []Term
+
+	add := func(t Term) {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+
+	for _, t := range q.Terms {
+		add(t)
+	}
+	for _, p := range q.Phrases {
+		for _, w := range p {
+			add(Term{Text: w})
+		}
+	}
+	return out
+}
+
+// String returns the query in a canonical form, for binding cursors to it.
+func (q Query) String() string {
+
+	var parts []string
+	for _, t := range q.Terms {
+		if t.Prefix {
+			parts = append(parts, t.Text+"*")
+		} else {
+			parts = append(parts, t.Text)
+		}
+	}
+	for _, p := range q.Phrases {
+		parts = append(parts, `"`+strings.Join(p, " ")+`"`)
+	}
+	sort.Strings(parts)
+
+	return strings.Join(parts, " ") + "\ntype=" + q.Type + "\nstatus=" + strings.ToLower(q.Status) + "\nproject=" + q.Project
+}
+
+// Score ranks d against q: for every term, the weight of each field times
+// how often the term occurs in it, plus a bonus for each field holding a
+// phrase. ok is false when d does not match q.
+func (q Query) Score(d *Doc) (score int, ok bool) {
+
+	if q.Type != "" && d.Type != q.Type {
+		return 0, false
+	}
+	if q.Status != "" && (d.Type != TypeItem || !strings.EqualFold(fold(d.Status), fold(q.Status))) {
+		return 0, false
+	}
+	if q.Project != "" && d.ProjectID != q.Project {
+		return 0, false
+	}
+
+	for _, t := range q.Terms {
+		n := 0
+		for _, f := range d.Fields {
+			for _, tok := range f.Tokens {
+				if t.matches(tok) {
+					n += f.Weight
+				}
+			}
+		}
+		if n == 0 {
+			return 0, false
+		}
+		score += n
+	}
+
+	for _, p := range q.Phrases {
+		n := 0
+		for _, f := range d.Fields {
+			if containsPhrase(f.Tokens, p) {
+				n += f.Weight * phraseBonus * len(p)
+			}
+		}
+		if n == 0 {
+			return 0, false
+		}
+		score += n
+	}
+
+	return score, true
+}
+
+// fold drops spaces and punctuation, so status:inprogress and
+// status:"In Progress" are the same.
+func fold(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+func containsPhrase(tokens, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		match := true
+		for j, w := range phrase {
+			if tokens[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
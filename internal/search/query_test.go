@@ -0,0 +1,103 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	got := Tokenize("Send the Q3-report to Zoë, e-mail: ops@example.com!")
+	want := []string{"send", "the", "q3", "report", "to", "zoë", "e", "mail", "ops", "example", "com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize = %q, want %q", got, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	q, err := Parse(`Report rev* "Weekly  sync" status:"In Progress" project:p1 type:item`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Query{
+		Terms:   []Term{{Text: "report"}, {Text: "rev", Prefix: true}},
+		Phrases: [][]string{{"weekly", "sync"}},
+		Type:    TypeItem,
+		Status:  "In Progress",
+		Project: "p1",
+	}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("Parse = %+v, want %+v", q, want)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"status:done",
+		"r*",
+		"type:label report",
+		"a b c d e f g h i j k",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) accepted", s)
+		}
+	}
+}
+
+func TestScore(t *testing.T) {
+
+	doc := func(id, status, title, text string) *Doc {
+		d := &Doc{Type: TypeItem, ID: id, ProjectID: "p1", Status: status, Fields: []Field{
+			{Name: "title", Weight: WeightTitle, Tokens: Tokenize(title)},
+			{Name: "description", Weight: WeightText, Tokens: Tokenize(text)},
+		}}
+		return d
+	}
+
+	inTitle := doc("1", "Done", "Weekly report", "")
+	inText := doc("2", "Done", "Numbers", "the weekly report for ops")
+	other := doc("3", "Not Started", "Report sync", "sync weekly")
+
+	tests := []struct {
+		query string
+		doc   *Doc
+		score int
+		ok    bool
+	}{
+		{"report", inTitle, 3, true},
+		{"report", inText, 1, true},
+		{"rep*", other, 3, true},
+		{"report weekly", inTitle, 6, true},
+		{"report missing", inTitle, 0, false},
+		{`"weekly report"`, inText, 1 * phraseBonus * 2, true},
+		{`"weekly report"`, other, 0, false},
+		{"report status:done", other, 0, false},
+		{"report status:done", inTitle, 3, true},
+		{"report project:p2", inTitle, 0, false},
+		{"report type:comment", inTitle, 0, false},
+	}
+
+	for _, tt := range tests {
+		q, err := Parse(tt.query)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.query, err)
+		}
+		score, ok := q.Score(tt.doc)
+		if score != tt.score || ok != tt.ok {
+			t.Errorf("%q on doc %s = %d, %v, want %d, %v", tt.query, tt.doc.ID, score, ok, tt.score, tt.ok)
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	if got := bucket("u1", "zoë"); got != "u1#zo" {
+		t.Errorf("bucket = %q", got)
+	}
+	if got := bucket("u1", "ëx"); got != "u1#ëx" {
+		t.Errorf("bucket = %q", got)
+	}
+	if got := bucket("u1", "a"); got != "u1#a" {
+		t.Errorf("bucket = %q", got)
+	}
+}
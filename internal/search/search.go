@@ -0,0 +1,400 @@
+// Package search is the full-text index over projects, items and comments.
+//
+// The index is an inverted index in one DynamoDB table. Every distinct
+// token of a document is a posting row
+//
+//	bucket = ownerId#<first two characters of the token>
+//	term   = token#type#id
+//
+// so an exact word is a begins_with(term, "word#") Query on one bucket and
+// a prefix is begins_with(term, "prefix"). Next to the postings, each
+// document has one row in the owner's ownerId#doc bucket holding its
+// tokens per field, which is what phrases, filters and ranking are checked
+// against and what tells Put which postings to remove.
+//
+// Postings that point at a document which no longer holds the token, left
+// behind by two racing updates, are harmless: the document row decides.
+package search
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/storage"
+)
+
+const (
+	defaultTable = "To-Do-List-Search"
+
+	// bucketPrefix is how many characters of a token pick its bucket.
+	bucketPrefix = 2
+
+	// docBucket is the suffix of the bucket of the document rows. It is
+	// longer than bucketPrefix, so no token bucket can clash with it.
+	docBucket = "#doc"
+
+	// maxPostings caps the postings read for one term. A term that common
+	// does not narrow the search much; the other terms have to.
+	maxPostings = 2000
+
+	// maxCandidates caps the documents ranked for one search.
+	maxCandidates = 500
+)
+
+// Weights of the fields of a document.
+const (
+	WeightTitle = 3
+	WeightText  = 1
+)
+
+// Index reads and writes the search table.
+type Index struct {
+	DB    *dynamodb.Client
+	Table string
+}
+
+// New returns an Index for SEARCH_TABLE (default To-Do-List-Search).
+func New(db *dynamodb.Client) *Index {
+	x := &Index{DB: db, Table: defaultTable}
+	if t := os.Getenv("SEARCH_TABLE"); t != "" {
+		x.Table = t
+	}
+	return x
+}
+
+// Doc is a project, item or comment as the index sees it.
+type Doc struct {
+	Type    string `json:"type" dynamodbav:"type"`
+	ID      string `json:"id" dynamodbav:"id"`
+	OwnerID string `json:"-" dynamodbav:"ownerId"`
+
+	// ProjectID is the project the document belongs to, its own id for a
+	// project. ItemID is the item of a comment.
+	ProjectID string `json:"projectId" dynamodbav:"projectId"`
+	ItemID    string `json:"itemId,omitempty" dynamodbav:"itemId,omitempty"`
+
+	// Status is the status of an item. Title is shown in results: the
+	// title of an item, the name of a project, the start of a comment.
+	Status string `json:"status,omitempty" dynamodbav:"status,omitempty"`
+	Title  string `json:"title" dynamodbav:"title"`
+
+	Fields []Field `json:"-" dynamodbav:"fields"`
+}
+
+// Field is searchable text of a document. Put fills in Tokens from Text.
+type Field struct {
+	Name   string   `dynamodbav:"name"`
+	Weight int      `dynamodbav:"weight"`
+	Text   string   `dynamodbav:"-"`
+	Tokens []string `dynamodbav:"tokens,omitempty"`
+}
+
+// Hit is one search result.
+type Hit struct {
+	*Doc
+	Score int `json:"score"`
+}
+
+func (d *Doc) key() string {
+	return d.Type + "#" + d.ID
+}
+
+func (d *Doc) tokens() map[string]bool {
+	set := map[string]bool{}
+	for _, f := range d.Fields {
+		for _, t := range f.Tokens {
+			set[t] = true
+		}
+	}
+	return set
+}
+
+func bucket(ownerID, token string) string {
+	return ownerID + "#" + prefixOf(token, bucketPrefix)
+}
+
+func rowKey(bucket, term string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"bucket": &types.AttributeValueMemberS{Value: bucket},
+		"term":   &types.AttributeValueMemberS{Value: term},
+	}
+}
+
+// docRow is the stored form of a Doc.
+type docRow struct {
+	Bucket string `dynamodbav:"bucket"`
+	Term   string `dynamodbav:"term"`
+	Doc
+}
+
+// Put indexes d, replacing what was indexed for it before. Only the
+// postings of tokens that were added or removed are written.
+func (x *Index) Put(ctx context.Context, d *Doc) error {
+
+	for i := range d.Fields {
+		d.Fields[i].Tokens = Tokenize(d.Fields[i].Text)
+	}
+
+	old, err := x.get(ctx, d.OwnerID, d.key())
+	if err != nil {
+		return err
+	}
+
+	oldTokens := map[string]bool{}
+	if old != nil {
+		oldTokens = old.tokens()
+	}
+	newTokens := d.tokens()
+
+	var writes []types.WriteRequest
+	for t := range newTokens {
+		if !oldTokens[t] {
+			writes = append(writes, types.WriteRequest{PutRequest: &types.PutRequest{
+				Item: rowKey(bucket(d.OwnerID, t), t+"#"+d.key()),
+			}})
+		}
+	}
+	for t := range oldTokens {
+		if !newTokens[t] {
+			writes = append(writes, types.WriteRequest{DeleteRequest: &types.DeleteRequest{
+				Key: rowKey(bucket(d.OwnerID, t), t+"#"+d.key()),
+			}})
+		}
+	}
+
+	row, err := attributevalue.MarshalMap(docRow{Bucket: d.OwnerID + docBucket, Term: d.key(), Doc: *d})
+	if err != nil {
+		return err
+	}
+	writes = append(writes, types.WriteRequest{PutRequest: &types.PutRequest{Item: row}})
+
+	return storage.BatchWrite(ctx, x.DB, x.Table, writes)
+}
+
+// Remove takes the document docType/id of ownerID out of the index.
+func (x *Index) Remove(ctx context.Context, ownerID, docType, id string) error {
+
+	old, err := x.get(ctx, ownerID, docType+"#"+id)
+	if err != nil || old == nil {
+		return err
+	}
+	return x.remove(ctx, old)
+}
+
+func (x *Index) remove(ctx context.Context, d *Doc) error {
+
+	var writes []types.WriteRequest
+	for t := range d.tokens() {
+		writes = append(writes, types.WriteRequest{DeleteRequest: &types.DeleteRequest{
+			Key: rowKey(bucket(d.OwnerID, t), t+"#"+d.key()),
+		}})
+	}
+	writes = append(writes, types.WriteRequest{DeleteRequest: &types.DeleteRequest{
+		Key: rowKey(d.OwnerID+docBucket, d.key()),
+	}})
+
+	return storage.BatchWrite(ctx, x.DB, x.Table, writes)
+}
+
+// DeleteOwner removes everything indexed for ownerID, for account
+// deletion. It can be run again after a failure.
+func (x *Index) DeleteOwner(ctx context.Context, ownerID string) error {
+
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(x.Table),
+		KeyConditionExpression: aws.String("#bucket = :bucket"),
+		ExpressionAttributeNames: map[string]string{
+			"#bucket": "bucket",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":bucket": &types.AttributeValueMemberS{Value: ownerID + docBucket},
+		},
+	}
+
+	for {
+		result, err := x.DB.Query(ctx, in)
+		if err != nil {
+			return err
+		}
+
+		var rows []docRow
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &rows); err != nil {
+			return err
+		}
+
+		for i := range rows {
+			if err := x.remove(ctx, &rows[i].Doc); err != nil {
+				return err
+			}
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		in.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (x *Index) get(ctx context.Context, ownerID, key string) (*Doc, error) {
+
+	result, err := x.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(x.Table),
+		Key:       rowKey(ownerID+docBucket, key),
+	})
+	if err != nil || result.Item == nil {
+		return nil, err
+	}
+
+	var row docRow
+	if err := attributevalue.UnmarshalMap(result.Item, &row); err != nil {
+		return nil, err
+	}
+	return &row.Doc, nil
+}
+
+// Search returns the documents of ownerID matching q, best first, newest
+// first among equal scores.
+//
+// Each word, prefix and phrase word is one Query on its bucket. Only the
+// documents every one of them found are read and ranked.
+func (x *Index) Search(ctx context.Context, ownerID string, q Query) ([]Hit, error) {
+
+	var candidates map[string]bool
+
+	for _, t := range q.lookups() {
+		found, err := x.postings(ctx, ownerID, t)
+		if err != nil {
+			return nil, err
+		}
+
+		if candidates == nil {
+			candidates = found
+			continue
+		}
+		for key := range candidates {
+			if !found[key] {
+				delete(candidates, key)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(candidates))
+	for key := range candidates {
+		keys = append(keys, key)
+	}
+
+	// Ids sort by creation time, so a capped search keeps the newest.
+	sort.Slice(keys, func(i, j int) bool {
+		_, a, _ := strings.Cut(keys[i], "#")
+		_, b, _ := strings.Cut(keys[j], "#")
+		return a > b
+	})
+	if len(keys) > maxCandidates {
+		keys = keys[:maxCandidates]
+	}
+
+	docs, err := x.docs(ctx, ownerID, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := []Hit{}
+	for _, d := range docs {
+		if score, ok := q.Score(d); ok {
+			hits = append(hits, Hit{Doc: d, Score: score})
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID > hits[j].ID
+	})
+
+	return hits, nil
+}
+
+// postings returns the keys (type#id) of the documents holding a token t
+// matches.
+func (x *Index) postings(ctx context.Context, ownerID string, t Term) (map[string]bool, error) {
+
+	prefix := t.Text
+	if !t.Prefix {
+		prefix += "#"
+	}
+
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(x.Table),
+		KeyConditionExpression: aws.String("#bucket = :bucket AND begins_with(#term, :prefix)"),
+		ExpressionAttributeNames: map[string]string{
+			"#bucket": "bucket",
+			"#term":   "term",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":bucket": &types.AttributeValueMemberS{Value: bucket(ownerID, t.Text)},
+			":prefix": &types.AttributeValueMemberS{Value: prefix},
+		},
+	}
+
+	found := map[string]bool{}
+
+	for len(found) < maxPostings {
+		result, err := x.DB.Query(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range result.Items {
+			term, ok := item["term"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			if _, key, ok := strings.Cut(term.Value, "#"); ok {
+				found[key] = true
+			}
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		in.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	return found, nil
+}
+
+// docs reads the document rows of keys.
+func (x *Index) docs(ctx context.Context, ownerID string, keys []string) ([]*Doc, error) {
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	rowKeys := make([]map[string]types.AttributeValue, len(keys))
+	for i, key := range keys {
+		rowKeys[i] = rowKey(ownerID+docBucket, key)
+	}
+
+	items, err := storage.BatchGet(ctx, x.DB, x.Table, rowKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]*Doc, 0, len(items))
+	for _, item := range items {
+		var row docRow
+		if err := attributevalue.UnmarshalMap(item, &row); err != nil {
+			return nil, err
+		}
+		docs = append(docs, &row.Doc)
+	}
+	return docs, nil
+}
@@ -0,0 +1,48 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxTokenLength caps a token in bytes, so one very long word cannot make
+// an oversized key.
+const maxTokenLength = 64
+
+// Tokenize splits text into lowercase words: runs of letters and digits.
+// Everything else separates words, so "e-mail" is "e" and "mail".
+func Tokenize(text string) []string {
+
+	var tokens []string
+
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		tokens = append(tokens, truncate(w))
+	}
+	return tokens
+}
+
+// truncate cuts w to maxTokenLength bytes without splitting a rune.
+func truncate(w string) string {
+	if len(w) <= maxTokenLength {
+		return w
+	}
+	w = w[:maxTokenLength]
+	for !utf8.ValidString(w) {
+		w = w[:len(w)-1]
+	}
+	return w
+}
+
+// prefixOf returns the first n runes of token.
+func prefixOf(token string, n int) string {
+	for i := range token {
+		if n == 0 {
+			return token[:i]
+		}
+		n--
+	}
+	return token
+}
@@ -0,0 +1,165 @@
+// Package session issues and verifies the app's own session tokens.
+//
+// Tokens are compact HS256 JWTs signed with SESSION_SECRET, so every lambda
+// that shares the secret can verify a token without a database round trip.
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	issuer     = "to-do-list"
+	defaultTTL = time.Hour
+
+	// MinSecretLength is the shortest SESSION_SECRET accepted for signing.
+	MinSecretLength = 32
+)
+
+// Login methods recorded in the amr claim.
+const (
+	MethodPassword      = "pwd"
+	MethodOIDC          = "oidc"
+	MethodImpersonation = "imp"
+)
+
+var (
+	ErrNoSecret     = errors.New("session: SESSION_SECRET is not set or too short")
+	ErrInvalidToken = errors.New("session: invalid token")
+	ErrExpired      = errors.New("session: token expired")
+)
+
+// Claims is the payload carried by a session token.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	SessionID string `json:"sid"`
+	Method    string `json:"amr"`
+	Actor     string `json:"act,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Token is a freshly issued session token.
+type Token struct {
+	AccessToken string
+	ExpiresAt   time.Time
+	Claims      Claims
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func secret() ([]byte, error) {
+	s := os.Getenv("SESSION_SECRET")
+	if len(s) < MinSecretLength {
+		return nil, ErrNoSecret
+	}
+	return []byte(s), nil
+}
+
+// TTL returns the session lifetime from SESSION_TTL, falling back to one hour.
+func TTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SESSION_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultTTL
+}
+
+// Issue signs a new session token for userID.
+func Issue(userID, method string) (Token, error) {
+	return issue(userID, method, "", TTL())
+}
+
+// IssueImpersonation signs a short-lived token that acts as userID on behalf
+// of actorID. The actor is kept in the act claim so every request made with
+// it can be attributed to the staff member.
+func IssueImpersonation(userID, actorID string, ttl time.Duration) (Token, error) {
+	return issue(userID, MethodImpersonation, actorID, ttl)
+}
+
+func issue(userID, method, actor string, ttl time.Duration) (Token, error) {
+	key, err := secret()
+	if err != nil {
+		return Token{}, err
+	}
+
+	sid := make([]byte, 16)
+	if _, err := rand.Read(sid); err != nil {
+		return Token{}, err
+	}
+
+	now := time.Now()
+	exp := now.Add(ttl)
+	claims := Claims{
+		Issuer:    issuer,
+		Subject:   userID,
+		SessionID: hex.EncodeToString(sid),
+		Method:    method,
+		Actor:     actor,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: exp.Unix(),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return Token{}, err
+	}
+
+	signingInput := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	token := signingInput + "." + sign(key, signingInput)
+
+	return Token{AccessToken: token, ExpiresAt: exp, Claims: claims}, nil
+}
+
+// Verify checks the signature and expiry of token and returns its claims.
+func Verify(token string) (*Claims, error) {
+	key, err := secret()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, ErrInvalidToken
+	}
+
+	expected := sign(key, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.Issuer != issuer || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+
+	return &claims, nil
+}
+
+func sign(key []byte, signingInput string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,120 @@
+package session
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// forge signs claims with header the way issue does, so tests can build
+// tokens issue would never produce.
+func forge(t *testing.T, header string, claims Claims) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + sign([]byte(testSecret), signingInput)
+}
+
+func TestVerify(t *testing.T) {
+	t.Setenv("SESSION_SECRET", testSecret)
+
+	valid, err := Issue("user-1", MethodPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(valid.AccessToken, ".")
+
+	tampered := valid.Claims
+	tampered.Subject = "user-2"
+	tamperedPayload, _ := json.Marshal(tampered)
+
+	now := time.Now().Unix()
+	live := Claims{Issuer: issuer, Subject: "user-1", IssuedAt: now, ExpiresAt: now + 60}
+
+	expired := live
+	expired.IssuedAt = now - 120
+	expired.ExpiresAt = now - 60
+
+	wrongIssuer := live
+	wrongIssuer.Issuer = "someone-else"
+
+	noSubject := live
+	noSubject.Subject = ""
+
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", valid.AccessToken, nil},
+		{"forged live token", forge(t, jwtHeader, live), nil},
+		{"tampered payload", parts[0] + "." + base64.RawURLEncoding.EncodeToString(tamperedPayload) + "." + parts[2], ErrInvalidToken},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + sign([]byte("another-secret-another-secret-!!"), parts[0]+"."+parts[1]), ErrInvalidToken},
+		{"missing signature", parts[0] + "." + parts[1] + ".", ErrInvalidToken},
+		{"alg none header", forge(t, noneHeader, live), ErrInvalidToken},
+		{"garbage header", forge(t, "not-a-header", live), ErrInvalidToken},
+		{"too few parts", parts[0] + "." + parts[1], ErrInvalidToken},
+		{"empty", "", ErrInvalidToken},
+		{"wrong issuer", forge(t, jwtHeader, wrongIssuer), ErrInvalidToken},
+		{"no subject", forge(t, jwtHeader, noSubject), ErrInvalidToken},
+		{"expired", forge(t, jwtHeader, expired), ErrExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && claims.Subject != "user-1" {
+				t.Fatalf("Verify() subject = %q, want user-1", claims.Subject)
+			}
+		})
+	}
+}
+
+func TestVerifyWithoutSecret(t *testing.T) {
+	t.Setenv("SESSION_SECRET", testSecret)
+
+	tok, err := Issue("user-1", MethodPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SESSION_SECRET", "short")
+
+	if _, err := Verify(tok.AccessToken); !errors.Is(err, ErrNoSecret) {
+		t.Fatalf("Verify() error = %v, want %v", err, ErrNoSecret)
+	}
+}
+
+func TestIssueImpersonation(t *testing.T) {
+	t.Setenv("SESSION_SECRET", testSecret)
+
+	tok, err := IssueImpersonation("user-1", "staff-1", 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := Verify(tok.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Actor != "staff-1" || claims.Method != MethodImpersonation {
+		t.Fatalf("claims = %+v, want actor staff-1 and method %q", claims, MethodImpersonation)
+	}
+}
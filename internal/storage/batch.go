@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Limits on requests in one BatchWriteItem and keys in one BatchGetItem.
+const (
+	maxBatchWrite = 25
+	maxBatchGet   = 100
+)
+
+// ErrUnprocessed is returned when a batch call kept leaving requests
+// unprocessed after every retry.
+var ErrUnprocessed = errors.New("storage: batch write left unprocessed items")
+
+// BatchWrite sends writes to table in chunks of 25, retrying the requests
+// DynamoDB leaves unprocessed with the same backoff as other retries.
+func BatchWrite(ctx context.Context, db *dynamodb.Client, table string, writes []types.WriteRequest) error {
+
+	for len(writes) > 0 {
+		n := min(len(writes), maxBatchWrite)
+		pending := map[string][]types.WriteRequest{table: writes[:n]}
+		writes = writes[n:]
+
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt == maxAttempts {
+				return ErrUnprocessed
+			}
+			if attempt > 0 {
+				d, _ := backoff(attempt, nil)
+				time.Sleep(d)
+			}
+
+			result, err := db.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if err != nil {
+				return err
+			}
+			pending = result.UnprocessedItems
+		}
+	}
+
+	return nil
+}
+
+// BatchGet reads the items with keys from table in chunks of 100, with the
+// same retries as BatchWrite. Keys that do not exist are left out, and the
+// items come back in no particular order.
+func BatchGet(ctx context.Context, db *dynamodb.Client, table string, keys []map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+
+	var items []map[string]types.AttributeValue
+
+	for len(keys) > 0 {
+		n := min(len(keys), maxBatchGet)
+		pending := map[string]types.KeysAndAttributes{table: {Keys: keys[:n]}}
+		keys = keys[n:]
+
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt == maxAttempts {
+				return nil, ErrUnprocessed
+			}
+			if attempt > 0 {
+				d, _ := backoff(attempt, nil)
+				time.Sleep(d)
+			}
+
+			result, err := db.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: pending})
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, result.Responses[table]...)
+			pending = result.UnprocessedKeys
+		}
+	}
+
+	return items, nil
+}
+
+// DeleteQueried deletes every item the Query in returns, page by page.
+// keyNames are the attributes of the table's own key. It is safe to run
+// again after a failure: whatever was deleted is simply not found again.
+func DeleteQueried(ctx context.Context, db *dynamodb.Client, in *dynamodb.QueryInput, keyNames ...string) error {
+
+	for {
+		result, err := db.Query(ctx, in)
+		if err != nil {
+			return err
+		}
+
+		writes := make([]types.WriteRequest, 0, len(result.Items))
+		for _, item := range result.Items {
+			key := map[string]types.AttributeValue{}
+			for _, name := range keyNames {
+				key[name] = item[name]
+			}
+			writes = append(writes, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+		}
+
+		if err := BatchWrite(ctx, db, aws.ToString(in.TableName), writes); err != nil {
+			return err
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		in.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,184 @@
+// Package storage holds the DynamoDB client setup and the error policy
+// shared by the lambdas.
+//
+// Throttling and transient failures are retried inside the SDK with jittered
+// exponential backoff, but only while the Lambda has time left to use the
+// result. Whatever still fails is classified so handlers can answer with a
+// status the client can act on instead of a generic 500.
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	maxAttempts = 5
+	baseBackoff = 25 * time.Millisecond
+	maxBackoff  = time.Second
+
+	// deadlineReserve is the time kept back from the Lambda deadline for the
+	// last attempt and for writing the response.
+	deadlineReserve = 500 * time.Millisecond
+)
+
+// ErrNoTimeToRetry is joined to the last error when a retry was due but the
+// Lambda deadline was too close to make it.
+var ErrNoTimeToRetry = errors.New("storage: not enough time left to retry")
+
+// Kind is the class of a failed DynamoDB call.
+type Kind int
+
+const (
+	KindNone Kind = iota
+	KindThrottled
+	KindConditionFailed
+	KindValidation
+	KindTransient
+	KindOther
+)
+
+// NewClient returns a DynamoDB client that retries with Retryer.
+func NewClient(cfg aws.Config) *dynamodb.Client {
+	return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		o.Retryer = NewRetryer()
+	})
+}
+
+// NewRetryer returns the SDK standard retryer with full-jitter backoff, no
+// client-side retry quota and a check against the context deadline before
+// every retry.
+func NewRetryer() aws.RetryerV2 {
+	std := retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = maxAttempts
+		o.MaxBackoff = maxBackoff
+		o.Backoff = retry.BackoffDelayerFunc(backoff)
+		o.RateLimiter = ratelimit.None
+		o.Retryables = append(o.Retryables, retry.RetryableErrorCode{
+			Codes: map[string]struct{}{"TransactionConflictException": {}},
+		})
+	})
+	return deadlineRetryer{std}
+}
+
+// backoff waits a random time up to baseBackoff doubled per attempt, capped
+// at maxBackoff.
+func backoff(attempt int, err error) (time.Duration, error) {
+	d := maxBackoff
+	if attempt < 16 {
+		d = min(baseBackoff<<attempt, maxBackoff)
+	}
+	return rand.N(d) + 1, nil
+}
+
+type deadlineRetryer struct {
+	aws.RetryerV2
+}
+
+// GetRetryToken refuses the retry when the context would expire during the
+// longest possible backoff and another attempt, so the caller gets the real
+// error rather than a cancellation.
+func (r deadlineRetryer) GetRetryToken(ctx context.Context, opErr error) (func(error) error, error) {
+	if d, ok := ctx.Deadline(); ok && time.Until(d) < maxBackoff+deadlineReserve {
+		return nil, ErrNoTimeToRetry
+	}
+	return r.RetryerV2.GetRetryToken(ctx, opErr)
+}
+
+// Classify returns the kind of err.
+func Classify(err error) Kind {
+	if err == nil {
+		return KindNone
+	}
+
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		return classifyCancellation(canceled)
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ProvisionedThroughputExceededException", "ThrottlingException",
+			"RequestLimitExceeded", "LimitExceededException":
+			return KindThrottled
+		case "ConditionalCheckFailedException", "TransactionConflictException":
+			return KindConditionFailed
+		case "ValidationException", "SerializationException":
+			return KindValidation
+		case "InternalServerError", "ServiceUnavailable", "InternalFailure":
+			return KindTransient
+		}
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() >= 500 {
+		return KindTransient
+	}
+
+	var netErr net.Error
+	if errors.Is(err, ErrNoTimeToRetry) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return KindTransient
+	}
+
+	var canceledReq *aws.RequestCanceledError
+	if errors.As(err, &canceledReq) {
+		return KindTransient
+	}
+
+	return KindOther
+}
+
+// classifyCancellation uses the first reason that is not "None"; DynamoDB
+// reports one reason per item in the transaction.
+func classifyCancellation(e *types.TransactionCanceledException) Kind {
+	for _, r := range e.CancellationReasons {
+		switch aws.ToString(r.Code) {
+		case "", "None":
+			continue
+		case "ConditionalCheckFailed", "TransactionConflict":
+			return KindConditionFailed
+		case "ThrottlingError", "ProvisionedThroughputExceeded":
+			return KindThrottled
+		case "ValidationError", "ItemCollectionSizeLimitExceeded":
+			return KindValidation
+		default:
+			return KindTransient
+		}
+	}
+	return KindTransient
+}
+
+// IsConditionFailed reports whether err is a failed condition expression,
+// on its own or inside a transaction.
+func IsConditionFailed(err error) bool {
+	return Classify(err) == KindConditionFailed
+}
+
+// Status returns the HTTP status and error message for a failed call.
+func Status(err error) (int, string) {
+	switch Classify(err) {
+	case KindThrottled:
+		return http.StatusTooManyRequests, "too many requests, retry later"
+	case KindConditionFailed:
+		return http.StatusConflict, "conflicting update"
+	case KindValidation:
+		return http.StatusBadRequest, "invalid request"
+	case KindTransient:
+		return http.StatusServiceUnavailable, "database temporarily unavailable"
+	default:
+		return http.StatusInternalServerError, "dynamodb error"
+	}
+}
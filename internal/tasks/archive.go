@@ -0,0 +1,328 @@
+package tasks
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/etag"
+)
+
+// archiveList is the listKey of the archived tasks of projectID.
+func archiveList(projectID string) string {
+	return projectID + "#archive"
+}
+
+// writable refuses a change to an archived task, and any change to a task
+// of an archived project, including moves into and out of one.
+func (tx *Tx) writable(ctx context.Context, before, it *Item) error {
+
+	if before != nil && before.ArchivedAt != "" {
+		return refused(409, "the task is archived, unarchive it first")
+	}
+
+	projects := []string{it.ProjectID}
+	if before != nil && before.ProjectID != it.ProjectID {
+		projects = append(projects, before.ProjectID)
+	}
+	for _, id := range projects {
+		project, err := tx.Project(ctx, it.OwnerID, id)
+		if err != nil {
+			return err
+		}
+		if err := project.writable(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ArchiveTree moves it, a top-level task, and its subtasks to the archive,
+// marked with archivedAt and with, the project whose archiving takes it
+// along ("" when it is archived itself). They are detached from the tasks
+// that remain, as for the trash.
+func (tx *Tx) ArchiveTree(ctx context.Context, it *Item, archivedAt, with string) error {
+
+	if it.ParentID != "" {
+		return refused(409, "only top-level tasks are archived, with their subtasks")
+	}
+
+	sub, err := tx.subtree(ctx, it)
+	if err != nil {
+		return err
+	}
+
+	batch := append(sub, it)
+	for _, d := range batch {
+		d.ArchivedAt, d.ArchivedWith = archivedAt, cmp.Or(with, it.ItemID)
+		d.UpdatedAt = archivedAt
+		tx.PutItem(d)
+	}
+	it.ArchivedWith = with
+
+	if err := tx.detach(ctx, batch); err != nil {
+		return err
+	}
+	return tx.record(ctx, it.ItemID, it.OwnerID, []HistoryEntry{{Field: FieldArchived}})
+}
+
+// UnarchiveTree takes it out of the archive along with the subtasks
+// archived with it. Their dependencies are not restored. A status the
+// project's workflow no longer has becomes the first state of the same
+// category.
+func (tx *Tx) UnarchiveTree(ctx context.Context, it *Item) error {
+
+	with := cmp.Or(it.ArchivedWith, it.ItemID)
+	sub, err := tx.tree(ctx, it, func(c *Item) bool { return c.DeletedAt == "" && c.ArchivedWith == with })
+	if err != nil {
+		return err
+	}
+
+	project, err := tx.Project(ctx, it.OwnerID, it.ProjectID)
+	if err != nil {
+		return err
+	}
+	w := project.EffectiveWorkflow()
+
+	ts := now()
+	for _, d := range append(sub, it) {
+		w.settle(d)
+		d.ArchivedAt, d.ArchivedWith = "", ""
+		d.UpdatedAt = ts
+		tx.PutItem(d)
+	}
+
+	return tx.record(ctx, it.ItemID, it.OwnerID, []HistoryEntry{{Field: FieldUnarchived}})
+}
+
+// UnarchiveItem takes the task itemID out of the archive with its
+// subtasks. A task archived along with its project comes back with the
+// project.
+func (s *Store) UnarchiveItem(ctx context.Context, ownerID, itemID string, pre *etag.Precondition) (*Item, error) {
+	return s.UpdateItem(ctx, ownerID, itemID, pre, func(tx *Tx, it *Item) error {
+
+		if it.ArchivedAt == "" {
+			return refused(409, "the task is not archived")
+		}
+		if it.ArchivedWith != "" {
+			return refused(409, "the task was archived along with %s, unarchive that instead", it.ArchivedWith)
+		}
+
+		project, err := tx.Project(ctx, ownerID, it.ProjectID)
+		if err != nil {
+			return err
+		}
+		if err := project.writable(); err != nil {
+			return err
+		}
+
+		return tx.UnarchiveTree(ctx, it)
+	})
+}
+
+// ArchiveProject archives the project projectID and moves every task in it
+// to the archive, archived with it. The tasks go first. If anything fails
+// after that, the project write included, the tasks archived so far come
+// out of the archive again: a project that is not archived cannot bring
+// them back.
+func (s *Store) ArchiveProject(ctx context.Context, ownerID, projectID string, pre *etag.Precondition) (*Project, error) {
+
+	p, err := s.GetProject(ctx, ownerID, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	if pre != nil && !pre.Allows(p.Version) {
+		return nil, &PreconditionError{Project: p}
+	}
+	if err := p.writable(); err != nil {
+		return nil, err
+	}
+
+	archivedAt := now()
+	var archived []string
+	err = s.eachItem(ctx, ItemsByList, p.ProjectID, func(it *Item) error {
+		if it.ParentID != "" {
+			return nil
+		}
+		_, err := s.UpdateItem(ctx, ownerID, it.ItemID, nil, func(tx *Tx, it *Item) error {
+			if it.ArchivedAt != "" {
+				return nil
+			}
+			return tx.ArchiveTree(ctx, it, archivedAt, projectID)
+		})
+		if err == nil {
+			archived = append(archived, it.ItemID)
+		}
+		if err != ErrNotFound {
+			return err
+		}
+		return nil
+	})
+
+	if err == nil {
+		p, err = s.UpdateProject(ctx, ownerID, projectID, pre, func(tx *Tx, p *Project) error {
+			if err := p.writable(); err != nil {
+				return err
+			}
+			p.ArchivedAt = archivedAt
+			if err := tx.record(ctx, p.ProjectID, p.OwnerID, []HistoryEntry{{Field: FieldArchived}}); err != nil {
+				return err
+			}
+			p.UpdatedAt = now()
+			tx.PutProject(p)
+			return nil
+		})
+	}
+
+	if err != nil {
+		s.unarchive(ctx, ownerID, projectID, archivedAt, archived)
+		return nil, err
+	}
+	return p, nil
+}
+
+// unarchive takes the tasks itemIDs, which a failed ArchiveProject moved to
+// the archive with project projectID at archivedAt, out of it again with
+// their subtasks, as untrash does for the trash.
+func (s *Store) unarchive(ctx context.Context, ownerID, projectID, archivedAt string, itemIDs []string) {
+
+	for _, id := range itemIDs {
+		_, err := s.UpdateItem(ctx, ownerID, id, nil, func(tx *Tx, it *Item) error {
+			if it.ArchivedAt != archivedAt || it.ArchivedWith != projectID {
+				return nil
+			}
+			return tx.UnarchiveTree(ctx, it)
+		})
+		if err != nil && err != ErrNotFound {
+			log.Println("unarchive error:", id, err)
+		}
+	}
+}
+
+// UnarchiveProject takes the project projectID out of the archive with the
+// tasks archived along with it; tasks archived before it on their own stay
+// in the archive. The tasks go first, so a failure part way leaves the
+// project archived and the unarchive can simply be retried.
+func (s *Store) UnarchiveProject(ctx context.Context, ownerID, projectID string, pre *etag.Precondition) (*Project, error) {
+
+	p, err := s.GetProject(ctx, ownerID, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	if pre != nil && !pre.Allows(p.Version) {
+		return nil, &PreconditionError{Project: p}
+	}
+	if p.ArchivedAt == "" {
+		return nil, refused(409, "the project is not archived")
+	}
+
+	err = s.eachItem(ctx, ItemsByList, archiveList(projectID), func(it *Item) error {
+		if it.ArchivedWith != projectID || it.ParentID != "" {
+			return nil
+		}
+		_, err := s.UpdateItem(ctx, ownerID, it.ItemID, nil, func(tx *Tx, it *Item) error {
+			if it.ArchivedWith != projectID {
+				return nil
+			}
+			tx.projects[projectID] = p
+			return tx.UnarchiveTree(ctx, it)
+		})
+		if err != ErrNotFound {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.UpdateProject(ctx, ownerID, projectID, pre, func(tx *Tx, p *Project) error {
+		if p.ArchivedAt == "" {
+			return refused(409, "the project is not archived")
+		}
+		p.ArchivedAt = ""
+		if err := tx.record(ctx, p.ProjectID, p.OwnerID, []HistoryEntry{{Field: FieldUnarchived}}); err != nil {
+			return err
+		}
+		p.UpdatedAt = now()
+		tx.PutProject(p)
+		return nil
+	})
+}
+
+// AutoArchiveProjects calls f for every project with an auto-archive rule,
+// until f fails.
+func (s *Store) AutoArchiveProjects(ctx context.Context, f func(p *Project) error) error {
+	return eachQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:              aws.String(s.Projects),
+		IndexName:              aws.String(ProjectsByAutoArchive.Name),
+		KeyConditionExpression: aws.String("autoArchive = :on"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":on": &types.AttributeValueMemberS{Value: autoArchiveOn},
+		},
+	}, f)
+}
+
+// AutoArchive moves the top-level tasks of p that have been done for more
+// than its autoArchiveDoneAfterDays at ts to the archive, with their
+// subtasks, and returns how many it moved. A task that cannot be archived,
+// such as one with too many subtasks, is logged and left in place.
+func (s *Store) AutoArchive(ctx context.Context, p *Project, ts time.Time) (int, error) {
+
+	if p.AutoArchiveDays <= 0 || p.ArchivedAt != "" || p.DeletedAt != "" {
+		return 0, nil
+	}
+	cutoff := ts.AddDate(0, 0, -p.AutoArchiveDays).UTC().Format(time.RFC3339)
+
+	archived := 0
+	for _, state := range p.EffectiveWorkflow().States {
+		if state.Category != CategoryDone {
+			continue
+		}
+
+		err := eachQueried(ctx, s.DB, &dynamodb.QueryInput{
+			TableName:              aws.String(s.Items),
+			IndexName:              aws.String(ItemsByStatus.Name),
+			KeyConditionExpression: aws.String("statusKey = :statusKey"),
+			FilterExpression:       aws.String("completedAt < :cutoff AND attribute_not_exists(parentId)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":statusKey": &types.AttributeValueMemberS{Value: p.ProjectID + "#" + state.Name},
+				":cutoff":    &types.AttributeValueMemberS{Value: cutoff},
+			},
+		}, func(it *Item) error {
+			moved := false
+			_, err := s.UpdateItem(ctx, p.OwnerID, it.ItemID, nil, func(tx *Tx, it *Item) error {
+				moved = false
+				if !it.Done() || it.CompletedAt >= cutoff || it.ParentID != "" || it.ArchivedAt != "" {
+					return nil
+				}
+				moved = true
+				return tx.ArchiveTree(ctx, it, now(), "")
+			})
+
+			var refusal *Error
+			switch {
+			case errors.As(err, &refusal):
+				log.Println("auto-archive skipped", it.ItemID+":", refusal.Msg)
+			case err != nil && err != ErrNotFound:
+				return err
+			case err == nil && moved:
+				archived++
+			}
+			return nil
+		})
+		if err != nil {
+			return archived, err
+		}
+	}
+
+	return archived, nil
+}
@@ -0,0 +1,65 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestArchiveTree(t *testing.T) {
+
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusDone, CompletedAt: "2030-01-01T09:00:00Z", Blocks: []string{"c"}}
+	waiting := &Item{ItemID: "c", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, BlockedBy: []string{"a"}}
+	tx := subtaskTx(false, it, waiting)
+
+	if err := tx.ArchiveTree(context.Background(), it, "2030-02-01T09:00:00Z", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	it.derive()
+	if it.ArchivedAt == "" || it.ArchivedWith != "" || it.ListKey != "p1#archive" || it.StatusKey != "p1#archive#Done" {
+		t.Errorf("archived task = %+v", it)
+	}
+	if len(it.Blocks) != 0 || len(waiting.BlockedBy) != 0 {
+		t.Errorf("links left: %v %v", it.Blocks, waiting.BlockedBy)
+	}
+	if _, err := tx.LoadItem(context.Background(), "u1", "a"); err != ErrNotFound {
+		t.Errorf("archived task loaded: %v", err)
+	}
+	if e := stagedHistory(t, tx); len(e) != 1 || e[0].Field != FieldArchived {
+		t.Errorf("history = %+v", e)
+	}
+}
+
+func TestArchivedIsReadOnly(t *testing.T) {
+
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Title: "Report", Status: StatusDone, ArchivedAt: "2030-02-01T09:00:00Z"}
+	live := &Item{ItemID: "b", OwnerID: "u1", ProjectID: "p1", Title: "Draft", Status: StatusNotStarted}
+	tx := subtaskTx(false, it, live)
+
+	var te *Error
+	title := "Final report"
+	if err := tx.PatchItem(context.Background(), it, ItemPatch{Title: &title}); !errors.As(err, &te) || te.Code != 409 {
+		t.Errorf("change to an archived task: %v, want 409", err)
+	}
+
+	tx.projects["p1"].ArchivedAt = "2030-02-01T09:00:00Z"
+	if err := tx.PatchItem(context.Background(), live, ItemPatch{Title: &title}); !errors.As(err, &te) || te.Code != 409 {
+		t.Errorf("change in an archived project: %v, want 409", err)
+	}
+}
+
+func TestUnarchiveTree(t *testing.T) {
+
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: "Shipped", Category: CategoryDone, ArchivedAt: "2030-02-01T09:00:00Z"}
+	tx := subtaskTx(false, it)
+
+	if err := tx.UnarchiveTree(context.Background(), it); err != nil {
+		t.Fatal(err)
+	}
+
+	it.derive()
+	if it.ArchivedAt != "" || it.ListKey != "p1" || it.Status != StatusDone {
+		t.Errorf("unarchived task = %+v", it)
+	}
+}
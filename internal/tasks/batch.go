@@ -0,0 +1,357 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+
+	"to_do_list_demo/internal/storage"
+)
+
+// Limits of a batch. An atomic batch is one transaction, so besides the
+// 100 operations everything they write together (history entries, parent
+// counts, dependencies) must fit in maxTransactItems.
+const (
+	maxBatchOperations  = 500
+	maxAtomicOperations = 100
+
+	// batchChunk is how many groups of operations of a batch that is not
+	// atomic run at the same time.
+	batchChunk = 25
+)
+
+// Operations of a batch.
+const (
+	OpUpdate = "update"
+	OpMove   = "move"
+	OpDelete = "delete"
+)
+
+// StatusNotApplied is the status of the operations of an atomic batch
+// that were not applied because another one failed.
+const StatusNotApplied = 424
+
+// Batch is the body of POST /items:batch. With Atomic all operations are
+// applied together or none is.
+type Batch struct {
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is one operation of a batch: update sets status, priority
+// and labelIds, move sets projectId and parentId, delete moves the task to
+// the trash. Force starts a blocked task, as ?force=true does on PATCH.
+type BatchOperation struct {
+	Op        string    `json:"op"`
+	ItemID    string    `json:"itemId"`
+	Status    *string   `json:"status"`
+	Priority  *Priority `json:"priority"`
+	LabelIDs  *[]string `json:"labelIds"`
+	ProjectID *string   `json:"projectId"`
+	ParentID  *string   `json:"parentId"`
+	Force     bool      `json:"force"`
+}
+
+// BatchResult is the outcome of one operation, at the operation's place in
+// the batch: its status and the task after it, or why it failed.
+type BatchResult struct {
+	ItemID string `json:"itemId"`
+	Status int    `json:"status"`
+	Item   *Item  `json:"item,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// check validates b. Each task can be in one operation only, so the
+// operations do not depend on the order they run in.
+func (b Batch) check() error {
+
+	limit := maxBatchOperations
+	if b.Atomic {
+		limit = maxAtomicOperations
+	}
+	if len(b.Operations) == 0 || len(b.Operations) > limit {
+		return invalid("a batch needs 1 to %d operations", limit)
+	}
+
+	seen := map[string]bool{}
+	for i, op := range b.Operations {
+		if op.ItemID == "" {
+			return invalid("operations[%d]: itemId is required", i)
+		}
+		if seen[op.ItemID] {
+			return invalid("operations[%d]: task %s is in more than one operation", i, op.ItemID)
+		}
+		seen[op.ItemID] = true
+
+		updates := op.Status != nil || op.Priority != nil || op.LabelIDs != nil
+		moves := op.ProjectID != nil || op.ParentID != nil
+
+		switch op.Op {
+		case OpUpdate:
+			if !updates || moves {
+				return invalid("operations[%d]: update sets status, priority or labelIds", i)
+			}
+		case OpMove:
+			if !moves || updates {
+				return invalid("operations[%d]: move sets projectId or parentId", i)
+			}
+		case OpDelete:
+			if moves || updates {
+				return invalid("operations[%d]: delete takes only an itemId", i)
+			}
+		default:
+			return invalid("operations[%d]: op must be update, move or delete", i)
+		}
+	}
+	return nil
+}
+
+// apply stages op on it, read in tx.
+func (tx *Tx) apply(ctx context.Context, it *Item, op BatchOperation) error {
+
+	tx.Force = op.Force
+
+	if op.Op == OpDelete {
+		return tx.deleteItem(ctx, it, "")
+	}
+	return tx.PatchItem(ctx, it, ItemPatch{
+		Status:    op.Status,
+		Priority:  op.Priority,
+		LabelIDs:  op.LabelIDs,
+		ProjectID: op.ProjectID,
+		ParentID:  op.ParentID,
+	})
+}
+
+// RunBatch applies the operations of b to the tasks of ownerID and returns
+// a result per operation, in order. Each operation goes through the same
+// checks and history as the single request it stands for.
+//
+// Without Atomic every operation is its own transaction and fails on its
+// own. Operations that write the same rows, such as the parent of sibling
+// tasks or a task they all block, are grouped and run one after another,
+// so they do not keep failing each other's transactions; batchChunk groups
+// run at the same time. The tasks moved into a project get their ranks
+// after one read of its last rank, made before the batch starts. With
+// Atomic they are one transaction: if one fails, nothing is written, the
+// failed operation has its error and the others StatusNotApplied.
+func (s *Store) RunBatch(ctx context.Context, ownerID string, b Batch) ([]BatchResult, error) {
+
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+
+	if b.Atomic {
+		return s.runAtomic(ctx, ownerID, b.Operations)
+	}
+
+	items := make([]*Item, len(b.Operations))
+	runGroups(eachAlone(len(b.Operations)), func(_, i int) {
+		// A task that cannot be read is grouped on its own; its
+		// operation fails with the same error when it runs.
+		items[i], _ = s.GetItem(ctx, ownerID, b.Operations[i].ItemID)
+	})
+
+	last := map[string]string{}
+	for _, op := range b.Operations {
+		if op.ProjectID == nil {
+			continue
+		}
+		if _, ok := last[*op.ProjectID]; ok {
+			continue
+		}
+		r, err := s.lastRank(ctx, *op.ProjectID)
+		if err != nil {
+			return nil, err
+		}
+		last[*op.ProjectID] = r
+	}
+
+	results := make([]BatchResult, len(b.Operations))
+	groups := batchGroups(b.Operations, items)
+	ranks := make([]map[string]string, len(groups))
+	for g := range groups {
+		ranks[g] = maps.Clone(last)
+	}
+
+	runGroups(groups, func(g, i int) {
+		op, r := b.Operations[i], ranks[g]
+		it, err := s.UpdateItem(ctx, ownerID, op.ItemID, nil, func(tx *Tx, it *Item) error {
+			if op.ProjectID != nil {
+				tx.ranks[*op.ProjectID] = r[*op.ProjectID]
+			}
+			if err := tx.apply(ctx, it, op); err != nil {
+				return err
+			}
+			if op.ProjectID != nil {
+				r[*op.ProjectID] = tx.ranks[*op.ProjectID]
+			}
+			return nil
+		})
+		results[i] = batchResult(op, it, err)
+	})
+	return results, nil
+}
+
+// batchGroups groups the operations of ops that write the same rows: the
+// task, its parent and the tasks it blocks or is blocked by, as read in
+// items, and for a move the new parent and project. Each group lists its
+// operations in batch order.
+func batchGroups(ops []BatchOperation, items []*Item) [][]int {
+
+	group := make([]int, len(ops))
+	for i := range group {
+		group[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if group[i] != i {
+			group[i] = find(group[i])
+		}
+		return group[i]
+	}
+
+	owner := map[string]int{}
+	join := func(i int, key string) {
+		if key == "" {
+			return
+		}
+		if j, ok := owner[key]; ok {
+			group[find(i)] = find(j)
+			return
+		}
+		owner[key] = i
+	}
+
+	for i, op := range ops {
+		join(i, "item#"+op.ItemID)
+		if op.ParentID != nil {
+			join(i, "item#"+*op.ParentID)
+		}
+		if op.ProjectID != nil {
+			join(i, "project#"+*op.ProjectID)
+		}
+		if it := items[i]; it != nil {
+			if it.ParentID != "" {
+				join(i, "item#"+it.ParentID)
+			}
+			for _, id := range slices.Concat(it.BlockedBy, it.Blocks) {
+				join(i, "item#"+id)
+			}
+		}
+	}
+
+	var groups [][]int
+	at := map[int]int{}
+	for i := range ops {
+		root := find(i)
+		g, ok := at[root]
+		if !ok {
+			g = len(groups)
+			at[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+// eachAlone is n groups of one operation each.
+func eachAlone(n int) [][]int {
+
+	groups := make([][]int, n)
+	for i := range groups {
+		groups[i] = []int{i}
+	}
+	return groups
+}
+
+// runGroups calls run with the index of the group and of each of its
+// operations, one after another, batchChunk groups at a time.
+func runGroups(groups [][]int, run func(g, i int)) {
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchChunk)
+	for g, ops := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			for _, i := range ops {
+				run(g, i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Store) runAtomic(ctx context.Context, ownerID string, ops []BatchOperation) ([]BatchResult, error) {
+
+	for attempt := 1; ; attempt++ {
+		tx := s.Begin()
+		items := make([]*Item, len(ops))
+
+		for i, op := range ops {
+			it, err := tx.load(ctx, ownerID, op.ItemID)
+			if err == nil {
+				err = tx.apply(ctx, it, op)
+			}
+			if err != nil {
+				results := make([]BatchResult, len(ops))
+				for j, op := range ops {
+					results[j] = BatchResult{ItemID: op.ItemID, Status: StatusNotApplied, Error: "not applied, another operation failed"}
+				}
+				results[i] = batchResult(op, nil, err)
+				return results, nil
+			}
+			items[i] = it
+		}
+
+		err := tx.Commit(ctx)
+		if err == errStale && attempt < maxRetries {
+			continue
+		}
+		if err == errStale {
+			return nil, ErrConflict
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([]BatchResult, len(ops))
+		for i, op := range ops {
+			results[i] = batchResult(op, items[i], nil)
+		}
+		return results, nil
+	}
+}
+
+// batchResult is the result of op, which left it or failed with err.
+func batchResult(op BatchOperation, it *Item, err error) BatchResult {
+
+	r := BatchResult{ItemID: op.ItemID}
+	var te *Error
+
+	switch {
+	case err == nil && op.Op == OpDelete:
+		r.Status = 204
+	case err == nil:
+		r.Status, r.Item = 200, it
+	case errors.As(err, &te):
+		r.Status, r.Error = te.Code, te.Msg
+	case errors.Is(err, ErrNotFound):
+		r.Status, r.Error = 404, "not found"
+	case errors.Is(err, ErrConflict):
+		r.Status, r.Error = 409, "conflicting update, retry"
+	default:
+		log.Println("tasks error:", err)
+		r.Status, r.Error = storage.Status(err)
+	}
+	return r
+}
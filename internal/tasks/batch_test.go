@@ -0,0 +1,155 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchCheck(t *testing.T) {
+
+	done, p2 := StatusDone, "p2"
+	high := PriorityHigh
+	many := make([]BatchOperation, maxAtomicOperations+1)
+	for i := range many {
+		many[i] = BatchOperation{Op: OpDelete, ItemID: fmt.Sprint(i)}
+	}
+
+	tests := []struct {
+		name string
+		b    Batch
+		ok   bool
+	}{
+		{"update, move and delete", Batch{Operations: []BatchOperation{
+			{Op: OpUpdate, ItemID: "a", Status: &done, Priority: &high},
+			{Op: OpMove, ItemID: "b", ProjectID: &p2},
+			{Op: OpDelete, ItemID: "c"},
+		}}, true},
+		{"empty", Batch{}, false},
+		{"same task twice", Batch{Operations: []BatchOperation{{Op: OpDelete, ItemID: "a"}, {Op: OpUpdate, ItemID: "a", Status: &done}}}, false},
+		{"update that moves", Batch{Operations: []BatchOperation{{Op: OpUpdate, ItemID: "a", Status: &done, ProjectID: &p2}}}, false},
+		{"move without a target", Batch{Operations: []BatchOperation{{Op: OpMove, ItemID: "a"}}}, false},
+		{"unknown op", Batch{Operations: []BatchOperation{{Op: "archive", ItemID: "a"}}}, false},
+		{"101 operations", Batch{Operations: many}, true},
+		{"101 atomic operations", Batch{Atomic: true, Operations: many}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.b.check(); (err == nil) != tt.ok {
+			t.Errorf("%s: check = %v", tt.name, err)
+		}
+	}
+}
+
+func TestBatchApply(t *testing.T) {
+
+	a := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Title: "Report", Status: StatusNotStarted, Priority: PriorityMedium}
+	b := &Item{ItemID: "b", OwnerID: "u1", ProjectID: "p1", Title: "Draft", Status: StatusDone, CompletedAt: "2030-01-01T09:00:00Z"}
+	tx := subtaskTx(false, a, b)
+	ctx := context.Background()
+
+	done := StatusDone
+	if err := tx.apply(ctx, a, BatchOperation{Op: OpUpdate, ItemID: "a", Status: &done}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.apply(ctx, b, BatchOperation{Op: OpDelete, ItemID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Status != StatusDone || a.CompletedAt == "" {
+		t.Errorf("updated task = %+v", a)
+	}
+	if b.DeletedAt == "" {
+		t.Error("deleted task is not in the trash")
+	}
+	if r := batchResult(BatchOperation{Op: OpDelete, ItemID: "b"}, b, nil); r.Status != 204 || r.Item != nil {
+		t.Errorf("delete result = %+v", r)
+	}
+	if r := batchResult(BatchOperation{Op: OpUpdate, ItemID: "x"}, nil, ErrNotFound); r.Status != 404 {
+		t.Errorf("missing task result = %+v", r)
+	}
+}
+
+func TestBatchGroups(t *testing.T) {
+
+	p2 := "p2"
+	ops := []BatchOperation{
+		{Op: OpDelete, ItemID: "a"},
+		{Op: OpDelete, ItemID: "b"},
+		{Op: OpDelete, ItemID: "c"},
+		{Op: OpDelete, ItemID: "d"},
+		{Op: OpMove, ItemID: "e", ProjectID: &p2},
+		{Op: OpMove, ItemID: "f", ProjectID: &p2},
+		{Op: OpDelete, ItemID: "g"},
+	}
+	items := []*Item{
+		{ItemID: "a", ParentID: "p"},
+		{ItemID: "b", Blocks: []string{"x"}},
+		{ItemID: "c", ParentID: "p"},
+		{ItemID: "d", BlockedBy: []string{"b"}},
+		{ItemID: "e"},
+		{ItemID: "f"},
+		nil,
+	}
+
+	want := [][]int{{0, 2}, {1, 3}, {4, 5}, {6}}
+	if got := batchGroups(ops, items); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("groups = %v, want %v", got, want)
+	}
+}
+
+// TestBatchSiblingsDone marks the subtasks of one parent done in one
+// batch. Each operation writes the parent's childrenDone, so the grouped
+// operations must not race on it: run stands for their transactions,
+// conditioned on the parent's version and retried like updateItem.
+func TestBatchSiblingsDone(t *testing.T) {
+
+	const n = 40
+	done := StatusDone
+	ops := make([]BatchOperation, n)
+	items := make([]*Item, n)
+	for i := range ops {
+		id := fmt.Sprint("c", i)
+		ops[i] = BatchOperation{Op: OpUpdate, ItemID: id, Status: &done}
+		items[i] = &Item{ItemID: id, ParentID: "p", Status: StatusNotStarted}
+	}
+
+	var mu sync.Mutex
+	var version, childrenDone int
+	results := make([]int, n)
+
+	runGroups(batchGroups(ops, items), func(_, i int) {
+		results[i] = 409
+		for range maxRetries {
+			mu.Lock()
+			read := version
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			ok := version == read
+			if ok {
+				version++
+				childrenDone++
+			}
+			mu.Unlock()
+			if ok {
+				results[i] = 200
+				return
+			}
+		}
+	})
+
+	for i, status := range results {
+		if status != 200 {
+			t.Errorf("operation %d = %d, want 200", i, status)
+		}
+	}
+	if childrenDone != n {
+		t.Errorf("childrenDone = %d, want %d", childrenDone, n)
+	}
+}
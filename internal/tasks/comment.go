@@ -0,0 +1,312 @@
+package tasks
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/etag"
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/search"
+	"to_do_list_demo/internal/storage"
+)
+
+const maxCommentLength = 5000
+
+// Comment is an item in the comments table, a note on a task.
+type Comment struct {
+	ItemID    string `json:"itemId" dynamodbav:"itemId"`
+	CommentID string `json:"commentId" dynamodbav:"commentId"`
+	ProjectID string `json:"projectId" dynamodbav:"projectId"`
+	OwnerID   string `json:"-" dynamodbav:"ownerId"`
+	Body      string `json:"body" dynamodbav:"body"`
+	CreatedAt string `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt string `json:"updatedAt" dynamodbav:"updatedAt"`
+	Version   int64  `json:"version" dynamodbav:"version"`
+}
+
+// CommentsByOwner lists every comment of a user, for account deletion.
+var CommentsByOwner = Index{Name: "owner-index", PartitionKey: "ownerId", SortKey: "commentId"}
+
+// CommentBody is the body of a comment create or PATCH request.
+type CommentBody struct {
+	Body *string `json:"body"`
+}
+
+func (b CommentBody) text() (string, error) {
+	if b.Body == nil {
+		return "", invalid("body is required")
+	}
+	body := strings.TrimSpace(*b.Body)
+	if body == "" || utf8.RuneCountInString(body) > maxCommentLength {
+		return "", invalid("body is required and must be at most %d characters", maxCommentLength)
+	}
+	return body, nil
+}
+
+func (s *Store) getComment(ctx context.Context, ownerID, itemID, commentID string) (*Comment, error) {
+
+	result, err := s.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Comments),
+		Key: map[string]types.AttributeValue{
+			"itemId":    &types.AttributeValueMemberS{Value: itemID},
+			"commentId": &types.AttributeValueMemberS{Value: commentID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	var c Comment
+	if err := attributevalue.UnmarshalMap(result.Item, &c); err != nil {
+		return nil, err
+	}
+
+	if c.OwnerID != ownerID {
+		return nil, ErrNotFound
+	}
+	return &c, nil
+}
+
+// commentable returns the item itemID of ownerID, refusing changes to the
+// comments of an archived one.
+func (s *Store) commentable(ctx context.Context, ownerID, itemID string) (*Item, error) {
+
+	it, err := s.GetItem(ctx, ownerID, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	if it.ArchivedAt != "" {
+		return nil, refused(409, "the task is archived, unarchive it first")
+	}
+	return it, nil
+}
+
+// ListComments returns a page of the comments on item itemID, oldest first.
+func (s *Store) ListComments(ctx context.Context, ownerID, itemID string, r pagination.Request) ([]Comment, map[string]types.AttributeValue, error) {
+
+	if _, err := s.GetItem(ctx, ownerID, itemID); err != nil {
+		return nil, nil, err
+	}
+
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(s.Comments),
+		KeyConditionExpression: aws.String("itemId = :item"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":item": &types.AttributeValueMemberS{Value: itemID},
+		},
+	}
+
+	raw, lastKey, err := pagination.Query(ctx, s.DB, in, r, "itemId", "commentId")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	comments := []Comment{}
+	if err := attributevalue.UnmarshalListOfMaps(raw, &comments); err != nil {
+		return nil, nil, err
+	}
+	return comments, lastKey, nil
+}
+
+// CreateComment adds a comment to item itemID.
+func (s *Store) CreateComment(ctx context.Context, ownerID, itemID string, b CommentBody) (*Comment, error) {
+
+	body, err := b.text()
+	if err != nil {
+		return nil, err
+	}
+
+	it, err := s.commentable(ctx, ownerID, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := now()
+	c := &Comment{
+		ItemID:    itemID,
+		CommentID: NewID(),
+		ProjectID: it.ProjectID,
+		OwnerID:   ownerID,
+		Body:      body,
+		CreatedAt: ts,
+		UpdatedAt: ts,
+		Version:   1,
+	}
+
+	if err := s.putComment(ctx, c, 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// UpdateComment replaces the body of a comment.
+func (s *Store) UpdateComment(ctx context.Context, ownerID, itemID, commentID string, pre *etag.Precondition, b CommentBody) (*Comment, error) {
+
+	body, err := b.text()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.commentable(ctx, ownerID, itemID); err != nil {
+		return nil, err
+	}
+
+	c, err := s.getComment(ctx, ownerID, itemID, commentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if pre != nil && !pre.Allows(c.Version) {
+		return nil, &PreconditionError{Comment: c}
+	}
+
+	c.Body = body
+	c.UpdatedAt = now()
+	c.Version++
+
+	if err := s.putComment(ctx, c, c.Version-1); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// putComment writes c if the stored comment is still at version read (0
+// for a new one) and indexes it for search.
+func (s *Store) putComment(ctx context.Context, c *Comment, read int64) error {
+
+	item, err := attributevalue.MarshalMap(c)
+	if err != nil {
+		return err
+	}
+
+	in := &dynamodb.PutItemInput{
+		TableName:           aws.String(s.Comments),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(commentId)"),
+	}
+	if read > 0 {
+		in.ConditionExpression = aws.String("#version = :readVersion")
+		in.ExpressionAttributeNames = map[string]string{"#version": "version"}
+		in.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":readVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(read, 10)},
+		}
+	}
+
+	if _, err := s.DB.PutItem(ctx, in); err != nil {
+		if storage.IsConditionFailed(err) {
+			return ErrConflict
+		}
+		return err
+	}
+
+	s.indexed(s.Search.Put(ctx, commentDoc(c)))
+	return nil
+}
+
+// DeleteComment removes a comment.
+func (s *Store) DeleteComment(ctx context.Context, ownerID, itemID, commentID string, pre *etag.Precondition) error {
+
+	if _, err := s.commentable(ctx, ownerID, itemID); err != nil {
+		return err
+	}
+
+	c, err := s.getComment(ctx, ownerID, itemID, commentID)
+	if err != nil {
+		return err
+	}
+
+	if pre != nil && !pre.Allows(c.Version) {
+		return &PreconditionError{Comment: c}
+	}
+
+	_, err = s.DB.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Comments),
+		Key: map[string]types.AttributeValue{
+			"itemId":    &types.AttributeValueMemberS{Value: itemID},
+			"commentId": &types.AttributeValueMemberS{Value: commentID},
+		},
+		ConditionExpression:       aws.String("#version = :readVersion"),
+		ExpressionAttributeNames:  map[string]string{"#version": "version"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":readVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(c.Version, 10)}},
+	})
+	if err != nil {
+		if storage.IsConditionFailed(err) {
+			return ErrConflict
+		}
+		return err
+	}
+
+	s.indexed(s.Search.Remove(ctx, ownerID, search.TypeComment, commentID))
+	return nil
+}
+
+// deleteComments removes the comments on a deleted item and takes them out
+// of the search index.
+func (s *Store) deleteComments(ctx context.Context, ownerID, itemID string) error {
+
+	if err := s.indexComments(ctx, ownerID, itemID, false); err != nil {
+		return err
+	}
+
+	return storage.DeleteQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:              aws.String(s.Comments),
+		KeyConditionExpression: aws.String("itemId = :item"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":item": &types.AttributeValueMemberS{Value: itemID},
+		},
+	}, "itemId", "commentId")
+}
+
+// indexComments puts the comments on item itemID in the search index, or
+// takes them out of it when the item goes to the trash.
+func (s *Store) indexComments(ctx context.Context, ownerID, itemID string, indexed bool) error {
+
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(s.Comments),
+		KeyConditionExpression: aws.String("itemId = :item"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":item": &types.AttributeValueMemberS{Value: itemID},
+		},
+	}
+
+	for {
+		result, err := s.DB.Query(ctx, in)
+		if err != nil {
+			return err
+		}
+
+		var page []Comment
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return err
+		}
+
+		for i := range page {
+			if indexed {
+				err = s.Search.Put(ctx, commentDoc(&page[i]))
+			} else {
+				err = s.Search.Remove(ctx, ownerID, search.TypeComment, page[i].CommentID)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		in.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
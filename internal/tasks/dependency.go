@@ -0,0 +1,208 @@
+package tasks
+
+import (
+	"context"
+	"slices"
+)
+
+const (
+	// maxDependencies caps the tasks one task can be blocked by, and the
+	// tasks one task can block.
+	maxDependencies = 50
+
+	// maxGraphWalk caps the tasks visited looking for a cycle.
+	maxGraphWalk = 500
+
+	maxEstimateHours = 10000
+)
+
+// updateDependencies keeps both ends of every dependency of it in step:
+// the blocker lists it in Blocks and it counts the blockers not done yet.
+// A dependency that would close a cycle is refused, and so is starting a
+// blocked task unless the transaction is forced.
+func (tx *Tx) updateDependencies(ctx context.Context, before, it *Item) error {
+
+	var oldBlockers []string
+	if before != nil {
+		oldBlockers = before.BlockedBy
+
+		if before.ProjectID != it.ProjectID && (len(it.BlockedBy) > 0 || len(it.Blocks) > 0) {
+			return invalid("remove the task's dependencies before moving it to another project")
+		}
+	}
+
+	for _, id := range it.BlockedBy {
+		if slices.Contains(oldBlockers, id) {
+			continue
+		}
+
+		blocker, err := tx.LoadItem(ctx, it.OwnerID, id)
+		if err == ErrNotFound {
+			return invalid("unknown task %q in blockedBy", id)
+		}
+		if err != nil {
+			return err
+		}
+
+		if blocker.ProjectID != it.ProjectID {
+			return invalid("a task can only be blocked by tasks of the same project")
+		}
+		if len(blocker.Blocks) >= maxDependencies {
+			return invalid("task %q already blocks %d tasks", id, maxDependencies)
+		}
+
+		graph, err := tx.dependencyGraph(ctx, it.ProjectID)
+		if err != nil {
+			return err
+		}
+		cycle, complete := reaches(graph, id, it.ItemID, maxGraphWalk)
+		if cycle {
+			return refused(409, "task %q already waits for this task, the dependency would be a cycle", id)
+		}
+		if !complete {
+			return refused(409, "too many dependencies to check for a cycle")
+		}
+
+		blocker.Blocks = append(blocker.Blocks, it.ItemID)
+		slices.Sort(blocker.Blocks)
+		tx.PutItem(blocker)
+
+		if !blocker.Done() {
+			it.OpenBlockers++
+		}
+	}
+
+	for _, id := range oldBlockers {
+		if slices.Contains(it.BlockedBy, id) {
+			continue
+		}
+
+		blocker, err := tx.LoadItem(ctx, it.OwnerID, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		blocker.Blocks = slices.DeleteFunc(blocker.Blocks, func(b string) bool { return b == it.ItemID })
+		tx.PutItem(blocker)
+
+		if !blocker.Done() {
+			it.OpenBlockers = max(it.OpenBlockers-1, 0)
+		}
+	}
+
+	if before != nil && doneCount(before) != doneCount(it) {
+		for _, id := range it.Blocks {
+			dependent, err := tx.LoadItem(ctx, it.OwnerID, id)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			dependent.OpenBlockers = max(dependent.OpenBlockers+doneCount(before)-doneCount(it), 0)
+			tx.PutItem(dependent)
+		}
+	}
+
+	starting := it.category() == CategoryDoing && (before == nil || before.category() != CategoryDoing)
+	if starting && it.OpenBlockers > 0 && !tx.Force {
+		return refused(409, "the task is blocked by tasks that are not done, start it with ?force=true to override")
+	}
+
+	return nil
+}
+
+// dropDependencies takes a deleted task out of the dependencies of the
+// tasks it was linked to. Tasks deleted in the same transaction are left
+// alone.
+func (tx *Tx) dropDependencies(ctx context.Context, it *Item) error {
+
+	for _, id := range it.BlockedBy {
+		blocker, err := tx.LoadItem(ctx, it.OwnerID, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		blocker.Blocks = slices.DeleteFunc(blocker.Blocks, func(b string) bool { return b == it.ItemID })
+		tx.PutItem(blocker)
+	}
+
+	for _, id := range it.Blocks {
+		dependent, err := tx.LoadItem(ctx, it.OwnerID, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dependent.BlockedBy = slices.DeleteFunc(dependent.BlockedBy, func(b string) bool { return b == it.ItemID })
+		if !it.Done() {
+			dependent.OpenBlockers = max(dependent.OpenBlockers-1, 0)
+		}
+		tx.PutItem(dependent)
+	}
+
+	return nil
+}
+
+// dependencyGraph returns the blockedBy lists of every task of projectID,
+// read once per transaction, with the tasks changed in it applied.
+func (tx *Tx) dependencyGraph(ctx context.Context, projectID string) (map[string][]string, error) {
+
+	graph, ok := tx.graphs[projectID]
+	if !ok {
+		graph = map[string][]string{}
+		err := tx.s.eachItem(ctx, ItemsByList, projectID, func(it *Item) error {
+			if len(it.BlockedBy) > 0 {
+				graph[it.ItemID] = it.BlockedBy
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		tx.graphs[projectID] = graph
+	}
+
+	for id, it := range tx.items {
+		if it.ProjectID == projectID {
+			graph[id] = it.BlockedBy
+		}
+	}
+	return graph, nil
+}
+
+// reaches reports whether to can be reached from from by following the
+// edges of graph, visiting at most limit tasks. complete is false when the
+// walk stopped at the limit without an answer.
+func reaches(graph map[string][]string, from, to string, limit int) (found, complete bool) {
+
+	seen := map[string]bool{from: true}
+	queue := []string{from}
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		if id == to {
+			return true, true
+		}
+		if len(seen) > limit {
+			return false, false
+		}
+
+		for _, next := range graph[id] {
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return false, true
+}
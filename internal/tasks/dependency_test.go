@@ -0,0 +1,102 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestAddBlocker(t *testing.T) {
+
+	a := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted}
+	b := &Item{ItemID: "b", OwnerID: "u1", ProjectID: "p1", Status: StatusInProgress}
+	tx := subtaskTx(false, a, b)
+
+	ids := []string{"b"}
+	if err := tx.PatchItem(context.Background(), a, ItemPatch{BlockedBy: &ids}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(b.Blocks, []string{"a"}) {
+		t.Errorf("blocker's blocks = %v", b.Blocks)
+	}
+	if a.OpenBlockers != 1 {
+		t.Errorf("openBlockers = %d, want 1", a.OpenBlockers)
+	}
+}
+
+func TestDependencyCycleIsRefused(t *testing.T) {
+
+	// c waits for a, a waits for b: b waiting for c closes the loop.
+	a := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, BlockedBy: []string{"b"}, Blocks: []string{"c"}, OpenBlockers: 1}
+	b := &Item{ItemID: "b", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, Blocks: []string{"a"}}
+	c := &Item{ItemID: "c", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, BlockedBy: []string{"a"}, OpenBlockers: 1}
+	tx := subtaskTx(false, a, b, c)
+
+	ids := []string{"c"}
+	err := tx.PatchItem(context.Background(), b, ItemPatch{BlockedBy: &ids})
+
+	var te *Error
+	if !errors.As(err, &te) || te.Code != 409 {
+		t.Errorf("dependency cycle: err = %v", err)
+	}
+}
+
+func TestBlockedStartNeedsForce(t *testing.T) {
+
+	for _, force := range []bool{false, true} {
+		a := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, BlockedBy: []string{"b"}, OpenBlockers: 1}
+		b := &Item{ItemID: "b", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, Blocks: []string{"a"}}
+		tx := subtaskTx(false, a, b)
+
+		start := StatusInProgress
+		err := tx.PatchItem(context.Background(), a, ItemPatch{Status: &start, Force: force})
+		if got := err == nil; got != force {
+			t.Errorf("force=%v: err = %v", force, err)
+		}
+	}
+}
+
+func TestBlockerDoneUnblocks(t *testing.T) {
+
+	a := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, BlockedBy: []string{"b"}, OpenBlockers: 1}
+	b := &Item{ItemID: "b", OwnerID: "u1", ProjectID: "p1", Status: StatusInProgress, Blocks: []string{"a"}}
+	tx := subtaskTx(false, a, b)
+
+	done := StatusDone
+	if err := tx.PatchItem(context.Background(), b, ItemPatch{Status: &done}); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.OpenBlockers != 0 || tx.Item("a") == nil {
+		t.Errorf("dependent openBlockers = %d, staged = %v", a.OpenBlockers, tx.Item("a") != nil)
+	}
+}
+
+func TestCriticalPath(t *testing.T) {
+
+	nodes := []GraphNode{
+		{ItemID: "a", Status: StatusDone, Category: CategoryDone, EstimateHours: 40},
+		{ItemID: "b", Status: StatusNotStarted, EstimateHours: 2},
+		{ItemID: "c", Status: StatusNotStarted, EstimateHours: 5},
+		{ItemID: "d", Status: StatusNotStarted, EstimateHours: 1},
+		{ItemID: "e", Status: StatusNotStarted, EstimateHours: 3},
+	}
+	edges := []GraphEdge{
+		{From: "a", To: "d"},
+		{From: "b", To: "d"},
+		{From: "c", To: "e"},
+		{From: "d", To: "e"},
+	}
+
+	path, hours := criticalPath(nodes, edges)
+	if !slices.Equal(path, []string{"c", "e"}) || hours != 8 {
+		t.Errorf("critical path = %v (%vh), want [c e] (8h)", path, hours)
+	}
+
+	path, hours = criticalPath(nil, nil)
+	if len(path) != 0 || hours != 0 {
+		t.Errorf("empty graph: %v (%vh)", path, hours)
+	}
+}
@@ -0,0 +1,357 @@
+package tasks
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/pagination"
+)
+
+// Sort orders of an item list. A leading "-" means descending.
+const (
+	SortDueDate   = "dueDate"
+	SortPriority  = "priority"
+	SortCreatedAt = "createdAt"
+	SortRank      = "rank"
+)
+
+// Label modes: a task must carry all of the filter's labels, or any one.
+const (
+	LabelModeAll = "all"
+	LabelModeAny = "any"
+)
+
+// ItemFilter is the query string of an item list:
+//
+//	?status=In Progress,Done&priority=high,urgent&minPriority=high
+//	&dueAfter=2026-10-19&dueBefore=2026-10-26&sort=dueDate|-priority|createdAt|rank
+//	&labels=<labelId>,<labelId>&labelMode=all|any&archived=true
+//
+// Archived lists the project's archive instead of its tasks.
+type ItemFilter struct {
+	Statuses    []string
+	Priorities  []Priority
+	MinPriority Priority
+	DueAfter    string
+	DueBefore   string
+	Labels      []string
+	LabelMode   string
+	Sort        string
+	Descending  bool
+	Archived    bool
+}
+
+// ParseItemFilter reads an ItemFilter from the query string q.
+func ParseItemFilter(q map[string]string) (ItemFilter, error) {
+
+	f := ItemFilter{Sort: SortDueDate, LabelMode: LabelModeAll}
+
+	// Statuses are checked against the project's workflow by ListItems.
+	f.Statuses = splitList(q["status"])
+	if len(f.Statuses) > maxWorkflowStates {
+		return ItemFilter{}, invalid("at most %d statuses", maxWorkflowStates)
+	}
+
+	for _, s := range splitList(q["priority"]) {
+		p, ok := ParsePriority(s)
+		if !ok {
+			return ItemFilter{}, invalid("unknown priority %q", s)
+		}
+		f.Priorities = append(f.Priorities, p)
+	}
+
+	if s := q["minPriority"]; s != "" {
+		p, ok := ParsePriority(s)
+		if !ok {
+			return ItemFilter{}, invalid("unknown priority %q", s)
+		}
+		f.MinPriority = p
+	}
+
+	var err error
+	if f.DueAfter, err = parseBound(q["dueAfter"]); err != nil {
+		return ItemFilter{}, invalid("dueAfter must be a date (2026-10-19) or an RFC 3339 time")
+	}
+	if f.DueBefore, err = parseBound(q["dueBefore"]); err != nil {
+		return ItemFilter{}, invalid("dueBefore must be a date (2026-10-19) or an RFC 3339 time")
+	}
+
+	f.Labels = splitList(q["labels"])
+	if len(f.Labels) > maxItemLabels {
+		return ItemFilter{}, invalid("filter on at most %d labels", maxItemLabels)
+	}
+
+	if s := q["labelMode"]; s != "" {
+		f.LabelMode = strings.ToLower(s)
+		if f.LabelMode != LabelModeAll && f.LabelMode != LabelModeAny {
+			return ItemFilter{}, invalid("labelMode must be all or any")
+		}
+	}
+
+	if s := q["sort"]; s != "" {
+		f.Descending = strings.HasPrefix(s, "-")
+		f.Sort = strings.TrimPrefix(s, "-")
+		switch f.Sort {
+		case SortDueDate, SortPriority, SortCreatedAt, SortRank:
+		default:
+			return ItemFilter{}, invalid("sort must be dueDate, priority, createdAt or rank, with - for descending")
+		}
+	}
+
+	if s := q["archived"]; s != "" {
+		if f.Archived, err = strconv.ParseBool(s); err != nil {
+			return ItemFilter{}, invalid("archived must be true or false")
+		}
+	}
+
+	return f, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// parseBound accepts a date, meaning midnight UTC, or an RFC 3339 time.
+func parseBound(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t.UTC().Format(time.RFC3339), nil
+	}
+	return ParseTime(s)
+}
+
+// Scope returns the filter in a canonical form, for binding cursors to it.
+func (f ItemFilter) Scope() string {
+
+	statuses := append([]string(nil), f.Statuses...)
+	sort.Strings(statuses)
+
+	var prios []string
+	for _, p := range f.Priorities {
+		prios = append(prios, p.String())
+	}
+	sort.Strings(prios)
+
+	labels := append([]string(nil), f.Labels...)
+	sort.Strings(labels)
+
+	return strings.Join([]string{
+		"status=" + strings.Join(statuses, ","),
+		"labels=" + strings.Join(labels, ",") + "/" + f.LabelMode,
+		"priority=" + strings.Join(prios, ","),
+		"minPriority=" + f.MinPriority.String(),
+		"dueAfter=" + f.DueAfter,
+		"dueBefore=" + f.DueBefore,
+		"sort=" + f.Sort + strconv.FormatBool(f.Descending),
+		"archived=" + strconv.FormatBool(f.Archived),
+	}, "\n")
+}
+
+// queryBuilder collects the parts of a Query expression.
+type queryBuilder struct {
+	keys    []string
+	filters []string
+	names   map[string]string
+	values  map[string]types.AttributeValue
+}
+
+func newQueryBuilder() *queryBuilder {
+	return &queryBuilder{names: map[string]string{}, values: map[string]types.AttributeValue{}}
+}
+
+func (b *queryBuilder) value(name, v string) string {
+	b.values[name] = &types.AttributeValueMemberS{Value: v}
+	return name
+}
+
+// Query returns the Query on the items table that lists the items of
+// listKey matching f, in f's order, and the index it reads.
+//
+// The index is picked so the sort order and as much of the filter as
+// possible are part of the key condition: one status sorted by due date
+// reads status-due-index, a priority sort reads list-priority-index with
+// minPriority as a key range, and so on. Whatever the key cannot express is
+// added as a FilterExpression on the same Query, never a Scan.
+func (f ItemFilter) Query(table, listKey string) (*dynamodb.QueryInput, Index) {
+
+	b := newQueryBuilder()
+	var index Index
+
+	dueInKey := false
+
+	switch {
+	case f.Sort == SortCreatedAt:
+		index = ItemsByList
+		b.keys = append(b.keys, "listKey = "+b.value(":listKey", listKey))
+
+	case f.Sort == SortRank:
+		index = ItemsByRank
+		b.keys = append(b.keys, "listKey = "+b.value(":listKey", listKey))
+
+	case f.Sort == SortPriority:
+		index = ItemsByPriority
+		b.keys = append(b.keys, "listKey = "+b.value(":listKey", listKey))
+
+		switch {
+		case len(f.Priorities) == 1:
+			b.keys = append(b.keys, "begins_with(prioritySort, "+b.value(":priority", strconv.Itoa(int(f.Priorities[0]))+"#")+")")
+		case f.MinPriority > 0:
+			b.keys = append(b.keys, "prioritySort >= "+b.value(":minPriority", strconv.Itoa(int(f.MinPriority))))
+		}
+
+	case len(f.Statuses) == 1:
+		index = ItemsByStatus
+		b.keys = append(b.keys, "statusKey = "+b.value(":statusKey", listKey+"#"+f.Statuses[0]))
+		dueInKey = true
+
+	default:
+		index = ItemsByDue
+		b.keys = append(b.keys, "listKey = "+b.value(":listKey", listKey))
+		dueInKey = true
+	}
+
+	f.dueRange(b, dueInKey)
+
+	if len(f.Statuses) > 1 || (len(f.Statuses) == 1 && index != ItemsByStatus) {
+		var in []string
+		for i, s := range f.Statuses {
+			in = append(in, b.value(":status"+strconv.Itoa(i), s))
+		}
+		b.names["#status"] = "status"
+		b.filters = append(b.filters, "#status IN ("+strings.Join(in, ", ")+")")
+	}
+
+	if len(f.Priorities) > 0 && !(index == ItemsByPriority && len(f.Priorities) == 1) {
+		var in []string
+		for i, p := range f.Priorities {
+			k := ":p" + strconv.Itoa(i)
+			b.values[k] = &types.AttributeValueMemberN{Value: strconv.Itoa(int(p))}
+			in = append(in, k)
+		}
+		b.names["#priority"] = "priority"
+		b.filters = append(b.filters, "#priority IN ("+strings.Join(in, ", ")+")")
+	}
+
+	if f.MinPriority > 0 && !(index == ItemsByPriority && len(f.Priorities) != 1) {
+		b.values[":minPriorityN"] = &types.AttributeValueMemberN{Value: strconv.Itoa(int(f.MinPriority))}
+		b.names["#priority"] = "priority"
+		b.filters = append(b.filters, "#priority >= :minPriorityN")
+	}
+
+	if len(f.Labels) > 0 {
+		var has []string
+		for i, l := range f.Labels {
+			has = append(has, "contains(labelIds, "+b.value(":label"+strconv.Itoa(i), l)+")")
+		}
+		op := " AND "
+		if f.LabelMode == LabelModeAny {
+			op = " OR "
+		}
+		b.filters = append(b.filters, "("+strings.Join(has, op)+")")
+	}
+
+	return f.build(b, table, index), index
+}
+
+// dueRange limits dueSort to [dueAfter, dueBefore). dueSort starts with the
+// due date and is NoDate for items without one, which sorts after every
+// date, so "due after" needs an upper bound to leave undated items out.
+func (f ItemFilter) dueRange(b *queryBuilder, inKey bool) {
+
+	if f.DueAfter == "" && f.DueBefore == "" {
+		return
+	}
+
+	lo := f.DueAfter
+	hi := f.DueBefore
+	if hi == "" {
+		hi = NoDate
+	}
+
+	if inKey {
+		if lo == "" {
+			b.keys = append(b.keys, "dueSort < "+b.value(":dueBefore", hi))
+			return
+		}
+		b.keys = append(b.keys, "dueSort BETWEEN "+b.value(":dueAfter", lo)+" AND "+b.value(":dueBefore", hi))
+		return
+	}
+
+	b.filters = append(b.filters, "dueSort < "+b.value(":dueBefore", hi))
+	if lo != "" {
+		b.filters = append(b.filters, "dueSort >= "+b.value(":dueAfter", lo))
+	}
+}
+
+func (f ItemFilter) build(b *queryBuilder, table string, index Index) *dynamodb.QueryInput {
+
+	in := &dynamodb.QueryInput{
+		TableName:                 aws.String(table),
+		IndexName:                 aws.String(index.Name),
+		KeyConditionExpression:    aws.String(strings.Join(b.keys, " AND ")),
+		ExpressionAttributeNames:  nilIfEmpty(b.names),
+		ExpressionAttributeValues: b.values,
+		ScanIndexForward:          aws.Bool(!f.Descending),
+	}
+
+	if len(b.filters) > 0 {
+		in.FilterExpression = aws.String(strings.Join(b.filters, " AND "))
+	}
+
+	return in
+}
+
+// ListItems returns a page of the items of project projectID of ownerID
+// matching f, or of its archive with f.Archived, with the key to continue
+// after it.
+func (s *Store) ListItems(ctx context.Context, ownerID, projectID string, f ItemFilter, r pagination.Request) ([]Item, map[string]types.AttributeValue, error) {
+
+	project, err := s.GetProject(ctx, ownerID, projectID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w := project.EffectiveWorkflow()
+	f.Statuses = slices.Clone(f.Statuses)
+	for i, name := range f.Statuses {
+		state, ok := w.state(name)
+		if !ok {
+			return nil, nil, invalid("unknown status %q, this project's states are %s", name, w.names())
+		}
+		f.Statuses[i] = state.Name
+	}
+
+	listKey := projectID
+	if f.Archived {
+		listKey = archiveList(projectID)
+	}
+	in, index := f.Query(s.Items, listKey)
+
+	raw, lastKey, err := pagination.Query(ctx, s.DB, in, r, index.KeyNames("itemId")...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items := []Item{}
+	if err := attributevalue.UnmarshalListOfMaps(raw, &items); err != nil {
+		return nil, nil, err
+	}
+	return items, lastKey, nil
+}
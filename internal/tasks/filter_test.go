@@ -0,0 +1,172 @@
+package tasks
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestItemFilterQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		q         map[string]string
+		index     string
+		key       string
+		filter    string
+		ascending bool
+	}{
+		{
+			name:      "default sorts by due date",
+			q:         map[string]string{},
+			index:     "list-due-index",
+			key:       "listKey = :listKey",
+			ascending: true,
+		},
+		{
+			name:      "one status due this week is a key range",
+			q:         map[string]string{"status": "in progress", "dueAfter": "2026-10-19", "dueBefore": "2026-10-26"},
+			index:     "status-due-index",
+			key:       "statusKey = :statusKey AND dueSort BETWEEN :dueAfter AND :dueBefore",
+			ascending: true,
+		},
+		{
+			name:      "two statuses are filtered",
+			q:         map[string]string{"status": "Not Started,Done"},
+			index:     "list-due-index",
+			key:       "listKey = :listKey",
+			filter:    "#status IN (:status0, :status1)",
+			ascending: true,
+		},
+		{
+			name:   "priority at least high, highest first",
+			q:      map[string]string{"minPriority": "high", "sort": "-priority"},
+			index:  "list-priority-index",
+			key:    "listKey = :listKey AND prioritySort >= :minPriority",
+			filter: "",
+		},
+		{
+			name:      "exact priority sorted by priority is a key prefix",
+			q:         map[string]string{"priority": "urgent", "sort": "priority", "dueBefore": "2026-10-26"},
+			index:     "list-priority-index",
+			key:       "listKey = :listKey AND begins_with(prioritySort, :priority)",
+			filter:    "dueSort < :dueBefore",
+			ascending: true,
+		},
+		{
+			name:   "created order filters everything else",
+			q:      map[string]string{"sort": "-createdAt", "status": "Done", "minPriority": "2", "dueAfter": "2026-10-19T08:00:00+02:00"},
+			index:  "list-index",
+			key:    "listKey = :listKey",
+			filter: "dueSort < :dueBefore AND dueSort >= :dueAfter AND #status IN (:status0) AND #priority >= :minPriorityN",
+		},
+		{
+			name:      "manual order of one column filters the status",
+			q:         map[string]string{"sort": "rank", "status": "In Progress"},
+			index:     "list-rank-index",
+			key:       "listKey = :listKey",
+			filter:    "#status IN (:status0)",
+			ascending: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseItemFilter(tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			in, index := f.Query("items", "p1")
+
+			if index.Name != tt.index || aws.ToString(in.IndexName) != tt.index {
+				t.Errorf("index = %q, want %q", index.Name, tt.index)
+			}
+			if got := aws.ToString(in.KeyConditionExpression); got != tt.key {
+				t.Errorf("key condition = %q, want %q", got, tt.key)
+			}
+			if got := aws.ToString(in.FilterExpression); got != tt.filter {
+				t.Errorf("filter = %q, want %q", got, tt.filter)
+			}
+			if got := aws.ToBool(in.ScanIndexForward); got != tt.ascending {
+				t.Errorf("ascending = %v, want %v", got, tt.ascending)
+			}
+
+			for _, expr := range []string{aws.ToString(in.KeyConditionExpression), aws.ToString(in.FilterExpression)} {
+				for _, word := range strings.Fields(expr) {
+					word = strings.Trim(word, "(),")
+					if strings.HasPrefix(word, ":") && in.ExpressionAttributeValues[word] == nil {
+						t.Errorf("value %s is not set", word)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseItemFilterRejects(t *testing.T) {
+	for _, q := range []map[string]string{
+		{"status": strings.Repeat("s,", maxWorkflowStates+1)},
+		{"priority": "extreme"},
+		{"minPriority": "0"},
+		{"dueBefore": "next week"},
+		{"sort": "title"},
+		{"labels": "a", "labelMode": "some"},
+	} {
+		if _, err := ParseItemFilter(q); err == nil {
+			t.Errorf("ParseItemFilter(%v) accepted an invalid filter", q)
+		}
+	}
+}
+
+func TestLabelFilter(t *testing.T) {
+	tests := []struct {
+		q      map[string]string
+		filter string
+	}{
+		{map[string]string{"labels": "l1,l2"}, "(contains(labelIds, :label0) AND contains(labelIds, :label1))"},
+		{map[string]string{"labels": "l1,l2", "labelMode": "any"}, "(contains(labelIds, :label0) OR contains(labelIds, :label1))"},
+		{map[string]string{"labels": "l1", "status": "Done,In Progress", "labelMode": "ANY"}, "#status IN (:status0, :status1) AND (contains(labelIds, :label0))"},
+	}
+
+	for _, tt := range tests {
+		f, err := ParseItemFilter(tt.q)
+		if err != nil {
+			t.Fatalf("ParseItemFilter(%v): %v", tt.q, err)
+		}
+		in, _ := f.Query("items", "p1")
+		if got := aws.ToString(in.FilterExpression); got != tt.filter {
+			t.Errorf("%v: filter %q, want %q", tt.q, got, tt.filter)
+		}
+	}
+
+	all, _ := ParseItemFilter(map[string]string{"labels": "l1,l2"})
+	anyOf, _ := ParseItemFilter(map[string]string{"labels": "l2,l1", "labelMode": "any"})
+	if all.Scope() == anyOf.Scope() {
+		t.Error("labelMode is not part of the cursor scope")
+	}
+}
+
+func TestDueRangeKeepsUndatedItemsOut(t *testing.T) {
+	f, _ := ParseItemFilter(map[string]string{"dueAfter": "2026-10-19"})
+	in, _ := f.Query("items", "p1")
+
+	hi, ok := in.ExpressionAttributeValues[":dueBefore"].(*types.AttributeValueMemberS)
+	if !ok {
+		t.Fatal("dueAfter alone sets no upper bound")
+	}
+
+	undated := &Item{ItemID: "x"}
+	undated.derive()
+
+	dated := &Item{ItemID: "y", DueDate: "2099-12-31T23:59:59Z"}
+	dated.derive()
+
+	if undated.DueSort <= hi.Value {
+		t.Errorf("undated dueSort %q falls inside the range ending at %q", undated.DueSort, hi.Value)
+	}
+	if dated.DueSort >= hi.Value {
+		t.Errorf("dated dueSort %q falls outside the range ending at %q", dated.DueSort, hi.Value)
+	}
+}
@@ -0,0 +1,145 @@
+package tasks
+
+import (
+	"context"
+	"slices"
+)
+
+// Graph is the dependency graph of a project's tasks.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+
+	// CriticalPath is the chain of dependent tasks with the most estimated
+	// work left, first task first. Done tasks count for no work.
+	CriticalPath  []string `json:"criticalPath"`
+	CriticalHours float64  `json:"criticalHours"`
+}
+
+// GraphNode is one task of the graph.
+type GraphNode struct {
+	ItemID        string  `json:"itemId"`
+	Title         string  `json:"title"`
+	Status        string  `json:"status"`
+	Category      string  `json:"category"`
+	DueDate       string  `json:"dueDate,omitempty"`
+	EstimateHours float64 `json:"estimateHours,omitempty"`
+	Blocked       bool    `json:"blocked"`
+}
+
+// GraphEdge says task From has to be done before task To.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ProjectGraph returns the dependency graph of project projectID.
+func (s *Store) ProjectGraph(ctx context.Context, ownerID, projectID string) (*Graph, error) {
+
+	if _, err := s.GetProject(ctx, ownerID, projectID); err != nil {
+		return nil, err
+	}
+
+	g := &Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}, CriticalPath: []string{}}
+
+	err := s.eachItem(ctx, ItemsByList, projectID, func(it *Item) error {
+		g.Nodes = append(g.Nodes, GraphNode{
+			ItemID:        it.ItemID,
+			Title:         it.Title,
+			Status:        it.Status,
+			Category:      it.category(),
+			DueDate:       it.DueDate,
+			EstimateHours: it.EstimateHours,
+			Blocked:       it.OpenBlockers > 0,
+		})
+		for _, b := range it.BlockedBy {
+			g.Edges = append(g.Edges, GraphEdge{From: b, To: it.ItemID})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	g.CriticalPath, g.CriticalHours = criticalPath(g.Nodes, g.Edges)
+	return g, nil
+}
+
+// criticalPath returns the path through the graph with the most hours of
+// work left, and those hours. Tasks in a done state count for none. Between paths of equal hours the one with
+// more tasks wins, then the one ending at the lowest task id.
+func criticalPath(nodes []GraphNode, edges []GraphEdge) ([]string, float64) {
+
+	hours := map[string]float64{}
+	for _, n := range nodes {
+		if n.Category != CategoryDone {
+			hours[n.ItemID] = n.EstimateHours
+		} else {
+			hours[n.ItemID] = 0
+		}
+	}
+
+	blockers := map[string][]string{}
+	for _, e := range edges {
+		if _, ok := hours[e.From]; ok {
+			blockers[e.To] = append(blockers[e.To], e.From)
+		}
+	}
+
+	type best struct {
+		hours float64
+		count int
+		prev  string
+	}
+	better := func(a, b best) bool {
+		return a.hours > b.hours || a.hours == b.hours && a.count > b.count
+	}
+
+	// Longest path ending at each task, blockers first. A cycle, which
+	// updateDependencies never lets in, is cut where the walk meets it.
+	memo := map[string]best{}
+	visiting := map[string]bool{}
+	var walk func(id string) best
+	walk = func(id string) best {
+		if b, ok := memo[id]; ok {
+			return b
+		}
+		visiting[id] = true
+
+		var top best
+		for _, from := range blockers[id] {
+			if visiting[from] {
+				continue
+			}
+			if b := walk(from); top.prev == "" || better(b, top) {
+				top = best{hours: b.hours, count: b.count, prev: from}
+			}
+		}
+
+		b := best{hours: top.hours + hours[id], count: top.count + 1, prev: top.prev}
+		visiting[id] = false
+		memo[id] = b
+		return b
+	}
+
+	ids := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		ids = append(ids, n.ItemID)
+	}
+	slices.Sort(ids)
+
+	var end string
+	var top best
+	for _, id := range ids {
+		if b := walk(id); end == "" || better(b, top) {
+			end, top = id, b
+		}
+	}
+
+	path := []string{}
+	for id := end; id != ""; id = memo[id].prev {
+		path = append(path, id)
+	}
+	slices.Reverse(path)
+	return path, top.hours
+}
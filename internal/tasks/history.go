@@ -0,0 +1,307 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/auth"
+	"to_do_list_demo/internal/etag"
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/storage"
+)
+
+// ActorSystem is the actor of changes made without a caller, such as the
+// scheduled jobs.
+const ActorSystem = "system"
+
+// Fields of the entries recording a project or item was created, moved to
+// the trash and restored from it, archived and unarchived.
+const (
+	FieldCreated    = "created"
+	FieldDeleted    = "deleted"
+	FieldRestored   = "restored"
+	FieldArchived   = "archived"
+	FieldUnarchived = "unarchived"
+)
+
+// HistoryByOwner holds every history entry of a user, for account deletion.
+var HistoryByOwner = Index{Name: "owner-index", PartitionKey: "ownerId", SortKey: "entryId"}
+
+// HistoryEntry is one changed field of a project or item. Before and After
+// are the field's JSON values, as in the API.
+type HistoryEntry struct {
+	TargetID  string          `json:"-" dynamodbav:"targetId"`
+	EntryID   string          `json:"entryId" dynamodbav:"entryId"`
+	OwnerID   string          `json:"-" dynamodbav:"ownerId"`
+	ActorID   string          `json:"actorId" dynamodbav:"actorId"`
+	ChangedAt string          `json:"changedAt" dynamodbav:"changedAt"`
+	Field     string          `json:"field" dynamodbav:"field"`
+	Before    json.RawMessage `json:"before" dynamodbav:"before,omitempty"`
+	After     json.RawMessage `json:"after" dynamodbav:"after,omitempty"`
+}
+
+type actorKey struct{}
+
+// WithActor returns a context whose changes are recorded in the history as
+// made by actorID.
+func WithActor(ctx context.Context, actorID string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actorID)
+}
+
+// Acting runs next with the caller as the actor of its changes: the user,
+// or the staff member behind an impersonation session.
+func Acting(next auth.Handler) auth.Handler {
+	return func(ctx context.Context, req events.APIGatewayV2HTTPRequest, p *auth.Principal) (events.APIGatewayV2HTTPResponse, error) {
+		return next(WithActor(ctx, p.Actor()), req, p)
+	}
+}
+
+func actorOf(ctx context.Context) string {
+	if a, ok := ctx.Value(actorKey{}).(string); ok && a != "" {
+		return a
+	}
+	return ActorSystem
+}
+
+// field is a field of T the history keeps track of, under its name in the
+// API. value returns it as the API writes it, lists never nil.
+type field[T any] struct {
+	name  string
+	value func(T) any
+}
+
+var itemFields = []field[*Item]{
+	{"title", func(it *Item) any { return it.Title }},
+	{"description", func(it *Item) any { return it.Description }},
+	{"status", func(it *Item) any { return it.Status }},
+	{"assignee", func(it *Item) any { return it.Assignee }},
+	{"priority", func(it *Item) any { return it.Priority }},
+	{"dueDate", func(it *Item) any { return it.DueDate }},
+	{"labelIds", func(it *Item) any { return orEmpty(it.LabelIDs) }},
+	{"checklist", func(it *Item) any { return orEmpty(it.Checklist) }},
+	{"parentId", func(it *Item) any { return it.ParentID }},
+	{"projectId", func(it *Item) any { return it.ProjectID }},
+	{"blockedBy", func(it *Item) any { return orEmpty(it.BlockedBy) }},
+	{"estimateHours", func(it *Item) any { return it.EstimateHours }},
+	{"rrule", func(it *Item) any {
+		if it.Recurrence == nil {
+			return ""
+		}
+		return it.Recurrence.RRule
+	}},
+	{"repeatAfterDays", func(it *Item) any {
+		if it.Recurrence == nil {
+			return 0
+		}
+		return it.Recurrence.AfterDays
+	}},
+}
+
+var projectFields = []field[*Project]{
+	{"name", func(p *Project) any { return p.Name }},
+	{"description", func(p *Project) any { return p.Description }},
+	{"autoCompleteParent", func(p *Project) any { return p.AutoCompleteParent }},
+	{"autoArchiveDoneAfterDays", func(p *Project) any { return p.AutoArchiveDays }},
+	{"workflow", func(p *Project) any { return p.Workflow }},
+}
+
+func orEmpty[S ~[]E, E any](s S) S {
+	if s == nil {
+		return S{}
+	}
+	return s
+}
+
+// changes returns an entry for every field that differs between before and
+// after, or the created entry when before is nil.
+func changes[T any](fields []field[T], before, after T, isNew bool) ([]HistoryEntry, error) {
+
+	if isNew {
+		return []HistoryEntry{{Field: FieldCreated}}, nil
+	}
+
+	var entries []HistoryEntry
+	for _, f := range fields {
+		b, err := json.Marshal(f.value(before))
+		if err != nil {
+			return nil, err
+		}
+		a, err := json.Marshal(f.value(after))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(a, b) {
+			entries = append(entries, HistoryEntry{Field: f.name, Before: b, After: a})
+		}
+	}
+	return entries, nil
+}
+
+// recordItem stages the history entries of the change of it from before
+// (nil for a new item).
+func (tx *Tx) recordItem(ctx context.Context, before, it *Item) error {
+
+	entries, err := changes(itemFields, before, it, before == nil)
+	if err != nil {
+		return err
+	}
+	return tx.record(ctx, it.ItemID, it.OwnerID, entries)
+}
+
+// recordProject is recordItem for projects.
+func (tx *Tx) recordProject(ctx context.Context, before, p *Project) error {
+
+	entries, err := changes(projectFields, before, p, before == nil)
+	if err != nil {
+		return err
+	}
+	return tx.record(ctx, p.ProjectID, p.OwnerID, entries)
+}
+
+func (tx *Tx) record(ctx context.Context, targetID, ownerID string, entries []HistoryEntry) error {
+
+	ts, actor := now(), actorOf(ctx)
+	for _, e := range entries {
+		e.TargetID, e.EntryID, e.OwnerID = targetID, NewID(), ownerID
+		e.ActorID, e.ChangedAt = actor, ts
+
+		item, err := attributevalue.MarshalMap(e)
+		if err != nil {
+			return err
+		}
+		tx.Add(types.TransactWriteItem{Put: &types.Put{
+			TableName: aws.String(tx.s.History),
+			Item:      item,
+		}})
+	}
+	return nil
+}
+
+// ListHistory returns a page of the changes to item itemID, newest first.
+func (s *Store) ListHistory(ctx context.Context, ownerID, itemID string, r pagination.Request) ([]HistoryEntry, map[string]types.AttributeValue, error) {
+
+	if _, err := s.GetItem(ctx, ownerID, itemID); err != nil {
+		return nil, nil, err
+	}
+	return s.history(ctx, itemID, r)
+}
+
+// ProjectHistory returns a page of the changes to project projectID itself,
+// newest first.
+func (s *Store) ProjectHistory(ctx context.Context, ownerID, projectID string, r pagination.Request) ([]HistoryEntry, map[string]types.AttributeValue, error) {
+
+	if _, err := s.GetProject(ctx, ownerID, projectID); err != nil {
+		return nil, nil, err
+	}
+	return s.history(ctx, projectID, r)
+}
+
+func (s *Store) history(ctx context.Context, targetID string, r pagination.Request) ([]HistoryEntry, map[string]types.AttributeValue, error) {
+
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(s.History),
+		KeyConditionExpression: aws.String("targetId = :target"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":target": &types.AttributeValueMemberS{Value: targetID},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+
+	raw, lastKey, err := pagination.Query(ctx, s.DB, in, r, "targetId", "entryId")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := []HistoryEntry{}
+	if err := attributevalue.UnmarshalListOfMaps(raw, &entries); err != nil {
+		return nil, nil, err
+	}
+	return entries, lastKey, nil
+}
+
+// RevertChange sets the field changed by history entry entryID of item
+// itemID back to its value before. The field must still have the value
+// the entry gave it, else the revert is refused with 409. The revert goes
+// through the same checks as any change and is recorded like one.
+func (s *Store) RevertChange(ctx context.Context, ownerID, itemID, entryID string, pre *etag.Precondition) (*Item, error) {
+
+	out, err := s.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.History),
+		Key: map[string]types.AttributeValue{
+			"targetId": &types.AttributeValueMemberS{Value: itemID},
+			"entryId":  &types.AttributeValueMemberS{Value: entryID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	var e HistoryEntry
+	if err := attributevalue.UnmarshalMap(out.Item, &e); err != nil {
+		return nil, err
+	}
+	if e.OwnerID != ownerID {
+		return nil, ErrNotFound
+	}
+
+	return s.UpdateItem(ctx, ownerID, itemID, pre, func(tx *Tx, it *Item) error {
+		return tx.revert(ctx, it, &e)
+	})
+}
+
+// revert undoes the change e made to it, which must be the latest change
+// to its field.
+func (tx *Tx) revert(ctx context.Context, it *Item, e *HistoryEntry) error {
+
+	i := slices.IndexFunc(itemFields, func(f field[*Item]) bool { return f.name == e.Field })
+	if i < 0 {
+		return invalid("a %s entry cannot be reverted", e.Field)
+	}
+
+	current, err := json.Marshal(itemFields[i].value(it))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, e.After) {
+		return refused(409, "%s was changed again since, it is now %s", e.Field, current)
+	}
+
+	// The old value is set back through a patch of that one field, as the
+	// client would send it.
+	body, err := json.Marshal(map[string]json.RawMessage{e.Field: e.Before})
+	if err != nil {
+		return err
+	}
+	var p ItemPatch
+	if err := json.Unmarshal(body, &p); err != nil {
+		return err
+	}
+	if e.Field == "rrule" || e.Field == "repeatAfterDays" {
+		p.Scope = ScopeFollowing
+	}
+	return tx.PatchItem(ctx, it, p)
+}
+
+// deleteHistory deletes the history of the project or item targetID.
+func (s *Store) deleteHistory(ctx context.Context, targetID string) error {
+	return storage.DeleteQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:              aws.String(s.History),
+		KeyConditionExpression: aws.String("targetId = :target"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":target": &types.AttributeValueMemberS{Value: targetID},
+		},
+	}, "targetId", "entryId")
+}
@@ -0,0 +1,78 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+// stagedHistory returns the history entries staged on tx.
+func stagedHistory(t *testing.T, tx *Tx) []HistoryEntry {
+	t.Helper()
+
+	var entries []HistoryEntry
+	for _, w := range tx.extra {
+		if w.Put == nil {
+			continue
+		}
+		var e HistoryEntry
+		if err := attributevalue.UnmarshalMap(w.Put.Item, &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestChangesAreRecorded(t *testing.T) {
+
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Title: "Report", Status: StatusNotStarted, Priority: PriorityMedium}
+	tx := subtaskTx(false, it)
+	ctx := WithActor(context.Background(), "staff1")
+
+	title, due, labels := "Report", "2030-01-07T09:00:00Z", []string{}
+	if err := tx.PatchItem(ctx, it, ItemPatch{Title: &title, DueDate: &due, LabelIDs: &labels}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := stagedHistory(t, tx)
+	if len(entries) != 1 {
+		t.Fatalf("%d entries, want 1 for the due date: %+v", len(entries), entries)
+	}
+	e := entries[0]
+	if e.TargetID != "a" || e.OwnerID != "u1" || e.ActorID != "staff1" || e.Field != "dueDate" {
+		t.Errorf("entry = %+v", e)
+	}
+	if string(e.Before) != `""` || string(e.After) != `"2030-01-07T09:00:00Z"` {
+		t.Errorf("before %s, after %s", e.Before, e.After)
+	}
+}
+
+func TestRevert(t *testing.T) {
+
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Title: "Report", Status: StatusNotStarted, Priority: PriorityMedium}
+	tx := subtaskTx(false, it)
+
+	high := PriorityHigh
+	if err := tx.PatchItem(context.Background(), it, ItemPatch{Priority: &high}); err != nil {
+		t.Fatal(err)
+	}
+	e := stagedHistory(t, tx)[0]
+
+	if err := tx.revert(context.Background(), it, &e); err != nil {
+		t.Fatal(err)
+	}
+	if it.Priority != PriorityMedium {
+		t.Errorf("priority = %v after the revert, want medium", it.Priority)
+	}
+
+	var te *Error
+	if err := tx.revert(context.Background(), it, &e); !errors.As(err, &te) || te.Code != 409 {
+		t.Errorf("revert of a field changed since: %v, want 409", err)
+	}
+	if err := tx.revert(context.Background(), it, &HistoryEntry{Field: FieldCreated}); !errors.As(err, &te) || te.Code != 400 {
+		t.Errorf("revert of a creation: %v, want 400", err)
+	}
+}
@@ -0,0 +1,91 @@
+package tasks
+
+import (
+	"context"
+	"log"
+
+	"to_do_list_demo/internal/search"
+)
+
+// commentTitleLength is how much of a comment a search result shows.
+const commentTitleLength = 100
+
+func itemDoc(it *Item) *search.Doc {
+	return &search.Doc{
+		Type:      search.TypeItem,
+		ID:        it.ItemID,
+		OwnerID:   it.OwnerID,
+		ProjectID: it.ProjectID,
+		ItemID:    it.ItemID,
+		Status:    it.Status,
+		Title:     it.Title,
+		Fields: []search.Field{
+			{Name: "title", Weight: search.WeightTitle, Text: it.Title},
+			{Name: "description", Weight: search.WeightText, Text: it.Description},
+		},
+	}
+}
+
+func projectDoc(p *Project) *search.Doc {
+	return &search.Doc{
+		Type:      search.TypeProject,
+		ID:        p.ProjectID,
+		OwnerID:   p.OwnerID,
+		ProjectID: p.ProjectID,
+		Title:     p.Name,
+		Fields: []search.Field{
+			{Name: "name", Weight: search.WeightTitle, Text: p.Name},
+			{Name: "description", Weight: search.WeightText, Text: p.Description},
+		},
+	}
+}
+
+func commentDoc(c *Comment) *search.Doc {
+
+	title := []rune(c.Body)
+	if len(title) > commentTitleLength {
+		title = append(title[:commentTitleLength], '…')
+	}
+
+	return &search.Doc{
+		Type:      search.TypeComment,
+		ID:        c.CommentID,
+		OwnerID:   c.OwnerID,
+		ProjectID: c.ProjectID,
+		ItemID:    c.ItemID,
+		Title:     string(title),
+		Fields: []search.Field{
+			{Name: "body", Weight: search.WeightText, Text: c.Body},
+		},
+	}
+}
+
+// committed brings what depends on a committed project or item up to date:
+// its search index entry, which it loses while in the trash, and for a
+// deleted project or item everything that belonged to it.
+func (s *Store) committed(ctx context.Context, st *staged) {
+
+	switch {
+	case st.project != nil && st.delete:
+		s.indexed(s.ProjectPurged(ctx, st.project.OwnerID, st.project.ProjectID))
+	case st.project != nil && st.project.DeletedAt != "":
+		s.indexed(s.Search.Remove(ctx, st.project.OwnerID, search.TypeProject, st.project.ProjectID))
+	case st.project != nil:
+		s.indexed(s.Search.Put(ctx, projectDoc(st.project)))
+	case st.delete:
+		s.indexed(s.ItemPurged(ctx, st.item.OwnerID, st.item.ItemID))
+	case st.item.DeletedAt != "":
+		s.indexed(s.Search.Remove(ctx, st.item.OwnerID, search.TypeItem, st.item.ItemID))
+	default:
+		s.indexed(s.Search.Put(ctx, itemDoc(st.item)))
+	}
+}
+
+// indexed logs a failed index or cleanup write. The change itself is
+// committed by then, so it is not failed for it; the next write to the same
+// document repairs its index entry.
+func (s *Store) indexed(err error) {
+	if err != nil {
+		log.Println("search index error:", err)
+	}
+}
@@ -0,0 +1,655 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"to_do_list_demo/internal/etag"
+)
+
+// The statuses from the project notes, the states of DefaultWorkflow.
+const (
+	StatusNotStarted = "Not Started"
+	StatusInProgress = "In Progress"
+	StatusDone       = "Done"
+)
+
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 5000
+	maxItemLabels        = 20
+	maxChecklistEntries  = 50
+	maxChecklistText     = 200
+	maxAssigneeLength    = 100
+
+	// NoDate is the dueSort of an item without a due date. It sorts after
+	// every date, so undated items come last when sorting by due date.
+	NoDate = "~"
+)
+
+// Priority is stored as a number so "at least high" is a range on an index
+// key. In JSON it is written by name.
+type Priority int
+
+const (
+	PriorityLow Priority = iota + 1
+	PriorityMedium
+	PriorityHigh
+	PriorityUrgent
+)
+
+var priorityNames = []string{"", "low", "medium", "high", "urgent"}
+
+// ParsePriority accepts a priority name in any case or its number.
+func ParsePriority(s string) (Priority, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, name := range priorityNames {
+		if i > 0 && (s == name || s == strconv.Itoa(i)) {
+			return Priority(i), true
+		}
+	}
+	return 0, false
+}
+
+func (p Priority) String() string {
+	if p < PriorityLow || p > PriorityUrgent {
+		return ""
+	}
+	return priorityNames[p]
+}
+
+func (p Priority) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *Priority) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		s = string(b)
+	}
+	v, ok := ParsePriority(s)
+	if !ok {
+		return invalid("priority must be low, medium, high or urgent")
+	}
+	*p = v
+	return nil
+}
+
+// Item is a task in the items table.
+type Item struct {
+	ItemID      string   `json:"itemId" dynamodbav:"itemId"`
+	ProjectID   string   `json:"projectId" dynamodbav:"projectId"`
+	OwnerID     string   `json:"-" dynamodbav:"ownerId"`
+	Title       string   `json:"title" dynamodbav:"title"`
+	Description string   `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	Status      string   `json:"status" dynamodbav:"status"`
+	Category    string   `json:"category" dynamodbav:"category"`
+	Assignee    string   `json:"assignee,omitempty" dynamodbav:"assignee,omitempty"`
+	Priority    Priority `json:"priority" dynamodbav:"priority"`
+	DueDate     string   `json:"dueDate,omitempty" dynamodbav:"dueDate,omitempty"`
+	LabelIDs    []string `json:"labelIds,omitempty" dynamodbav:"labelIds,stringset,omitempty"`
+	CreatedAt   string   `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt   string   `json:"updatedAt" dynamodbav:"updatedAt"`
+	CompletedAt string   `json:"completedAt,omitempty" dynamodbav:"completedAt,omitempty"`
+	Version     int64    `json:"version" dynamodbav:"version"`
+
+	// ParentID is the task this one is a subtask of, Depth how many
+	// parents it has. ChildCount and ChildrenDone count its direct
+	// subtasks and are kept up to date in the same transaction as every
+	// change to them.
+	ParentID     string           `json:"parentId,omitempty" dynamodbav:"parentId,omitempty"`
+	Depth        int              `json:"depth" dynamodbav:"depth"`
+	ChildCount   int              `json:"childCount" dynamodbav:"childCount"`
+	ChildrenDone int              `json:"childrenDone" dynamodbav:"childrenDone"`
+	Checklist    []ChecklistEntry `json:"checklist,omitempty" dynamodbav:"checklist,omitempty"`
+	Progress     *Progress        `json:"progress,omitempty" dynamodbav:"progress,omitempty"`
+
+	// BlockedBy are the tasks of the same project that have to be done
+	// before this one, Blocks the tasks waiting for it. OpenBlockers counts
+	// the BlockedBy tasks not done yet; Blocked is OpenBlockers > 0.
+	BlockedBy     []string `json:"blockedBy,omitempty" dynamodbav:"blockedBy,stringset,omitempty"`
+	Blocks        []string `json:"blocks,omitempty" dynamodbav:"blocks,stringset,omitempty"`
+	OpenBlockers  int      `json:"-" dynamodbav:"openBlockers"`
+	Blocked       bool     `json:"blocked" dynamodbav:"blocked"`
+	EstimateHours float64  `json:"estimateHours,omitempty" dynamodbav:"estimateHours,omitempty"`
+
+	Recurrence *Recurrence `json:"recurrence,omitempty" dynamodbav:"recurrence,omitempty"`
+
+	// Rank places the task in its project's manual order, see rank.go.
+	Rank string `json:"rank,omitempty" dynamodbav:"rank,omitempty"`
+
+	// ReminderCount counts the task's reminders, changed in the same
+	// transaction as they are.
+	ReminderCount int `json:"reminderCount,omitempty" dynamodbav:"reminderCount,omitempty"`
+
+	// DeletedAt is set while the task is in the trash, DeletedWith is the
+	// project or task whose deletion took it along ("" when it was
+	// deleted itself). PurgeAt is when the table's TTL removes it.
+	DeletedAt   string `json:"deletedAt,omitempty" dynamodbav:"deletedAt,omitempty"`
+	DeletedWith string `json:"deletedWith,omitempty" dynamodbav:"deletedWith,omitempty"`
+	PurgeAt     int64  `json:"-" dynamodbav:"purgeAt,omitempty"`
+
+	// ArchivedAt is set while the task is archived, read-only and out of
+	// its project's lists. ArchivedWith is the project or task whose
+	// archiving took it along.
+	ArchivedAt   string `json:"archivedAt,omitempty" dynamodbav:"archivedAt,omitempty"`
+	ArchivedWith string `json:"archivedWith,omitempty" dynamodbav:"archivedWith,omitempty"`
+
+	// Index keys, worked out by derive on every write.
+	ListKey      string `json:"-" dynamodbav:"listKey,omitempty"`
+	StatusKey    string `json:"-" dynamodbav:"statusKey,omitempty"`
+	DueSort      string `json:"-" dynamodbav:"dueSort,omitempty"`
+	PrioritySort string `json:"-" dynamodbav:"prioritySort,omitempty"`
+	RankSort     string `json:"-" dynamodbav:"rankSort,omitempty"`
+
+	// OpenOwner is the ownerId while the item is neither done nor
+	// archived, and absent otherwise, so open-owner-due-index only holds
+	// open items.
+	OpenOwner string `json:"-" dynamodbav:"openOwner,omitempty"`
+
+	// TrashOwner and TrashSort are only set on a task deleted itself, so
+	// trash-index lists what the user deleted and not what went with it.
+	TrashOwner string `json:"-" dynamodbav:"trashOwner,omitempty"`
+	TrashSort  string `json:"-" dynamodbav:"trashSort,omitempty"`
+}
+
+// Indexes of the items table. listKey is the projectId of a live item, so
+// every index partitioned on it lists one project; a task in the archive or
+// the trash is listed under projectId#archive or projectId#trash instead.
+var (
+	// ItemsByList lists a project's items oldest first.
+	ItemsByList = Index{Name: "list-index", PartitionKey: "listKey", SortKey: "itemId"}
+
+	// ItemsByStatus lists a project's items in one status by due date.
+	ItemsByStatus = Index{Name: "status-due-index", PartitionKey: "statusKey", SortKey: "dueSort"}
+
+	// ItemsByDue lists a project's items by due date.
+	ItemsByDue = Index{Name: "list-due-index", PartitionKey: "listKey", SortKey: "dueSort"}
+
+	// ItemsByPriority lists a project's items by priority, then due date.
+	ItemsByPriority = Index{Name: "list-priority-index", PartitionKey: "listKey", SortKey: "prioritySort"}
+
+	// ItemsByRank lists a project's items in their manual order.
+	ItemsByRank = Index{Name: "list-rank-index", PartitionKey: "listKey", SortKey: "rankSort"}
+
+	// ItemsByOwner lists every item of a user, for account deletion.
+	ItemsByOwner = Index{Name: "owner-index", PartitionKey: "ownerId", SortKey: "itemId"}
+
+	// ItemsByOpenOwner lists the open items of a user across all
+	// projects by due date, for the "My tasks" views.
+	ItemsByOpenOwner = Index{Name: "open-owner-due-index", PartitionKey: "openOwner", SortKey: "dueSort"}
+
+	// ItemsByTrash lists the tasks a user deleted, newest first.
+	ItemsByTrash = Index{Name: "trash-index", PartitionKey: "trashOwner", SortKey: "trashSort"}
+)
+
+// derive sets the index keys from the item's fields.
+func (it *Item) derive() {
+
+	it.DueSort = NoDate + "#" + it.ItemID
+	if it.DueDate != "" {
+		it.DueSort = it.DueDate + "#" + it.ItemID
+	}
+
+	it.ListKey = it.ProjectID
+	if it.ArchivedAt != "" {
+		it.ListKey = archiveList(it.ProjectID)
+	}
+	it.StatusKey = it.ListKey + "#" + it.Status
+	it.PrioritySort = strconv.Itoa(int(it.Priority)) + "#" + it.DueSort
+
+	it.RankSort = rankSort(it)
+
+	it.OpenOwner = ""
+	if !it.Done() && it.ArchivedAt == "" {
+		it.OpenOwner = it.OwnerID
+	}
+
+	it.TrashOwner, it.TrashSort = "", ""
+	if it.DeletedAt != "" {
+		it.ListKey, it.StatusKey, it.OpenOwner = trashList(it.ProjectID), "", ""
+		if it.DeletedWith == "" {
+			it.TrashOwner, it.TrashSort = it.OwnerID, it.DeletedAt+"#"+it.ItemID
+		}
+	}
+
+	it.Progress = progress(it)
+	it.Blocked = it.OpenBlockers > 0
+}
+
+// category returns the category of the state it is in. Items written
+// before workflows have none; their status is one of the default states.
+func (it *Item) category() string {
+	if it.Category != "" {
+		return it.Category
+	}
+	if s, ok := DefaultWorkflow().state(it.Status); ok {
+		return s.Category
+	}
+	return CategoryTodo
+}
+
+// Done reports whether it is in a state of the done category.
+func (it *Item) Done() bool {
+	return it.category() == CategoryDone
+}
+
+// Clone returns a copy of it that shares nothing with it.
+func (it *Item) Clone() *Item {
+	c := *it
+	c.LabelIDs = slices.Clone(it.LabelIDs)
+	c.Checklist = slices.Clone(it.Checklist)
+	c.BlockedBy = slices.Clone(it.BlockedBy)
+	c.Blocks = slices.Clone(it.Blocks)
+	c.Recurrence = it.Recurrence.clone()
+	if it.Progress != nil {
+		p := *it.Progress
+		c.Progress = &p
+	}
+	return &c
+}
+
+// HasLabel reports whether it is tagged with labelID.
+func (it *Item) HasLabel(labelID string) bool {
+	return slices.Contains(it.LabelIDs, labelID)
+}
+
+// ItemPatch is the body of a create or PATCH request. Only the fields that
+// are present change; an empty dueDate or assignee removes it. status is
+// checked against the project's workflow when the task is saved. labelIds and
+// checklist replace the whole list, [] empties it, and so does blockedBy.
+// parentId moves the task under another task of the same project, "" makes
+// it a top-level task; projectId moves it, with its subtasks, to another
+// project. rrule or repeatAfterDays make the task recurring, "" and 0
+// stop it. Force is ?force=true: start a task even though it is blocked;
+// Scope is ?scope=: whether an edit of a recurring task is for this
+// occurrence only or for this and following.
+type ItemPatch struct {
+	Title       *string           `json:"title"`
+	Description *string           `json:"description"`
+	Status      *string           `json:"status"`
+	Assignee    *string           `json:"assignee"`
+	Priority    *Priority         `json:"priority"`
+	DueDate     *string           `json:"dueDate"`
+	LabelIDs    *[]string         `json:"labelIds"`
+	Checklist   *[]ChecklistEntry `json:"checklist"`
+	ParentID    *string           `json:"parentId"`
+	ProjectID   *string           `json:"projectId"`
+	BlockedBy   *[]string         `json:"blockedBy"`
+	Estimate    *float64          `json:"estimateHours"`
+	RRule       *string           `json:"rrule"`
+	RepeatAfter *int              `json:"repeatAfterDays"`
+
+	Force bool   `json:"-"`
+	Scope string `json:"-"`
+}
+
+// Empty reports whether p changes nothing.
+func (p ItemPatch) Empty() bool {
+	return p == ItemPatch{}
+}
+
+// apply checks p and makes its changes to it.
+func (p ItemPatch) apply(it *Item) error {
+
+	if p.Title != nil {
+		title := strings.TrimSpace(*p.Title)
+		if title == "" || utf8.RuneCountInString(title) > maxTitleLength {
+			return invalid("title is required and must be at most %d characters", maxTitleLength)
+		}
+		it.Title = title
+	}
+
+	if p.Description != nil {
+		if utf8.RuneCountInString(*p.Description) > maxDescriptionLength {
+			return invalid("description must be at most %d characters", maxDescriptionLength)
+		}
+		it.Description = *p.Description
+	}
+
+	if p.Assignee != nil {
+		assignee := strings.TrimSpace(*p.Assignee)
+		if utf8.RuneCountInString(assignee) > maxAssigneeLength {
+			return invalid("assignee must be at most %d characters", maxAssigneeLength)
+		}
+		it.Assignee = assignee
+	}
+
+	if p.Priority != nil {
+		it.Priority = *p.Priority
+	}
+
+	if p.DueDate != nil {
+		due, err := ParseTime(*p.DueDate)
+		if err != nil {
+			return invalid("dueDate must be an RFC 3339 time such as 2026-10-20T17:00:00Z")
+		}
+		it.DueDate = due
+	}
+
+	if p.LabelIDs != nil {
+		var ids []string
+		for _, id := range *p.LabelIDs {
+			if id = strings.TrimSpace(id); id == "" {
+				return invalid("labelIds must not contain empty ids")
+			}
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		ids = slices.Compact(ids)
+		if len(ids) > maxItemLabels {
+			return invalid("a task can have at most %d labels", maxItemLabels)
+		}
+		it.LabelIDs = ids
+	}
+
+	if p.BlockedBy != nil {
+		var ids []string
+		for _, id := range *p.BlockedBy {
+			switch id = strings.TrimSpace(id); id {
+			case "":
+				return invalid("blockedBy must not contain empty ids")
+			case it.ItemID:
+				return invalid("a task cannot block itself")
+			}
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		ids = slices.Compact(ids)
+		if len(ids) > maxDependencies {
+			return invalid("a task can be blocked by at most %d tasks", maxDependencies)
+		}
+		it.BlockedBy = ids
+	}
+
+	if p.Estimate != nil {
+		if *p.Estimate < 0 || *p.Estimate > maxEstimateHours {
+			return invalid("estimateHours must be between 0 and %d", maxEstimateHours)
+		}
+		it.EstimateHours = *p.Estimate
+	}
+
+	if p.Checklist != nil {
+		if len(*p.Checklist) > maxChecklistEntries {
+			return invalid("a checklist can have at most %d entries", maxChecklistEntries)
+		}
+		var list []ChecklistEntry
+		for _, e := range *p.Checklist {
+			e.Text = strings.TrimSpace(e.Text)
+			if e.Text == "" || utf8.RuneCountInString(e.Text) > maxChecklistText {
+				return invalid("checklist entries need a text of at most %d characters", maxChecklistText)
+			}
+			list = append(list, e)
+		}
+		it.Checklist = list
+	}
+
+	if p.ProjectID != nil && *p.ProjectID != it.ProjectID {
+		if strings.TrimSpace(*p.ProjectID) == "" {
+			return invalid("projectId must not be empty")
+		}
+		it.ProjectID = *p.ProjectID
+		it.ParentID = ""
+	}
+
+	if p.ParentID != nil {
+		if *p.ParentID == it.ItemID {
+			return invalid("a task cannot be its own subtask")
+		}
+		it.ParentID = strings.TrimSpace(*p.ParentID)
+	}
+
+	if p.Status != nil {
+		status := strings.TrimSpace(*p.Status)
+		if status == "" {
+			return invalid("status must not be empty")
+		}
+		it.Status = status
+	}
+
+	return p.applyRecurrence(it)
+}
+
+// ParseTime parses an RFC 3339 time and returns it in UTC as stored in
+// dueDate, so times sort as strings. "" stays "".
+func ParseTime(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+// GetItem returns the item itemID of ownerID. Items of other users are
+// reported as ErrNotFound, so item ids cannot be probed, and so are items
+// in the trash.
+func (s *Store) GetItem(ctx context.Context, ownerID, itemID string) (*Item, error) {
+
+	it, err := s.anyItem(ctx, ownerID, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	if it.DeletedAt != "" {
+		return nil, ErrNotFound
+	}
+	return it, nil
+}
+
+// anyItem is GetItem for items in the trash too.
+func (s *Store) anyItem(ctx context.Context, ownerID, itemID string) (*Item, error) {
+
+	var it Item
+	if err := s.get(ctx, s.Items, "itemId", itemID, &it); err != nil {
+		return nil, err
+	}
+
+	if it.OwnerID != ownerID {
+		return nil, ErrNotFound
+	}
+	return &it, nil
+}
+
+// CreateItem adds a task built from p to project projectID of ownerID.
+func (s *Store) CreateItem(ctx context.Context, ownerID, projectID string, p ItemPatch) (*Item, error) {
+
+	if p.Title == nil {
+		return nil, invalid("title is required")
+	}
+	p.ProjectID = nil
+
+	project, err := s.GetProject(ctx, ownerID, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := now()
+	it := &Item{
+		ItemID:    NewID(),
+		ProjectID: projectID,
+		OwnerID:   ownerID,
+		Status:    project.EffectiveWorkflow().States[0].Name,
+		Priority:  PriorityMedium,
+		CreatedAt: ts,
+		UpdatedAt: ts,
+	}
+
+	if err := p.apply(it); err != nil {
+		return nil, err
+	}
+
+	tx := s.Begin()
+	tx.projects[project.ProjectID] = project
+	tx.Force = p.Force
+	if err := tx.SaveItem(ctx, nil, it); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// UpdateItem reads the item, checks pre against it and lets change modify
+// and stage it along with any other writes the change needs. Everything
+// staged is committed in one transaction. When another write got in
+// between, the whole read-modify-write runs again.
+func (s *Store) UpdateItem(ctx context.Context, ownerID, itemID string, pre *etag.Precondition, change func(tx *Tx, it *Item) error) (*Item, error) {
+	return s.updateItem(ctx, s.GetItem, ownerID, itemID, pre, change)
+}
+
+// updateItem is UpdateItem reading the item with get.
+func (s *Store) updateItem(ctx context.Context, get func(ctx context.Context, ownerID, itemID string) (*Item, error), ownerID, itemID string, pre *etag.Precondition, change func(tx *Tx, it *Item) error) (*Item, error) {
+
+	for attempt := 1; ; attempt++ {
+		it, err := get(ctx, ownerID, itemID)
+		if err != nil {
+			return nil, err
+		}
+
+		if pre != nil && !pre.Allows(it.Version) {
+			return nil, &PreconditionError{Item: it}
+		}
+
+		tx := s.Begin()
+		tx.items[it.ItemID] = it
+		if err := change(tx, it); err != nil {
+			return nil, err
+		}
+
+		// After a lost race the item is read again; with an If-Match that
+		// no longer holds, that read ends in a PreconditionError.
+		err = tx.Commit(ctx)
+		if err == errStale && attempt < maxRetries {
+			continue
+		}
+		if err == errStale {
+			return nil, ErrConflict
+		}
+		if err != nil {
+			return nil, err
+		}
+		return it, nil
+	}
+}
+
+// PatchItem applies p to the item itemID.
+func (s *Store) PatchItem(ctx context.Context, ownerID, itemID string, pre *etag.Precondition, p ItemPatch) (*Item, error) {
+	return s.UpdateItem(ctx, ownerID, itemID, pre, func(tx *Tx, it *Item) error {
+		return tx.PatchItem(ctx, it, p)
+	})
+}
+
+// PatchItem applies p to it, which was read in this transaction, and stages
+// the result.
+func (tx *Tx) PatchItem(ctx context.Context, it *Item, p ItemPatch) error {
+
+	before := it.Clone()
+
+	if err := p.apply(it); err != nil {
+		return err
+	}
+
+	tx.Force = tx.Force || p.Force
+	return tx.SaveItem(ctx, before, it)
+}
+
+// DeleteItem moves the item itemID with all of its subtasks to the trash.
+// Deleting only this occurrence of a recurring task skips it: the next one
+// is created as if it had been completed. Deleting this and following ends
+// the series.
+func (s *Store) DeleteItem(ctx context.Context, ownerID, itemID string, pre *etag.Precondition, scope string) error {
+
+	if err := checkScope(scope); err != nil {
+		return err
+	}
+
+	_, err := s.UpdateItem(ctx, ownerID, itemID, pre, func(tx *Tx, it *Item) error {
+		return tx.deleteItem(ctx, it, scope)
+	})
+	return err
+}
+
+// deleteItem moves it, read in this transaction, to the trash with its
+// subtasks, as DeleteItem does.
+func (tx *Tx) deleteItem(ctx context.Context, it *Item, scope string) error {
+
+	if it.ArchivedAt != "" {
+		return refused(409, "the task is archived, unarchive it first")
+	}
+	if err := tx.TrashTree(ctx, it, now(), ""); err != nil {
+		return err
+	}
+	if scope == ScopeFollowing || it.Done() {
+		return nil
+	}
+	return tx.repeat(ctx, it)
+}
+
+// SaveItem stages it, changed from before (nil for a new item), after the
+// checks every change to an item goes through.
+func (tx *Tx) SaveItem(ctx context.Context, before, it *Item) error {
+
+	if err := tx.writable(ctx, before, it); err != nil {
+		return err
+	}
+
+	if err := tx.applyWorkflow(ctx, before, it); err != nil {
+		return err
+	}
+
+	ts := now()
+	it.UpdatedAt = ts
+
+	wasDone := before != nil && before.Done()
+	switch {
+	case it.Done() && !wasDone:
+		it.CompletedAt = ts
+	case !it.Done():
+		it.CompletedAt = ""
+	}
+
+	if err := tx.checkLabels(ctx, before, it); err != nil {
+		return err
+	}
+
+	if err := tx.placeItem(ctx, before, it); err != nil {
+		return err
+	}
+
+	if err := tx.rankItem(ctx, before, it); err != nil {
+		return err
+	}
+
+	if err := tx.updateDependencies(ctx, before, it); err != nil {
+		return err
+	}
+
+	if err := tx.updateReminders(ctx, before, it); err != nil {
+		return err
+	}
+
+	if err := tx.recordItem(ctx, before, it); err != nil {
+		return err
+	}
+
+	tx.PutItem(it)
+	if err := tx.updateParents(ctx, before, it); err != nil {
+		return err
+	}
+
+	if it.Done() && !wasDone {
+		return tx.repeat(ctx, it)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package tasks
+
+import (
+	"context"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/storage"
+)
+
+func labelKey(ownerID, labelID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":  &types.AttributeValueMemberS{Value: ownerID},
+		"labelId": &types.AttributeValueMemberS{Value: labelID},
+	}
+}
+
+// checkLabels makes sure every label added to it is one of its owner's
+// labels. Each added label is also checked inside the transaction, so a
+// label deleted in the meantime fails the commit instead of leaving a
+// dangling id on the task.
+func (tx *Tx) checkLabels(ctx context.Context, before, it *Item) error {
+
+	var added []string
+	for _, id := range it.LabelIDs {
+		if before == nil || !before.HasLabel(id) {
+			added = append(added, id)
+		}
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	keys := make([]map[string]types.AttributeValue, len(added))
+	for i, id := range added {
+		keys[i] = labelKey(it.OwnerID, id)
+	}
+
+	found, err := storage.BatchGet(ctx, tx.s.DB, tx.s.Labels, keys)
+	if err != nil {
+		return err
+	}
+
+	known := map[string]bool{}
+	for _, item := range found {
+		var l struct {
+			LabelID string `dynamodbav:"labelId"`
+		}
+		if err := attributevalue.UnmarshalMap(item, &l); err != nil {
+			return err
+		}
+		known[l.LabelID] = true
+	}
+
+	for _, id := range added {
+		if !known[id] {
+			return invalid("unknown label %q", id)
+		}
+		tx.Add(types.TransactWriteItem{ConditionCheck: &types.ConditionCheck{
+			TableName:           aws.String(tx.s.Labels),
+			Key:                 labelKey(it.OwnerID, id),
+			ConditionExpression: aws.String("attribute_exists(labelId)"),
+		}})
+	}
+
+	return nil
+}
+
+// swapLabel returns ids with from replaced by into, or removed when into
+// is "".
+func swapLabel(ids []string, from, into string) []string {
+
+	ids = slices.DeleteFunc(slices.Clone(ids), func(l string) bool { return l == from })
+	if into != "" {
+		ids = append(ids, into)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+// Relabel replaces label from with label into on every task of ownerID
+// tagged with it, or removes it when into is "". The same goes for the
+// labels the next occurrences of a recurring task will get, and for the
+// tasks in the archive or the trash, which are only rewritten. It is what merging and
+// deleting a label do to the tasks, and it can be run again after a
+// failure: tasks already changed no longer carry from.
+func (s *Store) Relabel(ctx context.Context, ownerID, from, into string) error {
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.Items),
+		IndexName:              aws.String(ItemsByOwner.Name),
+		KeyConditionExpression: aws.String("ownerId = :owner"),
+		FilterExpression:       aws.String("contains(labelIds, :label) OR contains(recurrence.template.labelIds, :label)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: ownerID},
+			":label": &types.AttributeValueMemberS{Value: from},
+		},
+		ProjectionExpression: aws.String("itemId"),
+	}
+
+	for {
+		result, err := s.DB.Query(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range result.Items {
+			id, ok := item["itemId"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+
+			_, err := s.updateItem(ctx, s.anyItem, ownerID, id.Value, nil, func(tx *Tx, it *Item) error {
+				r := it.Recurrence
+				inTemplate := r != nil && slices.Contains(r.Template.LabelIDs, from)
+				if !it.HasLabel(from) && !inTemplate {
+					return nil
+				}
+				before := it.Clone()
+				if inTemplate {
+					r.Template.LabelIDs = swapLabel(r.Template.LabelIDs, from, into)
+				}
+				if it.HasLabel(from) {
+					it.LabelIDs = swapLabel(it.LabelIDs, from, into)
+				}
+				if it.DeletedAt != "" || it.ArchivedAt != "" {
+					tx.PutItem(it)
+					return nil
+				}
+				return tx.SaveItem(ctx, before, it)
+			})
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
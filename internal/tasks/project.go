@@ -0,0 +1,471 @@
+package tasks
+
+import (
+	"context"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/etag"
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/storage"
+)
+
+const (
+	maxProjectNameLength = 100
+	maxAutoArchiveDays   = 3650
+)
+
+// Project is an item in the projects table.
+type Project struct {
+	ProjectID   string `json:"projectId" dynamodbav:"projectId"`
+	OwnerID     string `json:"-" dynamodbav:"ownerId"`
+	Name        string `json:"name" dynamodbav:"name"`
+	Description string `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	CreatedAt   string `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt   string `json:"updatedAt" dynamodbav:"updatedAt"`
+	Version     int64  `json:"version" dynamodbav:"version"`
+
+	// AutoCompleteParent marks a task Done once all of its subtasks are.
+	AutoCompleteParent bool `json:"autoCompleteParent" dynamodbav:"autoCompleteParent,omitempty"`
+
+	// Workflow is the project's own states and transitions, nil for
+	// DefaultWorkflow. Set with SetWorkflow.
+	Workflow *Workflow `json:"workflow,omitempty" dynamodbav:"workflow,omitempty"`
+
+	// DeletedAt is set while the project is in the trash, PurgeAt is when
+	// the table's TTL removes it.
+	DeletedAt string `json:"deletedAt,omitempty" dynamodbav:"deletedAt,omitempty"`
+	PurgeAt   int64  `json:"-" dynamodbav:"purgeAt,omitempty"`
+
+	// ArchivedAt is set while the project is archived: read-only and left
+	// out of the project list.
+	ArchivedAt string `json:"archivedAt,omitempty" dynamodbav:"archivedAt,omitempty"`
+
+	// AutoArchiveDays moves tasks Done for more than that many days to the
+	// archive, 0 for never. AutoArchive is the partition key of
+	// auto-archive-index, set only while the rule applies.
+	AutoArchiveDays int    `json:"autoArchiveDoneAfterDays" dynamodbav:"autoArchiveDays,omitempty"`
+	AutoArchive     string `json:"-" dynamodbav:"autoArchive,omitempty"`
+
+	// ListSort places the project in its owner's partition of
+	// owner-index: the list it shows up in, then its id.
+	ListSort string `json:"-" dynamodbav:"listSort"`
+}
+
+// ProjectsByOwner holds every project of a user. Each list is a prefix of
+// listSort, so one Query reads one list oldest first. The trash is sorted
+// by deletedAt.
+var ProjectsByOwner = Index{Name: "owner-index", PartitionKey: "ownerId", SortKey: "listSort"}
+
+// ProjectsByAutoArchive holds the projects with an auto-archive rule, for
+// the archive job.
+var ProjectsByAutoArchive = Index{Name: "auto-archive-index", PartitionKey: "autoArchive", SortKey: "projectId"}
+
+// Prefixes of listSort.
+const (
+	listActive   = "active#"
+	listArchived = "archived#"
+	listTrash    = "trash#"
+)
+
+// autoArchiveOn is the one value of autoArchive.
+const autoArchiveOn = "on"
+
+func (p *Project) derive() {
+	p.ListSort = listActive + p.ProjectID
+	p.AutoArchive = ""
+	switch {
+	case p.DeletedAt != "":
+		p.ListSort = listTrash + p.DeletedAt + "#" + p.ProjectID
+	case p.ArchivedAt != "":
+		p.ListSort = listArchived + p.ProjectID
+	case p.AutoArchiveDays > 0:
+		p.AutoArchive = autoArchiveOn
+	}
+}
+
+// writable refuses changes to an archived project.
+func (p *Project) writable() error {
+	if p.ArchivedAt != "" {
+		return refused(409, "the project is archived, unarchive it first")
+	}
+	return nil
+}
+
+// ProjectPatch is the body of a project create or PATCH request.
+type ProjectPatch struct {
+	Name               *string `json:"name"`
+	Description        *string `json:"description"`
+	AutoCompleteParent *bool   `json:"autoCompleteParent"`
+	AutoArchiveDays    *int    `json:"autoArchiveDoneAfterDays"`
+}
+
+func (pp ProjectPatch) apply(p *Project) error {
+
+	if pp.Name != nil {
+		name := strings.TrimSpace(*pp.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxProjectNameLength {
+			return invalid("name is required and must be at most %d characters", maxProjectNameLength)
+		}
+		p.Name = name
+	}
+
+	if pp.Description != nil {
+		if utf8.RuneCountInString(*pp.Description) > maxDescriptionLength {
+			return invalid("description must be at most %d characters", maxDescriptionLength)
+		}
+		p.Description = *pp.Description
+	}
+
+	if pp.AutoCompleteParent != nil {
+		p.AutoCompleteParent = *pp.AutoCompleteParent
+	}
+
+	if pp.AutoArchiveDays != nil {
+		if *pp.AutoArchiveDays < 0 || *pp.AutoArchiveDays > maxAutoArchiveDays {
+			return invalid("autoArchiveDoneAfterDays must be 0 to %d", maxAutoArchiveDays)
+		}
+		p.AutoArchiveDays = *pp.AutoArchiveDays
+	}
+
+	return nil
+}
+
+// GetProject returns the project projectID of ownerID. Projects of other
+// users and projects in the trash are reported as ErrNotFound; archived
+// projects are returned, read-only.
+func (s *Store) GetProject(ctx context.Context, ownerID, projectID string) (*Project, error) {
+
+	p, err := s.anyProject(ctx, ownerID, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.DeletedAt != "" {
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+// anyProject is GetProject for projects in the trash too.
+func (s *Store) anyProject(ctx context.Context, ownerID, projectID string) (*Project, error) {
+
+	var p Project
+	if err := s.get(ctx, s.Projects, "projectId", projectID, &p); err != nil {
+		return nil, err
+	}
+
+	if p.OwnerID != ownerID {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+// CreateProject adds a project built from pp for ownerID.
+func (s *Store) CreateProject(ctx context.Context, ownerID string, pp ProjectPatch) (*Project, error) {
+
+	if pp.Name == nil {
+		return nil, invalid("name is required")
+	}
+
+	ts := now()
+	p := &Project{
+		ProjectID: NewID(),
+		OwnerID:   ownerID,
+		CreatedAt: ts,
+		UpdatedAt: ts,
+	}
+
+	if err := pp.apply(p); err != nil {
+		return nil, err
+	}
+
+	tx := s.Begin()
+	if err := tx.recordProject(ctx, nil, p); err != nil {
+		return nil, err
+	}
+	tx.PutProject(p)
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UpdateProject is UpdateItem for projects.
+func (s *Store) UpdateProject(ctx context.Context, ownerID, projectID string, pre *etag.Precondition, change func(tx *Tx, p *Project) error) (*Project, error) {
+	return s.updateProject(ctx, s.GetProject, ownerID, projectID, pre, change)
+}
+
+// updateProject is UpdateProject reading the project with get.
+func (s *Store) updateProject(ctx context.Context, get func(ctx context.Context, ownerID, projectID string) (*Project, error), ownerID, projectID string, pre *etag.Precondition, change func(tx *Tx, p *Project) error) (*Project, error) {
+
+	for attempt := 1; ; attempt++ {
+		p, err := get(ctx, ownerID, projectID)
+		if err != nil {
+			return nil, err
+		}
+
+		if pre != nil && !pre.Allows(p.Version) {
+			return nil, &PreconditionError{Project: p}
+		}
+
+		tx := s.Begin()
+		tx.projects[p.ProjectID] = p
+		if err := change(tx, p); err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit(ctx)
+		if err == errStale && attempt < maxRetries {
+			continue
+		}
+		if err == errStale {
+			return nil, ErrConflict
+		}
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+// PatchProject applies pp to the project projectID.
+func (s *Store) PatchProject(ctx context.Context, ownerID, projectID string, pre *etag.Precondition, pp ProjectPatch) (*Project, error) {
+	return s.UpdateProject(ctx, ownerID, projectID, pre, func(tx *Tx, p *Project) error {
+		if err := p.writable(); err != nil {
+			return err
+		}
+		before := *p
+		if err := pp.apply(p); err != nil {
+			return err
+		}
+		if err := tx.recordProject(ctx, &before, p); err != nil {
+			return err
+		}
+		p.UpdatedAt = now()
+		tx.PutProject(p)
+		return nil
+	})
+}
+
+// DeleteProject moves the project projectID and every item in it, archived
+// or not, to the trash, the items deleted with it. The items go first. If
+// anything fails after that, the project write included, the items trashed
+// so far are taken out of the trash again: a project that is not in the
+// trash cannot restore them.
+func (s *Store) DeleteProject(ctx context.Context, ownerID, projectID string, pre *etag.Precondition) error {
+
+	p, err := s.GetProject(ctx, ownerID, projectID)
+	if err != nil {
+		return err
+	}
+
+	if pre != nil && !pre.Allows(p.Version) {
+		return &PreconditionError{Project: p}
+	}
+
+	// Every task goes with its top-level task, so the subtasks are left
+	// to it and no child count changes.
+	deletedAt := now()
+	var trashed []string
+	for _, list := range []string{p.ProjectID, archiveList(p.ProjectID)} {
+		err = s.eachItem(ctx, ItemsByList, list, func(it *Item) error {
+			if it.ParentID != "" {
+				return nil
+			}
+			_, err := s.UpdateItem(ctx, ownerID, it.ItemID, nil, func(tx *Tx, it *Item) error {
+				return tx.TrashTree(ctx, it, deletedAt, projectID)
+			})
+			if err == nil {
+				trashed = append(trashed, it.ItemID)
+			}
+			if err != ErrNotFound {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		_, err = s.UpdateProject(ctx, ownerID, projectID, pre, func(tx *Tx, p *Project) error {
+			p.DeletedAt, p.PurgeAt = deletedAt, s.purgeAt(deletedAt)
+			if err := tx.record(ctx, p.ProjectID, p.OwnerID, []HistoryEntry{{Field: FieldDeleted}}); err != nil {
+				return err
+			}
+			p.UpdatedAt = now()
+			tx.PutProject(p)
+			return nil
+		})
+	}
+
+	if err != nil {
+		s.untrash(ctx, ownerID, projectID, deletedAt, trashed)
+	}
+	return err
+}
+
+// untrash takes the tasks itemIDs, which a failed DeleteProject moved to
+// the trash with project projectID at deletedAt, out of it again with their
+// subtasks. The dependencies they were taken out of are not restored.
+// Failures are logged: a task left behind comes back when the project is
+// deleted and restored.
+func (s *Store) untrash(ctx context.Context, ownerID, projectID, deletedAt string, itemIDs []string) {
+
+	for _, id := range itemIDs {
+		_, err := s.updateItem(ctx, s.trashedItem, ownerID, id, nil, func(tx *Tx, it *Item) error {
+			if it.DeletedAt != deletedAt || it.DeletedWith != projectID {
+				return nil
+			}
+			return tx.RestoreTree(ctx, it)
+		})
+		if err != nil && err != ErrNotFound {
+			log.Println("untrash error:", id, err)
+		}
+	}
+}
+
+// eachItem calls f for every item in partition value of index, until f
+// fails.
+func (s *Store) eachItem(ctx context.Context, index Index, value string, f func(it *Item) error) error {
+	return eachQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:              aws.String(s.Items),
+		IndexName:              aws.String(index.Name),
+		KeyConditionExpression: aws.String("#pk = :pk"),
+		ExpressionAttributeNames: map[string]string{
+			"#pk": index.PartitionKey,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: value},
+		},
+	}, f)
+}
+
+// eachQueried calls f for every row input reads, page by page, until f
+// fails.
+func eachQueried[T any](ctx context.Context, db *dynamodb.Client, input *dynamodb.QueryInput, f func(v *T) error) error {
+
+	for {
+		result, err := db.Query(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		var page []T
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return err
+		}
+
+		for i := range page {
+			if err := f(&page[i]); err != nil {
+				return err
+			}
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// ListProjects returns a page of the projects of ownerID, oldest first:
+// the archived ones if archived is set, else the others.
+func (s *Store) ListProjects(ctx context.Context, ownerID string, archived bool, r pagination.Request) ([]Project, map[string]types.AttributeValue, error) {
+
+	list := listActive
+	if archived {
+		list = listArchived
+	}
+
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(s.Projects),
+		IndexName:              aws.String(ProjectsByOwner.Name),
+		KeyConditionExpression: aws.String("ownerId = :owner AND begins_with(listSort, :list)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: ownerID},
+			":list":  &types.AttributeValueMemberS{Value: list},
+		},
+	}
+
+	raw, lastKey, err := pagination.Query(ctx, s.DB, in, r, ProjectsByOwner.KeyNames("projectId")...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	projects := []Project{}
+	if err := attributevalue.UnmarshalListOfMaps(raw, &projects); err != nil {
+		return nil, nil, err
+	}
+	return projects, lastKey, nil
+}
+
+// DeleteOwner removes every project, item, comment, reminder and history
+// entry of ownerID, in the trash or not, and their search index, for
+// account deletion. It can be run again after a failure.
+func (s *Store) DeleteOwner(ctx context.Context, ownerID string) error {
+
+	owner := map[string]types.AttributeValue{
+		":owner": &types.AttributeValueMemberS{Value: ownerID},
+	}
+
+	if err := s.Search.DeleteOwner(ctx, ownerID); err != nil {
+		return err
+	}
+
+	err := storage.DeleteQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.History),
+		IndexName:                 aws.String(HistoryByOwner.Name),
+		KeyConditionExpression:    aws.String("ownerId = :owner"),
+		ExpressionAttributeValues: owner,
+	}, "targetId", "entryId")
+	if err != nil {
+		return err
+	}
+
+	err = storage.DeleteQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.Reminders),
+		IndexName:                 aws.String(RemindersByOwner.Name),
+		KeyConditionExpression:    aws.String("ownerId = :owner"),
+		ExpressionAttributeValues: owner,
+	}, "itemId", "reminderId")
+	if err != nil {
+		return err
+	}
+
+	err = storage.DeleteQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.Comments),
+		IndexName:                 aws.String(CommentsByOwner.Name),
+		KeyConditionExpression:    aws.String("ownerId = :owner"),
+		ExpressionAttributeValues: owner,
+	}, "itemId", "commentId")
+	if err != nil {
+		return err
+	}
+
+	err = storage.DeleteQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.Items),
+		IndexName:                 aws.String(ItemsByOwner.Name),
+		KeyConditionExpression:    aws.String("ownerId = :owner"),
+		ExpressionAttributeValues: owner,
+	}, "itemId")
+	if err != nil {
+		return err
+	}
+
+	return storage.DeleteQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.Projects),
+		IndexName:                 aws.String(ProjectsByOwner.Name),
+		KeyConditionExpression:    aws.String("ownerId = :owner"),
+		ExpressionAttributeValues: owner,
+	}, "projectId")
+}
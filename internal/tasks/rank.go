@@ -0,0 +1,395 @@
+package tasks
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/etag"
+)
+
+// Ranks are fractional indexes: strings of base 62 digits, in ASCII order,
+// compared as strings. There is always a rank between two others, so a
+// move only rewrites the moved task. No rank ends in the zero digit, so
+// there is always one before it too.
+const rankDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// maxRankLength is how long a rank may get before the project's ranks are
+// rewritten evenly spaced.
+const maxRankLength = 32
+
+// unranked stands for the rank of a task without one, created before
+// ranks existed. It sorts after every rank, so those tasks come last,
+// oldest first.
+const unranked = "~"
+
+// errTied means the tasks a task moves between have the same rank, so
+// there is none between them until the ranks are spread out.
+var errTied = errors.New("tasks: neighbours have the same rank")
+
+// rankSort is the rankSort of it: its rank, or unranked, then its itemId.
+// Tasks created at the same time can get the same rank; the itemId still
+// puts them in one order every list and move agrees on.
+func rankSort(it *Item) string {
+	return cmp.Or(it.Rank, unranked) + "#" + it.ItemID
+}
+
+// rankAfter returns the shortest rank after a, "" for the first one.
+func rankAfter(a string) string {
+
+	i := 0
+	for i < len(a) && a[i] == rankDigits[len(rankDigits)-1] {
+		i++
+	}
+	if i == len(a) {
+		return a + rankDigits[len(rankDigits)/2:len(rankDigits)/2+1]
+	}
+	return a[:i] + string(rankDigits[strings.IndexByte(rankDigits, a[i])+1])
+}
+
+// rankBetween returns a rank after a and before b. "" leaves that end open.
+func rankBetween(a, b string) (string, error) {
+
+	if b == "" {
+		return rankAfter(a), nil
+	}
+	if a >= b {
+		return "", invalid("the task in after must come before the task in before")
+	}
+	return midpoint(a, b), nil
+}
+
+// midpoint returns a rank between a and b, a < b and b not "".
+func midpoint(a, b string) string {
+
+	digit := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return rankDigits[0]
+	}
+	rest := func(s string, i int) string {
+		if i < len(s) {
+			return s[i:]
+		}
+		return ""
+	}
+
+	n := 0
+	for n < len(b) && digit(a, n) == b[n] {
+		n++
+	}
+	if n > 0 {
+		return b[:n] + midpoint(rest(a, n), b[n:])
+	}
+
+	da, db := strings.IndexByte(rankDigits, digit(a, 0)), strings.IndexByte(rankDigits, b[0])
+	if db-da > 1 {
+		return string(rankDigits[(da+db)/2])
+	}
+	if len(b) > 1 {
+		return b[:1]
+	}
+	return string(rankDigits[da]) + rankAfter(rest(a, 1))
+}
+
+// spread returns n ranks in order, evenly spaced and as short as n allows.
+func spread(n int) []string {
+
+	base := len(rankDigits)
+	width, space := 1, base
+	for space <= n {
+		width, space = width+1, space*base
+	}
+	step := space / (n + 1)
+
+	ranks := make([]string, n)
+	for i := range ranks {
+		v := (i + 1) * step
+		digits := make([]byte, width)
+		for j := width - 1; j >= 0; j-- {
+			digits[j] = rankDigits[v%base]
+			v /= base
+		}
+		ranks[i] = strings.TrimRight(string(digits), rankDigits[:1])
+	}
+	return ranks
+}
+
+// neighbour returns the ranked task right after the rankSort key in
+// listKey, or right before it when after is false, nil if there is none.
+// Tasks without a rank are not neighbours: before unranked is the last
+// ranked task.
+func (s *Store) neighbour(ctx context.Context, listKey, key string, after bool) (*Item, error) {
+
+	b := newQueryBuilder()
+	b.keys = append(b.keys, "listKey = "+b.value(":listKey", listKey))
+	if after {
+		// rankSort > :key is not a key condition that can be combined
+		// with the upper bound, but every rankSort after key sorts after
+		// key+"!", "!" being below every digit and itemId character.
+		b.keys = append(b.keys, "rankSort BETWEEN "+b.value(":key", key+"!")+" AND "+b.value(":unranked", unranked))
+	} else {
+		b.keys = append(b.keys, "rankSort < "+b.value(":key", key))
+	}
+
+	out, err := s.DB.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.Items),
+		IndexName:                 aws.String(ItemsByRank.Name),
+		KeyConditionExpression:    aws.String(strings.Join(b.keys, " AND ")),
+		ExpressionAttributeValues: b.values,
+		ScanIndexForward:          aws.Bool(after),
+		Limit:                     aws.Int32(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Items) == 0 {
+		return nil, nil
+	}
+
+	var it Item
+	if err := attributevalue.UnmarshalMap(out.Items[0], &it); err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+// lastRank returns the last rank in project projectID, "" if there is none.
+func (s *Store) lastRank(ctx context.Context, projectID string) (string, error) {
+
+	last, err := s.neighbour(ctx, projectID, unranked, false)
+	if err != nil || last == nil {
+		return "", err
+	}
+	return last.Rank, nil
+}
+
+// rankItem gives a new task, or one moved to another project, the rank
+// after the last one there.
+func (tx *Tx) rankItem(ctx context.Context, before, it *Item) error {
+
+	if before != nil && before.ProjectID == it.ProjectID {
+		return nil
+	}
+
+	last, ok := tx.ranks[it.ProjectID]
+	if !ok {
+		var err error
+		if last, err = tx.s.lastRank(ctx, it.ProjectID); err != nil {
+			return err
+		}
+	}
+
+	it.Rank = rankAfter(last)
+	tx.ranks[it.ProjectID] = it.Rank
+	tx.rebalance(it)
+	return nil
+}
+
+// rebalance rewrites the ranks of the project of it after the commit if
+// the rank of it got too long.
+func (tx *Tx) rebalance(it *Item) {
+
+	if len(it.Rank) <= maxRankLength {
+		return
+	}
+	ownerID, projectID := it.OwnerID, it.ProjectID
+	tx.AfterCommit(func(ctx context.Context) {
+		if err := tx.s.Rebalance(ctx, ownerID, projectID); err != nil {
+			log.Println("rebalance error:", projectID, err)
+		}
+	})
+}
+
+// MoveTo is the body of POST /items/{itemId}/move: the task goes after the
+// task After and before the task Before, and into the state Column. A task
+// left out leaves that side open: only After puts it right after that task,
+// only Before right before it, neither at the end.
+type MoveTo struct {
+	Before string  `json:"before"`
+	After  string  `json:"after"`
+	Column *string `json:"column"`
+}
+
+// MoveItem places the task itemID between the tasks of mv in its project's
+// manual order, writing only that task. A move into another column is a
+// change of status and goes through the project's workflow like one.
+// Between two tasks with the same rank the project's ranks are spread out
+// first, leaving the task itself as it is so pre still holds.
+func (s *Store) MoveItem(ctx context.Context, ownerID, itemID string, pre *etag.Precondition, mv MoveTo) (*Item, error) {
+
+	if mv.Before == itemID || mv.After == itemID {
+		return nil, invalid("a task cannot move next to itself")
+	}
+
+	var projectID string
+	move := func() (*Item, error) {
+		return s.UpdateItem(ctx, ownerID, itemID, pre, func(tx *Tx, it *Item) error {
+			projectID = it.ProjectID
+			return tx.move(ctx, it, mv)
+		})
+	}
+
+	it, err := move()
+	if err != errTied {
+		return it, err
+	}
+	if err := s.rebalance(ctx, ownerID, projectID, itemID); err != nil {
+		return nil, err
+	}
+	if it, err = move(); err == errTied {
+		return nil, ErrConflict
+	}
+	return it, err
+}
+
+// move stages the move of it, read in tx, to mv.
+func (tx *Tx) move(ctx context.Context, it *Item, mv MoveTo) error {
+
+	neighbour := func(id string) (*Item, error) {
+		if id == "" {
+			return nil, nil
+		}
+		n, err := tx.LoadItem(ctx, it.OwnerID, id)
+		if err == ErrNotFound {
+			return nil, invalid("task %s is not in this project", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n.ProjectID != it.ProjectID {
+			return nil, invalid("task %s is not in this project", id)
+		}
+		if n.Rank == "" {
+			return nil, refused(409, "task %s has no rank yet, move it first", id)
+		}
+		return n, nil
+	}
+
+	after, err := neighbour(mv.After)
+	if err != nil {
+		return err
+	}
+	before, err := neighbour(mv.Before)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case after != nil && before == nil:
+		before, err = tx.s.neighbour(ctx, it.ProjectID, rankSort(after), true)
+	case after == nil && before != nil:
+		after, err = tx.s.neighbour(ctx, it.ProjectID, rankSort(before), false)
+	case after == nil && before == nil:
+		after, err = tx.s.neighbour(ctx, it.ProjectID, unranked, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The task itself may be the neighbour found: then it is already
+	// there.
+	is := func(n *Item) bool { return n != nil && n.ItemID == it.ItemID }
+	if mv.Column == nil && (is(after) || is(before)) {
+		return nil
+	}
+
+	var a, b string
+	if after != nil {
+		a = after.Rank
+	}
+	if before != nil {
+		b = before.Rank
+	}
+	if a != "" && a == b {
+		return errTied
+	}
+	rank, err := rankBetween(a, b)
+	if err != nil {
+		return err
+	}
+
+	prev := it.Clone()
+	it.Rank = rank
+	if mv.Column != nil {
+		it.Status = *mv.Column
+	}
+	if err := tx.SaveItem(ctx, prev, it); err != nil {
+		return err
+	}
+	tx.rebalance(it)
+	return nil
+}
+
+// Rebalance rewrites the ranks of the tasks of project projectID evenly
+// spaced, keeping their order, one transaction per 100 tasks. Tasks
+// without a rank get one after the others. A task changed meanwhile is
+// read again and rewritten.
+func (s *Store) Rebalance(ctx context.Context, ownerID, projectID string) error {
+	return s.rebalance(ctx, ownerID, projectID, "")
+}
+
+// rebalance is Rebalance leaving the task skip as it is.
+func (s *Store) rebalance(ctx context.Context, ownerID, projectID, skip string) error {
+
+	var order []*Item
+	err := eachQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:              aws.String(s.Items),
+		IndexName:              aws.String(ItemsByRank.Name),
+		KeyConditionExpression: aws.String("listKey = :listKey"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":listKey": &types.AttributeValueMemberS{Value: projectID},
+		},
+	}, func(it *Item) error {
+		order = append(order, it)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ranks := spread(len(order))
+	for start := 0; start < len(order); start += maxTransactItems {
+		end := min(start+maxTransactItems, len(order))
+
+		for attempt := 1; ; attempt++ {
+			tx := s.Begin()
+			for i := start; i < end; i++ {
+				it := order[i]
+				if attempt > 1 {
+					if it, err = s.GetItem(ctx, ownerID, it.ItemID); err == ErrNotFound {
+						continue
+					} else if err != nil {
+						return err
+					}
+				}
+				if it.ItemID == skip || it.ProjectID != projectID || it.ArchivedAt != "" || it.Rank == ranks[i] {
+					continue
+				}
+				it.Rank = ranks[i]
+				tx.PutItem(it)
+			}
+
+			err := tx.Commit(ctx)
+			if err == errStale && attempt < maxRetries {
+				continue
+			}
+			if err == errStale {
+				return ErrConflict
+			}
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
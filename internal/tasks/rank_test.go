@@ -0,0 +1,96 @@
+package tasks
+
+import (
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRankBetween(t *testing.T) {
+
+	tests := []struct{ a, b, want string }{
+		{"", "", "V"},
+		{"V", "", "W"},
+		{"z", "", "zV"},
+		{"", "V", "F"},
+		{"V", "X", "W"},
+		{"V", "W", "VV"},
+		{"A", "A05", "A02"},
+		{"Vz", "W", "VzV"},
+	}
+	for _, tt := range tests {
+		if got, err := rankBetween(tt.a, tt.b); err != nil || got != tt.want {
+			t.Errorf("rankBetween(%q, %q) = %q, %v, want %q", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+
+	if _, err := rankBetween("W", "V"); err == nil {
+		t.Error("rankBetween out of order succeeded")
+	}
+
+	// Inserting at random places keeps every rank between its neighbours
+	// and never ends one in the zero digit.
+	rng := rand.New(rand.NewSource(1))
+	ranks := []string{}
+	for range 2000 {
+		i := rng.Intn(len(ranks) + 1)
+		var a, b string
+		if i > 0 {
+			a = ranks[i-1]
+		}
+		if i < len(ranks) {
+			b = ranks[i]
+		}
+		r, err := rankBetween(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r <= a || (b != "" && r >= b) || strings.HasSuffix(r, "0") {
+			t.Fatalf("rankBetween(%q, %q) = %q", a, b, r)
+		}
+		ranks = append(ranks[:i], append([]string{r}, ranks[i:]...)...)
+	}
+}
+
+func TestSpread(t *testing.T) {
+
+	for _, n := range []int{1, 61, 62, 5000} {
+		ranks := spread(n)
+		for i, r := range ranks {
+			if r == "" || strings.HasSuffix(r, "0") || len(r) > 3 {
+				t.Fatalf("n=%d: rank %d = %q", n, i, r)
+			}
+			if i > 0 && ranks[i-1] >= r {
+				t.Fatalf("n=%d: %q before %q", n, ranks[i-1], r)
+			}
+		}
+	}
+}
+
+func TestRankSort(t *testing.T) {
+
+	// Ranked tasks in rank order, equal ranks by itemId, then the tasks
+	// without a rank by itemId.
+	order := []*Item{
+		{ItemID: "b", Rank: "V"},
+		{ItemID: "c", Rank: "V"},
+		{ItemID: "a", Rank: "V1"},
+		{ItemID: "d", Rank: "z"},
+		{ItemID: "a"},
+		{ItemID: "e"},
+	}
+
+	keys := make([]string, len(order))
+	for i, it := range order {
+		keys[i] = rankSort(it)
+	}
+	if !slices.IsSorted(keys) {
+		t.Errorf("rankSort order = %q", keys)
+	}
+	for _, k := range keys[:4] {
+		if k >= unranked || k+"!" >= unranked {
+			t.Errorf("ranked key %q not before %q", k, unranked)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package tasks
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"to_do_list_demo/internal/rrule"
+)
+
+// Scopes of an edit or delete of a recurring task (?scope=).
+const (
+	ScopeThis      = "this"
+	ScopeFollowing = "following"
+)
+
+const (
+	maxRepeatAfterDays = 365
+
+	// maxSkippedOccurrences caps the occurrences passed over when a
+	// series is completed long after its due date.
+	maxSkippedOccurrences = 1000
+)
+
+// Recurrence makes a task one occurrence of a series. The series repeats
+// on RRule, or AfterDays after each occurrence is completed. Only the
+// latest occurrence is a task yet: completing it (or deleting just it)
+// creates the next one, NextID.
+type Recurrence struct {
+	SeriesID   string `json:"seriesId" dynamodbav:"seriesId"`
+	RRule      string `json:"rrule,omitempty" dynamodbav:"rrule,omitempty"`
+	AfterDays  int    `json:"repeatAfterDays,omitempty" dynamodbav:"afterDays,omitempty"`
+	Occurrence int    `json:"occurrence" dynamodbav:"occurrence"`
+	NextID     string `json:"nextItemId,omitempty" dynamodbav:"nextId,omitempty"`
+
+	// Slot is the due date the series gave this occurrence. Moving just
+	// this occurrence leaves it, so the next one is still on schedule.
+	Slot string `json:"-" dynamodbav:"slot,omitempty"`
+
+	// Template is what the next occurrence is made from. Edits of this
+	// occurrence only leave it alone, edits of this and following change it.
+	Template SeriesTemplate `json:"-" dynamodbav:"template"`
+}
+
+// SeriesTemplate is the part of a task every occurrence starts with.
+type SeriesTemplate struct {
+	Title         string           `dynamodbav:"title"`
+	Description   string           `dynamodbav:"description,omitempty"`
+	Priority      Priority         `dynamodbav:"priority"`
+	LabelIDs      []string         `dynamodbav:"labelIds,stringset,omitempty"`
+	Checklist     []ChecklistEntry `dynamodbav:"checklist,omitempty"`
+	EstimateHours float64          `dynamodbav:"estimateHours,omitempty"`
+}
+
+func templateOf(it *Item) SeriesTemplate {
+
+	t := SeriesTemplate{
+		Title:         it.Title,
+		Description:   it.Description,
+		Priority:      it.Priority,
+		LabelIDs:      slices.Clone(it.LabelIDs),
+		EstimateHours: it.EstimateHours,
+	}
+	for _, e := range it.Checklist {
+		t.Checklist = append(t.Checklist, ChecklistEntry{Text: e.Text})
+	}
+	return t
+}
+
+func (r *Recurrence) clone() *Recurrence {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	c.Template.LabelIDs = slices.Clone(r.Template.LabelIDs)
+	c.Template.Checklist = slices.Clone(r.Template.Checklist)
+	return &c
+}
+
+func checkScope(scope string) error {
+	switch scope {
+	case "", ScopeThis, ScopeFollowing:
+		return nil
+	}
+	return invalid("scope must be this or following")
+}
+
+// applyRecurrence makes the rrule and repeatAfterDays changes of p to it,
+// after the rest of p. With scope=following the other changes of p also
+// go into the template of the occurrences to come.
+func (p ItemPatch) applyRecurrence(it *Item) error {
+
+	if err := checkScope(p.Scope); err != nil {
+		return err
+	}
+	following := p.Scope == ScopeFollowing
+
+	r := it.Recurrence
+	if following && r != nil && r.NextID != "" {
+		return refused(409, "the next occurrence already exists, change it instead")
+	}
+
+	if p.RRule != nil || p.RepeatAfter != nil {
+		var rule string
+		var after int
+		if r != nil {
+			rule, after = r.RRule, r.AfterDays
+		}
+
+		if p.RRule != nil {
+			rule = ""
+			if *p.RRule != "" {
+				parsed, err := rrule.Parse(*p.RRule)
+				if err != nil {
+					return invalid("rrule: %v", err)
+				}
+				rule = parsed.String()
+			}
+		}
+		if p.RepeatAfter != nil {
+			after = *p.RepeatAfter
+			if after < 0 || after > maxRepeatAfterDays {
+				return invalid("repeatAfterDays must be between 0 and %d", maxRepeatAfterDays)
+			}
+		}
+		if rule != "" && after > 0 {
+			return invalid("a task repeats on an rrule or repeatAfterDays after completion, not both")
+		}
+
+		if r == nil || rule != r.RRule || after != r.AfterDays {
+			if r != nil && !following {
+				return invalid("the repeat rule of a series can only change for this and following occurrences (?scope=following)")
+			}
+
+			// A new rule starts a new series from this occurrence on; the
+			// ones before keep the old seriesId.
+			it.Recurrence = nil
+			if rule != "" || after > 0 {
+				it.Recurrence = &Recurrence{SeriesID: it.ItemID, RRule: rule, AfterDays: after, Occurrence: 1, Slot: it.DueDate}
+				following = true
+			}
+		}
+	}
+
+	r = it.Recurrence
+	if r == nil {
+		return nil
+	}
+	if r.RRule != "" && it.DueDate == "" {
+		return invalid("a task with an rrule needs a dueDate")
+	}
+
+	if following {
+		r.Template = templateOf(it)
+		if p.DueDate != nil {
+			r.Slot = it.DueDate
+		}
+	}
+	return nil
+}
+
+// repeat creates the occurrence after it, unless there is one already or
+// the series is over. It runs when it is completed, or deleted on its own.
+func (tx *Tx) repeat(ctx context.Context, it *Item) error {
+
+	r := it.Recurrence
+	if r == nil || r.NextID != "" {
+		return nil
+	}
+
+	loc, err := tx.location(ctx, it.OwnerID)
+	if err != nil {
+		return err
+	}
+
+	ts := now()
+	due, occurrence, ok, err := r.next(ts, loc)
+	if err != nil || !ok {
+		return err
+	}
+
+	project, err := tx.Project(ctx, it.OwnerID, it.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	next := &Item{
+		ItemID:        NewID(),
+		ProjectID:     it.ProjectID,
+		OwnerID:       it.OwnerID,
+		ParentID:      it.ParentID,
+		Title:         r.Template.Title,
+		Description:   r.Template.Description,
+		Status:        project.EffectiveWorkflow().States[0].Name,
+		Priority:      r.Template.Priority,
+		DueDate:       due,
+		LabelIDs:      slices.Clone(r.Template.LabelIDs),
+		Checklist:     slices.Clone(r.Template.Checklist),
+		EstimateHours: r.Template.EstimateHours,
+		CreatedAt:     ts,
+		UpdatedAt:     ts,
+	}
+
+	nr := r.clone()
+	nr.Occurrence, nr.Slot, nr.NextID = occurrence, due, ""
+	next.Recurrence = nr
+
+	if err := tx.copyReminders(ctx, it, next); err != nil {
+		return err
+	}
+
+	r.NextID = next.ItemID
+	return tx.SaveItem(ctx, nil, next)
+}
+
+// next works out the due date and number of the occurrence after r, which
+// is completed at ts. A rule's occurrences that are already past at ts are
+// skipped. Without a due date the next occurrence of a repeatAfterDays
+// series is due at the time of day it was completed.
+func (r *Recurrence) next(ts string, loc *time.Location) (due string, occurrence int, ok bool, err error) {
+
+	done, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return "", 0, false, err
+	}
+	done = done.In(loc)
+
+	var slot time.Time
+	if r.Slot != "" {
+		if slot, err = time.Parse(time.RFC3339, r.Slot); err != nil {
+			return "", 0, false, err
+		}
+		slot = slot.In(loc)
+	}
+
+	if r.AfterDays > 0 {
+		y, m, d := done.Date()
+		hh, mm, ss := done.Clock()
+		if !slot.IsZero() {
+			hh, mm, ss = slot.Clock()
+		}
+		t := time.Date(y, m, d+r.AfterDays, hh, mm, ss, 0, loc)
+		return t.UTC().Format(time.RFC3339), r.Occurrence + 1, true, nil
+	}
+
+	rule, err := rrule.Parse(r.RRule)
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	n := r.Occurrence
+	for range maxSkippedOccurrences {
+		next, ok := rule.Next(slot, n)
+		if !ok {
+			return "", 0, false, nil
+		}
+		slot, n = next, n+1
+		if slot.After(done) {
+			break
+		}
+	}
+	return slot.UTC().Format(time.RFC3339), n, true, nil
+}
+
+// location returns the time zone of ownerID's profile, read once per
+// transaction. A transaction only ever changes one user's tasks.
+func (tx *Tx) location(ctx context.Context, ownerID string) (*time.Location, error) {
+
+	if tx.loc == nil {
+		loc, err := tx.s.Location(ctx, ownerID)
+		if err != nil {
+			return nil, err
+		}
+		tx.loc = loc
+	}
+	return tx.loc, nil
+}
@@ -0,0 +1,105 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var cet = time.FixedZone("CET", 3600)
+
+func TestCompletingCreatesNextOccurrence(t *testing.T) {
+
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted}
+	title, due, rule := "Weekly report", "2030-01-07T09:00:00+01:00", "FREQ=WEEKLY;BYDAY=MO"
+	if err := (ItemPatch{Title: &title, DueDate: &due, RRule: &rule}).apply(it); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := subtaskTx(false, it)
+	tx.loc = cet
+
+	// Only this occurrence: the next one still gets the series' title.
+	late := "Weekly report (late)"
+	if err := tx.PatchItem(context.Background(), it, ItemPatch{Title: &late, Scope: ScopeThis}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := StatusDone
+	if err := tx.PatchItem(context.Background(), it, ItemPatch{Status: &done}); err != nil {
+		t.Fatal(err)
+	}
+
+	next := tx.Item(it.Recurrence.NextID)
+	if next == nil {
+		t.Fatal("no next occurrence staged")
+	}
+	if next.DueDate != "2030-01-14T08:00:00Z" || next.Title != title || next.Status != StatusNotStarted {
+		t.Errorf("next occurrence = %q %q %q", next.DueDate, next.Title, next.Status)
+	}
+	if r := next.Recurrence; r.SeriesID != "a" || r.Occurrence != 2 || r.NextID != "" {
+		t.Errorf("next recurrence = %+v", r)
+	}
+
+	// Reopening and completing again does not make another one.
+	staged := len(tx.staged)
+	reopen, again := StatusInProgress, StatusDone
+	for _, s := range []*string{&reopen, &again} {
+		if err := tx.PatchItem(context.Background(), it, ItemPatch{Status: s}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(tx.staged) != staged {
+		t.Errorf("completing twice staged %d more writes", len(tx.staged)-staged)
+	}
+}
+
+func TestNextOccurrence(t *testing.T) {
+
+	tests := []struct {
+		r        Recurrence
+		doneAt   string
+		wantDue  string
+		wantN    int
+		wantMore bool
+	}{
+		// 3 days after completion, at the time of day of the slot in the
+		// user's zone: done late on the 20th local time.
+		{Recurrence{AfterDays: 3, Slot: "2030-01-07T08:00:00Z", Occurrence: 1}, "2030-01-20T22:30:00Z", "2030-01-23T08:00:00Z", 2, true},
+		// Completed two weeks late: the missed Mondays are skipped.
+		{Recurrence{RRule: "FREQ=WEEKLY", Slot: "2030-01-07T08:00:00Z", Occurrence: 1}, "2030-01-22T12:00:00Z", "2030-01-28T08:00:00Z", 4, true},
+		{Recurrence{RRule: "FREQ=WEEKLY;COUNT=2", Slot: "2030-01-07T08:00:00Z", Occurrence: 2}, "2030-01-14T12:00:00Z", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		due, n, ok, err := tt.r.next(tt.doneAt, cet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if due != tt.wantDue || n != tt.wantN || ok != tt.wantMore {
+			t.Errorf("%+v done %s: %q #%d %v, want %q #%d %v", tt.r, tt.doneAt, due, n, ok, tt.wantDue, tt.wantN, tt.wantMore)
+		}
+	}
+}
+
+func TestRuleChangeNeedsFollowing(t *testing.T) {
+
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", DueDate: "2030-01-07T08:00:00Z",
+		Recurrence: &Recurrence{SeriesID: "s", RRule: "FREQ=WEEKLY", Occurrence: 3, Slot: "2030-01-07T08:00:00Z"}}
+
+	daily := "FREQ=DAILY"
+	err := ItemPatch{RRule: &daily}.apply(it)
+
+	var te *Error
+	if !errors.As(err, &te) || te.Code != 400 {
+		t.Fatalf("rule change of one occurrence: err = %v", err)
+	}
+
+	if err := (ItemPatch{RRule: &daily, Scope: ScopeFollowing}).apply(it); err != nil {
+		t.Fatal(err)
+	}
+	if r := it.Recurrence; r.SeriesID != "a" || r.Occurrence != 1 || r.RRule != daily {
+		t.Errorf("new series = %+v", r)
+	}
+}
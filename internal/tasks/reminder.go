@@ -0,0 +1,475 @@
+package tasks
+
+import (
+	"context"
+	"hash/fnv"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/storage"
+)
+
+// Channels a reminder can be delivered through.
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+	ChannelInbox   = "inbox"
+)
+
+const (
+	maxItemReminders = 10
+
+	// maxMinutesBefore is four weeks.
+	maxMinutesBefore = 4 * 7 * 24 * 60
+
+	// ReminderShards spreads pending reminders over this many partitions of
+	// pending-index, so one busy minute does not land on one partition.
+	ReminderShards = 8
+)
+
+// RemindersByPending lists the reminders still to be sent by when they are
+// due, one partition per shard. Sent reminders have no pending attribute
+// and drop out of the index.
+var RemindersByPending = Index{Name: "pending-index", PartitionKey: "pending", SortKey: "sendAt"}
+
+// RemindersByOwner lists every reminder of a user, for account deletion.
+var RemindersByOwner = Index{Name: "owner-index", PartitionKey: "ownerId", SortKey: "reminderId"}
+
+// Reminder is an item in the reminders table. It fires at At, or
+// MinutesBefore the task is due; SendAt is when that is, and follows the
+// task's due date.
+type Reminder struct {
+	ItemID        string   `json:"itemId" dynamodbav:"itemId"`
+	ReminderID    string   `json:"reminderId" dynamodbav:"reminderId"`
+	OwnerID       string   `json:"-" dynamodbav:"ownerId"`
+	At            string   `json:"at,omitempty" dynamodbav:"at,omitempty"`
+	MinutesBefore *int     `json:"minutesBeforeDue,omitempty" dynamodbav:"minutesBefore,omitempty"`
+	Channels      []string `json:"channels" dynamodbav:"channels,stringset"`
+	WebhookURL    string   `json:"webhookUrl,omitempty" dynamodbav:"webhookUrl,omitempty"`
+	SendAt        string   `json:"sendAt,omitempty" dynamodbav:"sendAt,omitempty"`
+	CreatedAt     string   `json:"createdAt" dynamodbav:"createdAt"`
+
+	// Delivered are the channels this SendAt went out through, SentAt when
+	// the reminder was done with. Failed are channels given up on.
+	Delivered []string `json:"delivered,omitempty" dynamodbav:"delivered,stringset,omitempty"`
+	Failed    []string `json:"failed,omitempty" dynamodbav:"failed,stringset,omitempty"`
+	SentAt    string   `json:"sentAt,omitempty" dynamodbav:"sentAt,omitempty"`
+
+	// Pending is the pending-index shard while the reminder waits to be
+	// sent. Lease is held by the scheduler run sending it, until LeaseUntil.
+	Pending    string `json:"-" dynamodbav:"pending,omitempty"`
+	Lease      string `json:"-" dynamodbav:"lease,omitempty"`
+	LeaseUntil string `json:"-" dynamodbav:"leaseUntil,omitempty"`
+	Attempts   int    `json:"-" dynamodbav:"attempts,omitempty"`
+}
+
+// ReminderBody is the body of a reminder create request: either at or
+// minutesBeforeDue.
+type ReminderBody struct {
+	At            *string  `json:"at"`
+	MinutesBefore *int     `json:"minutesBeforeDue"`
+	Channels      []string `json:"channels"`
+	WebhookURL    string   `json:"webhookUrl"`
+}
+
+func reminderShard(itemID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(itemID))
+	return strconv.Itoa(int(h.Sum32() % ReminderShards))
+}
+
+// schedule works out when r fires for a task due at due, and puts it back
+// in line to be sent. A relative reminder on a task without a due date
+// waits until it gets one.
+func (r *Reminder) schedule(due string) error {
+
+	r.SendAt = r.At
+	if r.MinutesBefore != nil {
+		r.SendAt = ""
+		if due != "" {
+			t, err := time.Parse(time.RFC3339, due)
+			if err != nil {
+				return err
+			}
+			r.SendAt = t.Add(-time.Duration(*r.MinutesBefore) * time.Minute).UTC().Format(time.RFC3339)
+		}
+	}
+
+	r.Pending = ""
+	if r.SendAt != "" {
+		r.Pending = reminderShard(r.ItemID)
+	}
+	r.Delivered, r.Failed, r.SentAt = nil, nil, ""
+	r.Lease, r.LeaseUntil, r.Attempts = "", "", 0
+	return nil
+}
+
+func (b ReminderBody) reminder(it *Item) (*Reminder, error) {
+
+	r := &Reminder{
+		ItemID:     it.ItemID,
+		ReminderID: NewID(),
+		OwnerID:    it.OwnerID,
+		CreatedAt:  now(),
+	}
+
+	switch {
+	case (b.At == nil) == (b.MinutesBefore == nil):
+		return nil, invalid("a reminder needs either at or minutesBeforeDue")
+	case b.At != nil:
+		at, err := ParseTime(*b.At)
+		if err != nil || at == "" {
+			return nil, invalid("at must be an RFC 3339 time such as 2026-10-20T17:00:00Z")
+		}
+		if at <= now() {
+			return nil, invalid("at must be in the future")
+		}
+		r.At = at
+	default:
+		if *b.MinutesBefore < 0 || *b.MinutesBefore > maxMinutesBefore {
+			return nil, invalid("minutesBeforeDue must be between 0 and %d", maxMinutesBefore)
+		}
+		m := *b.MinutesBefore
+		r.MinutesBefore = &m
+	}
+
+	r.Channels = []string{ChannelInbox}
+	if len(b.Channels) > 0 {
+		r.Channels = nil
+		for _, c := range b.Channels {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if c != ChannelEmail && c != ChannelWebhook && c != ChannelInbox {
+				return nil, invalid("channels must be email, webhook or inbox")
+			}
+			r.Channels = append(r.Channels, c)
+		}
+		slices.Sort(r.Channels)
+		r.Channels = slices.Compact(r.Channels)
+	}
+
+	if slices.Contains(r.Channels, ChannelWebhook) {
+		u, err := url.Parse(b.WebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, invalid("the webhook channel needs an https webhookUrl")
+		}
+		r.WebhookURL = u.String()
+	} else if b.WebhookURL != "" {
+		return nil, invalid("webhookUrl is only used with the webhook channel")
+	}
+
+	return r, r.schedule(it.DueDate)
+}
+
+func reminderKey(itemID, reminderID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"itemId":     &types.AttributeValueMemberS{Value: itemID},
+		"reminderId": &types.AttributeValueMemberS{Value: reminderID},
+	}
+}
+
+// itemReminders returns every reminder of item itemID.
+func (s *Store) itemReminders(ctx context.Context, itemID string) ([]Reminder, error) {
+
+	result, err := s.DB.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.Reminders),
+		KeyConditionExpression: aws.String("itemId = :item"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":item": &types.AttributeValueMemberS{Value: itemID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reminders := []Reminder{}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &reminders); err != nil {
+		return nil, err
+	}
+	return reminders, nil
+}
+
+// ListReminders returns the reminders of item itemID, oldest first. An item
+// has at most maxItemReminders, so they always fit on one page.
+func (s *Store) ListReminders(ctx context.Context, ownerID, itemID string) ([]Reminder, error) {
+
+	if _, err := s.GetItem(ctx, ownerID, itemID); err != nil {
+		return nil, err
+	}
+	return s.itemReminders(ctx, itemID)
+}
+
+func (s *Store) getReminder(ctx context.Context, itemID, reminderID string) (*Reminder, error) {
+
+	result, err := s.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Reminders),
+		Key:            reminderKey(itemID, reminderID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	var r Reminder
+	if err := attributevalue.UnmarshalMap(result.Item, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// CreateReminder adds a reminder to item itemID. The item counts its
+// reminders and is written in the same transaction, so a reminder never
+// outlives a task deleted meanwhile.
+func (s *Store) CreateReminder(ctx context.Context, ownerID, itemID string, b ReminderBody) (*Reminder, error) {
+
+	var r *Reminder
+
+	_, err := s.UpdateItem(ctx, ownerID, itemID, nil, func(tx *Tx, it *Item) error {
+		if it.ReminderCount >= maxItemReminders {
+			return refused(409, "a task can have at most %d reminders", maxItemReminders)
+		}
+
+		var err error
+		if r, err = b.reminder(it); err != nil {
+			return err
+		}
+		if err := tx.putReminder(r, true); err != nil {
+			return err
+		}
+
+		before := it.Clone()
+		it.ReminderCount++
+		return tx.SaveItem(ctx, before, it)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// DeleteReminder removes a reminder of item itemID.
+func (s *Store) DeleteReminder(ctx context.Context, ownerID, itemID, reminderID string) error {
+
+	_, err := s.UpdateItem(ctx, ownerID, itemID, nil, func(tx *Tx, it *Item) error {
+		if _, err := tx.s.getReminder(ctx, itemID, reminderID); err != nil {
+			return err
+		}
+
+		tx.Add(types.TransactWriteItem{Delete: &types.Delete{
+			TableName:           aws.String(tx.s.Reminders),
+			Key:                 reminderKey(itemID, reminderID),
+			ConditionExpression: aws.String("attribute_exists(reminderId)"),
+		}})
+
+		before := it.Clone()
+		it.ReminderCount = max(it.ReminderCount-1, 0)
+		return tx.SaveItem(ctx, before, it)
+	})
+	return err
+}
+
+// updateReminders moves the relative reminders of it along with its due
+// date, in the same transaction. A reminder that went out for the old due
+// date is sent again for the new one.
+func (tx *Tx) updateReminders(ctx context.Context, before, it *Item) error {
+
+	if before == nil || before.DueDate == it.DueDate || it.ReminderCount == 0 {
+		return nil
+	}
+
+	reminders, err := tx.s.itemReminders(ctx, it.ItemID)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range reminders {
+		if r.MinutesBefore == nil {
+			continue
+		}
+		if err := r.schedule(it.DueDate); err != nil {
+			return err
+		}
+		if err := tx.putReminder(&r, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyReminders gives next, the next occurrence of a recurring task, the
+// relative reminders of it. Reminders at a fixed time stay with it.
+func (tx *Tx) copyReminders(ctx context.Context, it, next *Item) error {
+
+	if it.ReminderCount == 0 {
+		return nil
+	}
+
+	reminders, err := tx.s.itemReminders(ctx, it.ItemID)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range reminders {
+		if r.MinutesBefore == nil {
+			continue
+		}
+		r.ItemID, r.ReminderID, r.CreatedAt = next.ItemID, NewID(), now()
+		if err := r.schedule(next.DueDate); err != nil {
+			return err
+		}
+		if err := tx.putReminder(&r, true); err != nil {
+			return err
+		}
+		next.ReminderCount++
+	}
+	return nil
+}
+
+// putReminder stages r to be written: a new reminder, or one that must
+// still exist.
+func (tx *Tx) putReminder(r *Reminder, create bool) error {
+
+	item, err := attributevalue.MarshalMap(r)
+	if err != nil {
+		return err
+	}
+
+	cond := "attribute_exists(reminderId)"
+	if create {
+		cond = "attribute_not_exists(reminderId)"
+	}
+
+	tx.Add(types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(tx.s.Reminders),
+		Item:                item,
+		ConditionExpression: aws.String(cond),
+	}})
+	return nil
+}
+
+// deleteReminders removes the reminders of a deleted item.
+func (s *Store) deleteReminders(ctx context.Context, itemID string) error {
+	return storage.DeleteQueried(ctx, s.DB, &dynamodb.QueryInput{
+		TableName:              aws.String(s.Reminders),
+		KeyConditionExpression: aws.String("itemId = :item"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":item": &types.AttributeValueMemberS{Value: itemID},
+		},
+	}, "itemId", "reminderId")
+}
+
+//////////////////////
+// SCHEDULER
+//////////////////////
+
+// DueReminders returns up to limit reminders of shard that were due at or
+// before ts, soonest first.
+func (s *Store) DueReminders(ctx context.Context, shard, ts string, limit int32) ([]Reminder, error) {
+
+	result, err := s.DB.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.Reminders),
+		IndexName:              aws.String(RemindersByPending.Name),
+		KeyConditionExpression: aws.String("pending = :shard AND sendAt <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":shard": &types.AttributeValueMemberS{Value: shard},
+			":now":   &types.AttributeValueMemberS{Value: ts},
+		},
+		Limit: aws.Int32(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reminders := []Reminder{}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &reminders); err != nil {
+		return nil, err
+	}
+	return reminders, nil
+}
+
+// ClaimReminder takes a lease on r until until, so no other scheduler run
+// sends it meanwhile. It fails with ErrConflict when r was sent, moved or
+// claimed since it was read.
+func (s *Store) ClaimReminder(ctx context.Context, r *Reminder, lease, until string) error {
+
+	out, err := s.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.Reminders),
+		Key:                 reminderKey(r.ItemID, r.ReminderID),
+		UpdateExpression:    aws.String("SET lease = :lease, leaseUntil = :until ADD attempts :one"),
+		ConditionExpression: aws.String("sendAt = :sendAt AND attribute_exists(pending) AND (attribute_not_exists(leaseUntil) OR leaseUntil < :now)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":lease":  &types.AttributeValueMemberS{Value: lease},
+			":until":  &types.AttributeValueMemberS{Value: until},
+			":sendAt": &types.AttributeValueMemberS{Value: r.SendAt},
+			":now":    &types.AttributeValueMemberS{Value: now()},
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if storage.IsConditionFailed(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	return attributevalue.UnmarshalMap(out.Attributes, r)
+}
+
+// leased updates r, which the caller holds the lease on.
+func (s *Store) leased(ctx context.Context, r *Reminder, update string, values map[string]types.AttributeValue) error {
+
+	values[":lease"] = &types.AttributeValueMemberS{Value: r.Lease}
+	values[":sendAt"] = &types.AttributeValueMemberS{Value: r.SendAt}
+
+	_, err := s.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.Reminders),
+		Key:                       reminderKey(r.ItemID, r.ReminderID),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("lease = :lease AND sendAt = :sendAt"),
+		ExpressionAttributeValues: values,
+	})
+	if storage.IsConditionFailed(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// MarkDelivered records that r went out through channel, right after it
+// did, so a later run does not send it there again.
+func (s *Store) MarkDelivered(ctx context.Context, r *Reminder, channel string) error {
+
+	err := s.leased(ctx, r, "ADD delivered :channel", map[string]types.AttributeValue{
+		":channel": &types.AttributeValueMemberSS{Value: []string{channel}},
+	})
+	if err == nil {
+		r.Delivered = append(r.Delivered, channel)
+	}
+	return err
+}
+
+// FinishReminder takes r out of pending-index. failed are the channels it
+// could not be delivered through, given up on.
+func (s *Store) FinishReminder(ctx context.Context, r *Reminder, failed []string) error {
+
+	update := "SET sentAt = :now REMOVE pending, lease, leaseUntil"
+	values := map[string]types.AttributeValue{
+		":now": &types.AttributeValueMemberS{Value: now()},
+	}
+	if len(failed) > 0 {
+		update = "SET sentAt = :now, failed = :failed REMOVE pending, lease, leaseUntil"
+		values[":failed"] = &types.AttributeValueMemberSS{Value: failed}
+	}
+	return s.leased(ctx, r, update, values)
+}
@@ -0,0 +1,64 @@
+package tasks
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestReminderBody(t *testing.T) {
+
+	it := &Item{ItemID: "a", OwnerID: "u1", DueDate: "2030-01-07T09:00:00Z"}
+	at, before := "2030-01-06T18:00:00+01:00", 30
+
+	r, err := ReminderBody{At: &at}.reminder(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.SendAt != "2030-01-06T17:00:00Z" || r.Pending == "" || !slices.Equal(r.Channels, []string{ChannelInbox}) {
+		t.Errorf("at reminder = %q %q %v", r.SendAt, r.Pending, r.Channels)
+	}
+
+	r, err = ReminderBody{MinutesBefore: &before, Channels: []string{"Webhook", "email", "webhook"}, WebhookURL: "https://example.com/hook"}.reminder(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.SendAt != "2030-01-07T08:30:00Z" || !slices.Equal(r.Channels, []string{ChannelEmail, ChannelWebhook}) {
+		t.Errorf("relative reminder = %q %v", r.SendAt, r.Channels)
+	}
+
+	past, tooLong := "2001-01-01T00:00:00Z", maxMinutesBefore+1
+	bad := []ReminderBody{
+		{},
+		{At: &at, MinutesBefore: &before},
+		{At: &past},
+		{MinutesBefore: &tooLong},
+		{At: &at, Channels: []string{"sms"}},
+		{At: &at, Channels: []string{ChannelWebhook}, WebhookURL: "http://example.com/hook"},
+		{At: &at, WebhookURL: "https://example.com/hook"},
+	}
+	for _, b := range bad {
+		if _, err := b.reminder(it); err == nil {
+			t.Errorf("%+v accepted", b)
+		}
+	}
+}
+
+func TestRelativeReminderWaitsForDueDate(t *testing.T) {
+
+	before := 60
+	r, err := ReminderBody{MinutesBefore: &before}.reminder(&Item{ItemID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.SendAt != "" || r.Pending != "" {
+		t.Errorf("reminder without a due date = %q %q, want not pending", r.SendAt, r.Pending)
+	}
+
+	r.Delivered, r.Attempts = []string{ChannelInbox}, 2
+	if err := r.schedule("2030-01-07T09:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	if r.SendAt != "2030-01-07T08:00:00Z" || r.Pending != reminderShard("a") || r.Delivered != nil || r.Attempts != 0 {
+		t.Errorf("rescheduled reminder = %+v", r)
+	}
+}
@@ -0,0 +1,76 @@
+package tasks
+
+import (
+	"errors"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"to_do_list_demo/internal/etag"
+	"to_do_list_demo/internal/respond"
+)
+
+// ErrorResponse answers a failed Store call: the status of a refused
+// change, 412 with the current project or item for a failed If-Match, 404,
+// 409 for a change that kept losing against other writes, and the storage
+// status for anything else.
+func ErrorResponse(err error) (events.APIGatewayV2HTTPResponse, error) {
+
+	var te *Error
+	var pe *PreconditionError
+
+	switch {
+	case errors.As(err, &te):
+		return respond.Error(te.Code, te.Msg)
+	case errors.As(err, &pe) && pe.Item != nil:
+		return ItemResponse(412, pe.Item)
+	case errors.As(err, &pe) && pe.Comment != nil:
+		return CommentResponse(412, pe.Comment)
+	case errors.As(err, &pe):
+		return ProjectResponse(412, pe.Project)
+	case errors.Is(err, ErrNotFound):
+		return respond.Error(404, "not found")
+	case errors.Is(err, ErrConflict):
+		return respond.Error(409, "conflicting update, retry")
+	}
+
+	log.Println("tasks error:", err)
+	return respond.DBError(err)
+}
+
+// ItemResponse answers with it and its ETag.
+func ItemResponse(code int, it *Item) (events.APIGatewayV2HTTPResponse, error) {
+
+	resp, err := respond.JSON(code, it)
+	resp.Headers["ETag"] = etag.Format(it.Version)
+
+	return resp, err
+}
+
+// ProjectResponse answers with p and its ETag.
+func ProjectResponse(code int, p *Project) (events.APIGatewayV2HTTPResponse, error) {
+
+	resp, err := respond.JSON(code, p)
+	resp.Headers["ETag"] = etag.Format(p.Version)
+
+	return resp, err
+}
+
+// CommentResponse answers with c and its ETag.
+func CommentResponse(code int, c *Comment) (events.APIGatewayV2HTTPResponse, error) {
+
+	resp, err := respond.JSON(code, c)
+	resp.Headers["ETag"] = etag.Format(c.Version)
+
+	return resp, err
+}
+
+// NotModified answers a GET whose If-None-Match matched version.
+func NotModified(version int64) (events.APIGatewayV2HTTPResponse, error) {
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 304,
+		Headers: map[string]string{
+			"ETag": etag.Format(version),
+		},
+	}, nil
+}
@@ -0,0 +1,277 @@
+package tasks
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/pagination"
+)
+
+// maxSubtaskDepth is how many levels of subtasks a top-level task can have.
+const maxSubtaskDepth = 3
+
+// ItemsByParent lists the direct subtasks of a task, oldest first. Only
+// subtasks have a parentId, so the index holds nothing else.
+var ItemsByParent = Index{Name: "parent-index", PartitionKey: "parentId", SortKey: "itemId"}
+
+// ChecklistEntry is one step of a task's checklist. Unlike subtasks,
+// entries have no status, due date or history of their own.
+type ChecklistEntry struct {
+	Text string `json:"text" dynamodbav:"text"`
+	Done bool   `json:"done" dynamodbav:"done"`
+}
+
+// Progress is how much of a task's subtasks and checklist is done.
+type Progress struct {
+	Done    int `json:"done" dynamodbav:"done"`
+	Total   int `json:"total" dynamodbav:"total"`
+	Percent int `json:"percent" dynamodbav:"percent"`
+}
+
+func progress(it *Item) *Progress {
+
+	p := Progress{Done: it.ChildrenDone, Total: it.ChildCount + len(it.Checklist)}
+	if p.Total == 0 {
+		return nil
+	}
+
+	for _, e := range it.Checklist {
+		if e.Done {
+			p.Done++
+		}
+	}
+	p.Percent = p.Done * 100 / p.Total
+	return &p
+}
+
+// placeItem checks where a new or moved task goes: its parent must be a
+// task of the same project that is not one of its own subtasks, and the
+// depth limit must hold for the task and everything under it. Subtasks
+// follow a task that changes depth or project.
+func (tx *Tx) placeItem(ctx context.Context, before, it *Item) error {
+
+	if before != nil && before.ParentID == it.ParentID && before.ProjectID == it.ProjectID {
+		return nil
+	}
+
+	if before != nil && before.ProjectID != it.ProjectID {
+		if _, err := tx.Project(ctx, it.OwnerID, it.ProjectID); err == ErrNotFound {
+			return invalid("unknown project %q", it.ProjectID)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	it.Depth = 0
+	if it.ParentID != "" {
+		parent, err := tx.LoadItem(ctx, it.OwnerID, it.ParentID)
+		if err == ErrNotFound {
+			return invalid("unknown parent task %q", it.ParentID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if parent.ProjectID != it.ProjectID {
+			return invalid("a subtask must be in the same project as its parent")
+		}
+
+		for a := parent; a.ParentID != ""; {
+			if a.ParentID == it.ItemID {
+				return invalid("a task cannot be moved under one of its own subtasks")
+			}
+			if a, err = tx.LoadItem(ctx, it.OwnerID, a.ParentID); err != nil {
+				return err
+			}
+		}
+
+		it.Depth = parent.Depth + 1
+	}
+
+	if before == nil || it.ChildCount == 0 {
+		if it.Depth > maxSubtaskDepth {
+			return invalid("subtasks can be at most %d levels deep", maxSubtaskDepth)
+		}
+		return nil
+	}
+
+	sub, err := tx.subtree(ctx, it)
+	if err != nil {
+		return err
+	}
+
+	shift := it.Depth - before.Depth
+	deepest := it.Depth
+	for _, d := range sub {
+		deepest = max(deepest, d.Depth+shift)
+	}
+	if deepest > maxSubtaskDepth {
+		return invalid("subtasks can be at most %d levels deep", maxSubtaskDepth)
+	}
+
+	ts := now()
+	for _, d := range sub {
+		d.Depth += shift
+		d.ProjectID = it.ProjectID
+		d.UpdatedAt = ts
+		tx.PutItem(d)
+	}
+	return nil
+}
+
+// subtree returns every subtask below it, breadth first, leaving out the
+// ones in the trash. A change to more subtasks than fit in one transaction
+// is refused.
+func (tx *Tx) subtree(ctx context.Context, it *Item) ([]*Item, error) {
+	return tx.tree(ctx, it, func(c *Item) bool { return c.DeletedAt == "" })
+}
+
+// tree returns the subtasks below it that keep accepts, breadth first. The
+// walk does not go below a subtask keep turns down.
+func (tx *Tx) tree(ctx context.Context, it *Item, keep func(c *Item) bool) ([]*Item, error) {
+
+	var sub []*Item
+
+	for level := []*Item{it}; len(level) > 0; {
+		var next []*Item
+		for _, parent := range level {
+			if parent.ChildCount == 0 {
+				continue
+			}
+			err := tx.s.eachItem(ctx, ItemsByParent, parent.ItemID, func(c *Item) error {
+				cached, ok := tx.items[c.ItemID]
+				if ok {
+					c = cached
+				}
+				if !keep(c) {
+					return nil
+				}
+				if len(sub) == maxTransactItems-1 {
+					return refused(409, "too many subtasks to change at once (at most %d)", maxTransactItems-1)
+				}
+				if !ok {
+					c = c.Clone()
+					tx.items[c.ItemID] = c
+				}
+				sub = append(sub, c)
+				next = append(next, c)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		level = next
+	}
+
+	return sub, nil
+}
+
+// updateParents keeps the child counts of the old and new parent of it up
+// to date. before is nil for a new task, it is nil for a deleted one.
+func (tx *Tx) updateParents(ctx context.Context, before, it *Item) error {
+
+	var oldParent, newParent string
+	var wasDone, isDone int
+	var ownerID string
+
+	if before != nil {
+		oldParent, ownerID = before.ParentID, before.OwnerID
+		wasDone = doneCount(before)
+	}
+	if it != nil {
+		newParent, ownerID = it.ParentID, it.OwnerID
+		isDone = doneCount(it)
+	}
+
+	if oldParent == newParent {
+		if oldParent == "" || wasDone == isDone {
+			return nil
+		}
+		return tx.adjustParent(ctx, ownerID, oldParent, 0, isDone-wasDone)
+	}
+
+	if oldParent != "" {
+		if err := tx.adjustParent(ctx, ownerID, oldParent, -1, -wasDone); err != nil {
+			return err
+		}
+	}
+	if newParent != "" {
+		return tx.adjustParent(ctx, ownerID, newParent, 1, isDone)
+	}
+	return nil
+}
+
+func doneCount(it *Item) int {
+	if it.Done() {
+		return 1
+	}
+	return 0
+}
+
+// adjustParent changes the child counts of parentID and completes it when
+// its last open subtask is done and its project has autoCompleteParent.
+// The parent is saved like any other change, so completing it can in turn
+// complete its own parent.
+func (tx *Tx) adjustParent(ctx context.Context, ownerID, parentID string, children, done int) error {
+
+	parent, err := tx.LoadItem(ctx, ownerID, parentID)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	before := parent.Clone()
+	parent.ChildCount = max(parent.ChildCount+children, 0)
+	parent.ChildrenDone = min(max(parent.ChildrenDone+done, 0), parent.ChildCount)
+
+	if !parent.Done() && parent.ChildCount > 0 && parent.ChildrenDone == parent.ChildCount {
+		project, err := tx.Project(ctx, ownerID, parent.ProjectID)
+		if err != nil {
+			return err
+		}
+		if project.AutoCompleteParent {
+			if status, ok := project.EffectiveWorkflow().completion(parent); ok {
+				parent.Status = status
+			}
+		}
+	}
+
+	return tx.SaveItem(ctx, before, parent)
+}
+
+// ListSubtasks returns a page of the direct subtasks of item itemID that
+// are not in the trash.
+func (s *Store) ListSubtasks(ctx context.Context, ownerID, itemID string, r pagination.Request) ([]Item, map[string]types.AttributeValue, error) {
+
+	if _, err := s.GetItem(ctx, ownerID, itemID); err != nil {
+		return nil, nil, err
+	}
+
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(s.Items),
+		IndexName:              aws.String(ItemsByParent.Name),
+		KeyConditionExpression: aws.String("parentId = :parent"),
+		FilterExpression:       aws.String("attribute_not_exists(deletedAt)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":parent": &types.AttributeValueMemberS{Value: itemID},
+		},
+	}
+
+	raw, lastKey, err := pagination.Query(ctx, s.DB, in, r, ItemsByParent.KeyNames("itemId")...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items := []Item{}
+	if err := attributevalue.UnmarshalListOfMaps(raw, &items); err != nil {
+		return nil, nil, err
+	}
+	return items, lastKey, nil
+}
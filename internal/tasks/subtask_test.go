@@ -0,0 +1,118 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// subtaskTx returns a transaction whose reads are all answered from its
+// cache: project p1, its dependency graph and the given items.
+func subtaskTx(autoComplete bool, items ...*Item) *Tx {
+	tx := (&Store{}).Begin()
+	tx.projects["p1"] = &Project{ProjectID: "p1", OwnerID: "u1", AutoCompleteParent: autoComplete}
+	tx.graphs["p1"] = map[string][]string{}
+	tx.ranks["p1"] = ""
+	for _, it := range items {
+		tx.items[it.ItemID] = it
+	}
+	return tx
+}
+
+func TestChildDoneCompletesParent(t *testing.T) {
+
+	for _, auto := range []bool{true, false} {
+		parent := &Item{ItemID: "p", OwnerID: "u1", ProjectID: "p1", Status: StatusInProgress, ChildCount: 2, ChildrenDone: 1}
+		child := &Item{ItemID: "c", OwnerID: "u1", ProjectID: "p1", Status: StatusInProgress, ParentID: "p", Depth: 1}
+		tx := subtaskTx(auto, parent, child)
+
+		done := StatusDone
+		if err := tx.PatchItem(context.Background(), child, ItemPatch{Status: &done}); err != nil {
+			t.Fatal(err)
+		}
+
+		if parent.ChildrenDone != 2 {
+			t.Errorf("auto=%v: childrenDone = %d, want 2", auto, parent.ChildrenDone)
+		}
+		if got := parent.Status == StatusDone; got != auto {
+			t.Errorf("auto=%v: parent done = %v", auto, got)
+		}
+		if tx.Item("p") == nil {
+			t.Errorf("auto=%v: parent not staged", auto)
+		}
+	}
+}
+
+func TestMoveSubtaskUpdatesBothParents(t *testing.T) {
+
+	oldParent := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, ChildCount: 1, ChildrenDone: 1}
+	newParent := &Item{ItemID: "b", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, ParentID: "x", Depth: 1}
+	grand := &Item{ItemID: "x", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, ChildCount: 1}
+	child := &Item{ItemID: "c", OwnerID: "u1", ProjectID: "p1", Status: StatusDone, ParentID: "a", Depth: 1}
+	tx := subtaskTx(false, oldParent, newParent, grand, child)
+
+	to := "b"
+	if err := tx.PatchItem(context.Background(), child, ItemPatch{ParentID: &to}); err != nil {
+		t.Fatal(err)
+	}
+
+	if oldParent.ChildCount != 0 || oldParent.ChildrenDone != 0 {
+		t.Errorf("old parent counts = %d/%d", oldParent.ChildrenDone, oldParent.ChildCount)
+	}
+	if newParent.ChildCount != 1 || newParent.ChildrenDone != 1 {
+		t.Errorf("new parent counts = %d/%d", newParent.ChildrenDone, newParent.ChildCount)
+	}
+	if child.Depth != 2 {
+		t.Errorf("depth = %d, want 2", child.Depth)
+	}
+}
+
+func TestMoveUnderOwnSubtaskIsRefused(t *testing.T) {
+
+	top := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted}
+	mid := &Item{ItemID: "b", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, ParentID: "a", Depth: 1}
+	low := &Item{ItemID: "c", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, ParentID: "b", Depth: 2}
+	tx := subtaskTx(false, top, mid, low)
+
+	to := "c"
+	err := tx.PatchItem(context.Background(), top, ItemPatch{ParentID: &to})
+
+	var te *Error
+	if !errors.As(err, &te) || te.Code != 400 {
+		t.Errorf("moving a task under its grandchild: err = %v", err)
+	}
+}
+
+func TestDepthLimit(t *testing.T) {
+
+	deepest := &Item{ItemID: "d", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, ParentID: "x", Depth: maxSubtaskDepth}
+	x := &Item{ItemID: "x", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, Depth: maxSubtaskDepth - 1}
+	tx := subtaskTx(false, deepest, x)
+
+	title := "one level too deep"
+	it := &Item{ItemID: "n", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted}
+	p := ItemPatch{Title: &title, ParentID: &deepest.ItemID}
+	if err := p.apply(it); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.SaveItem(context.Background(), nil, it); err == nil {
+		t.Error("a subtask below the depth limit was accepted")
+	}
+}
+
+func TestProgress(t *testing.T) {
+
+	it := &Item{ChildCount: 2, ChildrenDone: 1, Checklist: []ChecklistEntry{{Text: "a", Done: true}, {Text: "b"}}}
+	it.derive()
+
+	if it.Progress == nil || *it.Progress != (Progress{Done: 2, Total: 4, Percent: 50}) {
+		t.Errorf("progress = %+v", it.Progress)
+	}
+
+	empty := &Item{}
+	empty.derive()
+	if empty.Progress != nil {
+		t.Errorf("progress without subtasks or checklist = %+v", empty.Progress)
+	}
+}
@@ -0,0 +1,195 @@
+// Package tasks holds the projects and project items (tasks) shared by the
+// projects and items lambdas: their types, the index keys derived from them,
+// the checks every change goes through and the store that writes them.
+//
+// Every change to a project or item is staged on a Tx and committed in one
+// DynamoDB transaction, with each written item conditioned on the version it
+// was read at. Two clients editing the same task therefore never overwrite
+// each other silently: the second write fails and is retried or answered
+// with 412.
+package tasks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/search"
+)
+
+const (
+	defaultProjectsTable  = "To-Do-List-Projects"
+	defaultItemsTable     = "To-Do-List-Project-Items"
+	defaultUsersTable     = "To-Do-List-Users"
+	defaultCommentsTable  = "To-Do-List-Comments"
+	defaultLabelsTable    = "To-Do-List-Labels"
+	defaultRemindersTable = "To-Do-List-Reminders"
+	defaultHistoryTable   = "To-Do-List-History"
+
+	// defaultTrashRetention is how long deleted projects and items stay
+	// in the trash.
+	defaultTrashRetention = 30 * 24 * time.Hour
+
+	// maxRetries is how often a change is re-read and re-applied when
+	// another write got in between and the client sent no If-Match.
+	maxRetries = 3
+)
+
+var (
+	ErrNotFound = errors.New("tasks: not found")
+
+	// ErrConflict is returned when a change keeps losing against other
+	// writes, or a related item changed in a way that breaks it.
+	ErrConflict = errors.New("tasks: conflicting update")
+)
+
+// Error is a change the checks refused. Code is the HTTP status to answer
+// with and Msg tells the client what to fix.
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func invalid(format string, args ...any) error {
+	return &Error{Code: 400, Msg: fmt.Sprintf(format, args...)}
+}
+
+func refused(code int, format string, args ...any) error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// PreconditionError is returned when an If-Match precondition fails. It
+// carries the current project or item so the client can merge its change.
+type PreconditionError struct {
+	Project *Project
+	Item    *Item
+	Comment *Comment
+}
+
+func (e *PreconditionError) Error() string {
+	return "tasks: precondition failed"
+}
+
+// Store reads and writes the projects, items, comments, reminders and
+// history tables and keeps the search index up to date with them. Users and Labels are only read,
+// for the owner's time zone and to check the labels put on a task.
+// TrashRetention is how long a deleted project or item can be restored.
+type Store struct {
+	DB             *dynamodb.Client
+	Projects       string
+	Items          string
+	Comments       string
+	Reminders      string
+	History        string
+	Users          string
+	Labels         string
+	Search         *search.Index
+	TrashRetention time.Duration
+}
+
+// New returns a Store for PROJECTS_TABLE (default To-Do-List-Projects),
+// ITEMS_TABLE (default To-Do-List-Project-Items), COMMENTS_TABLE (default
+// To-Do-List-Comments), REMINDERS_TABLE (default To-Do-List-Reminders),
+// HISTORY_TABLE (default To-Do-List-History) and LABELS_TABLE (default
+// To-Do-List-Labels), keeping the trash for TRASH_RETENTION (default 720h).
+func New(db *dynamodb.Client) *Store {
+	s := &Store{
+		DB:             db,
+		Projects:       defaultProjectsTable,
+		Items:          defaultItemsTable,
+		Comments:       defaultCommentsTable,
+		Reminders:      defaultRemindersTable,
+		History:        defaultHistoryTable,
+		Users:          defaultUsersTable,
+		Labels:         defaultLabelsTable,
+		Search:         search.New(db),
+		TrashRetention: defaultTrashRetention,
+	}
+	if t := os.Getenv("PROJECTS_TABLE"); t != "" {
+		s.Projects = t
+	}
+	if t := os.Getenv("ITEMS_TABLE"); t != "" {
+		s.Items = t
+	}
+	if t := os.Getenv("COMMENTS_TABLE"); t != "" {
+		s.Comments = t
+	}
+	if t := os.Getenv("REMINDERS_TABLE"); t != "" {
+		s.Reminders = t
+	}
+	if t := os.Getenv("HISTORY_TABLE"); t != "" {
+		s.History = t
+	}
+	if t := os.Getenv("LABELS_TABLE"); t != "" {
+		s.Labels = t
+	}
+	if d, err := time.ParseDuration(os.Getenv("TRASH_RETENTION")); err == nil && d > 0 {
+		s.TrashRetention = d
+	}
+	return s
+}
+
+// NewID returns a random id that sorts by creation time, so a Query on an
+// index sorted by id lists projects and items oldest first.
+func NewID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic("tasks: crypto/rand failed: " + err.Error())
+	}
+	return fmt.Sprintf("%013x", time.Now().UnixMicro()) + hex.EncodeToString(b)
+}
+
+// Index is a global secondary index and the attributes of its key.
+type Index struct {
+	Name         string
+	PartitionKey string
+	SortKey      string
+}
+
+// KeyNames returns the attributes making up a key in index of table, whose
+// own key is tableKey, for pagination.Query.
+func (i Index) KeyNames(tableKey string) []string {
+	if i.Name == "" {
+		return []string{tableKey}
+	}
+	return []string{tableKey, i.PartitionKey, i.SortKey}
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// get reads one item of table by its key with a consistent read,
+// returning ErrNotFound when it does not exist.
+func (s *Store) get(ctx context.Context, table, keyName, id string, out any) error {
+
+	result, err := s.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			keyName: &types.AttributeValueMemberS{Value: id},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	if result.Item == nil {
+		return ErrNotFound
+	}
+
+	return attributevalue.UnmarshalMap(result.Item, out)
+}
@@ -0,0 +1,321 @@
+package tasks
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/pagination"
+	"to_do_list_demo/internal/search"
+)
+
+// trashList is the listKey of the tasks of projectID in the trash.
+func trashList(projectID string) string {
+	return projectID + "#trash"
+}
+
+// purgeAt returns when the TTL of the table removes a project or item
+// deleted at deletedAt, in seconds since the epoch.
+func (s *Store) purgeAt(deletedAt string) int64 {
+	t, err := time.Parse(time.RFC3339, deletedAt)
+	if err != nil {
+		t = time.Now()
+	}
+	return t.Add(s.TrashRetention).Unix()
+}
+
+// expired reports whether purgeAt has passed. The TTL removes expired rows
+// some time later; until then they are treated as gone.
+func expired(purgeAt int64) bool {
+	return purgeAt > 0 && purgeAt <= time.Now().Unix()
+}
+
+// TrashTree moves it and its subtasks to the trash, marked with deletedAt
+// and with, the project whose deletion takes it along ("" when it is
+// deleted itself). They are detached from the tasks that remain, so only
+// the links between them come back on restore.
+func (tx *Tx) TrashTree(ctx context.Context, it *Item, deletedAt, with string) error {
+
+	sub, err := tx.subtree(ctx, it)
+	if err != nil {
+		return err
+	}
+
+	purgeAt := tx.s.purgeAt(deletedAt)
+	batch := append(sub, it)
+	for _, d := range batch {
+		d.DeletedAt, d.DeletedWith, d.PurgeAt = deletedAt, cmp.Or(with, it.ItemID), purgeAt
+		d.UpdatedAt = deletedAt
+		tx.PutItem(d)
+
+		ownerID, itemID := d.OwnerID, d.ItemID
+		tx.AfterCommit(func(ctx context.Context) {
+			tx.s.indexed(tx.s.indexComments(ctx, ownerID, itemID, false))
+		})
+	}
+	it.DeletedWith = with
+
+	if err := tx.detach(ctx, batch); err != nil {
+		return err
+	}
+
+	if err := tx.record(ctx, it.ItemID, it.OwnerID, []HistoryEntry{{Field: FieldDeleted}}); err != nil {
+		return err
+	}
+	return tx.updateParents(ctx, it, nil)
+}
+
+// detach takes the tasks of batch, which leave their project's lists, out
+// of the dependencies of the tasks that remain, and those tasks out of
+// theirs. The links between the tasks of batch are kept.
+func (tx *Tx) detach(ctx context.Context, batch []*Item) error {
+
+	for _, d := range batch {
+		if err := tx.dropDependencies(ctx, d); err != nil {
+			return err
+		}
+	}
+
+	leaving := map[string]*Item{}
+	for _, d := range batch {
+		leaving[d.ItemID] = d
+	}
+	gone := func(id string) bool { return leaving[id] == nil }
+	for _, d := range batch {
+		d.BlockedBy = slices.DeleteFunc(d.BlockedBy, gone)
+		d.Blocks = slices.DeleteFunc(d.Blocks, gone)
+		d.OpenBlockers = 0
+		for _, id := range d.BlockedBy {
+			if !leaving[id].Done() {
+				d.OpenBlockers++
+			}
+		}
+	}
+	return nil
+}
+
+// RestoreTree takes it, which was deleted itself or with its project, out
+// of the trash along with the subtasks deleted with it. A task whose
+// parent is no longer there becomes a top-level task. A status the
+// project's workflow no longer has becomes the first state of the same
+// category.
+func (tx *Tx) RestoreTree(ctx context.Context, it *Item) error {
+
+	with := cmp.Or(it.DeletedWith, it.ItemID)
+	sub, err := tx.tree(ctx, it, func(c *Item) bool { return c.DeletedAt != "" && c.DeletedWith == with })
+	if err != nil {
+		return err
+	}
+
+	project, err := tx.Project(ctx, it.OwnerID, it.ProjectID)
+	if err != nil {
+		return err
+	}
+	w := project.EffectiveWorkflow()
+
+	if it.ParentID != "" {
+		if _, err := tx.LoadItem(ctx, it.OwnerID, it.ParentID); err == ErrNotFound {
+			for _, d := range sub {
+				d.Depth -= it.Depth
+			}
+			it.ParentID, it.Depth = "", 0
+		} else if err != nil {
+			return err
+		}
+	}
+
+	ts := now()
+	for _, d := range append(sub, it) {
+		w.settle(d)
+		d.DeletedAt, d.DeletedWith, d.PurgeAt = "", "", 0
+		d.UpdatedAt = ts
+		tx.PutItem(d)
+
+		ownerID, itemID := d.OwnerID, d.ItemID
+		tx.AfterCommit(func(ctx context.Context) {
+			tx.s.indexed(tx.s.indexComments(ctx, ownerID, itemID, true))
+		})
+	}
+
+	if err := tx.record(ctx, it.ItemID, it.OwnerID, []HistoryEntry{{Field: FieldRestored}}); err != nil {
+		return err
+	}
+	return tx.updateParents(ctx, nil, it)
+}
+
+// trashedItem returns the item itemID of ownerID if it is in the trash.
+func (s *Store) trashedItem(ctx context.Context, ownerID, itemID string) (*Item, error) {
+
+	it, err := s.anyItem(ctx, ownerID, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	if it.DeletedAt == "" || expired(it.PurgeAt) {
+		return nil, ErrNotFound
+	}
+	return it, nil
+}
+
+// trashedProject is trashedItem for projects.
+func (s *Store) trashedProject(ctx context.Context, ownerID, projectID string) (*Project, error) {
+
+	p, err := s.anyProject(ctx, ownerID, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.DeletedAt == "" || expired(p.PurgeAt) {
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+// RestoreItem takes the task itemID out of the trash with its subtasks. A
+// task deleted along with its project comes back with the project, and one
+// whose project is in the trash needs the project restored first.
+func (s *Store) RestoreItem(ctx context.Context, ownerID, itemID string) (*Item, error) {
+	return s.updateItem(ctx, s.trashedItem, ownerID, itemID, nil, func(tx *Tx, it *Item) error {
+
+		if it.DeletedWith != "" {
+			return refused(409, "the task was deleted along with %s, restore that instead", it.DeletedWith)
+		}
+		project, err := tx.Project(ctx, ownerID, it.ProjectID)
+		if err == ErrNotFound {
+			return refused(409, "the task's project %s is deleted, restore it first", it.ProjectID)
+		} else if err != nil {
+			return err
+		}
+		if err := project.writable(); err != nil {
+			return err
+		}
+
+		return tx.RestoreTree(ctx, it)
+	})
+}
+
+// RestoreProject takes the project projectID out of the trash with the
+// tasks deleted along with it; tasks deleted before it on their own stay
+// in the trash. Archived tasks come back to the archive. The tasks go
+// first, so a failure part way leaves the project in the trash and the
+// restore can simply be retried.
+func (s *Store) RestoreProject(ctx context.Context, ownerID, projectID string) (*Project, error) {
+
+	p, err := s.trashedProject(ctx, ownerID, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.eachItem(ctx, ItemsByList, trashList(projectID), func(it *Item) error {
+		if it.DeletedWith != projectID || it.ParentID != "" {
+			return nil
+		}
+		_, err := s.updateItem(ctx, s.trashedItem, ownerID, it.ItemID, nil, func(tx *Tx, it *Item) error {
+			tx.projects[projectID] = p
+			return tx.RestoreTree(ctx, it)
+		})
+		if err != ErrNotFound {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.updateProject(ctx, s.trashedProject, ownerID, projectID, nil, func(tx *Tx, p *Project) error {
+		p.DeletedAt, p.PurgeAt = "", 0
+		if err := tx.record(ctx, p.ProjectID, p.OwnerID, []HistoryEntry{{Field: FieldRestored}}); err != nil {
+			return err
+		}
+		p.UpdatedAt = now()
+		tx.PutProject(p)
+		return nil
+	})
+}
+
+// ListTrash returns a page of the tasks ownerID deleted, newest first. The
+// subtasks and project tasks deleted along with them are not listed.
+func (s *Store) ListTrash(ctx context.Context, ownerID string, r pagination.Request) ([]Item, map[string]types.AttributeValue, error) {
+
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(s.Items),
+		IndexName:              aws.String(ItemsByTrash.Name),
+		KeyConditionExpression: aws.String("trashOwner = :owner"),
+		FilterExpression:       aws.String("purgeAt > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: ownerID},
+			":now":   &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+
+	raw, lastKey, err := pagination.Query(ctx, s.DB, in, r, ItemsByTrash.KeyNames("itemId")...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items := []Item{}
+	if err := attributevalue.UnmarshalListOfMaps(raw, &items); err != nil {
+		return nil, nil, err
+	}
+	return items, lastKey, nil
+}
+
+// ListTrashedProjects returns a page of the projects of ownerID in the
+// trash, newest first.
+func (s *Store) ListTrashedProjects(ctx context.Context, ownerID string, r pagination.Request) ([]Project, map[string]types.AttributeValue, error) {
+
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(s.Projects),
+		IndexName:              aws.String(ProjectsByOwner.Name),
+		KeyConditionExpression: aws.String("ownerId = :owner AND begins_with(listSort, :list)"),
+		FilterExpression:       aws.String("purgeAt > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: ownerID},
+			":list":  &types.AttributeValueMemberS{Value: listTrash},
+			":now":   &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+
+	raw, lastKey, err := pagination.Query(ctx, s.DB, in, r, ProjectsByOwner.KeyNames("projectId")...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	projects := []Project{}
+	if err := attributevalue.UnmarshalListOfMaps(raw, &projects); err != nil {
+		return nil, nil, err
+	}
+	return projects, lastKey, nil
+}
+
+// ItemPurged deletes what belonged to the item itemID of ownerID once the
+// item itself is gone: its comments, reminders, history and search index
+// entry. It is run for the items the TTL removes from the trash.
+func (s *Store) ItemPurged(ctx context.Context, ownerID, itemID string) error {
+	return errors.Join(
+		s.deleteComments(ctx, ownerID, itemID),
+		s.deleteReminders(ctx, itemID),
+		s.deleteHistory(ctx, itemID),
+		s.Search.Remove(ctx, ownerID, search.TypeItem, itemID),
+	)
+}
+
+// ProjectPurged is ItemPurged for projects: their history and search index
+// entry.
+func (s *Store) ProjectPurged(ctx context.Context, ownerID, projectID string) error {
+	return errors.Join(
+		s.deleteHistory(ctx, projectID),
+		s.Search.Remove(ctx, ownerID, search.TypeProject, projectID),
+	)
+}
@@ -0,0 +1,79 @@
+package tasks
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTrashTree(t *testing.T) {
+
+	parent := &Item{ItemID: "p", OwnerID: "u1", ProjectID: "p1", Status: StatusInProgress, ChildCount: 2, ChildrenDone: 1}
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, ParentID: "p", Depth: 1, BlockedBy: []string{"b"}, Blocks: []string{"c"}, OpenBlockers: 1}
+	blocker := &Item{ItemID: "b", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, Blocks: []string{"a"}}
+	waiting := &Item{ItemID: "c", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, BlockedBy: []string{"a"}, OpenBlockers: 1}
+	tx := subtaskTx(false, parent, it, blocker, waiting)
+
+	if err := tx.TrashTree(context.Background(), it, "2030-01-07T09:00:00Z", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	it.derive()
+	if it.DeletedAt == "" || it.ListKey != "p1#trash" || it.StatusKey != "" || it.OpenOwner != "" || it.TrashOwner != "u1" {
+		t.Errorf("trashed task = %+v", it)
+	}
+	if len(it.BlockedBy) != 0 || len(it.Blocks) != 0 || it.OpenBlockers != 0 {
+		t.Errorf("trashed task keeps links %v %v", it.BlockedBy, it.Blocks)
+	}
+	if len(blocker.Blocks) != 0 || len(waiting.BlockedBy) != 0 || waiting.OpenBlockers != 0 {
+		t.Errorf("links left on the remaining tasks: %v %v", blocker.Blocks, waiting.BlockedBy)
+	}
+	if parent.ChildCount != 1 || parent.ChildrenDone != 1 {
+		t.Errorf("parent counts = %d/%d", parent.ChildrenDone, parent.ChildCount)
+	}
+	if _, err := tx.LoadItem(context.Background(), "u1", "a"); err != ErrNotFound {
+		t.Errorf("trashed task loaded: %v", err)
+	}
+	if e := stagedHistory(t, tx); len(e) != 1 || e[0].Field != FieldDeleted {
+		t.Errorf("history = %+v", e)
+	}
+}
+
+func TestRestoreTree(t *testing.T) {
+
+	parent := &Item{ItemID: "p", OwnerID: "u1", ProjectID: "p1", Status: StatusInProgress, ChildCount: 1}
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: "In Review", Category: CategoryDoing, ParentID: "p", Depth: 1,
+		DeletedAt: "2030-01-07T09:00:00Z", PurgeAt: 1}
+	tx := subtaskTx(false, parent, it)
+
+	if err := tx.RestoreTree(context.Background(), it); err != nil {
+		t.Fatal(err)
+	}
+
+	it.derive()
+	if it.DeletedAt != "" || it.PurgeAt != 0 || it.ListKey != "p1" || it.TrashOwner != "" {
+		t.Errorf("restored task = %+v", it)
+	}
+	if it.Status != StatusInProgress {
+		t.Errorf("status = %q, want the first doing state", it.Status)
+	}
+	if parent.ChildCount != 2 {
+		t.Errorf("parent childCount = %d, want 2", parent.ChildCount)
+	}
+}
+
+func TestRestoreUnderDeletedParent(t *testing.T) {
+
+	parent := &Item{ItemID: "p", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, DeletedAt: "2030-01-08T09:00:00Z"}
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusNotStarted, ParentID: "p", Depth: 1, DeletedAt: "2030-01-07T09:00:00Z"}
+	tx := subtaskTx(false, parent, it)
+
+	if err := tx.RestoreTree(context.Background(), it); err != nil {
+		t.Fatal(err)
+	}
+	if it.ParentID != "" || it.Depth != 0 {
+		t.Errorf("restored task under %q at depth %d, want top level", it.ParentID, it.Depth)
+	}
+	if tx.Item("p") != nil {
+		t.Error("the deleted parent was written")
+	}
+}
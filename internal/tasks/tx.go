@@ -0,0 +1,355 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxTransactItems is the DynamoDB limit on items in one transaction.
+const maxTransactItems = 100
+
+// errStale means a staged project or item was changed by someone else after
+// it was read. The change can be retried from a fresh read.
+var errStale = errors.New("tasks: item changed since it was read")
+
+// Tx collects the writes of one change so they are committed together.
+type Tx struct {
+	s      *Store
+	staged []*staged
+	extra  []types.TransactWriteItem
+
+	projects map[string]*Project
+	items    map[string]*Item
+	graphs   map[string]map[string][]string
+	after    []func(ctx context.Context)
+
+	// ranks is the last rank of each project, once read or given out.
+	ranks map[string]string
+
+	// Force lets a blocked task be started.
+	Force bool
+
+	loc *time.Location
+}
+
+// staged is a project or item to put or delete. version is the version it
+// was read at, 0 for one that does not exist yet, and the write only
+// succeeds while the stored version is still that.
+type staged struct {
+	item    *Item
+	project *Project
+	version int64
+	delete  bool
+}
+
+// Begin starts a transaction.
+func (s *Store) Begin() *Tx {
+	return &Tx{s: s, projects: map[string]*Project{}, items: map[string]*Item{}, graphs: map[string]map[string][]string{}, ranks: map[string]string{}}
+}
+
+// PutItem stages it to be written. Staging the same item again replaces
+// the earlier write.
+func (tx *Tx) PutItem(it *Item) {
+	tx.items[it.ItemID] = it
+	if st := tx.stagedItem(it.ItemID); st != nil {
+		st.item, st.delete = it, false
+		return
+	}
+	tx.staged = append(tx.staged, &staged{item: it, version: it.Version})
+}
+
+// DeleteItem stages it to be deleted.
+func (tx *Tx) DeleteItem(it *Item) {
+	tx.PutItem(it)
+	tx.stagedItem(it.ItemID).delete = true
+}
+
+// PutProject stages p to be written.
+func (tx *Tx) PutProject(p *Project) {
+	tx.projects[p.ProjectID] = p
+	for _, st := range tx.staged {
+		if st.project != nil && st.project.ProjectID == p.ProjectID {
+			st.project, st.delete = p, false
+			return
+		}
+	}
+	tx.staged = append(tx.staged, &staged{project: p, version: p.Version})
+}
+
+// DeleteProject stages p to be deleted.
+func (tx *Tx) DeleteProject(p *Project) {
+	tx.PutProject(p)
+	for _, st := range tx.staged {
+		if st.project == p {
+			st.delete = true
+		}
+	}
+}
+
+// Add stages a write to another table.
+func (tx *Tx) Add(w types.TransactWriteItem) {
+	tx.extra = append(tx.extra, w)
+}
+
+// AfterCommit runs f once the transaction has been committed, for work that
+// may lag behind the change, such as index maintenance.
+func (tx *Tx) AfterCommit(f func(ctx context.Context)) {
+	tx.after = append(tx.after, f)
+}
+
+// Item returns the staged version of the item itemID, or nil.
+func (tx *Tx) Item(itemID string) *Item {
+	if st := tx.stagedItem(itemID); st != nil && !st.delete {
+		return st.item
+	}
+	return nil
+}
+
+func (tx *Tx) stagedItem(itemID string) *staged {
+	for _, st := range tx.staged {
+		if st.item != nil && st.item.ItemID == itemID {
+			return st
+		}
+	}
+	return nil
+}
+
+// LoadItem returns the item itemID of ownerID, read once per transaction,
+// so every change in it works on the same copy. Tasks in the archive or
+// the trash are not among their project's tasks and are reported as
+// ErrNotFound.
+func (tx *Tx) LoadItem(ctx context.Context, ownerID, itemID string) (*Item, error) {
+
+	it, err := tx.load(ctx, ownerID, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	if it.ArchivedAt != "" {
+		return nil, ErrNotFound
+	}
+	return it, nil
+}
+
+// load is LoadItem for archived tasks too.
+func (tx *Tx) load(ctx context.Context, ownerID, itemID string) (*Item, error) {
+
+	it, ok := tx.items[itemID]
+	if !ok {
+		var err error
+		if it, err = tx.s.GetItem(ctx, ownerID, itemID); err != nil {
+			return nil, err
+		}
+		tx.items[itemID] = it
+	}
+
+	if it.OwnerID != ownerID || tx.deleted(itemID) || it.DeletedAt != "" {
+		return nil, ErrNotFound
+	}
+	return it, nil
+}
+
+func (tx *Tx) deleted(itemID string) bool {
+	st := tx.stagedItem(itemID)
+	return st != nil && st.delete
+}
+
+// Project returns the project projectID of ownerID, read once per
+// transaction.
+func (tx *Tx) Project(ctx context.Context, ownerID, projectID string) (*Project, error) {
+	if p, ok := tx.projects[projectID]; ok {
+		if p.OwnerID != ownerID {
+			return nil, ErrNotFound
+		}
+		return p, nil
+	}
+
+	p, err := tx.s.GetProject(ctx, ownerID, projectID)
+	if err != nil {
+		return nil, err
+	}
+	tx.projects[projectID] = p
+	return p, nil
+}
+
+// Commit writes everything staged. A single write goes out as a plain
+// PutItem or DeleteItem, anything more as one TransactWriteItems. It
+// returns errStale when a staged project or item changed since it was
+// read, and ErrConflict when another condition failed.
+func (tx *Tx) Commit(ctx context.Context) error {
+
+	writes := make([]types.TransactWriteItem, 0, len(tx.staged)+len(tx.extra))
+	for _, st := range tx.staged {
+		w, err := tx.write(st)
+		if err != nil {
+			return err
+		}
+		writes = append(writes, w)
+	}
+	writes = append(writes, tx.extra...)
+
+	if len(writes) == 0 {
+		return nil
+	}
+
+	if len(writes) > maxTransactItems {
+		return refused(409, "this change touches more than %d items", maxTransactItems)
+	}
+
+	var err error
+	if len(writes) == 1 && len(tx.staged) == 1 {
+		err = tx.commitOne(ctx, writes[0])
+	} else {
+		_, err = tx.s.DB.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: writes,
+		})
+	}
+
+	if err != nil {
+		return tx.classify(err)
+	}
+
+	for _, st := range tx.staged {
+		if !st.delete {
+			*st.versionOf() = st.version + 1
+		}
+	}
+
+	for _, st := range tx.staged {
+		tx.s.committed(ctx, st)
+	}
+
+	for _, f := range tx.after {
+		f(ctx)
+	}
+	return nil
+}
+
+func (tx *Tx) commitOne(ctx context.Context, w types.TransactWriteItem) error {
+
+	if w.Put != nil {
+		_, err := tx.s.DB.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                 w.Put.TableName,
+			Item:                      w.Put.Item,
+			ConditionExpression:       w.Put.ConditionExpression,
+			ExpressionAttributeNames:  w.Put.ExpressionAttributeNames,
+			ExpressionAttributeValues: w.Put.ExpressionAttributeValues,
+		})
+		return err
+	}
+
+	_, err := tx.s.DB.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 w.Delete.TableName,
+		Key:                       w.Delete.Key,
+		ConditionExpression:       w.Delete.ConditionExpression,
+		ExpressionAttributeNames:  w.Delete.ExpressionAttributeNames,
+		ExpressionAttributeValues: w.Delete.ExpressionAttributeValues,
+	})
+	return err
+}
+
+// classify turns a failed condition on a staged project or item into
+// errStale and one on any other write into ErrConflict.
+func (tx *Tx) classify(err error) error {
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return errStale
+	}
+
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return err
+	}
+
+	for i, r := range canceled.CancellationReasons {
+		if aws.ToString(r.Code) != "ConditionalCheckFailed" {
+			continue
+		}
+		if i < len(tx.staged) {
+			return errStale
+		}
+		return ErrConflict
+	}
+	return err
+}
+
+// write builds the conditional put or delete of st.
+func (tx *Tx) write(st *staged) (types.TransactWriteItem, error) {
+
+	table, keyName, id := tx.s.Items, "itemId", ""
+	if st.project != nil {
+		table, keyName, id = tx.s.Projects, "projectId", st.project.ProjectID
+		st.project.derive()
+	} else {
+		id = st.item.ItemID
+		st.item.derive()
+	}
+
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+
+	cond := "attribute_not_exists(" + keyName + ")"
+	if st.version > 0 {
+		cond = "#version = :readVersion"
+		names["#version"] = "version"
+		values[":readVersion"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(st.version, 10)}
+	}
+
+	if st.delete {
+		return types.TransactWriteItem{Delete: &types.Delete{
+			TableName: aws.String(table),
+			Key: map[string]types.AttributeValue{
+				keyName: &types.AttributeValueMemberS{Value: id},
+			},
+			ConditionExpression:       aws.String(cond),
+			ExpressionAttributeNames:  nilIfEmpty(names),
+			ExpressionAttributeValues: nilIfEmpty(values),
+		}}, nil
+	}
+
+	v := st.versionOf()
+	*v = st.version + 1
+	item, err := attributevalue.MarshalMap(st.value())
+	*v = st.version
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName:                 aws.String(table),
+		Item:                      item,
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  nilIfEmpty(names),
+		ExpressionAttributeValues: nilIfEmpty(values),
+	}}, nil
+}
+
+// versionOf points at the version field of the staged project or item.
+func (st *staged) versionOf() *int64 {
+	if st.project != nil {
+		return &st.project.Version
+	}
+	return &st.item.Version
+}
+
+func (st *staged) value() any {
+	if st.project != nil {
+		return st.project
+	}
+	return st.item
+}
+
+func nilIfEmpty[V any](m map[string]V) map[string]V {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,171 @@
+package tasks
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/pagination"
+)
+
+// Views of the "My tasks" list across all projects of a user.
+const (
+	ViewToday    = "today"
+	ViewOverdue  = "overdue"
+	ViewUpcoming = "upcoming"
+	ViewNoDate   = "no-date"
+)
+
+const (
+	defaultUpcomingDays = 7
+	maxUpcomingDays     = 90
+)
+
+// View is the query string of GET /users/me/tasks:
+//
+//	?view=today|overdue|upcoming|no-date&days=7
+//
+// days only applies to upcoming.
+type View struct {
+	Name string
+	Days int
+}
+
+// ParseView reads a View from the query string q. The default view is today.
+func ParseView(q map[string]string) (View, error) {
+
+	v := View{Name: ViewToday, Days: defaultUpcomingDays}
+	if s := q["view"]; s != "" {
+		v.Name = s
+	}
+
+	switch v.Name {
+	case ViewToday, ViewOverdue, ViewUpcoming, ViewNoDate:
+	default:
+		return View{}, invalid("view must be today, overdue, upcoming or no-date")
+	}
+
+	if s := q["days"]; s != "" {
+		days, err := strconv.Atoi(s)
+		if err != nil || days < 1 || days > maxUpcomingDays {
+			return View{}, invalid("days must be between 1 and %d", maxUpcomingDays)
+		}
+		v.Days = days
+	}
+
+	return v, nil
+}
+
+// Scope returns the view for binding cursors to it. The range itself is
+// left out: it moves with the clock, and a cursor taken just before
+// midnight should still continue the same list.
+func (v View) Scope() string {
+	return "view=" + v.Name + "\ndays=" + strconv.Itoa(v.Days)
+}
+
+// Range returns the dueSort range [lo, hi] of the view at now, with days
+// starting at midnight in loc:
+//
+//   - overdue is everything due before now,
+//   - today is the whole calendar day, including what is already overdue,
+//   - upcoming is the Days calendar days after today,
+//   - no-date is the items without a due date.
+//
+// lo is "" when the range has no lower bound. dueSort is the due time
+// followed by "#" and the item id, so a bound that is a bare time sorts
+// before every item due at that time.
+func (v View) Range(now time.Time, loc *time.Location) (lo, hi string) {
+
+	local := now.In(loc)
+	day := func(offset int) string {
+		t := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, loc)
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	switch v.Name {
+	case ViewOverdue:
+		return "", now.UTC().Format(time.RFC3339)
+	case ViewUpcoming:
+		return day(1), day(1 + v.Days)
+	case ViewNoDate:
+		return NoDate + "#", NoDate + "$"
+	default:
+		return day(0), day(1)
+	}
+}
+
+// Location returns the time zone set on the profile of userID, UTC when
+// there is none or it no longer loads.
+func (s *Store) Location(ctx context.Context, userID string) (*time.Location, error) {
+
+	result, err := s.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Users),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+		ProjectionExpression: aws.String("timeZone"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var user struct {
+		TimeZone string `dynamodbav:"timeZone"`
+	}
+	if err := attributevalue.UnmarshalMap(result.Item, &user); err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
+// ListMyTasks returns a page of the open items of ownerID in view v, across
+// all projects, soonest due first. It is one Query on the owner's partition
+// of open-owner-due-index however many projects there are.
+func (s *Store) ListMyTasks(ctx context.Context, ownerID string, v View, r pagination.Request) ([]Item, map[string]types.AttributeValue, error) {
+
+	loc, err := s.Location(ctx, ownerID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lo, hi := v.Range(time.Now(), loc)
+
+	key := "openOwner = :owner AND dueSort BETWEEN :lo AND :hi"
+	values := map[string]types.AttributeValue{
+		":owner": &types.AttributeValueMemberS{Value: ownerID},
+		":hi":    &types.AttributeValueMemberS{Value: hi},
+	}
+	if lo == "" {
+		key = "openOwner = :owner AND dueSort < :hi"
+	} else {
+		values[":lo"] = &types.AttributeValueMemberS{Value: lo}
+	}
+
+	in := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.Items),
+		IndexName:                 aws.String(ItemsByOpenOwner.Name),
+		KeyConditionExpression:    aws.String(key),
+		ExpressionAttributeValues: values,
+	}
+
+	raw, lastKey, err := pagination.Query(ctx, s.DB, in, r, ItemsByOpenOwner.KeyNames("itemId")...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items := []Item{}
+	if err := attributevalue.UnmarshalListOfMaps(raw, &items); err != nil {
+		return nil, nil, err
+	}
+	return items, lastKey, nil
+}
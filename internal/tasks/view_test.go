@@ -0,0 +1,94 @@
+package tasks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestViewRange(t *testing.T) {
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no zoneinfo:", err)
+	}
+
+	// 23:30 on Saturday 24 October in Berlin, the night before clocks go
+	// back: still the 24th there while it is already 21:30 UTC.
+	now := time.Date(2026, 10, 24, 21, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		view   View
+		lo, hi string
+	}{
+		{View{Name: ViewToday}, "2026-10-23T22:00:00Z", "2026-10-24T22:00:00Z"},
+		{View{Name: ViewOverdue}, "", "2026-10-24T21:30:00Z"},
+		// The 25th has 25 hours in Berlin, so the next midnight is 23:00 UTC.
+		{View{Name: ViewUpcoming, Days: 2}, "2026-10-24T22:00:00Z", "2026-10-26T23:00:00Z"},
+		{View{Name: ViewNoDate}, "~#", "~$"},
+	}
+
+	for _, tt := range tests {
+		lo, hi := tt.view.Range(now, berlin)
+		if lo != tt.lo || hi != tt.hi {
+			t.Errorf("%s: got [%q, %q], want [%q, %q]", tt.view.Name, lo, hi, tt.lo, tt.hi)
+		}
+	}
+}
+
+func TestViewRangeHoldsItsItems(t *testing.T) {
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	lo, hi := View{Name: ViewToday}.Range(now, time.UTC)
+
+	tests := []struct {
+		due  string
+		want bool
+	}{
+		{"2026-10-19T00:00:00Z", true},
+		{"2026-10-19T23:59:59Z", true},
+		{"2026-10-20T00:00:00Z", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		it := &Item{ItemID: "0001", DueDate: tt.due}
+		it.derive()
+		got := it.DueSort >= lo && it.DueSort <= hi
+		if got != tt.want {
+			t.Errorf("due %q in today = %v, want %v", tt.due, got, tt.want)
+		}
+	}
+}
+
+func TestParseView(t *testing.T) {
+
+	v, err := ParseView(map[string]string{})
+	if err != nil || v.Name != ViewToday || v.Days != defaultUpcomingDays {
+		t.Errorf("default view = %+v, %v", v, err)
+	}
+
+	for _, q := range []map[string]string{
+		{"view": "tomorrow"},
+		{"view": "upcoming", "days": "0"},
+		{"view": "upcoming", "days": "365"},
+	} {
+		if _, err := ParseView(q); err == nil {
+			t.Errorf("ParseView(%v) accepted", q)
+		}
+	}
+}
+
+func TestOpenOwnerLeavesDoneItemsOut(t *testing.T) {
+
+	it := &Item{ItemID: "0001", OwnerID: "u1", Status: StatusInProgress}
+	it.derive()
+	if it.OpenOwner != "u1" {
+		t.Errorf("open item: openOwner = %q", it.OpenOwner)
+	}
+
+	it.Status = StatusDone
+	it.derive()
+	if it.OpenOwner != "" {
+		t.Errorf("done item: openOwner = %q", it.OpenOwner)
+	}
+}
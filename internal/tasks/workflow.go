@@ -0,0 +1,391 @@
+package tasks
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"to_do_list_demo/internal/etag"
+)
+
+// Categories of workflow states. The rest of the package only looks at the
+// category: a done state completes a task, a doing state starts it.
+const (
+	CategoryTodo  = "todo"
+	CategoryDoing = "doing"
+	CategoryDone  = "done"
+)
+
+// Guards a transition can have. The task must pass all of them to take it.
+const (
+	GuardAssignee  = "requiresAssignee"
+	GuardDueDate   = "requiresDueDate"
+	GuardEstimate  = "requiresEstimate"
+	GuardChecklist = "requiresChecklistDone"
+	GuardSubtasks  = "requiresSubtasksDone"
+	GuardUnblocked = "requiresUnblocked"
+)
+
+var guards = []string{GuardAssignee, GuardDueDate, GuardEstimate, GuardChecklist, GuardSubtasks, GuardUnblocked}
+
+// AnyState as the from of a transition allows it from every state.
+const AnyState = "*"
+
+const (
+	maxWorkflowStates      = 20
+	maxWorkflowTransitions = 200
+	maxStateNameLength     = 50
+)
+
+// Workflow is the states a project's tasks can be in and the transitions
+// between them. The first state is the one new tasks start in.
+type Workflow struct {
+	States      []WorkflowState `json:"states" dynamodbav:"states"`
+	Transitions []Transition    `json:"transitions" dynamodbav:"transitions"`
+}
+
+// WorkflowState is a status a task can have.
+type WorkflowState struct {
+	Name     string `json:"name" dynamodbav:"name"`
+	Category string `json:"category" dynamodbav:"category"`
+}
+
+// Transition allows a task to go from one state to another, if it passes
+// the guards.
+type Transition struct {
+	From   string   `json:"from" dynamodbav:"from"`
+	To     string   `json:"to" dynamodbav:"to"`
+	Guards []string `json:"guards,omitempty" dynamodbav:"guards,omitempty"`
+}
+
+// DefaultWorkflow is the workflow of a project without one of its own:
+// the three statuses of the notes, from any one to any other.
+func DefaultWorkflow() *Workflow {
+	return &Workflow{
+		States: []WorkflowState{
+			{Name: StatusNotStarted, Category: CategoryTodo},
+			{Name: StatusInProgress, Category: CategoryDoing},
+			{Name: StatusDone, Category: CategoryDone},
+		},
+		Transitions: []Transition{
+			{From: AnyState, To: StatusNotStarted},
+			{From: AnyState, To: StatusInProgress},
+			{From: AnyState, To: StatusDone},
+		},
+	}
+}
+
+// EffectiveWorkflow returns the workflow of p, the default one if it has
+// none.
+func (p *Project) EffectiveWorkflow() *Workflow {
+	if p.Workflow == nil {
+		return DefaultWorkflow()
+	}
+	return p.Workflow
+}
+
+// check validates w and puts it in canonical form: names trimmed,
+// categories in lower case, transitions spelled like their states.
+func (w *Workflow) check() error {
+
+	if len(w.States) == 0 || len(w.States) > maxWorkflowStates {
+		return invalid("a workflow needs 1 to %d states", maxWorkflowStates)
+	}
+	if len(w.Transitions) > maxWorkflowTransitions {
+		return invalid("a workflow can have at most %d transitions", maxWorkflowTransitions)
+	}
+
+	var states []WorkflowState
+	for _, s := range w.States {
+		s.Name = strings.TrimSpace(s.Name)
+		s.Category = strings.ToLower(strings.TrimSpace(s.Category))
+		if s.Name == "" || s.Name == AnyState || utf8.RuneCountInString(s.Name) > maxStateNameLength {
+			return invalid("state names are required and must be at most %d characters", maxStateNameLength)
+		}
+		if s.Category != CategoryTodo && s.Category != CategoryDoing && s.Category != CategoryDone {
+			return invalid("state %q: category must be todo, doing or done", s.Name)
+		}
+		if _, ok := (&Workflow{States: states}).state(s.Name); ok {
+			return invalid("state %q is given twice", s.Name)
+		}
+		states = append(states, s)
+	}
+	w.States = states
+
+	if w.States[0].Category != CategoryTodo {
+		return invalid("the first state, where new tasks start, must be in the todo category")
+	}
+	if !slices.ContainsFunc(w.States, func(s WorkflowState) bool { return s.Category == CategoryDone }) {
+		return invalid("a workflow needs a state in the done category")
+	}
+
+	var transitions []Transition
+	for _, t := range w.Transitions {
+		from, ok := w.state(t.From)
+		if strings.TrimSpace(t.From) == AnyState {
+			from, ok = WorkflowState{Name: AnyState}, true
+		}
+		if !ok {
+			return invalid("transition from unknown state %q", t.From)
+		}
+		to, ok := w.state(t.To)
+		if !ok {
+			return invalid("transition to unknown state %q", t.To)
+		}
+		if from.Name == to.Name {
+			return invalid("state %q does not need a transition to itself", to.Name)
+		}
+
+		var gs []string
+		for _, g := range t.Guards {
+			i := slices.IndexFunc(guards, func(known string) bool { return strings.EqualFold(known, strings.TrimSpace(g)) })
+			if i < 0 {
+				return invalid("unknown guard %q, guards are %s", g, strings.Join(guards, ", "))
+			}
+			gs = append(gs, guards[i])
+		}
+		slices.Sort(gs)
+
+		t = Transition{From: from.Name, To: to.Name, Guards: slices.Compact(gs)}
+		if slices.ContainsFunc(transitions, func(o Transition) bool { return o.From == t.From && o.To == t.To }) {
+			return invalid("transition %q to %q is given twice", t.From, t.To)
+		}
+		transitions = append(transitions, t)
+	}
+	w.Transitions = transitions
+
+	return nil
+}
+
+// state returns the state called name, in any case.
+func (w *Workflow) state(name string) (WorkflowState, bool) {
+	name = strings.TrimSpace(name)
+	for _, s := range w.States {
+		if strings.EqualFold(s.Name, name) {
+			return s, true
+		}
+	}
+	return WorkflowState{}, false
+}
+
+// first returns the first state of category, or the start state if there
+// is none.
+func (w *Workflow) first(category string) WorkflowState {
+	for _, s := range w.States {
+		if s.Category == category {
+			return s
+		}
+	}
+	return w.States[0]
+}
+
+// settle gives it a status w has: its own, else the first state of the
+// same category.
+func (w *Workflow) settle(it *Item) {
+	s, ok := w.state(it.Status)
+	if !ok {
+		s = w.first(it.category())
+	}
+	it.Status, it.Category = s.Name, s.Category
+}
+
+func (w *Workflow) names() string {
+	names := make([]string, len(w.States))
+	for i, s := range w.States {
+		names[i] = s.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// transition returns the transition a task takes from state from to state
+// to. One from that exact state wins over one from AnyState.
+func (w *Workflow) transition(from, to string) (Transition, bool) {
+
+	var found *Transition
+	for i, t := range w.Transitions {
+		if t.To != to {
+			continue
+		}
+		if t.From == from {
+			return t, true
+		}
+		if t.From == AnyState {
+			found = &w.Transitions[i]
+		}
+	}
+	if found == nil {
+		return Transition{}, false
+	}
+	return *found, true
+}
+
+// enter checks that it, in state from, may go to the state it has now.
+func (w *Workflow) enter(from string, it *Item) error {
+
+	t, ok := w.transition(from, it.Status)
+	if !ok {
+		return refused(422, "a task cannot go from %s to %s in this project's workflow", from, it.Status)
+	}
+	for _, g := range t.Guards {
+		if reason := guardFails(g, it); reason != "" {
+			return refused(422, "a task needs %s to go to %s", reason, it.Status)
+		}
+	}
+	return nil
+}
+
+// guardFails returns what it is missing to pass guard g, or "".
+func guardFails(g string, it *Item) string {
+
+	switch g {
+	case GuardAssignee:
+		if it.Assignee == "" {
+			return "an assignee"
+		}
+	case GuardDueDate:
+		if it.DueDate == "" {
+			return "a due date"
+		}
+	case GuardEstimate:
+		if it.EstimateHours == 0 {
+			return "an estimate"
+		}
+	case GuardChecklist:
+		if slices.ContainsFunc(it.Checklist, func(e ChecklistEntry) bool { return !e.Done }) {
+			return "all checklist entries done"
+		}
+	case GuardSubtasks:
+		if it.ChildrenDone < it.ChildCount {
+			return "all subtasks done"
+		}
+	case GuardUnblocked:
+		if it.OpenBlockers > 0 {
+			return "the tasks blocking it done"
+		}
+	}
+	return ""
+}
+
+// completion returns the first done state it can go to from where it is,
+// for completing a parent whose subtasks are all done.
+func (w *Workflow) completion(it *Item) (string, bool) {
+
+	from := it.Status
+	for _, s := range w.States {
+		if s.Category != CategoryDone {
+			continue
+		}
+		next := it.Clone()
+		next.Status = s.Name
+		if w.enter(from, next) == nil {
+			return s.Name, true
+		}
+	}
+	return "", false
+}
+
+// applyWorkflow spells the status of it as its project's workflow does,
+// sets its category, and checks the change of status is a transition the
+// workflow allows. A task moved to another project keeps its status if
+// that project has it, else it goes to the first state of the same
+// category there; the move itself is not a transition.
+func (tx *Tx) applyWorkflow(ctx context.Context, before, it *Item) error {
+
+	project, err := tx.Project(ctx, it.OwnerID, it.ProjectID)
+	if err != nil {
+		return err
+	}
+	w := project.EffectiveWorkflow()
+
+	moved := before != nil && before.ProjectID != it.ProjectID
+	if _, ok := w.state(it.Status); !ok && moved && it.Status == before.Status {
+		it.Status = w.first(before.category()).Name
+	}
+
+	s, ok := w.state(it.Status)
+	if !ok {
+		return invalid("status must be one of %s", w.names())
+	}
+	it.Status, it.Category = s.Name, s.Category
+
+	from := w.States[0].Name
+	if before != nil {
+		if moved {
+			return nil
+		}
+		from = before.Status
+	}
+	if from == it.Status {
+		return nil
+	}
+	return w.enter(from, it)
+}
+
+// SetWorkflow replaces the workflow of project projectID; nil goes back to
+// the default one. A state that still has tasks cannot be removed or
+// change category, as those tasks would be left without one.
+func (s *Store) SetWorkflow(ctx context.Context, ownerID, projectID string, pre *etag.Precondition, w *Workflow) (*Project, error) {
+
+	if w != nil {
+		if err := w.check(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.UpdateProject(ctx, ownerID, projectID, pre, func(tx *Tx, p *Project) error {
+
+		if err := p.writable(); err != nil {
+			return err
+		}
+
+		next := w
+		if next == nil {
+			next = DefaultWorkflow()
+		}
+		for _, old := range p.EffectiveWorkflow().States {
+			if n, ok := next.state(old.Name); ok && n.Name == old.Name && n.Category == old.Category {
+				continue
+			}
+			used, err := s.stateUsed(ctx, p.ProjectID, old.Name)
+			if err != nil {
+				return err
+			}
+			if used {
+				return refused(409, "tasks are still in state %s, move them to another state first", old.Name)
+			}
+		}
+
+		before := *p
+		p.Workflow = w
+		if err := tx.recordProject(ctx, &before, p); err != nil {
+			return err
+		}
+		p.UpdatedAt = now()
+		tx.PutProject(p)
+		return nil
+	})
+}
+
+// stateUsed reports whether any task of projectID is in state name.
+func (s *Store) stateUsed(ctx context.Context, projectID, name string) (bool, error) {
+
+	out, err := s.DB.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.Items),
+		IndexName:              aws.String(ItemsByStatus.Name),
+		KeyConditionExpression: aws.String("statusKey = :statusKey"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":statusKey": &types.AttributeValueMemberS{Value: projectID + "#" + name},
+		},
+		Select: types.SelectCount,
+		Limit:  aws.Int32(1),
+	})
+	if err != nil {
+		return false, err
+	}
+	return out.Count > 0, nil
+}
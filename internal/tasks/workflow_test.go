@@ -0,0 +1,123 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// reviewFlow is a workflow with a review step that needs an assignee.
+func reviewFlow(t *testing.T) *Workflow {
+	t.Helper()
+
+	w := &Workflow{
+		States: []WorkflowState{
+			{Name: "Backlog", Category: "TODO"},
+			{Name: "In Progress", Category: "doing"},
+			{Name: "In Review", Category: "doing"},
+			{Name: "Done", Category: "done"},
+			{Name: "Cancelled", Category: "done"},
+		},
+		Transitions: []Transition{
+			{From: "backlog", To: "in progress"},
+			{From: "In Progress", To: "In Review", Guards: []string{"RequiresAssignee"}},
+			{From: "In Review", To: "Done"},
+			{From: "In Review", To: "In Progress"},
+			{From: "*", To: "Cancelled"},
+		},
+	}
+	if err := w.check(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestWorkflowTransitions(t *testing.T) {
+
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: "Backlog", Category: CategoryTodo}
+	tx := subtaskTx(false, it)
+	tx.projects["p1"].Workflow = reviewFlow(t)
+
+	// A refused change leaves the task as it was, like the aborted
+	// transaction of a request would.
+	move := func(status string) error {
+		saved := it.Clone()
+		err := tx.PatchItem(context.Background(), it, ItemPatch{Status: &status})
+		if err != nil {
+			*it = *saved
+		}
+		return err
+	}
+
+	var te *Error
+	if err := move("Done"); !errors.As(err, &te) || te.Code != 422 {
+		t.Fatalf("Backlog -> Done: %v, want 422", err)
+	}
+	if err := move("in progress"); err != nil {
+		t.Fatal(err)
+	}
+	if it.Status != "In Progress" || it.Category != CategoryDoing {
+		t.Errorf("started task = %q %q", it.Status, it.Category)
+	}
+
+	if err := move("In Review"); !errors.As(err, &te) || te.Code != 422 {
+		t.Fatalf("review without an assignee: %v, want 422", err)
+	}
+	assignee := "sam"
+	if err := tx.PatchItem(context.Background(), it, ItemPatch{Assignee: &assignee}); err != nil {
+		t.Fatal(err)
+	}
+	if err := move("In Review"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := move("Cancelled"); err != nil {
+		t.Fatal(err)
+	}
+	if !it.Done() || it.CompletedAt == "" {
+		t.Errorf("cancelled task = done %v, completedAt %q", it.Done(), it.CompletedAt)
+	}
+
+	if err := move("Someday"); !errors.As(err, &te) || te.Code != 400 {
+		t.Errorf("unknown state: %v, want 400", err)
+	}
+}
+
+func TestDefaultWorkflowAllowsEveryChange(t *testing.T) {
+
+	it := &Item{ItemID: "a", OwnerID: "u1", ProjectID: "p1", Status: StatusDone}
+	tx := subtaskTx(false, it)
+
+	for _, status := range []string{"not started", StatusDone, StatusInProgress, StatusNotStarted} {
+		if err := tx.PatchItem(context.Background(), it, ItemPatch{Status: &status}); err != nil {
+			t.Fatalf("-> %s: %v", status, err)
+		}
+	}
+	if it.Status != StatusNotStarted || it.Category != CategoryTodo {
+		t.Errorf("task = %q %q", it.Status, it.Category)
+	}
+}
+
+func TestWorkflowCheck(t *testing.T) {
+
+	bad := []Workflow{
+		{},
+		{States: []WorkflowState{{Name: "Open", Category: "doing"}, {Name: "Done", Category: "done"}}},
+		{States: []WorkflowState{{Name: "Open", Category: "todo"}}},
+		{States: []WorkflowState{{Name: "Open", Category: "todo"}, {Name: "open", Category: "done"}}},
+		{States: []WorkflowState{{Name: "Open", Category: "todo"}, {Name: "Done", Category: "finished"}}},
+		{States: []WorkflowState{{Name: "Open", Category: "todo"}, {Name: "Done", Category: "done"}}, Transitions: []Transition{{From: "Open", To: "Closed"}}},
+		{States: []WorkflowState{{Name: "Open", Category: "todo"}, {Name: "Done", Category: "done"}}, Transitions: []Transition{{From: "Open", To: "Done", Guards: []string{"requiresLuck"}}}},
+		{States: []WorkflowState{{Name: "Open", Category: "todo"}, {Name: "Done", Category: "done"}}, Transitions: []Transition{{From: "Done", To: "done"}}},
+	}
+	for _, w := range bad {
+		if err := w.check(); err == nil {
+			t.Errorf("%+v accepted", w)
+		}
+	}
+
+	w := reviewFlow(t)
+	if w.States[0].Category != CategoryTodo || w.Transitions[0].From != "Backlog" || w.Transitions[1].Guards[0] != GuardAssignee {
+		t.Errorf("not canonical: %+v", w)
+	}
+}